@@ -1,101 +1,470 @@
-package main
+package jsql
 
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"maps"
+	"math"
 	"sort"
+	"strconv"
 	"strings"
+
+	"github.com/tomberek/jsql/internal/pathspec"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// AnalyzeJSON analyzes a JSON file and returns a SQL DDL string
-func AnalyzeJSON(path string, sample int) string {
-	f, err := os.Open(path)
+// AnalyzeOptions controls schema inference
+type AnalyzeOptions struct {
+	Sample     int    // how many rows to sample
+	Tenant     string // prefix for every generated table name
+	Root       string // name of the root table (default main); other tables are prefixed with it
+	Provenance bool   // add _line, _source and _ingested_at to the root table
+	Ord        bool   // add _ord, numbering the documents in input order, to the root table
+	KeyOrder   bool   // add _key_order, recording the order of each document's keys, to the root table
+	NumberText bool   // add _number_text, recording the original text of numbers, to the root table
+	SoftDelete bool   // add _deleted_at, marking removed documents instead of deleting them, to the root table
+
+	Geometry      FieldType // column type for GeoJSON geometries; empty keeps them as sub-tables
+	NormalizeTime string    // NormalizeTimeUTC stores zoned times as UTCTIME epochs and their offsets
+	SpatialIndex  bool      // add an R*Tree index for every geometry column
+
+	Profile          *Profile                  // optional preset for a known dataset shape
+	Links            map[string]string         // "table.field" -> "table.key" references between datasets
+	Transform        *WasmTransform            // module rewriting the sampled documents, as the loader will
+	Enrich           []*Enrichment             // lookups applied to the sampled documents, as the loader will
+	Computed         map[string]ComputedColumn // dotted column path -> expression deriving it
+	Defaults         map[string]interface{}    // dotted field path -> value of documents lacking it
+	HashIDs          bool                      // symbol ids are hashes of the values
+	SymbolizeNumbers bool                      // symbolize numeric fields with few distinct values into numeric symbol tables
+	Explode          string                    // array field whose elements are the records
+	Subtree          string                    // dotted path of the nested objects analyzed instead of the documents
+	Renames          map[string]string         // dotted field path -> column storing it
+	Enums            map[string][]string       // string field -> the only values a CHECK constraint allows
+	EnumMax          int                       // give string fields with at most this many sampled values an enum CHECK
+	Filter           *pathspec.Filter          // fields kept and dropped from the sampled documents
+	Naming           Naming                    // how the columns referencing other tables are named
+
+	SnakeCase  bool   // rename fields to snake_case columns
+	TableNames string // field, singular or plural: the form of the names of object and symbol tables
+	Timestamps bool   // add created_at and updated_at columns kept by the database
+	History    bool   // keep the former versions of rows in <table>_history tables
+}
+
+// analyzeBatch is how many documents are analyzed at a time; only the
+// documents of one batch are held in memory
+const analyzeBatch = 10000
+
+// maxAnalyzeUniques bounds the distinct values of a field kept while
+// analyzing a whole file. Fields with more are never symbolized.
+const maxAnalyzeUniques = 100000
+
+// ErrNoRows is returned by Analyze for input without a document to analyze
+var ErrNoRows = errors.New("no rows for analysis")
+
+// AnalyzeJSON analyzes a JSON file, or standard input for "-", and returns
+// a SQL DDL string. With opts.Sample 0, the whole file is analyzed. Input
+// without a document to analyze fails with ErrNoRows.
+func AnalyzeJSON(path string, opts AnalyzeOptions) (string, error) {
+	f, err := openInputFile(path)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "analyze: open:", err)
-		os.Exit(1)
+		return "", fmt.Errorf("open: %w", err)
 	}
 	defer f.Close()
-	sc := bufio.NewScanner(f)
+	read := startPhase("analyze.read", attribute.String("jsql.input", InputName(path)))
+	return analyze(f, opts, read)
+}
+
+// Analyze infers a schema from the first opts.Sample documents of r, one
+// JSON object per line, or all of them if opts.Sample is 0, and returns its
+// SQL DDL. Lines that are not JSON objects are skipped.
+func Analyze(r io.Reader, opts AnalyzeOptions) (string, error) {
+	return analyze(r, opts, startPhase("analyze.read"))
+}
+
+// analyze is Analyze, ending the read phase once the input is read
+func analyze(r io.Reader, opts AnalyzeOptions, read *phase) (string, error) {
+	infer := newInference(opts)
+	err := infer.read(r)
+	read.set(attribute.Int("jsql.documents", infer.rows))
+	read.end()
+	if err != nil {
+		return "", err
+	}
+	if infer.rows == 0 {
+		return "", ErrNoRows
+	}
+	return infer.ddl(), nil
+}
+
+// inference accumulates what analysis finds in batches of documents
+type inference struct {
+	opts          AnalyzeOptions // Renames gains the snake_case renames found
+	schema        map[string]*TableSchema
+	stringUniques map[string]stringSet // string field -> its distinct values
+	jsonUniques   map[string]stringSet // array/object field -> its distinct JSON values
+	numberUniques map[string]map[float64]bool
+	computed      map[string]FieldType // computed column path -> type of its values so far
+	saturated     map[string]bool      // fields with more than maxAnalyzeUniques values
+	rows          int
+}
+
+func newInference(opts AnalyzeOptions) *inference {
+	if opts.SnakeCase {
+		opts.Renames = maps.Clone(opts.Renames)
+		if opts.Renames == nil {
+			opts.Renames = map[string]string{}
+		}
+	}
+	return &inference{
+		opts:          opts,
+		schema:        map[string]*TableSchema{},
+		stringUniques: map[string]stringSet{},
+		jsonUniques:   map[string]stringSet{},
+		numberUniques: map[string]map[float64]bool{},
+		computed:      map[string]FieldType{},
+		saturated:     map[string]bool{},
+	}
+}
+
+// read analyzes the documents of r to sample, in batches
+func (in *inference) read(r io.Reader) error {
+	opts := in.opts
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
 	var roots []map[string]interface{}
-	for n := 0; n < sample && sc.Scan(); n++ {
+	for n := 0; (opts.Sample == 0 || n < opts.Sample) && sc.Scan(); n++ {
 		var rec map[string]interface{}
-		if json.Unmarshal(sc.Bytes(), &rec) == nil {
-			roots = append(roots, rec)
+		if decodeJSON(sc.Bytes(), &rec) == nil {
+			rec, keep, err := opts.Transform.Apply(rec)
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
+			if err := enrichDocument(&DatabaseSchema{Enrich: opts.Enrich}, rec); err != nil {
+				return err
+			}
+			for _, doc := range ExplodeRecord(opts.Filter.Apply(rec), opts.Explode) {
+				roots = append(roots, subtreeRecords(doc, opts.Subtree)...)
+			}
 		}
+		if len(roots) >= analyzeBatch {
+			if err := in.add(roots); err != nil {
+				return err
+			}
+			roots = nil
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
 	}
 	if len(roots) == 0 {
-		fmt.Fprintln(os.Stderr, "No rows for analysis")
-		os.Exit(2)
+		return nil
 	}
+	return in.add(roots)
+}
 
-	// key: fieldname, val: set of unique string values
-	fieldStringUniques := make(map[string]stringSet) // string fields
-	fieldJSONUniques := make(map[string]stringSet)   // array/object fields
+// add analyzes a batch of documents
+func (in *inference) add(roots []map[string]interface{}) error {
+	opts := in.opts
+	if opts.SnakeCase {
+		addSnakeRenames(opts.Renames, roots, "main")
+	}
+	renames := renamesByTable(opts.Renames)
+	for i, doc := range roots {
+		roots[i] = renameKeys(doc, "main", renames)
+	}
+	analyzeObjectSymbol("main", roots, in.schema, in.stringUniques, in.jsonUniques, opts.Geometry, opts.NormalizeTime == NormalizeTimeUTC, opts.Profile.typeOverrides())
+	if err := addComputed(in.schema, roots, opts.Computed, in.computed); err != nil {
+		return err
+	}
+	if opts.SymbolizeNumbers {
+		addNumberUniques(in.numberUniques, roots)
+	}
+	in.rows += len(roots)
+	if opts.Sample == 0 {
+		in.capUniques()
+	}
+	return nil
+}
 
-	schema := make(map[string]*TableSchema)
-	analyzeObjectSymbol("main", roots, schema, fieldStringUniques, fieldJSONUniques)
+// capUniques forgets the values of fields with too many to symbolize, so
+// analyzing a whole file holds a bounded number of them
+func (in *inference) capUniques() {
+	for _, uniques := range []map[string]stringSet{in.stringUniques, in.jsonUniques} {
+		for field, values := range uniques {
+			if len(values) > maxAnalyzeUniques {
+				in.saturated[field] = true
+				uniques[field] = stringSet{}
+			}
+		}
+	}
+	for field, values := range in.numberUniques {
+		if len(values) > maxAnalyzeUniques {
+			in.saturated[field] = true
+			in.numberUniques[field] = map[float64]bool{}
+		}
+	}
+}
 
-	numRows := len(roots)
+// ddl returns the DDL of the analyzed documents
+func (in *inference) ddl() string {
+	opts := in.opts
+	phase := startPhase("analyze.infer")
+	numRows := in.rows
+	textFields := map[string]bool{}
+	for field, uniques := range in.stringUniques {
+		textFields[field] = len(uniques) < numRows/5 && !in.saturated[field]
+	}
+	jsonFields := map[string]bool{}
+	for field, uniques := range in.jsonUniques {
+		jsonFields[field] = len(uniques) < numRows/5 && !in.saturated[field]
+	}
+	if opts.EnumMax > 0 {
+		uniques := maps.Clone(in.stringUniques)
+		maps.DeleteFunc(uniques, func(field string, _ stringSet) bool { return in.saturated[field] })
+		enums := enumFields(uniques, numRows, opts.EnumMax)
+		maps.Copy(enums, opts.Enums)
+		opts.Enums = enums
+	}
+	phase.set(attribute.Int("jsql.tables", len(in.schema)))
+	phase.end()
+	ddl := startPhase("analyze.ddl")
+	defer ddl.end()
+	var numberFields map[string]FieldType
+	if opts.SymbolizeNumbers {
+		numberFields = numberSymbolFields(in.numberUniques, numRows)
+		maps.DeleteFunc(numberFields, func(field string, _ FieldType) bool { return in.saturated[field] })
+	}
+	return schemaDDL(in.schema, textFields, jsonFields, numberFields, opts)
+}
+
+// schemaDDL writes the DDL of the analyzed tables. textFields and
+// jsonFields map the string and array/object fields to whether they look
+// worth symbolizing; the options then force or prevent symbolization.
+// numberFields are the numeric fields worth symbolizing, with the type of
+// their symbol values.
+func schemaDDL(schema map[string]*TableSchema, textFields, jsonFields map[string]bool, numberFields map[string]FieldType, opts AnalyzeOptions) string {
+	defaults := defaultColumns(schema, opts.Defaults)
 	symbolFields := map[string]bool{}
 	symbolJSONFields := map[string]bool{}
-	for field, uniques := range fieldStringUniques {
-		if len(uniques) < numRows/5 {
+	for field, symbolize := range textFields {
+		if symbolize {
 			symbolFields[field] = true
 		}
 	}
-	for field, uniques := range fieldJSONUniques {
-		if len(uniques) < numRows/5 {
+	for field, symbolize := range jsonFields {
+		if symbolize {
 			symbolJSONFields[field] = true
 		}
 	}
+	force, never := opts.Profile.symbolChoices()
+	for field := range force {
+		if _, ok := textFields[field]; ok {
+			symbolFields[field] = true
+		}
+		if _, ok := jsonFields[field]; ok {
+			symbolJSONFields[field] = true
+		}
+	}
+	// Natural keys referenced from other datasets stay plain, indexed columns
+	for tbl := range schema {
+		for _, key := range linkedKeys(opts.Links, opts.tableName(tbl)) {
+			never[key] = true
+		}
+	}
+	// Enums are checked in their own columns
+	for field := range opts.Enums {
+		never[field] = true
+	}
+	// Symbol columns hold ids, which a DEFAULT clause cannot name
+	for path := range opts.Defaults {
+		_, col := profileColumn(path)
+		never[col] = true
+	}
+	symbolNumberFields := map[string]FieldType{}
+	for field, typ := range numberFields {
+		if !symbolFields[field] && !symbolJSONFields[field] {
+			symbolNumberFields[field] = typ
+		}
+	}
+	for field := range never {
+		delete(symbolFields, field)
+		delete(symbolJSONFields, field)
+		delete(symbolNumberFields, field)
+	}
 
 	// Output DDL
 	var sb strings.Builder
+	if opts.HashIDs {
+		sb.WriteString("-- jsql:symbol-id hash\n\n")
+	}
+	if d := opts.Naming.directive(); d != "" {
+		sb.WriteString(d + "\n\n")
+	}
 	order := resolveTableOrder(schema)
 	for _, tbl := range order {
 		ts := schema[tbl]
-		sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n", ts.Name))
+		start := sb.Len()
+		sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n", opts.tableName(ts.Name)))
 		keys := make([]string, 0, len(ts.Fields))
 		for k := range ts.Fields {
+			if tbl == "main" && (opts.Provenance && provenanceColumns[k] || opts.Ord && k == ordColumn || opts.KeyOrder && k == keyOrderColumn || opts.NumberText && k == numberTextColumn || opts.SoftDelete && k == deletedAtColumn) {
+				continue // replaced by the loader's own columns below
+			}
 			keys = append(keys, k)
 		}
 		sort.Strings(keys)
 		for j, k := range keys {
 			switch {
-			case symbolFields[k]:
-				sb.WriteString(fmt.Sprintf("  %s_symbol INTEGER REFERENCES %s_symbol(id)", k, k))
-			case symbolJSONFields[k]:
-				sb.WriteString(fmt.Sprintf("  %s_symbol INTEGER REFERENCES %s_symbol(id)", k, k))
+			case symbolFields[k], symbolJSONFields[k], symbolNumberFields[k] != "" && (ts.Fields[k] == TypeReal || ts.Fields[k] == TypeInt):
+				sb.WriteString(fmt.Sprintf("  %s INTEGER REFERENCES %s(id)", opts.Naming.SymbolColumn(k), opts.tableName(k+"_symbol")))
 			default:
-				sb.WriteString("  " + k + " " + string(ts.Fields[k]))
+				col := k
+				if field, ok := strings.CutSuffix(k, "_id"); ok && ts.FKs[k] != "" {
+					col = opts.Naming.ObjectColumn(field)
+				}
+				sb.WriteString("  " + col + " " + string(ts.Fields[k]))
 				if k == "id" {
 					sb.WriteString(" PRIMARY KEY")
 				}
+				if def, ok := defaults[tbl+"."+k]; ok {
+					sb.WriteString(" DEFAULT " + sqlLiteral(def))
+				}
+				if values, ok := opts.Enums[k]; ok && ts.Fields[k] == TypeText {
+					sb.WriteString(enumCheck(col, values))
+				}
 				if fk, ok := ts.FKs[k]; ok {
-					sb.WriteString(" REFERENCES " + fk + "(id)")
+					sb.WriteString(" REFERENCES " + opts.tableName(fk) + "(id)")
 				}
 			}
 			if j < len(keys)-1 {
 				sb.WriteString(",\n")
 			}
 		}
+		if opts.Provenance && tbl == "main" {
+			sb.WriteString(",\n  _line INTEGER,\n  _source TEXT,\n  _ingested_at TEXT")
+		}
+		if opts.Ord && tbl == "main" {
+			sb.WriteString(",\n  " + ordColumn + " INTEGER")
+		}
+		if opts.KeyOrder && tbl == "main" {
+			sb.WriteString(",\n  " + keyOrderColumn + " TEXT")
+		}
+		if opts.NumberText && tbl == "main" {
+			sb.WriteString(",\n  " + numberTextColumn + " TEXT")
+		}
+		if opts.SoftDelete && tbl == "main" {
+			sb.WriteString(",\n  " + deletedAtColumn + " TEXT")
+		}
+		timestamps := opts.Timestamps && ts.Fields["created_at"] == "" && ts.Fields["updated_at"] == ""
+		if timestamps {
+			sb.WriteString(",\n  created_at TEXT DEFAULT CURRENT_TIMESTAMP,\n  updated_at TEXT DEFAULT CURRENT_TIMESTAMP")
+		}
+		if opts.History {
+			sb.WriteString(",\n  " + validFromColumn + " TEXT DEFAULT (" + historyNow + ")")
+		}
+		links := declaredLinks(opts.Links, opts.tableName(ts.Name), ts.Fields)
+		for _, l := range links {
+			sb.WriteString(fmt.Sprintf(",\n  %s INTEGER REFERENCES %s(id)", linkColumn(l.Field), l.Table))
+		}
 		sb.WriteString("\n);\n\n")
+		if timestamps {
+			writeTimestamps(&sb, opts.tableName(ts.Name))
+		}
+		if opts.History {
+			// The history table has the columns just written
+			name := opts.tableName(ts.Name)
+			writeHistory(&sb, name, ParseDDL(sb.String()[start:]).Tables[name].Fields)
+		}
+		if opts.Provenance && tbl == "main" {
+			sb.WriteString(fmt.Sprintf("-- jsql:provenance %s\n\n", opts.tableName(ts.Name)))
+		}
+		if opts.Ord && tbl == "main" {
+			sb.WriteString(fmt.Sprintf("-- jsql:ord %s\n\n", opts.tableName(ts.Name)))
+			sb.WriteString(fmt.Sprintf("CREATE INDEX %[1]s%[2]s ON %[1]s (%[2]s);\n\n", opts.tableName(ts.Name), ordColumn))
+		}
+		if opts.KeyOrder && tbl == "main" {
+			sb.WriteString(fmt.Sprintf("-- jsql:key-order %s\n\n", opts.tableName(ts.Name)))
+		}
+		if opts.NumberText && tbl == "main" {
+			sb.WriteString(fmt.Sprintf("-- jsql:number-text %s\n\n", opts.tableName(ts.Name)))
+		}
+		if opts.SoftDelete && tbl == "main" {
+			sb.WriteString(fmt.Sprintf("-- jsql:soft-delete %s\n\n", opts.tableName(ts.Name)))
+		}
+		if tbl == "main" && opts.Explode != "" {
+			sb.WriteString(fmt.Sprintf("-- jsql:explode %s.%s\n\n", opts.tableName(ts.Name), opts.Explode))
+		}
+		for _, r := range sortedRenames(opts.Renames, tbl, ts) {
+			sb.WriteString(fmt.Sprintf("-- jsql:rename %s.%s -> %s\n\n", opts.tableName(ts.Name), r[0], r[1]))
+		}
+		for _, l := range links {
+			sb.WriteString(fmt.Sprintf("-- jsql:link %s.%s -> %s.%s\n\n", opts.tableName(ts.Name), l.Field, l.Table, l.Key))
+		}
+		for _, path := range sortedComputed(opts.Computed, tbl) {
+			col := path[strings.LastIndex(path, ".")+1:]
+			if ts.Fields[col] == "" {
+				continue
+			}
+			sb.WriteString(fmt.Sprintf("-- jsql:computed %s.%s = %s\n\n", opts.tableName(ts.Name), col, opts.Computed[path].Expr))
+			if opts.Computed[path].Index {
+				sb.WriteString(fmt.Sprintf("CREATE INDEX %[1]s_%[2]s_computed ON %[1]s (%[2]s);\n\n", opts.tableName(ts.Name), col))
+			}
+		}
+		for _, key := range linkedKeys(opts.Links, opts.tableName(ts.Name)) {
+			if ts.Fields[key] != "" {
+				sb.WriteString(fmt.Sprintf("CREATE INDEX %[1]s_%[2]s_link ON %[1]s (%[2]s);\n\n", opts.tableName(ts.Name), key))
+			}
+		}
+		if opts.SpatialIndex {
+			for _, k := range keys {
+				if ts.Fields[k] == TypeGeoJSON || ts.Fields[k] == TypeWKB {
+					writeSpatialIndex(&sb, opts.tableName(ts.Name), k)
+				}
+			}
+		}
 	}
 	// Emit symbol table DDLs for string and JSON fields
 	for field := range symbolFields {
-		sb.WriteString(fmt.Sprintf("CREATE TABLE %s_symbol (\n  id INTEGER PRIMARY KEY,\n  value TEXT UNIQUE\n);\n\n", field))
+		sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n  id INTEGER PRIMARY KEY,\n  value TEXT UNIQUE\n);\n\n", opts.tableName(field+"_symbol")))
 	}
 	for field := range symbolJSONFields {
 		if _, already := symbolFields[field]; already {
 			continue // already output
 		}
-		sb.WriteString(fmt.Sprintf("CREATE TABLE %s_symbol (\n  id INTEGER PRIMARY KEY,\n  value TEXT UNIQUE\n);\n\n", field))
+		sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n  id INTEGER PRIMARY KEY,\n  value TEXT UNIQUE\n);\n\n", opts.tableName(field+"_symbol")))
+	}
+	// Numeric symbol values stay numbers, for range queries on them
+	for field, typ := range symbolNumberFields {
+		sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n  id INTEGER PRIMARY KEY,\n  value %s UNIQUE\n);\n\n", opts.tableName(field+"_symbol"), typ))
 	}
+	opts.Profile.writeIndexes(&sb, schema, func(field string) bool {
+		return symbolFields[field] || symbolJSONFields[field] || symbolNumberFields[field] != ""
+	}, opts.tableName, opts.Naming)
 	return sb.String()
 }
 
+// tableName returns the name generated for an analyzed table, which is
+// named after its key with the root table as "main"
+func (opts AnalyzeOptions) tableName(name string) string {
+	if name != "main" {
+		name = inflectTable(name, opts.TableNames)
+	}
+	if opts.Root != "" {
+		if name == "main" {
+			name = opts.Root
+		} else {
+			name = opts.Root + "_" + name
+		}
+	}
+	return tenantTable(opts.Tenant, name)
+}
+
 // analyzeObjectSymbol analyzes an object and its fields to determine the schema
 func analyzeObjectSymbol(
 	tblName string,
@@ -103,6 +472,9 @@ func analyzeObjectSymbol(
 	schema map[string]*TableSchema,
 	stringUniques map[string]stringSet,
 	jsonUniques map[string]stringSet,
+	geometry FieldType,
+	times bool, // give fields holding zoned times UTCTIME columns
+	overrides map[string]FieldType, // "table.column" -> type
 ) {
 	if _, ok := schema[tblName]; !ok {
 		schema[tblName] = &TableSchema{Name: tblName, Fields: map[string]FieldType{}, FKs: map[string]string{}}
@@ -110,10 +482,68 @@ func analyzeObjectSymbol(
 	curr := schema[tblName]
 	fieldTypes := map[string]FieldType{}
 
+	// Keys holding a GeoJSON geometry in every row get a geometry column
+	geoKeys := map[string]bool{}
+	if geometry != "" {
+		notGeo := map[string]bool{}
+		for _, row := range rows {
+			for k, v := range row {
+				if _, isObj := v.(map[string]interface{}); isObj && isGeometry(v) {
+					geoKeys[k] = true
+				} else if isObj {
+					notGeo[k] = true
+				}
+			}
+		}
+		for k := range notGeo {
+			delete(geoKeys, k)
+		}
+	}
+
+	// Keys holding a time with a zone in every row get a UTCTIME column
+	timeKeys := map[string]bool{}
+	if times {
+		notTime := map[string]bool{}
+		for _, row := range rows {
+			for k, v := range row {
+				if _, ok := parseZonedTime(v); ok {
+					timeKeys[k] = true
+				} else if v != nil {
+					notTime[k] = true
+				}
+			}
+		}
+		for k := range notTime {
+			delete(timeKeys, k)
+		}
+	}
+
 	for _, row := range rows {
 		for k, v := range row {
+			// Profile types replace inference; JSON keeps objects in one column
+			if typ, ok := overrides[tblName+"."+k]; ok {
+				fieldTypes[k] = typ
+				uniques := stringUniques
+				text, isString := v.(string)
+				switch {
+				case typ == TypeJSON && v != nil:
+					js, _ := json.Marshal(v)
+					text, uniques = string(js), jsonUniques
+				case typ != TypeText || !isString:
+					continue
+				}
+				if _, ok := uniques[k]; !ok {
+					uniques[k] = stringSet{}
+				}
+				uniques[k][text] = struct{}{}
+				continue
+			}
 			switch v2 := v.(type) {
 			case map[string]interface{}:
+				if geoKeys[k] {
+					fieldTypes[k] = geometry
+					continue
+				}
 				fieldTypes[k+"_id"] = TypeInt
 				var subrows []map[string]interface{}
 				for _, xrow := range rows {
@@ -121,7 +551,7 @@ func analyzeObjectSymbol(
 						subrows = append(subrows, sub)
 					}
 				}
-				analyzeObjectSymbol(k, subrows, schema, stringUniques, jsonUniques)
+				analyzeObjectSymbol(k, subrows, schema, stringUniques, jsonUniques, geometry, times, overrides)
 				curr.FKs[k+"_id"] = k
 			case []interface{}:
 				fieldTypes[k] = TypeJSON
@@ -132,13 +562,24 @@ func analyzeObjectSymbol(
 				}
 				jsonUniques[k][string(js)] = struct{}{}
 			case string:
+				if timeKeys[k] {
+					fieldTypes[k] = TypeUTCTime
+					fieldTypes[k+timeOffsetSuffix] = TypeInt
+					continue
+				}
 				fieldTypes[k] = TypeText
 				if _, ok := stringUniques[k]; !ok {
 					stringUniques[k] = stringSet{}
 				}
 				stringUniques[k][v2] = struct{}{}
-			case float64:
-				fieldTypes[k] = TypeReal
+			case float64, int64:
+				// Whole numbers are INTEGER, so that 64-bit ones keep
+				// their digits, unless the field also holds fractions
+				if isWholeNumber(v2) && fieldTypes[k] != TypeReal && curr.Fields[k] != TypeReal {
+					fieldTypes[k] = TypeInt
+				} else {
+					fieldTypes[k] = TypeReal
+				}
 			case bool:
 				fieldTypes[k] = TypeBool
 			default:
@@ -150,4 +591,114 @@ func analyzeObjectSymbol(
 		curr.Fields[f] = t
 	}
 	curr.Fields["id"] = TypeInt
-}
\ No newline at end of file
+}
+
+// isWholeNumber reports whether a decoded number is an integer an INTEGER
+// column holds
+func isWholeNumber(v interface{}) bool {
+	switch n := v.(type) {
+	case int64:
+		return true
+	case float64:
+		return n == math.Trunc(n) && math.Abs(n) < 1<<63
+	}
+	return false
+}
+
+// writeSpatialIndex emits an R*Tree over the bounding boxes of a geometry
+// column. The loader fills it; triggers keep it in step when rows are
+// deleted or renumbered.
+func writeSpatialIndex(sb *strings.Builder, table, col string) {
+	rtree := spatialIndexName(table, col)
+	fmt.Fprintf(sb, "CREATE VIRTUAL TABLE %s USING rtree(id, minx, maxx, miny, maxy);\n\n", rtree)
+	fmt.Fprintf(sb, "CREATE TRIGGER %s_delete AFTER DELETE ON %s BEGIN\n  DELETE FROM %s WHERE id = old.id;\nEND;\n\n", rtree, table, rtree)
+	fmt.Fprintf(sb, "CREATE TRIGGER %s_renumber AFTER UPDATE OF id ON %s BEGIN\n  UPDATE %s SET id = new.id WHERE id = old.id;\nEND;\n\n", rtree, table, rtree)
+}
+
+// walkDocument calls fn with every value of doc and the path of keys
+// leading to it, as the analyzer traverses documents: nested objects are
+// descended into, as they become tables of their own, while arrays,
+// scalars and empty objects are the values of columns. With indexArrays
+// the elements of arrays are descended into too, keyed by their index.
+// fn must not keep path.
+func walkDocument(doc map[string]interface{}, indexArrays bool, fn func(path []string, v interface{})) {
+	var walk func(path []string, v interface{})
+	walk = func(path []string, v interface{}) {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if len(vv) > 0 || len(path) == 0 {
+				for k, sub := range vv {
+					walk(append(path, k), sub)
+				}
+				return
+			}
+		case []interface{}:
+			if indexArrays && len(vv) > 0 {
+				for i, sub := range vv {
+					walk(append(path, strconv.Itoa(i)), sub)
+				}
+				return
+			}
+		}
+		fn(path, v)
+	}
+	walk(nil, doc)
+}
+
+// addNumberUniques adds the distinct values of the numeric fields of roots
+// and their nested objects to uniques
+func addNumberUniques(uniques map[string]map[float64]bool, roots []map[string]interface{}) {
+	for _, root := range roots {
+		walkDocument(root, false, func(path []string, v interface{}) {
+			if f, ok := v.(float64); ok {
+				k := path[len(path)-1]
+				if uniques[k] == nil {
+					uniques[k] = map[float64]bool{}
+				}
+				uniques[k][f] = true
+			}
+		})
+	}
+}
+
+// numberSymbolFields returns the numeric fields with few distinct values
+// among the sampled documents, as strings are symbolized, with the type of
+// their symbol values: INTEGER if all are whole numbers, else REAL
+func numberSymbolFields(uniques map[string]map[float64]bool, numRows int) map[string]FieldType {
+	fields := map[string]FieldType{}
+	for k, values := range uniques {
+		if len(values) >= numRows/5 {
+			continue
+		}
+		fields[k] = TypeInt
+		for v := range values {
+			if v != math.Trunc(v) || math.Abs(v) >= 1<<53 {
+				fields[k] = TypeReal
+			}
+		}
+	}
+	return fields
+}
+
+// subtreeRecords returns the objects at a dotted path of a document, as
+// records of their own: the object there, or the objects of an array
+// there. Without a path the document is its own record.
+func subtreeRecords(doc map[string]interface{}, path string) []map[string]interface{} {
+	if path == "" {
+		return []map[string]interface{}{doc}
+	}
+	v, _ := lookupPath(doc, path)
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{vv}
+	case []interface{}:
+		var recs []map[string]interface{}
+		for _, elem := range vv {
+			if obj, ok := elem.(map[string]interface{}); ok {
+				recs = append(recs, obj)
+			}
+		}
+		return recs
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package jsql
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/tomberek/jsql/internal/pathspec"
+	"gopkg.in/yaml.v3"
+)
+
+// FieldRule describes how one field is anonymized
+type FieldRule struct {
+	Strategy string `yaml:"strategy"` // mask, hash, fake or drop
+	Keep     int    `yaml:"keep"`     // mask: trailing characters left visible
+	Length   int    `yaml:"length"`   // hash: hex digits kept (default 16)
+	Kind     string `yaml:"kind"`     // fake: name, email, city, word, phone or number
+}
+
+// UnmarshalYAML accepts either a bare strategy name or a mapping
+func (r *FieldRule) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		r.Strategy = node.Value
+		return nil
+	}
+	type plain FieldRule
+	return node.Decode((*plain)(r))
+}
+
+// AnonymizeProfile maps key paths of the dumped documents to rules. Arrays
+// are walked whether or not the path marks them with [].
+type AnonymizeProfile struct {
+	Salt   string               `yaml:"salt"`
+	Fields map[string]FieldRule `yaml:"fields"`
+}
+
+// LoadAnonymizeProfile reads and validates a YAML anonymization profile
+func LoadAnonymizeProfile(path string) (*AnonymizeProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p AnonymizeProfile
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for field, rule := range p.Fields {
+		if _, err := pathspec.Parse(field); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if (rule.Strategy == "hash" || rule.Strategy == "fake") && p.Salt == "" {
+			// Unsalted, a hash is reversed by hashing guesses of the value
+			return nil, fmt.Errorf("%s: field %s: %s requires a salt", path, field, rule.Strategy)
+		}
+		switch rule.Strategy {
+		case "mask", "hash", "drop":
+		case "fake":
+			switch rule.Kind {
+			case "":
+				rule.Kind = "word"
+				p.Fields[field] = rule
+			case "name", "city", "word", "email", "phone", "number":
+			default:
+				return nil, fmt.Errorf("%s: field %s: unknown fake kind %q", path, field, rule.Kind)
+			}
+		default:
+			return nil, fmt.Errorf("%s: field %s: unknown strategy %q", path, field, rule.Strategy)
+		}
+	}
+	return &p, nil
+}
+
+// Apply anonymizes a rehydrated document in place
+func (p *AnonymizeProfile) Apply(obj map[string]interface{}) {
+	paths := make([]string, 0, len(p.Fields))
+	for path := range p.Fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		keys, _ := pathspec.Parse(path)
+		p.applyPath(obj, keys.Keys(), p.Fields[path])
+	}
+}
+
+// applyPath walks nested objects (and every element of arrays) to the field
+func (p *AnonymizeProfile) applyPath(v interface{}, path []string, rule FieldRule) {
+	switch vv := v.(type) {
+	case []interface{}:
+		for _, elem := range vv {
+			p.applyPath(elem, path, rule)
+		}
+	case map[string]interface{}:
+		val, ok := vv[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) > 1 {
+			p.applyPath(val, path[1:], rule)
+			return
+		}
+		if rule.Strategy == "drop" {
+			delete(vv, path[0])
+			return
+		}
+		vv[path[0]] = p.anonymize(val, rule)
+	}
+}
+
+// anonymize replaces a single value according to rule
+func (p *AnonymizeProfile) anonymize(val interface{}, rule FieldRule) interface{} {
+	if val == nil {
+		return nil
+	}
+	switch rule.Strategy {
+	case "mask":
+		s, ok := val.(string)
+		if !ok {
+			js, _ := json.Marshal(val)
+			s = string(js)
+		}
+		runes := []rune(s)
+		for i := 0; i < len(runes)-rule.Keep; i++ {
+			runes[i] = '*'
+		}
+		return string(runes)
+	case "hash":
+		sum := p.digest(val)
+		n := rule.Length
+		if n <= 0 || n > len(sum)*2 {
+			n = 16
+		}
+		return hex.EncodeToString(sum[:])[:n]
+	case "fake":
+		return p.fake(val, rule.Kind)
+	}
+	return val
+}
+
+// digest hashes a value with the profile's salt; equal inputs give equal
+// outputs so anonymized fixtures keep their joins and duplicates
+func (p *AnonymizeProfile) digest(val interface{}) [32]byte {
+	js, _ := json.Marshal(val)
+	return sha256.Sum256(append([]byte(p.Salt), js...))
+}
+
+// fakeValues are the word lists used by the fake strategy
+var fakeValues = map[string][]string{
+	"name": {"Alex Morgan", "Sam Taylor", "Jordan Lee", "Casey Brown", "Riley Smith",
+		"Jamie Clark", "Avery Jones", "Quinn Davis", "Drew Miller", "Robin Wilson"},
+	"city": {"Springfield", "Riverton", "Fairview", "Lakeside", "Greenville",
+		"Franklin", "Clinton", "Georgetown", "Madison", "Salem"},
+	"word": {"alpha", "bravo", "charlie", "delta", "echo",
+		"foxtrot", "golf", "hotel", "india", "juliet"},
+}
+
+// fake returns a deterministic, realistic-looking replacement for val
+func (p *AnonymizeProfile) fake(val interface{}, kind string) interface{} {
+	sum := p.digest(val)
+	n := binary.BigEndian.Uint64(sum[:8])
+	switch kind {
+	case "email":
+		return fmt.Sprintf("user%06d@example.com", n%1000000)
+	case "phone":
+		return fmt.Sprintf("555-%04d", n%10000)
+	case "number":
+		return float64(n % 100000)
+	}
+	words := fakeValues[kind]
+	return words[n%uint64(len(words))]
+}
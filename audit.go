@@ -0,0 +1,220 @@
+package jsql
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The audit log of a database records every write jsql makes to it, so
+// that a database shared by several people keeps a history of how it was
+// modified. load, import, patch, retry-quarantine, sync, serve, repair,
+// recompact-symbols and denormalize append an entry to the _jsql_audit
+// table in the transaction of their write, so that the write and its entry
+// commit together: their command line, the SHA-256 of their input and the
+// number of rows they affected. A load committed in batches, like each batch
+// serve commits, records an entry per batch. --audit creates the log; a database
+// that has one records every later write.
+//
+// Entries form a hash chain: each holds the hash of the one before it and
+// its own hash over both, so that altering or removing an entry breaks the
+// chain from there on, which the audit command reports. Triggers refuse
+// UPDATE and DELETE statements on the table.
+//
+// The chain has no key: it catches edits made by hand, not someone who can
+// write the file. Dropping the triggers, the last entries can be removed,
+// or the whole chain rewritten with hashes of its own, and the log still
+// verifies. Only a hash kept outside the database anchors it: audit --head
+// checks that the log still holds the entry of a hash recorded earlier.
+
+// auditTable is the table of the audit log
+const auditTable = "_jsql_audit"
+
+// auditDDL creates the audit log
+var auditDDL = []string{
+	`CREATE TABLE IF NOT EXISTS ` + auditTable + ` (
+  id INTEGER PRIMARY KEY,
+  at TEXT NOT NULL,
+  command TEXT NOT NULL,
+  input TEXT,
+  input_sha256 TEXT,
+  rows INTEGER NOT NULL,
+  prev TEXT NOT NULL,
+  hash TEXT NOT NULL
+)`,
+	`CREATE TRIGGER IF NOT EXISTS ` + auditTable + `_no_update BEFORE UPDATE ON ` + auditTable + `
+BEGIN SELECT RAISE(ABORT, '` + auditTable + ` is append-only'); END`,
+	`CREATE TRIGGER IF NOT EXISTS ` + auditTable + `_no_delete BEFORE DELETE ON ` + auditTable + `
+BEGIN SELECT RAISE(ABORT, '` + auditTable + ` is append-only'); END`,
+}
+
+// AuditEntry is a write recorded in the audit log
+type AuditEntry struct {
+	ID          int64  `json:"id"`
+	At          string `json:"at"`                     // when the write finished, RFC 3339 in UTC
+	Command     string `json:"command"`                // command line of the write
+	Input       string `json:"input,omitempty"`        // input file, or stdin
+	InputSHA256 string `json:"input_sha256,omitempty"` // of the input's content
+	Rows        int64  `json:"rows"`                   // rows loaded, patched, removed or rewritten
+	Prev        string `json:"prev"`                   // hash of the entry before, "" for the first
+	Hash        string `json:"hash"`                   // over the entry's fields and Prev
+}
+
+// digest returns the hash the entry should have
+func (e AuditEntry) digest() string {
+	h := sha256.New()
+	for _, f := range []string{strconv.FormatInt(e.ID, 10), e.At, e.Command, e.Input, e.InputSHA256, strconv.FormatInt(e.Rows, 10), e.Prev} {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// hasAuditLog reports whether db has an audit log
+func hasAuditLog(db queryer) (bool, error) {
+	var n int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?", auditTable).Scan(&n)
+	return n > 0, err
+}
+
+// AuditWrite is a write to record in the audit log, by the transactions
+// that make it
+type AuditWrite struct {
+	Command     string // command line of the write
+	Input       string // input file, stdin or "" for none
+	InputSHA256 string // of the input's content; computed from Input if ""
+	Create      bool   // create the log if the database has none
+}
+
+// record appends the entry of the write, of rows documents, to the audit
+// log in tx. A nil write records nothing.
+func (w *AuditWrite) record(tx *sql.Tx, rows int64) error {
+	if w == nil {
+		return nil
+	}
+	// Standard input is hashed as far as it has been read at each commit
+	if w.InputSHA256 == "" || w.Input == StdinInput {
+		sum, err := inputSHA256(w.Input)
+		if err != nil {
+			return err
+		}
+		w.InputSHA256 = sum
+	}
+	e := AuditEntry{Command: w.Command, Input: InputName(w.Input), InputSHA256: w.InputSHA256, Rows: rows}
+	return appendAudit(tx, e, w.Create)
+}
+
+// RecordAudit appends e to the audit log of the database at dbPath, chained
+// to the last entry, and creates the log first if create is set. It does
+// nothing to a database without a log otherwise.
+func RecordAudit(dbPath string, e AuditEntry, create bool) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := appendAudit(tx, e, create); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// appendAudit appends e to the audit log in tx, as RecordAudit does
+func appendAudit(tx *sql.Tx, e AuditEntry, create bool) error {
+	if ok, err := hasAuditLog(tx); err != nil || !ok && !create {
+		return err
+	}
+	for _, stmt := range auditDDL {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	err := tx.QueryRow("SELECT id + 1, hash FROM "+auditTable+" ORDER BY id DESC LIMIT 1").Scan(&e.ID, &e.Prev)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		e.ID, e.Prev = 1, ""
+	case err != nil:
+		return err
+	}
+	if e.At == "" {
+		e.At = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	e.Hash = e.digest()
+	_, err = tx.Exec("INSERT INTO "+auditTable+" (id, at, command, input, input_sha256, rows, prev, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		e.ID, e.At, e.Command, nullString(e.Input), nullString(e.InputSHA256), e.Rows, e.Prev, e.Hash)
+	return err
+}
+
+// nullString stores "" as NULL
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// ReadAudit returns the entries of the audit log of the database at dbPath,
+// oldest first, and an error naming the first entry that breaks the hash
+// chain, if one does
+func ReadAudit(dbPath string) ([]AuditEntry, error) {
+	db, err := sql.Open("sqlite3", sqliteURI(dbPath, "mode=ro"))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	if ok, err := hasAuditLog(db); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("%s has no audit log; write to it with --audit to start one", dbPath)
+	}
+	rows, err := db.Query("SELECT id, at, command, COALESCE(input, ''), COALESCE(input_sha256, ''), rows, prev, hash FROM " + auditTable + " ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.At, &e.Command, &e.Input, &e.InputSHA256, &e.Rows, &e.Prev, &e.Hash); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	prev := ""
+	for i, e := range entries {
+		switch {
+		case e.ID != int64(i+1):
+			return entries, fmt.Errorf("audit entry %d follows entry %d: entries were removed", e.ID, i)
+		case e.Prev != prev:
+			return entries, fmt.Errorf("audit entry %d does not chain to entry %d: the log was altered", e.ID, i)
+		case e.Hash != e.digest():
+			return entries, fmt.Errorf("audit entry %d does not match its hash: the log was altered", e.ID)
+		}
+		prev = e.Hash
+	}
+	return entries, nil
+}
+
+// inputSHA256 returns the SHA-256 of an input's content, or "" for no
+// input. That of standard input covers what the command read of it.
+func inputSHA256(input string) (string, error) {
+	switch input {
+	case "":
+		return "", nil
+	case StdinInput:
+		return hex.EncodeToString(stdinDigest.Sum(nil)), nil
+	}
+	return fileSHA256(input)
+}
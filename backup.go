@@ -0,0 +1,81 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Backup copies the database at src to dst with SQLite's online backup API.
+// The copy is a consistent snapshot even while other connections or
+// processes are writing to src. It is written next to dst and renamed into
+// place, so dst is never left half-written. Cancelling ctx interrupts the
+// copy.
+func Backup(ctx context.Context, src, dst string) (pages int, err error) {
+	if _, err := os.Stat(src); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	srcDB, err := sql.Open("sqlite3", src)
+	if err != nil {
+		return 0, err
+	}
+	defer srcDB.Close()
+	dstDB, err := sql.Open("sqlite3", tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	defer dstDB.Close()
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer srcConn.Close()
+	dstConn, err := dstDB.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer dstConn.Close()
+
+	if pages, err = copyDatabase(dstConn, srcConn); err != nil {
+		return 0, err
+	}
+	dstConn.Close()
+	dstDB.Close()
+	return pages, replaceFile(tmp.Name(), dst)
+}
+
+// copyDatabase replaces the main database of dst with that of src using the
+// backup API, returning the number of pages copied
+func copyDatabase(dst, src *sql.Conn) (pages int, err error) {
+	err = dst.Raw(func(dc any) error {
+		return src.Raw(func(sc any) error {
+			b, err := dc.(*sqlite3.SQLiteConn).Backup("main", sc.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			// A single step copies every page under one read transaction;
+			// stepping in chunks would restart whenever a writer commits
+			done, err := b.Step(-1)
+			pages = b.PageCount()
+			if ferr := b.Finish(); err == nil {
+				err = ferr
+			}
+			if err == nil && !done {
+				err = fmt.Errorf("backup did not complete")
+			}
+			return err
+		})
+	})
+	return pages, err
+}
@@ -0,0 +1,162 @@
+package jsql
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps large values outside the database, addressed by the hex
+// SHA-256 of their content
+type BlobStore interface {
+	Put(hash string, data []byte) error
+	Get(hash string) ([]byte, error)
+}
+
+// BlobStorage moves TEXT and JSON values of at least Threshold bytes to Store.
+// The column then holds a BLOB "sha256:<hex>" reference instead of the text;
+// the dumper rehydrates the BLOBs of those columns that have the form of a
+// reference, if a store is configured, and keeps any other BLOB as it is.
+type BlobStorage struct {
+	Store     BlobStore
+	Threshold int
+}
+
+const blobRefPrefix = "sha256:"
+
+// OpenBlobStore returns the store at location: an http(s) URL answering
+// PUT and GET on <url>/<hash>, or else a local directory
+func OpenBlobStore(location string) BlobStore {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return &httpBlobStore{base: strings.TrimRight(location, "/"), client: &http.Client{Timeout: time.Minute}}
+	}
+	return &dirBlobStore{root: location}
+}
+
+// externalize stores text in the blob store if it is large enough, returning
+// the value to write to the column
+func (b *BlobStorage) externalize(text string) (interface{}, error) {
+	if b == nil || len(text) < b.Threshold {
+		return text, nil
+	}
+	sum := sha256.Sum256([]byte(text))
+	hash := hex.EncodeToString(sum[:])
+	if err := b.Store.Put(hash, []byte(text)); err != nil {
+		return nil, fmt.Errorf("blob store: %v", err)
+	}
+	return []byte(blobRefPrefix + hash), nil
+}
+
+// blobRef returns the hash of a column value that is a reference to the
+// blob store
+func blobRef(val []byte) (string, bool) {
+	hash, ok := strings.CutPrefix(string(val), blobRefPrefix)
+	if _, err := hex.DecodeString(hash); !ok || err != nil || len(hash) != 2*sha256.Size {
+		return "", false
+	}
+	return hash, true
+}
+
+// rehydrate returns the text a column reference points to
+func (b *BlobStorage) rehydrate(ref []byte) (string, error) {
+	hash, ok := blobRef(ref)
+	if !ok {
+		return "", fmt.Errorf("unknown blob reference %q", ref)
+	}
+	data, err := b.Store.Get(hash)
+	if err != nil {
+		return "", fmt.Errorf("blob store: %v", err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != hash {
+		return "", fmt.Errorf("blob store: content of %s does not match its hash", hash)
+	}
+	return string(data), nil
+}
+
+// dirBlobStore keeps blobs as files named by hash, sharded by the first two
+// hex digits
+type dirBlobStore struct {
+	root string
+}
+
+func (s *dirBlobStore) path(hash string) string {
+	return filepath.Join(s.root, hash[:2], hash)
+}
+
+func (s *dirBlobStore) Put(hash string, data []byte) error {
+	path := s.path(hash)
+	if _, err := os.Stat(path); err == nil {
+		return nil // content-addressed: already stored
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see partial blobs
+	tmp, err := os.CreateTemp(filepath.Dir(path), hash+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := replaceFile(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		if _, serr := os.Stat(path); serr == nil {
+			return nil // stored meanwhile by another writer, which holds it open
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *dirBlobStore) Get(hash string) ([]byte, error) {
+	return os.ReadFile(s.path(hash))
+}
+
+// httpBlobStore keeps blobs in an object store or any server accepting
+// PUT and GET of <base>/<hash>
+type httpBlobStore struct {
+	base   string
+	client *http.Client
+}
+
+func (s *httpBlobStore) Put(hash string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.base+"/"+hash, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpBlobStore) Get(hash string) ([]byte, error) {
+	resp, err := s.client.Get(s.base + "/" + hash)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s/%s: %s", s.base, hash, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
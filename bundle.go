@@ -0,0 +1,394 @@
+package jsql
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A bundle is a zstd-compressed tar of a database, its schema and metadata,
+// led by a manifest of SHA-256 checksums. The manifest may be signed with an
+// Ed25519 key and the whole bundle encrypted to age recipients.
+const (
+	bundleManifest  = "manifest.json"
+	bundleSignature = "manifest.sig"
+	bundleDB        = "data.db"
+	bundleSchema    = "schema.sql"
+	bundleMetadata  = "metadata.json"
+)
+
+// BundleManifest lists the files of a bundle with their checksums
+type BundleManifest struct {
+	Version int          `json:"version"`
+	Created string       `json:"created"`
+	Files   []BundleFile `json:"files"`
+}
+
+// BundleFile is one checksummed file of a bundle
+type BundleFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BundleMetadata describes the shipped dataset
+type BundleMetadata struct {
+	Description string           `json:"description,omitempty"`
+	Source      string           `json:"source"`
+	Created     string           `json:"created"`
+	Rows        map[string]int64 `json:"rows"` // per table
+}
+
+// ExportOptions controls how a bundle is written
+type ExportOptions struct {
+	Description string
+	Recipients  []string // age recipients (age1...) to encrypt to
+	SignKey     string   // PEM file with an Ed25519 private key
+}
+
+// ExportBundle writes the database at dbPath and its schema ddl to a
+// bundle. Cancelling ctx interrupts the snapshot of the database.
+func ExportBundle(ctx context.Context, dbPath, ddl, out string, opts ExportOptions) (err error) {
+	var signer ed25519.PrivateKey
+	if opts.SignKey != "" {
+		if signer, err = readSigningKey(opts.SignKey); err != nil {
+			return err
+		}
+	}
+	var recipients []age.Recipient
+	for _, r := range opts.Recipients {
+		rec, err := age.ParseX25519Recipient(r)
+		if err != nil {
+			return fmt.Errorf("recipient %s: %v", r, err)
+		}
+		recipients = append(recipients, rec)
+	}
+
+	// Ship a consistent snapshot even if the database is in use
+	tmpDir, err := os.MkdirTemp("", "jsql-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	snapshot := filepath.Join(tmpDir, bundleDB)
+	if _, err := Backup(ctx, dbPath, snapshot); err != nil {
+		return fmt.Errorf("snapshot: %v", err)
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	meta := BundleMetadata{Description: opts.Description, Source: filepath.Base(dbPath), Created: now}
+	if meta.Rows, err = countRows(snapshot, ParseDDL(ddl)); err != nil {
+		return err
+	}
+	metaJSON, _ := json.MarshalIndent(meta, "", "  ")
+
+	files := []struct {
+		name string
+		data []byte // nil: read from path
+		path string
+	}{
+		{name: bundleDB, path: snapshot},
+		{name: bundleSchema, data: []byte(ddl)},
+		{name: bundleMetadata, data: metaJSON},
+	}
+	manifest := BundleManifest{Version: 1, Created: now}
+	for _, f := range files {
+		var sum []byte
+		var size int64
+		if f.data != nil {
+			s := sha256.Sum256(f.data)
+			sum, size = s[:], int64(len(f.data))
+		} else if sum, size, err = hashFile(f.path); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, BundleFile{Name: f.name, Size: size, SHA256: hex.EncodeToString(sum)})
+	}
+	manifestJSON, _ := json.MarshalIndent(manifest, "", "  ")
+
+	outFile, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		outFile.Close()
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+	bw := bufio.NewWriter(outFile)
+	var w io.Writer = bw
+	var enc io.WriteCloser
+	if len(recipients) > 0 {
+		if enc, err = age.Encrypt(bw, recipients...); err != nil {
+			return err
+		}
+		w = enc
+	}
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	add := func(name string, size int64, r io.Reader) error {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: time.Now()}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	}
+	if err := add(bundleManifest, int64(len(manifestJSON)), bytes.NewReader(manifestJSON)); err != nil {
+		return err
+	}
+	if signer != nil {
+		sig := ed25519.Sign(signer, manifestJSON)
+		if err := add(bundleSignature, int64(len(sig)), bytes.NewReader(sig)); err != nil {
+			return err
+		}
+	}
+	for i, f := range files {
+		r := io.Reader(bytes.NewReader(f.data))
+		if f.data == nil {
+			fh, err := os.Open(f.path)
+			if err != nil {
+				return err
+			}
+			defer fh.Close()
+			r = fh
+		}
+		if err := add(f.name, manifest.Files[i].Size, r); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return outFile.Close()
+}
+
+// ImportOptions controls how a bundle is opened
+type ImportOptions struct {
+	Identities string // file of age identities, for encrypted bundles
+	VerifyKey  string // PEM file with the Ed25519 public key the manifest must be signed with
+}
+
+// ImportBundle verifies a bundle and unpacks its files into dir. Nothing is
+// left in dir unless every checksum (and the signature, if required) matches.
+func ImportBundle(bundle, dir string, opts ImportOptions) (*BundleManifest, error) {
+	in, err := os.Open(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	br := bufio.NewReader(in)
+	var r io.Reader = br
+	if head, _ := br.Peek(len("age-encryption.org/")); string(head) == "age-encryption.org/" {
+		if opts.Identities == "" {
+			return nil, fmt.Errorf("bundle is encrypted: an age identity file is required")
+		}
+		idFile, err := os.Open(opts.Identities)
+		if err != nil {
+			return nil, err
+		}
+		ids, err := age.ParseIdentities(idFile)
+		idFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", opts.Identities, err)
+		}
+		if r, err = age.Decrypt(br, ids...); err != nil {
+			return nil, err
+		}
+	}
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	staging, err := os.MkdirTemp(dir, ".bundle-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	var manifestJSON, sig []byte
+	sums := map[string]string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Name {
+		case bundleManifest:
+			manifestJSON, err = io.ReadAll(tr)
+		case bundleSignature:
+			sig, err = io.ReadAll(tr)
+		case bundleDB, bundleSchema, bundleMetadata:
+			sums[hdr.Name], err = extractFile(tr, filepath.Join(staging, hdr.Name))
+		default:
+			return nil, fmt.Errorf("unexpected file %q in bundle", hdr.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifestJSON == nil {
+		return nil, fmt.Errorf("bundle has no %s", bundleManifest)
+	}
+	if opts.VerifyKey != "" {
+		pub, err := readVerifyKey(opts.VerifyKey)
+		if err != nil {
+			return nil, err
+		}
+		if sig == nil || !ed25519.Verify(pub, manifestJSON, sig) {
+			return nil, fmt.Errorf("manifest signature does not verify with %s", opts.VerifyKey)
+		}
+	}
+	var manifest BundleManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: %v", bundleManifest, err)
+	}
+	for _, f := range manifest.Files {
+		got, ok := sums[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is listed in the manifest but missing", f.Name)
+		}
+		if got != f.SHA256 {
+			return nil, fmt.Errorf("%s: checksum mismatch", f.Name)
+		}
+		delete(sums, f.Name)
+	}
+	for name := range sums {
+		return nil, fmt.Errorf("%s is not listed in the manifest", name)
+	}
+	for _, f := range manifest.Files {
+		if err := replaceFile(filepath.Join(staging, f.Name), filepath.Join(dir, f.Name)); err != nil {
+			return nil, err
+		}
+	}
+	return &manifest, nil
+}
+
+// extractFile writes r to path, returning the hex SHA-256 of the content
+func extractFile(r io.Reader, path string) (string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		f.Close()
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), f.Close()
+}
+
+func hashFile(path string) ([]byte, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	return h.Sum(nil), n, err
+}
+
+// countRows returns the number of rows of every table of dbs
+func countRows(dbPath string, dbs *DatabaseSchema) (map[string]int64, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	counts := map[string]int64{}
+	for _, name := range dbs.TableOrder {
+		var n int64
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + name).Scan(&n); err != nil {
+			return nil, fmt.Errorf("count %s: %v", name, err)
+		}
+		counts[name] = n
+	}
+	return counts, nil
+}
+
+// readSigningKey reads a PKCS #8 PEM Ed25519 private key, as written by
+// `openssl genpkey -algorithm ed25519`
+func readSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 private key", path)
+	}
+	return priv, nil
+}
+
+// readVerifyKey reads a PKIX PEM Ed25519 public key, as written by
+// `openssl pkey -pubout`
+func readVerifyKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 public key", path)
+	}
+	return pub, nil
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	return block, nil
+}
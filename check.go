@@ -0,0 +1,106 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// Kinds of invariant violations found by CheckDatabase
+const (
+	DanglingSymbol  = "dangling-symbol"  // _symbol id missing from its symbol table
+	DanglingFK      = "dangling-fk"      // _id missing from its sub-table
+	InvalidJSON     = "invalid-json"     // JSON, GEOJSON or symbol value that does not parse
+	DuplicateSymbol = "duplicate-symbol" // symbol value stored under more than one id
+)
+
+// Violation counts the rows of one table breaking one invariant on one column
+type Violation struct {
+	Table  string
+	Column string
+	Kind   string
+	Count  int
+
+	where string // selects the offending rows
+}
+
+// CheckDatabase verifies the invariants the loader maintains and the dumper
+// relies on, returning the violations found ordered by table and column
+func CheckDatabase(dbPath string, dbs *DatabaseSchema) ([]Violation, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return checkInvariants(db, dbs)
+}
+
+// invariantChecks lists, for every table, the WHERE clauses selecting rows
+// that violate an invariant
+func invariantChecks(dbs *DatabaseSchema) []Violation {
+	var checks []Violation
+	symbolTables := map[string]bool{}
+	for _, name := range dbs.TableOrder {
+		t := dbs.Tables[name]
+		cols := make([]string, 0, len(t.Fields))
+		for col := range t.Fields {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			ref, isFK := t.FKs[col]
+			_, isLink := t.Links[col]
+			_, isSym := t.Naming.symbolField(col)
+			_, isObj := t.Naming.objectField(col)
+			switch {
+			case isFK && dbs.Tables[ref] != nil && (isSym || isObj || isLink):
+				kind := DanglingFK
+				if isSym {
+					kind = DanglingSymbol
+					symbolTables[ref] = true
+				}
+				// The loader writes 0 for null symbols and empty sub-objects
+				checks = append(checks, Violation{Table: name, Column: col, Kind: kind,
+					where: fmt.Sprintf("%[1]s IS NOT NULL AND %[1]s != 0 AND NOT EXISTS (SELECT 1 FROM %[2]s WHERE %[2]s.id = %[3]s.%[1]s)", col, ref, name)})
+			case t.Fields[col] == TypeJSON || t.Fields[col] == TypeGeoJSON:
+				// BLOBs are blob store references or WKB, not JSON text
+				checks = append(checks, Violation{Table: name, Column: col, Kind: InvalidJSON,
+					where: fmt.Sprintf("typeof(%[1]s) = 'text' AND NOT json_valid(%[1]s)", col)})
+			}
+		}
+	}
+	names := make([]string, 0, len(symbolTables))
+	for name := range symbolTables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks,
+			Violation{Table: name, Column: "value", Kind: InvalidJSON,
+				where: "value IS NOT NULL AND NOT json_valid(value)"},
+			// Every copy but the first is a duplicate
+			Violation{Table: name, Column: "value", Kind: DuplicateSymbol,
+				where: fmt.Sprintf("id > (SELECT MIN(id) FROM %[1]s s WHERE s.value = %[1]s.value)", name)})
+	}
+	return checks
+}
+
+// checkInvariants counts the rows selected by every invariant check
+func checkInvariants(db queryer, dbs *DatabaseSchema) ([]Violation, error) {
+	var found []Violation
+	for _, v := range invariantChecks(dbs) {
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", v.Table, v.where)).Scan(&v.Count); err != nil {
+			return nil, fmt.Errorf("check %s.%s: %v", v.Table, v.Column, err)
+		}
+		if v.Count > 0 {
+			found = append(found, v)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Table != found[j].Table {
+			return found[i].Table < found[j].Table
+		}
+		return found[i].Column < found[j].Column
+	})
+	return found, nil
+}
@@ -0,0 +1,120 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// chunker wraps every Size input lines of a strict load in a savepoint, so
+// that a failing row rolls back the lines of its chunk only, instead of
+// the whole load or nothing at all. The rest of a failed chunk is skipped.
+type chunker struct {
+	tx     *sql.Tx
+	size   int
+	index  int   // chunk of the lines being loaded, -1 before the first
+	open   bool  // savepoint taken for the current chunk
+	failed bool  // current chunk rolled back
+	rows   int64 // rows inserted in the current chunk
+	lost   []string
+	log    io.Writer
+}
+
+// newChunker returns a chunker for strict loads, nil otherwise
+func newChunker(tx *sql.Tx, dbs *DatabaseSchema) *chunker {
+	if !dbs.Strict {
+		return nil
+	}
+	return &chunker{tx: tx, size: dbs.ChunkSize, index: -1, log: dbs.Log}
+}
+
+// chunkLines returns the range of input lines of chunk i
+func (c *chunker) chunkLines(i int) string {
+	return fmt.Sprintf("lines %d-%d", i*c.size+1, (i+1)*c.size)
+}
+
+// next moves to the chunk of lineNum, releasing the previous chunk's
+// savepoint and taking a new one
+func (c *chunker) next(lineNum int) error {
+	if c == nil || (lineNum-1)/c.size == c.index {
+		return nil
+	}
+	if err := c.release(); err != nil {
+		return err
+	}
+	c.index, c.failed, c.rows = (lineNum-1)/c.size, false, 0
+	if _, err := c.tx.Exec("SAVEPOINT chunk"); err != nil {
+		return err
+	}
+	c.open = true
+	return nil
+}
+
+func (c *chunker) release() error {
+	if !c.open {
+		return nil
+	}
+	c.open = false
+	_, err := c.tx.Exec("RELEASE chunk")
+	return err
+}
+
+// skipping reports whether the current chunk has been rolled back
+func (c *chunker) skipping() bool {
+	return c != nil && c.failed
+}
+
+// inserted counts a row inserted in the current chunk
+func (c *chunker) inserted() {
+	if c != nil {
+		c.rows++
+	}
+}
+
+// fail rolls back the current chunk because of the error on lineNum
+func (c *chunker) fail(lineNum int, loadErr error) error {
+	if c == nil {
+		return nil
+	}
+	if _, err := c.tx.Exec("ROLLBACK TO chunk"); err != nil {
+		return err
+	}
+	if err := c.release(); err != nil {
+		return err
+	}
+	metrics.rowsIngested.Add(-c.rows)
+	metrics.pendingRows.Add(-c.rows)
+	c.failed = true
+	logf(c.log, "Chunk %d (%s) rolled back: line %d: %v\n", c.index+1, c.chunkLines(c.index), lineNum, loadErr)
+	c.lost = append(c.lost, c.chunkLines(c.index))
+	return nil
+}
+
+// failChunk rolls back the current chunk of a strict load, forgetting the
+// symbol ids staged since the chunk began
+func (ds *DatabaseSchema) failChunk(c *chunker, lineNum int, loadErr error) error {
+	if c == nil {
+		return nil
+	}
+	if ds.symbols != nil {
+		ds.symbols.rollback()
+	}
+	return c.fail(lineNum, loadErr)
+}
+
+// close releases the last chunk
+func (c *chunker) close() error {
+	if c == nil {
+		return nil
+	}
+	return c.release()
+}
+
+// err reports the chunks that were not committed
+func (c *chunker) err() error {
+	if c == nil || len(c.lost) == 0 {
+		return nil
+	}
+	return fmt.Errorf("chunks not committed: %s", strings.Join(c.lost, ", "))
+}
@@ -0,0 +1,2093 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tomberek/jsql"
+	"github.com/tomberek/jsql/internal/pathspec"
+)
+
+// Command-line handlers
+
+// readSchema reads and parses the schema stored in dbFile or, if it has
+// none, the DDL file, selecting the root table of tenant
+func readSchema(dbFile, ddlFile, tenant, root string) *jsql.DatabaseSchema {
+	return readSchemaIn(jsql.SQLite, dbFile, ddlFile, tenant, root)
+}
+
+// readSchemaIn is readSchema for a database of dialect d
+func readSchemaIn(d jsql.Dialect, dbFile, ddlFile, tenant, root string) *jsql.DatabaseSchema {
+	dbSchema := parseDDL(readDDLIn(d, dbFile, ddlFile))
+	if err := dbSchema.SetRoot(tenant, root); err != nil {
+		fmt.Fprintln(os.Stderr, "Schema:", err)
+		os.Exit(1)
+	}
+	if d != jsql.SQLite {
+		dbSchema.Dialect = d
+	}
+	return dbSchema
+}
+
+// parseDDL parses ddl into a schema whose writes report the rows they skip
+// on stderr
+func parseDDL(ddl string) *jsql.DatabaseSchema {
+	dbSchema := jsql.ParseDDL(ddl)
+	dbSchema.Log = os.Stderr
+	return dbSchema
+}
+
+// mappingSchema returns the schema loading into the existing table of the
+// mapping file
+func mappingSchema(dbFile, path string) *jsql.DatabaseSchema {
+	m, err := jsql.LoadMapping(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Mapping:", err)
+		os.Exit(1)
+	}
+	dbs, err := jsql.MappingSchema(dbFile, m)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Mapping:", err)
+		os.Exit(1)
+	}
+	dbs.Log = os.Stderr
+	return dbs
+}
+
+// readDDL returns the schema stored in dbFile or, if it has none, the DDL
+// of the schema file
+func readDDL(dbFile, ddlFile string) string {
+	return readDDLIn(jsql.SQLite, dbFile, ddlFile)
+}
+
+// readDDLIn is readDDL for a database of dialect d
+func readDDLIn(d jsql.Dialect, dbFile, ddlFile string) string {
+	var ddl string
+	var stored bool
+	var err error
+	if dbFile != "" {
+		ddl, stored, err = jsql.StoredSchemaIn(d, dbFile)
+		if err != nil && ddlFile == "" {
+			fmt.Fprintln(os.Stderr, "Read schema:", err)
+			os.Exit(1)
+		}
+	}
+	switch {
+	case stored && ddlFile != "":
+		warnSchemaDiffers(jsql.DatabaseName(d, dbFile), ddl, ddlFile)
+	case !stored && ddlFile == "":
+		fmt.Fprintf(os.Stderr, "--schema is required: %s has no stored schema\n", jsql.DatabaseName(d, dbFile))
+		os.Exit(1)
+	case !stored:
+		if ddl, err = jsql.ReadDDL(ddlFile); err != nil {
+			fmt.Fprintln(os.Stderr, "Read DDL:", err)
+			os.Exit(1)
+		}
+	}
+	return ddl
+}
+
+// warnSchemaDiffers notes on stderr that the tables of the schema file
+// differ from those stored in the database, which are used instead
+func warnSchemaDiffers(dbFile, stored, ddlFile string) {
+	ddl, err := jsql.ReadDDL(ddlFile)
+	if err != nil {
+		return
+	}
+	tables := map[string]jsql.TableModel{}
+	for _, t := range jsql.NewSchemaModel(stored).Tables {
+		tables[t.Name] = t
+	}
+	for _, t := range jsql.NewSchemaModel(ddl).Tables {
+		if st, ok := tables[t.Name]; !ok || !reflect.DeepEqual(st, t) {
+			fmt.Fprintf(os.Stderr, "Using the schema stored in %s: table %s differs in %s\n", dbFile, t.Name, ddlFile)
+			return
+		}
+	}
+}
+
+// stringList is a flag that may be repeated
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// inputMap assigns an input file to the root table it is loaded into
+type inputMap struct {
+	Input, Table string
+	Source       jsql.RecordSource // documents read from a query or another format instead of JSON lines
+}
+
+// load loads the input into the database
+func (in inputMap) load(dbFile string, dbSchema *jsql.DatabaseSchema) error {
+	if in.Source != nil {
+		return jsql.LoadSource(cmdContext, in.Source, dbFile, dbSchema)
+	}
+	return jsql.LoadData(cmdContext, in.Input, dbFile, dbSchema)
+}
+
+// commandInputs returns the inputs of a command: --input loaded into root,
+// every --map, or the query source
+func commandInputs(input string, maps []string, src *jsql.QuerySource, root string) []inputMap {
+	switch {
+	case input != "":
+		return []inputMap{{Input: input, Table: root}}
+	case src != nil:
+		return []inputMap{{Input: src.DB, Table: root, Source: src}}
+	}
+	return parseMaps(maps)
+}
+
+// stdinDefault returns the input of a command given none of --input, --map
+// and --source-db: standard input, unless it is a terminal nothing is piped
+// to, in which case the command asks for an input
+func stdinDefault(input string, maps []string, src *jsql.QuerySource) string {
+	if input != "" || len(maps) > 0 || src != nil {
+		return input
+	}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice == 0 {
+		return jsql.StdinInput
+	}
+	return input
+}
+
+// countSet returns how many of the conditions hold
+func countSet(conds ...bool) int {
+	n := 0
+	for _, c := range conds {
+		if c {
+			n++
+		}
+	}
+	return n
+}
+
+// parseMaps parses --map file=table arguments
+func parseMaps(maps []string) []inputMap {
+	var out []inputMap
+	for _, m := range maps {
+		input, table, ok := strings.Cut(m, "=")
+		if !ok || input == "" || table == "" || !jsql.ValidTenant(table) {
+			fmt.Fprintf(os.Stderr, "--map %q must be file=table\n", m)
+			os.Exit(1)
+		}
+		out = append(out, inputMap{Input: input, Table: table})
+	}
+	return out
+}
+
+// blobFlags registers --blob-store and --blob-threshold. The returned
+// function attaches the configured store to a schema once flags are parsed.
+func blobFlags(flags *flag.FlagSet) func(*jsql.DatabaseSchema) {
+	store := flags.String("blob-store", "", "Directory or http(s) URL keeping large values outside the database")
+	threshold := flags.String("blob-threshold", "1MiB", "Move TEXT and JSON values of at least this size to --blob-store")
+	return func(dbs *jsql.DatabaseSchema) {
+		if *store == "" || dbs == nil {
+			return
+		}
+		n, err := jsql.ParseByteSize(*threshold)
+		if err != nil || n < 1 {
+			fmt.Fprintln(os.Stderr, "--blob-threshold: invalid size", *threshold)
+			os.Exit(1)
+		}
+		dbs.Blobs = &jsql.BlobStorage{Store: jsql.OpenBlobStore(*store), Threshold: int(n)}
+	}
+}
+
+// poolFlags registers --max-open-conns and --max-idle-conns. The returned
+// function applies them to a database handle once flags are parsed.
+func poolFlags(flags *flag.FlagSet) func(*sql.DB) {
+	maxOpen := flags.Int("max-open-conns", 0, "Most connections reading the database at once (0: unlimited)")
+	maxIdle := flags.Int("max-idle-conns", 2, "Connections kept open between reads, each with its prepared statements")
+	return func(db *sql.DB) {
+		if *maxOpen < 0 || *maxIdle < 0 {
+			fmt.Fprintln(os.Stderr, "--max-open-conns and --max-idle-conns must not be negative")
+			os.Exit(1)
+		}
+		db.SetMaxOpenConns(*maxOpen)
+		db.SetMaxIdleConns(*maxIdle)
+	}
+}
+
+// mmapFlag registers --mmap-size. The returned function gives the size in
+// bytes once flags are parsed.
+func mmapFlag(flags *flag.FlagSet) func() int64 {
+	size := flags.String("mmap-size", "0", "Memory-map up to this much of the database for reading (e.g. 256MiB; 0: off)")
+	return func() int64 {
+		n, err := jsql.ParseByteSize(*size)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "--mmap-size:", err)
+			os.Exit(1)
+		}
+		return n
+	}
+}
+
+// profileFlag registers --profile. The returned function loads the selected
+// profile once flags are parsed, or returns nil if none was given.
+func profileFlag(flags *flag.FlagSet) func() *jsql.Profile {
+	name := flags.String("profile", "", "Preset for a known dataset shape: a YAML file or one of "+strings.Join(jsql.BuiltinProfiles(), ", "))
+	return func() *jsql.Profile {
+		if *name == "" {
+			return nil
+		}
+		p, err := jsql.LoadProfile(*name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Profile:", err)
+			os.Exit(1)
+		}
+		return p
+	}
+}
+
+// linksFlag registers --links. The returned function reads the declared
+// links once flags are parsed.
+func linksFlag(flags *flag.FlagSet) func() map[string]string {
+	file := flags.String("links", "", "YAML file of \"table.field: table.key\" references between datasets")
+	return func() map[string]string {
+		if *file == "" {
+			return nil
+		}
+		links, err := jsql.LoadLinks(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Links:", err)
+			os.Exit(1)
+		}
+		return links
+	}
+}
+
+// renameFlag registers --rename. The returned function parses the
+// mappings once flags are parsed.
+func renameFlag(flags *flag.FlagSet) func() map[string]string {
+	var specs stringList
+	flags.Var(&specs, "rename", "Store a field under another column name, as table.field=column (or field=column for the root table); dump restores the field; may be repeated")
+	return func() map[string]string {
+		renames, err := jsql.ParseRenames(specs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "--rename:", err)
+			os.Exit(1)
+		}
+		return renames
+	}
+}
+
+// filterFlags registers the key path flags selecting fields: include (named
+// --include, or --fields for dump) and --exclude. The returned function
+// parses them once flags are parsed, or returns nil if neither was given.
+func filterFlags(flags *flag.FlagSet, include, verb string) func() *pathspec.Filter {
+	var incl, excl stringList
+	flags.Var(&incl, include, "Only "+verb+" these fields, as key paths like meta.city or items[].price; comma-separated or repeated")
+	flags.Var(&excl, "exclude", "Do not "+verb+" these fields, as key paths like meta.city or items[].price; comma-separated or repeated")
+	return func() *pathspec.Filter {
+		if len(incl) == 0 && len(excl) == 0 {
+			return nil
+		}
+		var f pathspec.Filter
+		var err error
+		if f.Include, err = pathspec.ParseList(incl); err == nil {
+			f.Exclude, err = pathspec.ParseList(excl)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Fields:", err)
+			os.Exit(1)
+		}
+		return &f
+	}
+}
+
+// profilePathFlags registers --types and --symbolize. The returned function
+// adds them to the profile, if any, once flags are parsed.
+func profilePathFlags(flags *flag.FlagSet) func(*jsql.Profile) *jsql.Profile {
+	var types, symbols stringList
+	flags.Var(&types, "types", "Column type of a field, as key path=TYPE (INTEGER, REAL, TEXT, BOOLEAN, JSON, ...); may be repeated")
+	flags.Var(&symbols, "symbolize", "Always symbolize these fields, as key paths; comma-separated or repeated")
+	return func(p *jsql.Profile) *jsql.Profile {
+		if len(types) == 0 && len(symbols) == 0 {
+			return p
+		}
+		if p == nil {
+			p = &jsql.Profile{}
+		}
+		if p.Types == nil {
+			p.Types = map[string]jsql.FieldType{}
+		}
+		fail := func(err error) {
+			fmt.Fprintln(os.Stderr, "Fields:", err)
+			os.Exit(1)
+		}
+		for _, spec := range types {
+			path, typ, ok := strings.Cut(spec, "=")
+			if !ok {
+				fail(fmt.Errorf("--types %q must be path=TYPE", spec))
+			}
+			col, err := fieldColumn(path)
+			if err != nil {
+				fail(err)
+			}
+			if p.Types[col], err = jsql.ParseFieldType(typ); err != nil {
+				fail(fmt.Errorf("--types %s: %v", path, err))
+			}
+		}
+		paths, err := pathspec.ParseList(symbols)
+		if err != nil {
+			fail(err)
+		}
+		for _, path := range paths {
+			col, err := path.Column()
+			if err != nil {
+				fail(err)
+			}
+			p.Symbols = append(p.Symbols, col)
+		}
+		return p
+	}
+}
+
+// fieldColumn parses a key path naming a column
+func fieldColumn(s string) (string, error) {
+	path, err := pathspec.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return path.Column()
+}
+
+// computedFlag registers --computed. The returned function reads the
+// declared expressions once flags are parsed.
+func computedFlag(flags *flag.FlagSet) func() map[string]jsql.ComputedColumn {
+	file := flags.String("computed", "", "YAML file of \"table.column: expression\" columns computed from every document")
+	return func() map[string]jsql.ComputedColumn {
+		if *file == "" {
+			return nil
+		}
+		cols, err := jsql.LoadComputed(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Computed:", err)
+			os.Exit(1)
+		}
+		return cols
+	}
+}
+
+// defaultsFlag registers --defaults. The returned function reads the
+// declared default values once flags are parsed.
+func defaultsFlag(flags *flag.FlagSet) func() map[string]interface{} {
+	file := flags.String("defaults", "", "YAML file of \"table.field: value\" defaults for documents lacking a field")
+	return func() map[string]interface{} {
+		if *file == "" {
+			return nil
+		}
+		defaults, err := jsql.LoadDefaults(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Defaults:", err)
+			os.Exit(1)
+		}
+		return defaults
+	}
+}
+
+// checkStrict validates --strict, --chunk-size and --batch-size
+func checkStrict(dbSchema *jsql.DatabaseSchema) {
+	if dbSchema.ChunkSize < 1 {
+		fmt.Fprintln(os.Stderr, "--chunk-size must be at least 1")
+		os.Exit(1)
+	}
+	if dbSchema.BatchSize < 0 {
+		fmt.Fprintln(os.Stderr, "--batch-size must not be negative")
+		os.Exit(1)
+	}
+	if dbSchema.Strict && dbSchema.BatchSize%dbSchema.ChunkSize != 0 {
+		fmt.Fprintln(os.Stderr, "--batch-size must be a multiple of --chunk-size with --strict")
+		os.Exit(1)
+	}
+	if dbSchema.Strict && dbSchema.Quarantine {
+		fmt.Fprintln(os.Stderr, "--strict and --quarantine are mutually exclusive")
+		os.Exit(1)
+	}
+}
+
+// symbolIDHash validates --symbol-id, reporting whether it selects hashing
+func symbolIDHash(mode string) bool {
+	switch mode {
+	case "sequential":
+		return false
+	case "hash":
+		return true
+	}
+	fmt.Fprintf(os.Stderr, "--symbol-id must be sequential or hash, not %q\n", mode)
+	os.Exit(1)
+	return false
+}
+
+// prepopulateSymbols runs PrepopulateSymbols for --symbols-from, if given
+func prepopulateSymbols(dbFile string, dbSchema *jsql.DatabaseSchema, path string) {
+	if path == "" {
+		return
+	}
+	n, err := jsql.PrepopulateSymbols(dbFile, dbSchema, path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Symbols:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Inserted %d symbols from %s\n", n, path)
+}
+
+// enrichFlag registers the repeatable --enrich. The returned function opens
+// the lookup sources once flags are parsed.
+func enrichFlag(flags *flag.FlagSet) func() []*jsql.Enrichment {
+	var specs stringList
+	flags.Var(&specs, "enrich", "Add columns looked up by a field, as name=source.db|source.csv:field->column[,column]; may be repeated")
+	return func() []*jsql.Enrichment {
+		var enrich []*jsql.Enrichment
+		for _, spec := range specs {
+			e, err := jsql.ParseEnrichment(spec)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "--enrich:", err)
+				os.Exit(1)
+			}
+			enrich = append(enrich, e)
+		}
+		return enrich
+	}
+}
+
+// sourceFlags registers --source-db, --source-sql and --source-json-column.
+// The returned function yields the query source, or nil without --source-db.
+func sourceFlags(flags *flag.FlagSet) func() *jsql.QuerySource {
+	var q jsql.QuerySource
+	flags.StringVar(&q.DB, "source-db", "", "Read documents from the rows of --source-sql on this SQLite file or postgres:// URL, instead of --input")
+	flags.StringVar(&q.SQL, "source-sql", "", "Query whose result rows are the documents")
+	flags.StringVar(&q.JSONColumn, "source-json-column", "", "Column of --source-sql holding each document as JSON, instead of a document of all columns")
+	return func() *jsql.QuerySource {
+		if (q.DB == "") != (q.SQL == "") {
+			fmt.Fprintln(os.Stderr, "--source-db and --source-sql go together")
+			os.Exit(1)
+		}
+		if q.DB == "" {
+			return nil
+		}
+		return &q
+	}
+}
+
+// protoFlags registers --proto and --message. The returned function makes
+// the inputs length-delimited protobuf messages when --proto is given.
+func protoFlags(flags *flag.FlagSet) func([]inputMap) []inputMap {
+	descriptors := flags.String("proto", "", "Read --input (or --map) files as length-delimited protobuf messages described by this descriptor set")
+	message := flags.String("message", "", "Full name of the --proto message type of the input, e.g. pkg.Event")
+	return func(inputs []inputMap) []inputMap {
+		if *descriptors == "" {
+			return inputs
+		}
+		md, err := jsql.LoadProtoMessage(*descriptors, *message)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "--proto:", err)
+			os.Exit(1)
+		}
+		return readInputsAs(inputs, "--proto", func(path string) jsql.RecordSource {
+			return &jsql.ProtoSource{Path: path, Message: md}
+		})
+	}
+}
+
+// formatFlags registers --format and the options of the input formats. The
+// returned function reads the inputs in the chosen format.
+func formatFlags(flags *flag.FlagSet) func([]inputMap) []inputMap {
+	format := flags.String("format", "json", "Format of --input (or --map) files: json (one document per line), raw-len (length-prefixed frames written by dump --format raw-len), xml, or the logs logfmt, clf (common/combined log format) or syslog")
+	element := flags.String("record-element", "", "With --format xml, the element holding each record")
+	attrPrefix := flags.String("attr-prefix", "attr_", "With --format xml, prefix of the fields that attributes become")
+	return func(inputs []inputMap) []inputMap {
+		switch *format {
+		case "json":
+			return inputs
+		case "xml":
+			if *element == "" {
+				fmt.Fprintln(os.Stderr, "--format xml requires --record-element")
+				os.Exit(1)
+			}
+			return readInputsAs(inputs, "--format xml", func(path string) jsql.RecordSource {
+				return &jsql.XMLSource{Path: path, Element: *element, AttrPrefix: *attrPrefix}
+			})
+		case "raw-len":
+			return readInputsAs(inputs, "--format raw-len", func(path string) jsql.RecordSource {
+				return &jsql.RawLenSource{Path: path, Log: os.Stderr}
+			})
+		case "logfmt", "clf", "syslog":
+			return readInputsAs(inputs, "--format "+*format, func(path string) jsql.RecordSource {
+				return &jsql.LogSource{Path: path, Format: *format, Log: os.Stderr}
+			})
+		}
+		fmt.Fprintf(os.Stderr, "--format %q must be json, raw-len, xml, logfmt, clf or syslog\n", *format)
+		os.Exit(1)
+		return nil
+	}
+}
+
+// readInputsAs reads the --input or --map files through a source
+func readInputsAs(inputs []inputMap, option string, source func(path string) jsql.RecordSource) []inputMap {
+	for i, in := range inputs {
+		if in.Source != nil {
+			fmt.Fprintf(os.Stderr, "%s reads --input or --map files, not --source-db or another format\n", option)
+			os.Exit(1)
+		}
+		inputs[i].Source = source(in.Input)
+	}
+	return inputs
+}
+
+// optimize runs Optimize, reporting how much the file shrank
+// openMemoryDB opens the in-memory database of --db :memory:, starting from
+// the --serialize file when adding a tenant to it
+func openMemoryDB(serialize string, keep bool) *jsql.MemoryDB {
+	mem, err := jsql.OpenMemoryDB()
+	if err == nil && keep {
+		if _, serr := os.Stat(serialize); serr == nil {
+			err = mem.LoadFile(serialize)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Open DB:", err)
+		os.Exit(1)
+	}
+	return mem
+}
+
+func optimize(dbFile string) {
+	before, err := os.Stat(dbFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Optimize:", err)
+		os.Exit(1)
+	}
+	if err := jsql.Optimize(dbFile); err != nil {
+		fmt.Fprintln(os.Stderr, "Optimize:", err)
+		os.Exit(1)
+	}
+	if after, err := os.Stat(dbFile); err == nil {
+		fmt.Fprintf(os.Stdout, "Optimized %s (%d -> %d bytes)\n", dbFile, before.Size(), after.Size())
+	}
+}
+
+// geometryType resolves --geometry to the column type for GeoJSON
+// geometries; auto stores WKB only when SpatiaLite can be loaded to query it.
+// --spatial-index needs geometry columns to index.
+func geometryType(mode string, spatialIndex bool) jsql.FieldType {
+	if mode == "none" && spatialIndex {
+		fmt.Fprintln(os.Stderr, "--spatial-index requires --geometry json, wkb or auto")
+		os.Exit(1)
+	}
+	switch mode {
+	case "auto":
+		if jsql.SpatialiteAvailable() {
+			return jsql.TypeWKB
+		}
+		return jsql.TypeGeoJSON
+	case "json":
+		return jsql.TypeGeoJSON
+	case "wkb":
+		return jsql.TypeWKB
+	case "none":
+		return ""
+	}
+	fmt.Fprintf(os.Stderr, "--geometry %q must be auto, json, wkb or none\n", mode)
+	os.Exit(1)
+	return ""
+}
+
+// checkTenant exits if tenant cannot be used as a table name prefix
+func checkTenant(tenant string) {
+	if !jsql.ValidTenant(tenant) {
+		fmt.Fprintf(os.Stderr, "--tenant %q must contain only letters, digits and underscores\n", tenant)
+		os.Exit(1)
+	}
+}
+
+func analyzeCmd(args []string) {
+	flags := flag.NewFlagSet("analyze", flag.ExitOnError)
+	var input string
+	var opts jsql.AnalyzeOptions
+	flags.StringVar(&input, "input", "", "Line-delimited JSON input file (- or none: stdin)")
+	flags.IntVar(&opts.Sample, "sample", 20, "How many rows to sample for schema inference (0: the whole input)")
+	flags.StringVar(&opts.Subtree, "subtree", "", "Infer the schema of the objects at this dotted path of the documents only, such as meta or meta.owner, as tables of their own")
+	flags.BoolVar(&opts.SymbolizeNumbers, "symbolize-numbers", false, "Also symbolize numeric fields with few distinct values, into symbol tables of INTEGER or REAL values")
+	flags.IntVar(&opts.EnumMax, "enum-max", 0, "Limit string fields with at most N distinct sampled values to those values with a CHECK constraint (0: never)")
+	flags.StringVar(&opts.Tenant, "tenant", "", "Prefix all generated table names with this tenant")
+	flags.BoolVar(&opts.Provenance, "provenance", false, "Add _line, _source and _ingested_at columns to the root table")
+	flags.BoolVar(&opts.Ord, "ord", false, "Add an _ord column numbering the documents in input order, for dump --order-by _ord")
+	flags.BoolVar(&opts.SoftDelete, "soft-delete", false, "Add a _deleted_at column that patch and sync set instead of deleting documents, which dumps then leave out unless --include-deleted")
+	flags.BoolVar(&opts.History, "history", false, "Keep the former versions of rows in <table>_history tables, filled by triggers on update and delete, for asof --at")
+	flags.BoolVar(&opts.KeyOrder, "preserve-key-order", false, "Add a _key_order column recording the order of each document's keys, for dump --preserve-key-order")
+	numberMode := numberModeFlag(flags, "Store numbers as their values (float), or also keep the text of those dump would write differently in a _number_text column (string), for dump --number-mode string")
+	normalizeTime := normalizeTimeFlag(flags, "With utc, store fields holding RFC 3339 times with a zone as UTC epochs in UTCTIME columns, keeping their offsets in <column>_offset")
+	geometry := flags.String("geometry", "none", "Store GeoJSON geometries in one column as json, wkb or auto (wkb if SpatiaLite is available); none keeps them as sub-tables")
+	flags.BoolVar(&opts.SpatialIndex, "spatial-index", false, "Index geometry columns with an R*Tree")
+	profile := profileFlag(flags)
+	links := linksFlag(flags)
+	transform := wasmTransformFlag(flags)
+	enrich := enrichFlag(flags)
+	computed := computedFlag(flags)
+	symbolID := flags.String("symbol-id", "sequential", "How symbol ids are assigned: sequential, or hash of the value so databases agree on them")
+	defaults := defaultsFlag(flags)
+	renames := renameFlag(flags)
+	naming := namingFlag(flags)
+	filter := filterFlags(flags, "include", "analyze")
+	profilePaths := profilePathFlags(flags)
+	flags.StringVar(&opts.Explode, "explode", "", "Make every element of this array field of the documents a record of its own, with the document's scalar fields copied")
+	output := flags.String("output", "ddl", "Write the schema as ddl, or as a json model that --schema flags accept too")
+	sqlc := flags.String("sqlc", "", "Also write sqlc query stubs for the tables to this file")
+	orm := ormFlags(flags, &opts)
+	var maps stringList
+	flags.Var(&maps, "map", "Analyze file as root table, as file=table, instead of --input; may be repeated")
+	source := sourceFlags(flags)
+	proto := protoFlags(flags)
+	format := formatFlags(flags)
+	instrument := instrumentFlags(flags)
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	opts.NumberText = numberMode() == jsql.NumberModeString
+	defer deadline()()
+	defer instrument()()
+	src := source()
+	input = stdinDefault(input, maps, src)
+	if countSet(input != "", len(maps) > 0, src != nil) != 1 {
+		fmt.Fprintf(os.Stderr, "--input (or --map, or --source-db) is required\n")
+		os.Exit(1)
+	}
+	checkTenant(opts.Tenant)
+	if err := jsql.CheckExplodeField(opts.Explode); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.Geometry = geometryType(*geometry, opts.SpatialIndex)
+	opts.NormalizeTime = normalizeTime()
+	opts.Profile = profilePaths(profile())
+	opts.Links = links()
+	opts.Transform = transform()
+	defer opts.Transform.Close()
+	opts.Enrich = enrich()
+	opts.Computed = computed()
+	opts.HashIDs = symbolIDHash(*symbolID)
+	opts.Defaults = defaults()
+	opts.Renames = renames()
+	opts.Filter = filter()
+	opts.Naming = naming()
+	orm()
+	if *output != "ddl" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "--output %q must be ddl or json\n", *output)
+		os.Exit(1)
+	}
+	ddl := analyzeInputs(format(proto(commandInputs(input, maps, src, "main"))), len(maps) > 0, opts)
+	if *sqlc != "" {
+		if err := os.WriteFile(*sqlc, []byte(jsql.SqlcQueries(ddl)), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "Write sqlc queries:", err)
+			os.Exit(1)
+		}
+	}
+	if *output == "json" {
+		model, err := jsql.MarshalSchemaModel(ddl)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Schema model:", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(model)
+		return
+	}
+	fmt.Print(ddl)
+}
+
+// analyzeInputs analyzes the inputs, returning the combined DDL. Every
+// --map input gets its own root table, with the tables below prefixed by it.
+// Other sources are analyzed through a temporary file of their first
+// opts.Sample documents.
+func analyzeInputs(inputs []inputMap, mapped bool, opts jsql.AnalyzeOptions) string {
+	var ddl strings.Builder
+	for _, in := range inputs {
+		if mapped {
+			opts.Root = in.Table
+		}
+		path := in.Input
+		if in.Source != nil {
+			sample, err := jsql.SampleFile(in.Source, opts.Sample)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Read source:", err)
+				os.Exit(1)
+			}
+			defer os.Remove(sample)
+			path = sample
+		}
+		s, err := jsql.AnalyzeJSON(path, opts)
+		switch {
+		case errors.Is(err, jsql.ErrNoRows) && opts.Subtree != "":
+			fmt.Fprintf(os.Stderr, "No objects at %s in the sampled rows\n", opts.Subtree)
+			os.Exit(2)
+		case errors.Is(err, jsql.ErrNoRows):
+			fmt.Fprintln(os.Stderr, "No rows for analysis")
+			os.Exit(2)
+		case err != nil:
+			fmt.Fprintln(os.Stderr, "analyze:", err)
+			os.Exit(1)
+		}
+		ddl.WriteString(s)
+	}
+	return ddl.String()
+}
+
+func createDbCmd(args []string) {
+	flags := flag.NewFlagSet("create-db", flag.ExitOnError)
+	var ddlFile, dbFile, tenant string
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file")
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&tenant, "tenant", "", "Add this tenant's tables to an existing database instead of replacing it")
+	ifNotExists := flags.Bool("if-not-exists", false, "Create only the tables and indexes an existing database lacks, keeping its data")
+	force := flags.Bool("force", false, "Replace an existing database and everything in it (with --driver postgres, the schema's tables)")
+	backend := driverFlags(flags, "schema", "force", "timeout")
+	deadline := timeoutFlag(flags)
+	lock := lockFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	d := backend(&dbFile)
+	if ddlFile == "" || dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--schema and --db are required")
+		os.Exit(1)
+	}
+	if countSet(tenant != "", *ifNotExists, *force) > 1 {
+		fmt.Fprintln(os.Stderr, "--tenant, --if-not-exists and --force exclude each other")
+		os.Exit(1)
+	}
+	if d == jsql.SQLite {
+		defer lock(dbFile)()
+	}
+	checkTenant(tenant)
+	ddl, err := jsql.ReadDDL(ddlFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Read DDL:", err)
+		os.Exit(1)
+	}
+	switch {
+	case d != jsql.SQLite:
+		if err = jsql.CreateTables(cmdContext, d, dbFile, ddl, *force); err == nil {
+			fmt.Fprintf(os.Stdout, "Created the tables in %s\n", jsql.DatabaseName(d, dbFile))
+			return
+		}
+	case tenant != "":
+		err = jsql.ReplaceTables(dbFile, ddl)
+	case *ifNotExists:
+		var created []string
+		if created, err = jsql.CreateMissing(dbFile, ddl); err == nil {
+			if len(created) == 0 {
+				fmt.Fprintf(os.Stdout, "DB %s already has every table\n", dbFile)
+			} else {
+				fmt.Fprintf(os.Stdout, "Created %s in DB %s\n", strings.Join(created, ", "), dbFile)
+			}
+			return
+		}
+	default:
+		if !*force {
+			if used, err := jsql.HasTables(dbFile); used || err != nil {
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Create DB:", err)
+				}
+				fmt.Fprintf(os.Stderr, "%s already exists; use --if-not-exists to add the missing tables or --force to replace it\n", dbFile)
+				os.Exit(1)
+			}
+		}
+		err = jsql.CreateDatabase(dbFile, ddl)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Create DB:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Wrote DB %s\n", dbFile)
+}
+
+func loadCmd(args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	var input, dbFile, ddlFile, metricsAddr, tenant, root string
+	flags.StringVar(&input, "input", "", "Line-delimited JSON input (- or none: stdin)")
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9090)")
+	flags.StringVar(&tenant, "tenant", "", "Load into this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	var maps stringList
+	flags.Var(&maps, "map", "Load file into root table, as file=table, instead of --input; may be repeated")
+	source := sourceFlags(flags)
+	transform := wasmTransformFlag(flags)
+	enrich := enrichFlag(flags)
+	filter := filterFlags(flags, "include", "load")
+	optimizeAfter := flags.Bool("optimize", false, "Optimize, VACUUM and integrity-check the database afterwards")
+	quarantine := flags.Bool("quarantine", false, "Keep rows that fail to load in the _quarantine table for retry-quarantine")
+	fallbackJSON := flags.Bool("fallback-json", false, "Store values that do not fit their column as JSON in a <field>_fallback column, added to the schema")
+	strict := flags.Bool("strict", false, "Roll back the whole chunk of a failing row instead of skipping the row, and fail the load")
+	chunkSize := flags.Int("chunk-size", 10000, "Input lines per savepoint with --strict")
+	batchSize := flags.Int("batch-size", 0, "Commit every N input lines instead of loading in one transaction")
+	deferTriggers := flags.Bool("defer-triggers", false, "Drop the schema's triggers while loading, recreating them and replaying INSERT triggers for the new rows at the end")
+	duplicateKeys := duplicateKeysFlag(flags)
+	symbolsFrom := flags.String("symbols-from", "", "Insert the field<TAB>value[<TAB>count] lines of this file into the symbol tables before loading")
+	mapping := flags.String("mapping", "", "Load into an existing table, storing the document paths in the columns this YAML file maps them to")
+	withBlobs := blobFlags(flags)
+	proto := protoFlags(flags)
+	format := formatFlags(flags)
+	instrument := instrumentFlags(flags)
+	audit := auditFlag(flags)
+	lock := lockFlag(flags)
+	backend := driverFlags(flags, "input", "schema", "root", "map", "source-db", "source-sql", "source-json-column",
+		"wasm-transform", "enrich", "include", "exclude", "duplicate-keys", "proto", "message", "format",
+		"record-element", "attr-prefix", "logfmt", "pprof", "trace", "timeout", "max-duration")
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	defer instrument()()
+	d := backend(&dbFile)
+	src := source()
+	input = stdinDefault(input, maps, src)
+	if countSet(input != "", len(maps) > 0, src != nil) != 1 || dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--input (or --map, or --source-db), and --db are required")
+		os.Exit(1)
+	}
+	if d == jsql.SQLite {
+		defer lock(dbFile)()
+	}
+	if *mapping != "" && (ddlFile != "" || tenant != "" || len(maps) > 0 || *fallbackJSON) {
+		fmt.Fprintln(os.Stderr, "--mapping excludes --schema, --tenant, --map and --fallback-json")
+		os.Exit(1)
+	}
+	checkTenant(tenant)
+	inputs := format(proto(commandInputs(input, maps, src, root)))
+	var dbSchema *jsql.DatabaseSchema
+	if *mapping != "" {
+		dbSchema = mappingSchema(dbFile, *mapping)
+	} else {
+		dbSchema = readSchemaIn(d, dbFile, ddlFile, tenant, inputs[0].Table)
+	}
+	dbSchema.Transform = transform()
+	defer dbSchema.Transform.Close()
+	dbSchema.Enrich = enrich()
+	dbSchema.Filter = filter()
+	dbSchema.Quarantine = *quarantine
+	dbSchema.FallbackJSON = *fallbackJSON
+	dbSchema.DeferTriggers = *deferTriggers
+	dbSchema.DuplicateKeys = duplicateKeys()
+	dbSchema.Strict, dbSchema.ChunkSize, dbSchema.BatchSize = *strict, *chunkSize, *batchSize
+	checkStrict(dbSchema)
+	withBlobs(dbSchema)
+	prepopulateSymbols(dbFile, dbSchema, *symbolsFrom)
+	startMonitor(metricsAddr, dbFile)
+	for _, in := range inputs {
+		if dbSchema.Mapping == nil {
+			if err := dbSchema.SetRoot(tenant, in.Table); err != nil {
+				fmt.Fprintln(os.Stderr, "Schema:", err)
+				os.Exit(1)
+			}
+		}
+		if d == jsql.SQLite {
+			dbSchema.Audit = audit(in.Input)
+		}
+		if err := in.load(dbFile, dbSchema); err != nil {
+			fmt.Fprintln(os.Stderr, "Data load error:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Loaded %s into %s\n", jsql.InputName(in.Input), jsql.DatabaseName(d, dbFile))
+	}
+	if *optimizeAfter {
+		optimize(dbFile)
+	}
+}
+
+func dumpCmd(args []string) {
+	dumpDocuments("dump", args)
+}
+
+// asofCmd dumps the documents as they were at --at, from the history
+// tables of a schema analyzed with --history
+func asofCmd(args []string) {
+	dumpDocuments("asof", args)
+}
+
+// dumpDocuments runs dump, or asof, which takes dump's flags and --at
+func dumpDocuments(name string, args []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	var dbFile, ddlFile, tenant, root, anonymize string
+	var opts jsql.DumpOptions
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Dump this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	flags.StringVar(&opts.View, "table", "", "Dump the rows of this view as they are, instead of the documents of --root")
+	flags.BoolVar(&opts.WithProvenance, "with-provenance", false, "Include _line, _source, _ingested_at and the created_at and updated_at timestamps in the output")
+	flags.StringVar(&anonymize, "anonymize", "", "YAML profile of per-field mask/hash/fake/drop rules")
+	flags.Float64Var(&opts.Sample, "sample", 0, "Emit a random fraction of documents (e.g. 0.01)")
+	flags.IntVar(&opts.Head, "head", 0, "Emit only the first N documents")
+	flags.IntVar(&opts.Tail, "tail", 0, "Emit only the last N documents")
+	flags.Int64Var(&opts.AfterID, "after-id", 0, "Emit only documents with a greater row id, resuming a previous dump")
+	limit := flags.Int("limit", 0, "Emit at most N documents in row id order, then print the last id to stderr")
+	numberMode := numberModeFlag(flags, "Write numbers as their values format (float), or as the text recorded in _number_text when they were loaded (string)")
+	normalizeTime := normalizeTimeFlag(flags, "With utc, write the times of UTCTIME columns in UTC rather than with their original offsets")
+	flags.BoolVar(&opts.PreserveKeyOrder, "preserve-key-order", false, "Write the keys of documents in the order recorded in _key_order when they were loaded, rather than sorted")
+	flags.StringVar(&opts.OrderBy, "order-by", "", "Emit the documents in the order of this column of the root table, such as _ord, rather than by row id")
+	flags.StringVar(&opts.Where, "where", "", "Emit only the documents whose root row matches this SQL condition on its columns, e.g. \"age > ?\"")
+	var whereArgs stringList
+	flags.Var(&whereArgs, "arg", "Value of the next ? of --where, bound as a number if it is one; may be repeated")
+	flags.BoolVar(&opts.IncludeDeleted, "include-deleted", false, "Also emit soft-deleted documents, with their _deleted_at")
+	flags.BoolVar(&opts.OmitDefaults, "omit-defaults", false, "Leave out fields equal to their column's DEFAULT, restoring documents that lacked them")
+	flags.IntVar(&opts.PreloadSymbols, "preload-symbols", 1024, "Read symbol tables of at most N rows whole on first use rather than value by value (0: never)")
+	format := flags.String("format", "json", "Output format: json (one document per line), or raw-len (length-prefixed frames, for load --format raw-len)")
+	post := flags.String("post", "", "POST the documents to this URL as NDJSON batches instead of writing them to stdout")
+	batch := flags.Int("batch", 100, "Documents per --post request")
+	retries := flags.Int("post-retries", 5, "Times a --post batch failing with a network error, 429 or 5xx is sent again, with exponential backoff")
+	explain := flags.Bool("explain", false, "Print the query plan of each distinct query to stderr before it first runs, with indexes that would speed up lookups")
+	filter := filterFlags(flags, "fields", "emit")
+	script := dumpScriptFlags(flags)
+	withBlobs := blobFlags(flags)
+	mmapSize := mmapFlag(flags)
+	instrument := instrumentFlags(flags)
+	backend := driverFlags(flags, "schema", "root", "with-provenance", "anonymize", "head", "tail", "after-id", "limit",
+		"number-mode", "normalize-time", "preserve-key-order", "order-by", "where", "arg", "include-deleted",
+		"omit-defaults", "preload-symbols", "format", "post", "batch", "post-retries", "fields", "exclude",
+		"jq", "lua", "pprof", "trace", "timeout", "max-duration")
+	var at *string
+	if name == "asof" {
+		at = flags.String("at", "", "Time to dump the documents as of, such as 2024-05-01T12:00:00Z or 2024-05-01 (UTC)")
+	}
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	d := backend(&dbFile)
+	if at != nil {
+		if *at == "" {
+			fmt.Fprintln(os.Stderr, "--at is required")
+			os.Exit(1)
+		}
+		var err error
+		if opts.AsOf, err = jsql.ParseAsOf(*at); err != nil {
+			fmt.Fprintln(os.Stderr, "--at:", err)
+			os.Exit(1)
+		}
+	}
+	opts.NormalizeTime = normalizeTime()
+	opts.Script = script()
+	opts.NumberMode = numberMode()
+	defer deadline()()
+	defer instrument()()
+	opts.Filter = filter()
+	opts.MmapSize = mmapSize()
+	if opts.Where == "" && len(whereArgs) > 0 {
+		fmt.Fprintln(os.Stderr, "--arg binds the placeholders of --where")
+		os.Exit(1)
+	}
+	for _, a := range whereArgs {
+		opts.Args = append(opts.Args, jsql.SQLArg(a))
+	}
+	if *explain {
+		opts.Explain = os.Stderr
+	}
+	switch *format {
+	case "json":
+	case "raw-len":
+		opts.RawLen = true
+	default:
+		fmt.Fprintf(os.Stderr, "--format %q must be json or raw-len\n", *format)
+		os.Exit(1)
+	}
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	if opts.Sample < 0 || opts.Sample > 1 {
+		fmt.Fprintln(os.Stderr, "--sample must be between 0 and 1")
+		os.Exit(1)
+	}
+	var sink *jsql.PostSink
+	if *post != "" {
+		switch {
+		case opts.RawLen:
+			fmt.Fprintln(os.Stderr, "--post sends JSON lines, not --format raw-len")
+			os.Exit(1)
+		case *batch < 1:
+			fmt.Fprintln(os.Stderr, "--batch must be at least 1")
+			os.Exit(1)
+		case *retries < 0:
+			fmt.Fprintln(os.Stderr, "--post-retries must not be negative")
+			os.Exit(1)
+		}
+		sink = jsql.NewPostSink(cmdContext, *post, *batch, *retries)
+		opts.Output = sink
+	}
+	if opts.Head > 0 && opts.Tail > 0 {
+		fmt.Fprintln(os.Stderr, "--head and --tail are mutually exclusive")
+		os.Exit(1)
+	}
+	if opts.OrderBy != "" && (*limit > 0 || opts.AfterID > 0) {
+		fmt.Fprintln(os.Stderr, "--after-id and --limit resume in row id order and exclude --order-by")
+		os.Exit(1)
+	}
+	if *limit > 0 {
+		if opts.Head > 0 || opts.Tail > 0 || opts.View != "" {
+			fmt.Fprintln(os.Stderr, "--limit excludes --head, --tail and --table")
+			os.Exit(1)
+		}
+		opts.Head = *limit
+	}
+	checkTenant(tenant)
+	if anonymize != "" {
+		profile, err := jsql.LoadAnonymizeProfile(anonymize)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Anonymize profile:", err)
+			os.Exit(1)
+		}
+		opts.Anonymize = profile
+	}
+	dbSchema := readSchemaIn(d, dbFile, ddlFile, tenant, root)
+	withBlobs(dbSchema)
+	last, err := jsql.DumpRows(cmdContext, dbFile, dbSchema, opts)
+	if err == nil && sink != nil {
+		err = sink.Close()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Dump error:", err)
+		os.Exit(1)
+	}
+	if *limit > 0 {
+		fmt.Fprintf(os.Stderr, "last-id %d\n", last)
+	}
+}
+
+func getCmd(args []string) {
+	flags := flag.NewFlagSet("get", flag.ExitOnError)
+	var dbFile, ddlFile, tenant, root string
+	var opts jsql.DumpOptions
+	flags.StringVar(&dbFile, "db", "", "SQLite database file, opened read-only")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Look up this tenant's documents")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	var keys stringList
+	flags.Var(&keys, "key", "field=value of the documents to print, a field of the root table or id; may be repeated, all must match")
+	flags.BoolVar(&opts.WithProvenance, "with-provenance", false, "Include _line, _source, _ingested_at and the created_at and updated_at timestamps in the output")
+	flags.BoolVar(&opts.IncludeDeleted, "include-deleted", false, "Also print soft-deleted documents, with their _deleted_at")
+	withBlobs := blobFlags(flags)
+	mmapSize := mmapFlag(flags)
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	opts.MmapSize = mmapSize()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	if len(keys) == 0 {
+		fmt.Fprintln(os.Stderr, "--key is required")
+		os.Exit(1)
+	}
+	checkTenant(tenant)
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	withBlobs(dbSchema)
+	var conds []string
+	for _, k := range keys {
+		field, value, ok := strings.Cut(k, "=")
+		if !ok {
+			fmt.Fprintf(os.Stderr, "--key %q must be field=value\n", k)
+			os.Exit(1)
+		}
+		cond, args, err := jsql.FieldCondition(dbSchema.RootTable(), dbSchema, field, value)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "--key:", err)
+			os.Exit(1)
+		}
+		conds = append(conds, cond)
+		opts.Args = append(opts.Args, args...)
+	}
+	opts.Where = strings.Join(conds, " AND ")
+	last, err := jsql.DumpRows(cmdContext, dbFile, dbSchema, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Get error:", err)
+		os.Exit(1)
+	}
+	if last == 0 {
+		fmt.Fprintf(os.Stderr, "No document with %s\n", strings.Join(keys, ", "))
+		os.Exit(1)
+	}
+}
+
+// openAPISchema checks that an --openapi argument points to a schema
+// within the description
+func openAPISchema(spec string) string {
+	if _, pointer, _ := strings.Cut(spec, "#"); !strings.HasPrefix(pointer, "/") {
+		fmt.Fprintf(os.Stderr, "--openapi %q must be file#/components/schemas/Name\n", spec)
+		os.Exit(1)
+	}
+	return spec
+}
+
+func schemaFromJSONSchemaCmd(args []string) {
+	flags := flag.NewFlagSet("schema-from-jsonschema", flag.ExitOnError)
+	var input string
+	var opts jsql.AnalyzeOptions
+	flags.StringVar(&input, "input", "", "JSON Schema document of the records, optionally with a #/pointer to their schema within it")
+	openAPI := flags.String("openapi", "", "OpenAPI component schema of the records, as api.yaml#/components/schemas/Name, instead of --input")
+	flags.StringVar(&opts.Tenant, "tenant", "", "Prefix all generated table names with this tenant")
+	flags.BoolVar(&opts.Provenance, "provenance", false, "Add _line, _source and _ingested_at columns to the root table")
+	flags.BoolVar(&opts.Ord, "ord", false, "Add an _ord column numbering the documents in input order, for dump --order-by _ord")
+	flags.BoolVar(&opts.SoftDelete, "soft-delete", false, "Add a _deleted_at column that patch and sync set instead of deleting documents, which dumps then leave out unless --include-deleted")
+	flags.BoolVar(&opts.History, "history", false, "Keep the former versions of rows in <table>_history tables, filled by triggers on update and delete, for asof --at")
+	flags.BoolVar(&opts.KeyOrder, "preserve-key-order", false, "Add a _key_order column recording the order of each document's keys, for dump --preserve-key-order")
+	numberMode := numberModeFlag(flags, "Store numbers as their values (float), or also keep the text of those dump would write differently in a _number_text column (string), for dump --number-mode string")
+	profile := profileFlag(flags)
+	links := linksFlag(flags)
+	symbolID := flags.String("symbol-id", "sequential", "How symbol ids are assigned: sequential, or hash of the value so databases agree on them")
+	defaults := defaultsFlag(flags)
+	parseFlags(flags, args)
+	opts.NumberText = numberMode() == jsql.NumberModeString
+	if (input == "") == (*openAPI == "") {
+		fmt.Fprintln(os.Stderr, "--input (or --openapi) is required")
+		os.Exit(1)
+	}
+	if *openAPI != "" {
+		input = openAPISchema(*openAPI)
+	}
+	checkTenant(opts.Tenant)
+	opts.Profile = profile()
+	opts.Links = links()
+	opts.HashIDs = symbolIDHash(*symbolID)
+	opts.Defaults = defaults()
+	ddl, err := jsql.SchemaFromJSONSchema(input, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "JSON Schema:", err)
+		os.Exit(1)
+	}
+	fmt.Print(ddl)
+}
+
+func importCmd(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	var input, dbFile, ddlFile, metricsAddr string
+	var opts jsql.AnalyzeOptions
+	flags.StringVar(&input, "input", "", "Line-delimited JSON input (- or none: stdin)")
+	flags.StringVar(&dbFile, "db", "", "SQLite database output, or :memory: to import in RAM and write --serialize at the end")
+	flags.StringVar(&ddlFile, "schema", "", "If supplied, write DDL to this file")
+	serialize := flags.String("serialize", "", "With --db :memory:, write the database to this file once the import is done")
+	flags.IntVar(&opts.Sample, "sample", 20, "How many rows to sample for schema inference (0: the whole input)")
+	flags.BoolVar(&opts.SymbolizeNumbers, "symbolize-numbers", false, "Also symbolize numeric fields with few distinct values, into symbol tables of INTEGER or REAL values")
+	flags.IntVar(&opts.EnumMax, "enum-max", 0, "Limit string fields with at most N distinct sampled values to those values with a CHECK constraint (0: never)")
+	flags.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9090)")
+	flags.StringVar(&opts.Tenant, "tenant", "", "Prefix all tables with this tenant, keeping other tenants in --db")
+	flags.BoolVar(&opts.Provenance, "provenance", false, "Record _line, _source and _ingested_at for every row")
+	flags.BoolVar(&opts.Ord, "ord", false, "Add an _ord column numbering the documents in input order, for dump --order-by _ord")
+	flags.BoolVar(&opts.SoftDelete, "soft-delete", false, "Add a _deleted_at column that patch and sync set instead of deleting documents, which dumps then leave out unless --include-deleted")
+	flags.BoolVar(&opts.History, "history", false, "Keep the former versions of rows in <table>_history tables, filled by triggers on update and delete, for asof --at")
+	flags.BoolVar(&opts.KeyOrder, "preserve-key-order", false, "Add a _key_order column recording the order of each document's keys, for dump --preserve-key-order")
+	numberMode := numberModeFlag(flags, "Store numbers as their values (float), or also keep the text of those dump would write differently in a _number_text column (string), for dump --number-mode string")
+	normalizeTime := normalizeTimeFlag(flags, "With utc, store fields holding RFC 3339 times with a zone as UTC epochs in UTCTIME columns, keeping their offsets in <column>_offset")
+	geometry := flags.String("geometry", "none", "Store GeoJSON geometries in one column as json, wkb or auto (wkb if SpatiaLite is available); none keeps them as sub-tables")
+	flags.BoolVar(&opts.SpatialIndex, "spatial-index", false, "Index geometry columns with an R*Tree")
+	optimizeAfter := flags.Bool("optimize", false, "Optimize, VACUUM and integrity-check the database afterwards")
+	quarantine := flags.Bool("quarantine", false, "Keep rows that fail to load in the _quarantine table for retry-quarantine")
+	fallbackJSON := flags.Bool("fallback-json", false, "Store values that do not fit their column as JSON in a <field>_fallback column, added to the schema")
+	strict := flags.Bool("strict", false, "Roll back the whole chunk of a failing row instead of skipping the row, and fail the load")
+	chunkSize := flags.Int("chunk-size", 10000, "Input lines per savepoint with --strict")
+	batchSize := flags.Int("batch-size", 0, "Commit every N input lines instead of loading in one transaction")
+	deferTriggers := flags.Bool("defer-triggers", false, "Drop the schema's triggers while loading, recreating them and replaying INSERT triggers for the new rows at the end")
+	duplicateKeys := duplicateKeysFlag(flags)
+	symbolsFrom := flags.String("symbols-from", "", "Insert the field<TAB>value[<TAB>count] lines of this file into the symbol tables before loading")
+	profile := profileFlag(flags)
+	links := linksFlag(flags)
+	transform := wasmTransformFlag(flags)
+	enrich := enrichFlag(flags)
+	computed := computedFlag(flags)
+	symbolID := flags.String("symbol-id", "sequential", "How symbol ids are assigned: sequential, or hash of the value so databases agree on them")
+	defaults := defaultsFlag(flags)
+	renames := renameFlag(flags)
+	naming := namingFlag(flags)
+	orm := ormFlags(flags, &opts)
+	filter := filterFlags(flags, "include", "import")
+	profilePaths := profilePathFlags(flags)
+	flags.StringVar(&opts.Explode, "explode", "", "Load every element of this array field of the documents as a row of its own, with the document's scalar fields copied")
+	var maps stringList
+	flags.Var(&maps, "map", "Import file into root table, as file=table, instead of --input; may be repeated")
+	openAPI := flags.String("openapi", "", "Generate the schema from this OpenAPI component schema (api.yaml#/components/schemas/Name) instead of sampling")
+	review := flags.Bool("review", false, "Show the annotated schema and ask before creating the database, optionally editing it in $EDITOR")
+	source := sourceFlags(flags)
+	withBlobs := blobFlags(flags)
+	proto := protoFlags(flags)
+	format := formatFlags(flags)
+	instrument := instrumentFlags(flags)
+	audit := auditFlag(flags)
+	lock := lockFlag(flags)
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	opts.NumberText = numberMode() == jsql.NumberModeString
+	defer deadline()()
+	defer instrument()()
+	src := source()
+	input = stdinDefault(input, maps, src)
+	if countSet(input != "", len(maps) > 0, src != nil) != 1 || dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--input (or --map, or --source-db) and --db required")
+		os.Exit(1)
+	}
+	if input == jsql.StdinInput {
+		// Standard input is read again to load what was analyzed
+		cleanup, err := jsql.SpoolStdin()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Spool stdin:", err)
+			os.Exit(1)
+		}
+		defer cleanup()
+	}
+	if (dbFile == jsql.MemoryDBPath) != (*serialize != "") {
+		fmt.Fprintln(os.Stderr, "--db :memory: and --serialize go together")
+		os.Exit(1)
+	}
+	checkTenant(opts.Tenant)
+	if err := jsql.CheckExplodeField(opts.Explode); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.Geometry = geometryType(*geometry, opts.SpatialIndex)
+	opts.NormalizeTime = normalizeTime()
+	opts.Profile = profilePaths(profile())
+	opts.Links = links()
+	opts.Transform = transform()
+	defer opts.Transform.Close()
+	opts.Enrich = enrich()
+	opts.Computed = computed()
+	opts.HashIDs = symbolIDHash(*symbolID)
+	opts.Defaults = defaults()
+	opts.Renames = renames()
+	opts.Filter = filter()
+	opts.Naming = naming()
+	orm()
+	inputs := format(proto(commandInputs(input, maps, src, "main")))
+	var ddl string
+	switch {
+	case *openAPI != "" && len(maps) > 0:
+		fmt.Fprintln(os.Stderr, "--openapi describes the records of --input or --source-db, not --map")
+		os.Exit(1)
+	case *openAPI != "":
+		var err error
+		if ddl, err = jsql.SchemaFromJSONSchema(openAPISchema(*openAPI), opts); err != nil {
+			fmt.Fprintln(os.Stderr, "OpenAPI:", err)
+			os.Exit(1)
+		}
+	default:
+		ddl = analyzeInputs(inputs, len(maps) > 0, opts)
+	}
+	if *review {
+		var err error
+		if ddl, err = jsql.ReviewDDL(ddl, os.Stdin, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "Review:", err)
+			os.Exit(1)
+		}
+	}
+	if ddlFile != "" {
+		if err := os.WriteFile(ddlFile, []byte(ddl), 0666); err != nil {
+			fmt.Fprintln(os.Stderr, "Write DDL:", err)
+			os.Exit(1)
+		}
+	}
+	if dbFile == jsql.MemoryDBPath {
+		// The file written at the end is the database replaced
+		defer lock(*serialize)()
+	} else {
+		defer lock(dbFile)()
+	}
+	target := dbFile
+	var mem *jsql.MemoryDB
+	if dbFile == jsql.MemoryDBPath {
+		mem = openMemoryDB(*serialize, opts.Tenant != "")
+		dbFile = mem.URI
+	}
+	create := jsql.CreateDatabase
+	if opts.Tenant != "" {
+		create = jsql.ReplaceTables
+	}
+	if err := create(dbFile, ddl); err != nil {
+		fmt.Fprintln(os.Stderr, "Create DB:", err)
+		os.Exit(1)
+	}
+	dbSchema := parseDDL(ddl)
+	dbSchema.Transform = opts.Transform
+	dbSchema.Enrich = opts.Enrich
+	dbSchema.Filter = opts.Filter
+	dbSchema.Quarantine = *quarantine
+	dbSchema.FallbackJSON = *fallbackJSON
+	dbSchema.DeferTriggers = *deferTriggers
+	dbSchema.DuplicateKeys = duplicateKeys()
+	dbSchema.Strict, dbSchema.ChunkSize, dbSchema.BatchSize = *strict, *chunkSize, *batchSize
+	checkStrict(dbSchema)
+	withBlobs(dbSchema)
+	prepopulateSymbols(dbFile, dbSchema, *symbolsFrom)
+	startMonitor(metricsAddr, dbFile)
+	for _, in := range inputs {
+		if err := dbSchema.SetRoot(opts.Tenant, in.Table); err != nil {
+			fmt.Fprintln(os.Stderr, "Schema:", err)
+			os.Exit(1)
+		}
+		dbSchema.Audit = audit(in.Input)
+		if err := in.load(dbFile, dbSchema); err != nil {
+			fmt.Fprintln(os.Stderr, "Load data:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stdout, "Imported %s to %s\n", jsql.InputName(in.Input), target)
+	}
+	if mem != nil {
+		if err := mem.Serialize(*serialize); err != nil {
+			fmt.Fprintln(os.Stderr, "Serialize:", err)
+			os.Exit(1)
+		}
+		mem.Close()
+		dbFile = *serialize
+		fmt.Fprintf(os.Stdout, "Wrote %s\n", dbFile)
+	}
+	if *optimizeAfter {
+		optimize(dbFile)
+	}
+}
+
+func serveCmd(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	var dbFile, ddlFile, addr, maxBatchBytes, tenant, root string
+	var maxInflight int
+	var graphQL bool
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Ingest into this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	flags.StringVar(&addr, "addr", ":8080", "Address to listen on")
+	flags.IntVar(&maxInflight, "max-inflight", 16, "Maximum batches read, queued or being written at once before answering 429")
+	flags.StringVar(&maxBatchBytes, "max-batch-bytes", "16MiB", "Maximum size of a single request body")
+	flags.BoolVar(&graphQL, "graphql", false, "Serve a read-only GraphQL API on /graphql")
+	readOnly := flags.Bool("read-only", false, "Serve only GET /rows and /graphql, without POST /ingest or the database's write lock")
+	enrich := enrichFlag(flags)
+	withBlobs := blobFlags(flags)
+	mmapSize := mmapFlag(flags)
+	pool := poolFlags(flags)
+	audit := auditFlag(flags)
+	lock := lockFlag(flags)
+	parseFlags(flags, args)
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	if !*readOnly {
+		defer lock(dbFile)()
+	}
+	if maxInflight < 1 {
+		fmt.Fprintln(os.Stderr, "--max-inflight must be at least 1")
+		os.Exit(1)
+	}
+	checkTenant(tenant)
+	limit, err := jsql.ParseByteSize(maxBatchBytes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "--max-batch-bytes:", err)
+		os.Exit(1)
+	}
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	dbSchema.Enrich = enrich()
+	withBlobs(dbSchema)
+	if !*readOnly {
+		// Each batch is recorded with the client's address as its input
+		dbSchema.Audit = audit("")
+	}
+	mux := jsql.MonitorMux(dbFile)
+	if !*readOnly {
+		db, err := sql.Open("sqlite3", dbFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Open DB:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+		// A single connection keeps SQLite's one-writer rule inside the process
+		db.SetMaxOpenConns(1)
+		srv := jsql.NewIngestServer(db, dbSchema, maxInflight, limit)
+		go srv.Run()
+		mux = srv.Mux()
+	}
+	// Readers get their own read-only connections so queries do not wait
+	// for batches
+	readDB, err := jsql.OpenReadOnly(dbFile, mmapSize())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Open DB:", err)
+		os.Exit(1)
+	}
+	defer readDB.Close()
+	pool(readDB)
+	mux.Handle("/rows", jsql.RowsHandler(jsql.NewDumper(readDB, dbSchema, jsql.DumpOptions{})))
+	if graphQL {
+		mux.Handle("/graphql", jsql.NewGraphQL(readDB, dbSchema))
+	}
+	fmt.Fprintf(os.Stderr, "Serving %s on %s\n", dbFile, addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fmt.Fprintln(os.Stderr, "serve:", err)
+		os.Exit(1)
+	}
+}
+
+func splitCmd(args []string) {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	var input, out, bytesFlag string
+	var lines int
+	flags.StringVar(&input, "input", "", "Line-delimited JSON input (.gz is decompressed)")
+	flags.IntVar(&lines, "lines", 1000000, "Documents per output part")
+	flags.StringVar(&bytesFlag, "bytes", "", "Also start a new part before one exceeds this size, uncompressed (e.g. 64MiB)")
+	flags.StringVar(&out, "out", "part-%d.ndjson", "Output name pattern with %d for the part number (.gz compresses)")
+	parseFlags(flags, args)
+	if input == "" {
+		fmt.Fprintln(os.Stderr, "--input is required")
+		os.Exit(1)
+	}
+	if lines < 1 {
+		fmt.Fprintln(os.Stderr, "--lines must be at least 1")
+		os.Exit(1)
+	}
+	if strings.Count(out, "%d") != 1 || strings.Count(out, "%") != 1 {
+		fmt.Fprintf(os.Stderr, "--out must contain exactly one %%d\n")
+		os.Exit(1)
+	}
+	var bytesPer int64
+	if bytesFlag != "" {
+		var err error
+		if bytesPer, err = jsql.ParseByteSize(bytesFlag); err != nil || bytesPer == 0 {
+			fmt.Fprintln(os.Stderr, "--bytes must be a size of at least 1 byte")
+			os.Exit(1)
+		}
+	}
+	parts, invalid, err := jsql.SplitFile(os.Stderr, input, out, lines, bytesPer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Split:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d parts (%d invalid lines skipped)\n", parts, invalid)
+}
+
+func catCmd(args []string) {
+	flags := flag.NewFlagSet("cat", flag.ExitOnError)
+	var out string
+	flags.StringVar(&out, "out", "", "Write to this file instead of stdout (.gz compresses)")
+	parseFlags(flags, args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "at least one input file is required")
+		os.Exit(1)
+	}
+	var w io.WriteCloser = os.Stdout
+	if out != "" {
+		var err error
+		if w, err = jsql.CreateOutput(out); err != nil {
+			fmt.Fprintln(os.Stderr, "Cat:", err)
+			os.Exit(1)
+		}
+	}
+	invalid, err := jsql.CatFiles(w, os.Stderr, flags.Args())
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Cat:", err)
+		os.Exit(1)
+	}
+	if invalid > 0 {
+		fmt.Fprintf(os.Stderr, "%d invalid lines skipped\n", invalid)
+	}
+}
+
+func flattenCmd(args []string) {
+	flags := flag.NewFlagSet("flatten", flag.ExitOnError)
+	var input string
+	var opts jsql.FlattenOptions
+	flags.StringVar(&input, "input", "", "Line-delimited JSON input (.gz is decompressed)")
+	flags.StringVar(&opts.Sep, "sep", ".", "Separator between nested key segments")
+	flags.BoolVar(&opts.IndexArrays, "index-arrays", false, "Flatten array elements to key.0, key.1, ...")
+	explode := flags.String("explode", "", "First turn every element of this array field into a document of its own, with the scalar fields copied")
+	parseFlags(flags, args)
+	if input == "" {
+		fmt.Fprintln(os.Stderr, "--input is required")
+		os.Exit(1)
+	}
+	if err := jsql.CheckExplodeField(*explode); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err := jsql.TransformLines(os.Stdout, os.Stderr, input, func(obj map[string]interface{}) ([]map[string]interface{}, error) {
+		docs := jsql.ExplodeRecord(obj, *explode)
+		for i, doc := range docs {
+			docs[i] = jsql.FlattenRecord(doc, opts)
+		}
+		return docs, nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Flatten:", err)
+		os.Exit(1)
+	}
+}
+
+func unflattenCmd(args []string) {
+	flags := flag.NewFlagSet("unflatten", flag.ExitOnError)
+	var input string
+	var opts jsql.FlattenOptions
+	flags.StringVar(&input, "input", "", "Line-delimited JSON input (.gz is decompressed)")
+	flags.StringVar(&opts.Sep, "sep", ".", "Separator between nested key segments")
+	flags.BoolVar(&opts.IndexArrays, "index-arrays", false, "Turn objects keyed 0..n-1 back into arrays")
+	parseFlags(flags, args)
+	if input == "" {
+		fmt.Fprintln(os.Stderr, "--input is required")
+		os.Exit(1)
+	}
+	err := jsql.TransformLines(os.Stdout, os.Stderr, input, func(obj map[string]interface{}) ([]map[string]interface{}, error) {
+		out, err := jsql.UnflattenRecord(obj, opts)
+		return []map[string]interface{}{out}, err
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unflatten:", err)
+		os.Exit(1)
+	}
+}
+
+func diffCmd(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	var a, b, key, ddlFile, ddlFileB, root string
+	flags.StringVar(&a, "a", "", "Old database or dump file")
+	flags.StringVar(&b, "b", "", "New database or dump file")
+	flags.StringVar(&key, "key", "", "Field identifying a document (dotted paths allowed)")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file for database inputs")
+	flags.StringVar(&ddlFileB, "schema-b", "", "SQL DDL file for --b if it differs from --schema")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	withBlobs := blobFlags(flags)
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if a == "" || b == "" || key == "" {
+		fmt.Fprintln(os.Stderr, "--a, --b and --key are required")
+		os.Exit(1)
+	}
+	var dbsA, dbsB *jsql.DatabaseSchema
+	if ddlFile != "" {
+		dbsA = readSchema("", ddlFile, "", root)
+		dbsB = dbsA
+	}
+	if ddlFileB != "" {
+		dbsB = readSchema("", ddlFileB, "", root)
+	}
+	withBlobs(dbsA)
+	withBlobs(dbsB)
+	changes, err := jsql.DiffSources(os.Stdout, os.Stderr, a, dbsA, b, dbsB, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Diff:", err)
+		os.Exit(2)
+	}
+	if changes > 0 {
+		os.Exit(1)
+	}
+}
+
+func patchCmd(args []string) {
+	flags := flag.NewFlagSet("patch", flag.ExitOnError)
+	var input, dbFile, ddlFile, key, tenant, root string
+	flags.StringVar(&input, "input", "", "Line-delimited patches (JSON Patch, merge patch or diff output)")
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&key, "key", "", "Field identifying a document (\"id\" for the row id)")
+	flags.StringVar(&tenant, "tenant", "", "Patch this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	withBlobs := blobFlags(flags)
+	audit := auditFlag(flags)
+	lock := lockFlag(flags)
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if input == "" || dbFile == "" || key == "" {
+		fmt.Fprintln(os.Stderr, "--input, --db and --key are required")
+		os.Exit(1)
+	}
+	defer lock(dbFile)()
+	checkTenant(tenant)
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	withBlobs(dbSchema)
+	dbSchema.Audit = audit(input)
+	applied, failed, err := jsql.PatchDocuments(dbFile, dbSchema, key, input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Patch:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Applied %d patches to %s (%d failed)\n", applied, dbFile, failed)
+}
+
+func optimizeCmd(args []string) {
+	flags := flag.NewFlagSet("optimize", flag.ExitOnError)
+	var dbFile string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	deadline := timeoutFlag(flags)
+	lock := lockFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	defer lock(dbFile)()
+	optimize(dbFile)
+}
+
+func checkCmd(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	var dbFile, ddlFile, tenant, root string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Check this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	checkTenant(tenant)
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	violations, err := jsql.CheckDatabase(dbFile, dbSchema)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Check:", err)
+		os.Exit(2)
+	}
+	if len(violations) == 0 {
+		fmt.Fprintf(os.Stdout, "No violations found in %s\n", dbFile)
+		return
+	}
+	printViolations(violations)
+	os.Exit(1)
+}
+
+// printViolations writes a table of violation counts to stdout
+func printViolations(violations []jsql.Violation) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tCOLUMN\tVIOLATION\tROWS")
+	total := 0
+	for _, v := range violations {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", v.Table, v.Column, v.Kind, v.Count)
+		total += v.Count
+	}
+	w.Flush()
+	fmt.Fprintf(os.Stdout, "%d rows violate jsql invariants\n", total)
+}
+
+func repairCmd(args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	var dbFile, ddlFile, tenant, root string
+	var opts jsql.RepairOptions
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Repair this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	flags.BoolVar(&opts.Delete, "delete", false, "Delete rows with dangling references or invalid JSON instead of nulling the column")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Only report what would be repaired")
+	audit := auditFlag(flags)
+	deadline := timeoutFlag(flags)
+	lock := lockFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	if !opts.DryRun {
+		defer lock(dbFile)()
+	}
+	checkTenant(tenant)
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	dbSchema.Audit = audit("")
+	repairs, err := jsql.RepairDatabase(dbFile, dbSchema, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Repair:", err)
+		os.Exit(1)
+	}
+	if len(repairs) == 0 {
+		fmt.Fprintf(os.Stdout, "Nothing to repair in %s\n", dbFile)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tCOLUMN\tVIOLATION\tROWS\tACTION")
+	for _, r := range repairs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", r.Table, r.Column, r.Kind, r.Count, r.Action)
+	}
+	w.Flush()
+	if opts.DryRun {
+		fmt.Fprintln(os.Stdout, "Dry run: no changes written")
+	} else {
+		fmt.Fprintf(os.Stdout, "Repaired %s\n", dbFile)
+	}
+}
+
+func retryQuarantineCmd(args []string) {
+	flags := flag.NewFlagSet("retry-quarantine", flag.ExitOnError)
+	var dbFile, ddlFile, tenant, root string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Retry rows of this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	enrich := enrichFlag(flags)
+	withBlobs := blobFlags(flags)
+	audit := auditFlag(flags)
+	lock := lockFlag(flags)
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	defer lock(dbFile)()
+	checkTenant(tenant)
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	dbSchema.Enrich = enrich()
+	withBlobs(dbSchema)
+	dbSchema.Audit = audit("")
+	loaded, failed, err := jsql.RetryQuarantine(dbFile, dbSchema)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Retry quarantine:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Loaded %d quarantined rows into %s, %d still failing\n", loaded, dbFile, failed)
+}
+
+func recompactSymbolsCmd(args []string) {
+	flags := flag.NewFlagSet("recompact-symbols", flag.ExitOnError)
+	var dbFile, ddlFile string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	optimizeAfter := flags.Bool("optimize", false, "Optimize, VACUUM and integrity-check the database afterwards")
+	audit := auditFlag(flags)
+	deadline := timeoutFlag(flags)
+	lock := lockFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	defer lock(dbFile)()
+	// Every symbol table of the schema, whichever roots refer to it
+	dbSchema := parseDDL(readDDL(dbFile, ddlFile))
+	dbSchema.Audit = audit("")
+	done, err := jsql.RecompactSymbols(dbFile, dbSchema)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Recompact:", err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tSYMBOLS\tMOVED")
+	for _, r := range done {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", r.Table, r.Symbols, r.Moved)
+	}
+	w.Flush()
+	if *optimizeAfter {
+		optimize(dbFile)
+	}
+}
+
+func denormalizeCmd(args []string) {
+	flags := flag.NewFlagSet("denormalize", flag.ExitOnError)
+	var dbFile, ddlFile, tenant, root, out string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Denormalize this tenant's documents")
+	flags.StringVar(&root, "root", "main", "Root table of the documents, for schemas holding several datasets")
+	flags.StringVar(&out, "out-table", "", "Table to write the flattened documents to (default ROOT_flat)")
+	replace := flags.Bool("replace", false, "Overwrite --out-table if it exists")
+	audit := auditFlag(flags)
+	deadline := timeoutFlag(flags)
+	lock := lockFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	defer lock(dbFile)()
+	checkTenant(tenant)
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	if out == "" {
+		out = dbSchema.Root + "_flat"
+	}
+	dbSchema.Audit = audit("")
+	n, err := jsql.Denormalize(dbFile, dbSchema, out, *replace)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Denormalize:", timedOut(err))
+		os.Exit(1)
+	}
+	fmt.Printf("Wrote %d rows to %s\n", n, out)
+}
+
+func profileCmd(args []string) {
+	flags := flag.NewFlagSet("profile", flag.ExitOnError)
+	var dbFile, ddlFile, table string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema, to resolve symbols")
+	flags.StringVar(&table, "table", "main", "Table to profile")
+	top := flags.Int("top", 5, "Number of most frequent values to list per column")
+	output := flags.String("output", "table", "Write the statistics as a table or as json")
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "--output %q must be table or json\n", *output)
+		os.Exit(1)
+	}
+	// Without a schema the symbol ids are profiled as they are
+	var dbSchema *jsql.DatabaseSchema
+	if _, stored, _ := jsql.StoredSchema(dbFile); stored || ddlFile != "" {
+		dbSchema = parseDDL(readDDL(dbFile, ddlFile))
+	}
+	stats, err := jsql.ProfileTable(dbFile, dbSchema, table, *top)
+	if err == nil {
+		if *output == "json" {
+			err = stats.WriteJSON(os.Stdout)
+		} else {
+			err = stats.WriteTable(os.Stdout)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Profile:", timedOut(err))
+		os.Exit(1)
+	}
+}
+
+func backupCmd(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	var dbFile, out string
+	flags.StringVar(&dbFile, "db", "", "SQLite database to copy (may be in use)")
+	flags.StringVar(&out, "out", "", "Snapshot file to write")
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" || out == "" {
+		fmt.Fprintln(os.Stderr, "--db and --out are required")
+		os.Exit(1)
+	}
+	pages, err := jsql.Backup(cmdContext, dbFile, out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Backup:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Backed up %s to %s (%d pages)\n", dbFile, out, pages)
+}
+
+func exportBundleCmd(args []string) {
+	flags := flag.NewFlagSet("export-bundle", flag.ExitOnError)
+	var dbFile, ddlFile, out string
+	var opts jsql.ExportOptions
+	var recipients stringList
+	flags.StringVar(&dbFile, "db", "", "SQLite database to ship")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&out, "out", "", "Bundle to write (.tar.zst, or .tar.zst.age when encrypted)")
+	flags.StringVar(&opts.Description, "description", "", "Free-form description stored in the metadata")
+	flags.Var(&recipients, "recipient", "Encrypt to this age recipient (age1...); may be repeated")
+	flags.StringVar(&opts.SignKey, "sign-key", "", "Sign the manifest with this Ed25519 private key (PKCS #8 PEM)")
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" || out == "" {
+		fmt.Fprintln(os.Stderr, "--db and --out are required")
+		os.Exit(1)
+	}
+	opts.Recipients = recipients
+	if err := jsql.ExportBundle(cmdContext, dbFile, readDDL(dbFile, ddlFile), out, opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Export bundle:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Exported %s to %s\n", dbFile, out)
+}
+
+func importBundleCmd(args []string) {
+	flags := flag.NewFlagSet("import-bundle", flag.ExitOnError)
+	var bundle, out string
+	var opts jsql.ImportOptions
+	flags.StringVar(&bundle, "bundle", "", "Bundle written by export-bundle")
+	flags.StringVar(&out, "out", "", "Directory to unpack data.db, schema.sql and metadata.json into")
+	flags.StringVar(&opts.Identities, "identity", "", "age identity file for encrypted bundles")
+	flags.StringVar(&opts.VerifyKey, "verify-key", "", "Require a manifest signature by this Ed25519 public key (PEM)")
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if bundle == "" || out == "" {
+		fmt.Fprintln(os.Stderr, "--bundle and --out are required")
+		os.Exit(1)
+	}
+	manifest, err := jsql.ImportBundle(bundle, out, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Import bundle:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stdout, "Verified and unpacked %d files to %s\n", len(manifest.Files), out)
+}
+
+func schemaMergeCmd(args []string) {
+	flags := flag.NewFlagSet("schema-merge", flag.ExitOnError)
+	output := flags.String("output", "ddl", "Write the merged schema as ddl, or as a json model")
+	parseFlags(flags, args)
+	if flags.NArg() < 2 {
+		fmt.Fprintln(os.Stderr, "at least two schema files are required")
+		os.Exit(1)
+	}
+	if *output != "ddl" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "--output %q must be ddl or json\n", *output)
+		os.Exit(1)
+	}
+	var ddls []string
+	for _, path := range flags.Args() {
+		ddl, err := jsql.ReadDDL(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Read schema:", err)
+			os.Exit(1)
+		}
+		ddls = append(ddls, ddl)
+	}
+	merged, err := jsql.MergeSchemas(ddls...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Merge schemas:", err)
+		os.Exit(1)
+	}
+	if *output == "json" {
+		model, err := jsql.MarshalSchemaModel(merged.DDL())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Schema model:", err)
+			os.Exit(1)
+		}
+		os.Stdout.Write(model)
+		return
+	}
+	fmt.Print(merged.DDL())
+}
+
+func syncCmd(args []string) {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	config := flags.String("config", "", "YAML file of the source, db, key and sink to sync")
+	interval := flags.Duration("interval", 0, "Time between cycles, overriding the config's interval (e.g. 5m)")
+	once := flags.Bool("once", false, "Run one cycle, even if the config has an interval")
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if *config == "" {
+		fmt.Fprintln(os.Stderr, "--config is required")
+		os.Exit(1)
+	}
+	if *interval < 0 {
+		fmt.Fprintln(os.Stderr, "--interval must not be negative")
+		os.Exit(1)
+	}
+	cfg, err := jsql.LoadSyncConfig(*config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Sync config:", err)
+		os.Exit(1)
+	}
+	if *interval > 0 {
+		cfg.Interval = *interval
+	}
+	if *once {
+		cfg.Interval = 0
+	}
+	dbSchema := readSchema(cfg.DB, cfg.Schema, "", "main")
+	dbSchema.Audit = &jsql.AuditWrite{Command: commandLine()}
+	for {
+		changes, err := cfg.SyncOnce(cmdContext, dbSchema)
+		switch {
+		case err != nil && cfg.Interval == 0:
+			fmt.Fprintln(os.Stderr, "Sync:", err)
+			os.Exit(1)
+		case err != nil:
+			fmt.Fprintln(os.Stderr, "Sync:", err)
+		case changes > 0:
+			fmt.Fprintf(os.Stdout, "Synced %d changes from %s into %s\n", changes, cfg.Source, cfg.DB)
+		}
+		if cfg.Interval == 0 {
+			return
+		}
+		select {
+		case <-time.After(cfg.Interval):
+		case <-cmdContext.Done():
+			return
+		}
+	}
+}
+
+func queryCmd(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	var dbFile, ddlFile, tenant, root string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file, opened read-only")
+	flags.StringVar(&ddlFile, "schema", "", "SQL DDL file or JSON schema model, if --db has no stored schema")
+	flags.StringVar(&tenant, "tenant", "", "Resolve columns against this tenant's tables")
+	flags.StringVar(&root, "root", "main", "Root table, whose columns are preferred where tables share a column name")
+	withBlobs := blobFlags(flags)
+	mmapSize := mmapFlag(flags)
+	deadline := timeoutFlag(flags)
+	parseFlags(flags, args)
+	defer deadline()()
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "query takes one SQL statement, after the flags")
+		os.Exit(1)
+	}
+	checkTenant(tenant)
+	dbSchema := readSchema(dbFile, ddlFile, tenant, root)
+	withBlobs(dbSchema)
+	db, err := jsql.OpenReadOnly(dbFile, mmapSize())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Open DB:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	dw := jsql.NewDocWriter(os.Stdout)
+	err = jsql.NewDumper(db, dbSchema, jsql.DumpOptions{}).WithContext(cmdContext).Query(flags.Arg(0), nil, dw.Write)
+	if ferr := dw.Flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Query error:", timedOut(err))
+		os.Exit(1)
+	}
+}
+
+func auditCmd(args []string) {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	var dbFile, head string
+	flags.StringVar(&dbFile, "db", "", "SQLite database file")
+	flags.StringVar(&head, "head", "", "Hash of an entry recorded outside the database, which the log must still hold")
+	parseFlags(flags, args)
+	if dbFile == "" {
+		fmt.Fprintln(os.Stderr, "--db is required")
+		os.Exit(1)
+	}
+	entries, err := jsql.ReadAudit(dbFile)
+	if err == nil && head != "" {
+		err = fmt.Errorf("no entry has hash %s: the log was truncated or rewritten", head)
+		for _, e := range entries {
+			if e.Hash == head {
+				err = nil
+			}
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Audit:", err)
+		os.Exit(1)
+	}
+}
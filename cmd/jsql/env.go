@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// envPrefix is prepended to a flag's name to find its environment variable,
+// e.g. --db is read from JSQL_DB and --max-inflight from JSQL_MAX_INFLIGHT
+const envPrefix = "JSQL_"
+
+// envName returns the environment variable consulted for a flag
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// parseFlags parses the command line and then fills every flag that was not
+// given explicitly from its JSQL_* environment variable, so command-line
+// arguments always take precedence over the environment
+func parseFlags(flags *flag.FlagSet, args []string) {
+	flags.Parse(args)
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	flags.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		val, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if err := flags.Set(f.Name, val); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: invalid value %q: %v\n", envName(f.Name), val, err)
+			os.Exit(1)
+		}
+	})
+}
+
+// loadDotEnv reads KEY=VALUE lines from a .env file and exports the JSQL_*
+// entries that are not already present in the environment. A missing file
+// is not an error.
+func loadDotEnv(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, lineNum)
+		}
+		key = strings.TrimSpace(key)
+		val = strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		if !strings.HasPrefix(key, envPrefix) {
+			continue
+		}
+		if _, exists := os.LookupEnv(key); exists {
+			continue
+		}
+		os.Setenv(key, val)
+	}
+	return sc.Err()
+}
@@ -0,0 +1,123 @@
+// Command jsql loads line-delimited JSON into SQLite and dumps it back; see
+// the README for the commands and the jsql package for the Go API.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// main runs the jsql command named by os.Args[1]. Commands exit the process
+// when they fail.
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, `Usage:
+  %s analyze --input data.json [--sample N] [--profile name] [--pprof :6060] [--trace spans.json]
+  %s create-db --schema ddl.sql (--db my.db | --driver postgres --dsn URL) [--if-not-exists | --force]
+  %s load --input data.json --db my.db --schema ddl.sql [--metrics-addr :9090] [--quarantine] [--batch-size N]
+  %s dump --db my.db --schema ddl.sql [--root main] [--sample 0.01] [--head N | --tail N] [--after-id N --limit M]
+  %s asof --db my.db --schema ddl.sql --at 2024-05-01T12:00:00Z
+  %s get --db my.db --key name=Alice
+  %s import --input data.json --db my.db [--schema ddl.sql] [--optimize]
+  %s import --map orders.json=orders --map users.json=users --db my.db [--schema ddl.sql]
+  %s serve --db my.db --schema ddl.sql [--addr :8080] [--max-inflight N] [--max-batch-bytes 16MiB] [--graphql]
+  %s split --input huge.ndjson [--lines N] [--bytes SIZE] [--out part-%%d.ndjson[.gz]]
+  %s cat [--out all.ndjson] part-*.ndjson
+  %s flatten --input data.json [--sep .] [--index-arrays]
+  %s unflatten --input flat.json [--sep .] [--index-arrays]
+  %s diff --a old.db --b new.db --key name [--schema ddl.sql]
+  %s patch --db my.db --schema ddl.sql --key id --input patches.ndjson
+  %s optimize --db my.db
+  %s check --db my.db --schema ddl.sql
+  %s repair --db my.db --schema ddl.sql [--delete] [--dry-run]
+  %s backup --db live.db --out snapshot.db
+  %s export-bundle --db my.db --schema ddl.sql --out my.tar.zst [--recipient age1...] [--sign-key key.pem]
+  %s import-bundle --bundle my.tar.zst --out dir [--identity key.txt] [--verify-key pub.pem]
+  %s retry-quarantine --db my.db --schema ddl.sql
+  %s recompact-symbols --db my.db --schema ddl.sql [--optimize]
+  %s denormalize --db my.db [--out-table main_flat] [--replace]
+  %s profile --db my.db [--table main] [--top 5] [--output table|json]
+  %s schema-from-jsonschema --input model.schema.json [--profile name] > schema.sql
+  %s schema-merge a.sql b.sql [more.sql...] [--output ddl|json] > merged.sql
+  %s sync --config sync.yaml [--interval 5m] [--once]
+  %s query --db my.db --schema ddl.sql "SELECT ..."
+  %s audit --db my.db
+
+Any flag may also be supplied as a JSQL_* environment variable
+(e.g. JSQL_DB, JSQL_SCHEMA) or in a .env file in the working directory.
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+		os.Exit(1)
+	}
+
+	if err := loadDotEnv(".env"); err != nil {
+		fmt.Fprintln(os.Stderr, "Read .env:", err)
+		os.Exit(1)
+	}
+	
+	// Dispatch to the appropriate command
+	switch os.Args[1] {
+	case "analyze":
+		analyzeCmd(os.Args[2:])
+	case "create-db":
+		createDbCmd(os.Args[2:])
+	case "load":
+		loadCmd(os.Args[2:])
+	case "dump":
+		dumpCmd(os.Args[2:])
+	case "asof":
+		asofCmd(os.Args[2:])
+	case "get":
+		getCmd(os.Args[2:])
+	case "import":
+		importCmd(os.Args[2:])
+	case "serve":
+		serveCmd(os.Args[2:])
+	case "split":
+		splitCmd(os.Args[2:])
+	case "cat":
+		catCmd(os.Args[2:])
+	case "flatten":
+		flattenCmd(os.Args[2:])
+	case "unflatten":
+		unflattenCmd(os.Args[2:])
+	case "diff":
+		diffCmd(os.Args[2:])
+	case "patch":
+		patchCmd(os.Args[2:])
+	case "optimize":
+		optimizeCmd(os.Args[2:])
+	case "check":
+		checkCmd(os.Args[2:])
+	case "repair":
+		repairCmd(os.Args[2:])
+	case "backup":
+		backupCmd(os.Args[2:])
+	case "export-bundle":
+		exportBundleCmd(os.Args[2:])
+	case "import-bundle":
+		importBundleCmd(os.Args[2:])
+	case "retry-quarantine":
+		retryQuarantineCmd(os.Args[2:])
+	case "recompact-symbols":
+		recompactSymbolsCmd(os.Args[2:])
+	case "denormalize":
+		denormalizeCmd(os.Args[2:])
+	case "profile":
+		profileCmd(os.Args[2:])
+	case "schema-from-jsonschema":
+		schemaFromJSONSchemaCmd(os.Args[2:])
+	case "schema-merge":
+		schemaMergeCmd(os.Args[2:])
+	case "sync":
+		syncCmd(os.Args[2:])
+	case "query":
+		queryCmd(os.Args[2:])
+	case "audit":
+		auditCmd(os.Args[2:])
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
+		os.Exit(1)
+	}
+}
\ No newline at end of file
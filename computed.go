@@ -0,0 +1,180 @@
+package jsql
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"gopkg.in/yaml.v3"
+)
+
+// Computed columns are declared in the DDL as comment directives
+//
+//	-- jsql:computed main.duration_ms = end - start
+//
+// next to the column itself. The loader evaluates the expr-lang expression
+// against every row's document and stores the result; dump leaves the
+// column out since it is not part of the document.
+var reComputedDirective = regexp.MustCompile(`^--\s*jsql:computed\s+(\w+)\.(\w+)\s*=\s*(.+)$`)
+
+// ComputedColumn is one entry of a --computed file
+type ComputedColumn struct {
+	Expr  string `yaml:"expr"`
+	Index bool   `yaml:"index"` // add an index on the column
+}
+
+// UnmarshalYAML accepts either a bare expression or a mapping
+func (c *ComputedColumn) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		c.Expr = node.Value
+		return nil
+	}
+	type plain ComputedColumn
+	return node.Decode((*plain)(c))
+}
+
+// LoadComputed reads a YAML map of dotted column paths to expressions,
+// checking that every expression compiles
+func LoadComputed(path string) (map[string]ComputedColumn, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cols map[string]ComputedColumn
+	if err := yaml.Unmarshal(data, &cols); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, c := range cols {
+		// Directives hold the expression on a single line
+		c.Expr = strings.TrimSpace(strings.ReplaceAll(c.Expr, "\n", " "))
+		cols[name] = c
+		if err := compileComputed(c.Expr).err; err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, name, err)
+		}
+	}
+	return cols, nil
+}
+
+// Computed is a compiled computed column expression
+type Computed struct {
+	Expr    string
+	program *vm.Program
+	err     error // compile error, reported when the column is evaluated
+}
+
+func compileComputed(src string) *Computed {
+	c := &Computed{Expr: src}
+	c.program, c.err = expr.Compile(src, expr.Env(map[string]interface{}{}), expr.AllowUndefinedVariables())
+	return c
+}
+
+// eval evaluates the expression against obj, returning the value to store.
+// Expressions failing on a row (missing fields, wrong types) store NULL.
+func (c *Computed) eval(obj map[string]interface{}) (interface{}, error) {
+	if c.err != nil {
+		return nil, fmt.Errorf("computed %s: %v", c.Expr, c.err)
+	}
+	out, err := expr.Run(c.program, obj)
+	if err != nil {
+		return nil, nil
+	}
+	switch v := out.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case time.Duration:
+		return int64(v), nil
+	case []interface{}, map[string]interface{}:
+		js, _ := json.Marshal(v)
+		return string(js), nil
+	}
+	return out, nil
+}
+
+// computedType returns the column type for the values an expression yields
+// on the sampled rows, widening typ, that of the values it yielded on
+// earlier ones; "" if it yielded none
+func computedType(typ FieldType, vals []interface{}) FieldType {
+	for _, v := range vals {
+		var t FieldType
+		switch v.(type) {
+		case nil:
+			continue
+		case int, int64, time.Duration:
+			t = TypeInt
+		case float64:
+			t = TypeReal
+		case bool:
+			t = TypeBool
+		case string, time.Time:
+			t = TypeText
+		default:
+			t = TypeJSON
+		}
+		switch {
+		case typ == "" || typ == t:
+			typ = t
+		case (typ == TypeInt && t == TypeReal) || (typ == TypeReal && t == TypeInt):
+			typ = TypeReal
+		default:
+			typ = TypeJSON
+		}
+	}
+	return typ
+}
+
+// addComputed adds the computed columns to the analyzed tables, typed by
+// evaluating them on the sampled documents. types holds the types of their
+// values in earlier batches of documents, and gains those of these.
+func addComputed(schema map[string]*TableSchema, roots []map[string]interface{}, cols map[string]ComputedColumn, types map[string]FieldType) error {
+	for path, c := range cols {
+		table, col := profileColumn(path)
+		ts := schema[table]
+		if ts == nil {
+			continue // not in the sample
+		}
+		if _, typed := types[path]; !typed && ts.Fields[col] != "" {
+			return fmt.Errorf("computed column %s: the documents already have this field", path)
+		}
+		// Rows of a nested table are the objects at the parent path
+		parent := ""
+		if i := strings.LastIndex(path, "."); i >= 0 {
+			parent = path[:i]
+		}
+		prog := compileComputed(c.Expr)
+		var vals []interface{}
+		for _, root := range roots {
+			row := root
+			if parent != "" {
+				v, _ := lookupPath(root, parent)
+				if row, _ = v.(map[string]interface{}); row == nil {
+					continue
+				}
+			}
+			if out, err := expr.Run(prog.program, row); err == nil {
+				vals = append(vals, out)
+			}
+		}
+		types[path] = computedType(types[path], vals)
+		ts.Fields[col] = cmp.Or(types[path], TypeText)
+	}
+	return nil
+}
+
+// sortedComputed returns the paths of the computed columns of table
+func sortedComputed(cols map[string]ComputedColumn, table string) []string {
+	var paths []string
+	for path := range cols {
+		if t, _ := profileColumn(path); t == table {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -1,84 +1,694 @@
-package main
+package jsql
 
 import (
+	"context"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"maps"
+	"math"
 	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/tomberek/jsql/internal/pathspec"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// CreateDatabase creates a new SQLite database with the given schema
+// CreateDatabase creates a new SQLite database with the given schema, which
+// it also stores in the database
 func CreateDatabase(dbPath string, ddl string) error {
-	os.Remove(dbPath)
+	if err := removeDatabase(dbPath); err != nil {
+		return err
+	}
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec(ddl)
-	return err
+	if _, err := db.Exec(ddl); err != nil {
+		return err
+	}
+	return storeSchema(db, ddl)
 }
 
-// DumpRows dumps all rows from the main table in the database
-func DumpRows(dbPath string, dbs *DatabaseSchema) error {
+// ReplaceTables creates the tables of ddl in an existing database, dropping
+// only those tables first so that everything else in the file is kept. The
+// stored schema is updated the same way.
+func ReplaceTables(dbPath string, ddl string) error {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	main := dbs.Tables["main"]
-	return dumpTable(db, dbs, main, "", nil)
+	ds := ParseDDL(ddl)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i := len(ds.TableOrder) - 1; i >= 0; i-- {
+		table := ds.Tables[ds.TableOrder[i]]
+		for _, rtree := range table.SpatialIndexes {
+			if _, err := tx.Exec("DROP TABLE IF EXISTS " + rtree); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("DROP TABLE IF EXISTS " + table.Name); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ddl); err != nil {
+		return err
+	}
+	if err := mergeStoredSchema(tx, ddl); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-// dumpTable dumps all rows from a table in the database
-func dumpTable(db *sql.DB, dbs *DatabaseSchema, table *TableSchema, whereClause string, args []any) error {
-	query := fmt.Sprintf("SELECT * FROM %s", table.Name)
-	if whereClause != "" {
-		query += " WHERE " + whereClause
+// reCreateObject matches the start of a CREATE statement up to the name of
+// the table, index, view or trigger it creates
+var reCreateObject = regexp.MustCompile(`(?i)\bCREATE\s+((?:UNIQUE\s+|VIRTUAL\s+|TEMP\s+|TEMPORARY\s+)?(?:TABLE|INDEX|VIEW|TRIGGER)\s+)(?:IF\s+NOT\s+EXISTS\s+)?(` + qualifiedIdentPattern + `)`)
+
+// CreateMissing creates the tables, indexes and other objects of ddl that
+// the database lacks, leaving those it has, and their rows, alone. The
+// stored schema gains what was created. It returns the names of the tables
+// and statements' objects created, in the order of ddl. Tables the database
+// has with other columns than ddl gives them are an error: they are not
+// altered, and loads would not fit them.
+func CreateMissing(dbPath string, ddl string) ([]string, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	names, err := schemaObjects(tx)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[string]bool{}
+	for _, name := range names {
+		existing[name] = true
+	}
+	model, created := NewSchemaModel(ddl), &SchemaModel{}
+	if err := checkExistingColumns(tx, ddl, model, existing); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(reCreateObject.ReplaceAllString(ddl, "CREATE ${1}IF NOT EXISTS $2")); err != nil {
+		return nil, err
+	}
+	names = nil
+	for _, t := range model.Tables {
+		if !existing[t.Name] {
+			created.Tables = append(created.Tables, t)
+			names = append(names, t.Name)
+		}
+	}
+	for _, s := range model.Statements {
+		if m := reCreateObject.FindStringSubmatch(s); m != nil && !existing[unquoteIdent(m[3])] {
+			created.Statements = append(created.Statements, s)
+			names = append(names, unquoteIdent(m[3]))
+		}
+	}
+	// Without a stored schema the database is described by all of ddl,
+	// every object of which it now has
+	_, stored, err := loadStoredSchema(tx)
+	switch {
+	case err != nil:
+		return nil, err
+	case !stored:
+		err = storeSchema(tx, ddl)
+	case len(names) > 0:
+		err = mergeStoredSchema(tx, created.DDL())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return names, tx.Commit()
+}
+
+// checkExistingColumns compares the columns of the tables of model the
+// database has with those ddl declares, as SQLite reads them from a scratch
+// database, and returns an error listing every difference
+func checkExistingColumns(db queryer, ddl string, model *SchemaModel, existing map[string]bool) error {
+	scratch, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return err
+	}
+	defer scratch.Close()
+	if _, err := scratch.Exec(ddl); err != nil {
+		return err
+	}
+	var diffs []string
+	for _, t := range model.Tables {
+		if !existing[t.Name] {
+			continue
+		}
+		want, err := columnTypes(scratch, t.Name)
+		if err != nil {
+			return err
+		}
+		have, err := columnTypes(db, t.Name)
+		if err != nil {
+			return err
+		}
+		for _, col := range slices.Sorted(maps.Keys(want)) {
+			switch typ, ok := have[col]; {
+			case !ok:
+				diffs = append(diffs, fmt.Sprintf("%s has no column %s", t.Name, col))
+			case typ != want[col]:
+				diffs = append(diffs, fmt.Sprintf("%s.%s is %s, not %s", t.Name, col, typ, want[col]))
+			}
+		}
+		for _, col := range slices.Sorted(maps.Keys(have)) {
+			if _, ok := want[col]; !ok {
+				diffs = append(diffs, fmt.Sprintf("%s.%s is not in the schema", t.Name, col))
+			}
+		}
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("existing tables differ from the schema, and are not altered: %s", strings.Join(diffs, "; "))
+	}
+	return nil
+}
+
+// schemaObjects returns the names of the tables, indexes, views and
+// triggers of a database, other than SQLite's own
+func schemaObjects(db queryer) ([]string, error) {
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE name NOT LIKE 'sqlite\\_%' ESCAPE '\\'")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// HasTables reports whether the file at dbPath is a database holding
+// tables. Files that are not databases count as holding some.
+func HasTables(dbPath string) (bool, error) {
+	if st, err := os.Stat(dbPath); os.IsNotExist(err) || err == nil && st.Size() == 0 {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table'").Scan(&n); err != nil {
+		return true, fmt.Errorf("%s: %v", dbPath, err)
+	}
+	return n > 0, nil
+}
+
+// Optimize prepares a finished database for shipping: it refreshes the query
+// planner statistics, rebuilds the file without free pages and verifies it
+func Optimize(dbPath string) error {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, stmt := range []string{"PRAGMA optimize", "VACUUM"} {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("%s: %v", stmt, err)
+		}
+	}
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check failed:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// DumpOptions controls how rows are rehydrated into documents
+type DumpOptions struct {
+	WithProvenance   bool              // include _line, _source, _ingested_at and timestamps
+	Anonymize        *AnonymizeProfile // applied to every document before output
+	Sample           float64           // keep each document with this probability (0 or 1: all)
+	Head             int               // only the first N documents
+	Tail             int               // only the last N documents
+	AfterID          int64             // only rows with a greater id, to resume an earlier dump
+	OmitDefaults     bool              // leave out fields equal to their column's DEFAULT
+	Filter           *pathspec.Filter  // fields kept and dropped from every document
+	MmapSize         int64             // bytes of the database to memory-map
+	View             string            // dump the rows of this view instead of the root table's documents
+	Explain          io.Writer         // gets the plan of each distinct query before it first runs
+	PreloadSymbols   int               // read symbol tables of at most this many rows whole
+	RawLen           bool              // write raw-len frames instead of JSON lines
+	OrderBy          string            // column the documents are written in the order of, rather than row id
+	PreserveKeyOrder bool              // write keys in the order recorded in _key_order rather than sorted
+	NumberMode       string            // NumberModeString writes numbers as the text recorded in _number_text
+	NormalizeTime    string            // NormalizeTimeUTC writes UTCTIME columns in UTC rather than their original offsets
+	Script           DumpScript        // reshapes every document as the last step before output
+	Output           io.Writer         // where documents are written; os.Stdout if nil
+	IncludeDeleted   bool              // also write soft-deleted documents, with their _deleted_at
+	Where            string            // SQL condition on the columns of the root table's rows
+	Args             []any             // bound to the ? placeholders of Where
+	AsOf             string            // write the documents as they were at this time, as ParseAsOf returns it, from the history tables
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Dumper rehydrates rows of a database into JSON documents
+type Dumper struct {
+	ctx   context.Context // interrupts the queries of each operation
+	db    queryer
+	dbs   *DatabaseSchema
+	opts  DumpOptions
+	cache *dumpCache // within eachRow
+}
+
+// dumpCache holds what an eachRow operation reads once for all its rows.
+// It is not shared between operations, which may run concurrently.
+type dumpCache struct {
+	symbols map[string]map[int64]interface{} // symbol table -> id -> value
+	refs    map[*TableSchema]tableRefs
+}
+
+// tableRefs maps the columns of a table referencing other tables to the
+// document fields they hold
+type tableRefs struct {
+	objects map[string]string
+	symbols map[string]string
+}
+
+// refs returns the reference columns of a table
+func (d *Dumper) refs(table *TableSchema) tableRefs {
+	if d.cache != nil {
+		if r, ok := d.cache.refs[table]; ok {
+			return r
+		}
+	}
+	r := tableRefs{objects: map[string]string{}, symbols: map[string]string{}}
+	for col := range table.FKs {
+		if field, ok := table.Naming.symbolField(col); ok {
+			r.symbols[col] = field
+		} else if field, ok := table.Naming.objectField(col); ok {
+			r.objects[col] = field
+		}
+	}
+	if d.cache != nil {
+		d.cache.refs[table] = r
+	}
+	return r
+}
 
+// DumpRows dumps all rows from the main table in the database, returning
+// the id of the last row written (opts.AfterID if there was none).
+// Cancelling ctx interrupts the dump.
+func DumpRows(ctx context.Context, dbPath string, dbs *DatabaseSchema, opts DumpOptions) (int64, error) {
+	var db *sql.DB
+	var err error
+	switch d := dbs.dialect(); {
+	case d != SQLite:
+		db, err = d.Open(dbPath)
+	case opts.AsOf != "":
+		db, err = openAsOf(dbPath, dbs, opts.AsOf, opts.MmapSize)
+	default:
+		db, err = OpenReadOnly(dbPath, opts.MmapSize)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	main := dbs.RootTable()
+	if opts.View != "" {
+		if main, err = viewTable(db, dbs, opts.View); err != nil {
+			return 0, err
+		}
+		if opts.Tail > 0 || opts.AfterID > 0 {
+			return 0, fmt.Errorf("view %s has no row ids to take the last rows or resume after", opts.View)
+		}
+	}
+	if opts.OrderBy != "" && opts.OrderBy != "id" && main.Fields[opts.OrderBy] == "" {
+		return 0, fmt.Errorf("table %s has no column %s to order by", main.Name, opts.OrderBy)
+	}
+	dump := startPhase("dump", attribute.String("jsql.db", dbPath), attribute.String("jsql.root", main.Name))
+	defer dump.end()
+	d := &Dumper{ctx: ctx, db: db, dbs: dbs, opts: opts}
+	n, err := d.dumpTable(main, opts.Where, opts.Args)
+	dump.set(attribute.Int64("jsql.documents", n))
+	return n, timedOut(ctx, err)
+}
+
+// Dump writes the documents of the root table of dbs in db to w, one JSON
+// object per line in row id order, as the dump command does. It stops with
+// ctx's error once ctx is done.
+func Dump(ctx context.Context, db *sql.DB, w io.Writer, dbs *DatabaseSchema) error {
+	dw := NewDocWriter(w)
+	err := NewDumper(db, dbs, DumpOptions{}).WithContext(ctx).Each(func(doc map[string]interface{}) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return dw.Write(doc)
+	})
+	if ferr := dw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// viewTable returns the view named name, its column types read from the
+// database
+func viewTable(db queryer, dbs *DatabaseSchema, name string) (*TableSchema, error) {
+	view := dbs.Views[name]
+	if view == nil {
+		return nil, fmt.Errorf("schema has no view %s (views: %s)", name, strings.Join(sortedKeys(dbs.Views), ", "))
+	}
+	types, err := columnTypes(db, name)
+	if err != nil {
+		return nil, err
+	}
+	maps.Copy(view.Fields, types)
+	return view, nil
+}
+
+// NewDumper returns a Dumper reading the documents of dbs from db
+func NewDumper(db *sql.DB, dbs *DatabaseSchema, opts DumpOptions) *Dumper {
+	return &Dumper{ctx: context.Background(), db: db, dbs: dbs, opts: opts}
+}
+
+// WithContext returns a copy of d whose operations are interrupted once ctx
+// is done
+func (d *Dumper) WithContext(ctx context.Context) *Dumper {
+	d2 := *d
+	d2.ctx = ctx
+	return &d2
+}
+
+// Page returns up to limit documents of the root table following cursor
+// ("" for the first page), and the cursor of the next page, "" after the
+// last one. Cursors are opaque to callers; they hold the last row id, so
+// every page is an index range scan however deep into the table it is.
+func (d *Dumper) Page(cursor string, limit int) ([]map[string]interface{}, string, error) {
+	var after int64
+	if cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			after, err = strconv.ParseInt(string(b), 10, 64)
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid cursor %q", cursor)
+		}
+	}
+	if limit < 1 {
+		return nil, "", fmt.Errorf("limit must be at least 1")
+	}
+	// One row more than asked tells whether there is a next page
+	pd := *d
+	pd.opts.Head, pd.opts.Tail = limit+1, 0
+	var docs []map[string]interface{}
+	var ids []int64
+	err := pd.eachRow(d.dbs.RootTable(), "id > ?", []any{after}, func(id int64, obj map[string]interface{}) error {
+		docs = append(docs, obj)
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if len(docs) <= limit {
+		return docs, "", nil
+	}
+	next := base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(ids[limit-1], 10)))
+	return docs[:limit], next, nil
+}
+
+// Each calls fn with every document of the root table, in row id order
+func (d *Dumper) Each(fn func(map[string]interface{}) error) error {
+	return d.eachDocument(d.dbs.RootTable(), "", nil, fn)
+}
+
+// DocumentDecoder is implemented by types that convert documents
+// themselves rather than through encoding/json
+type DocumentDecoder interface {
+	DecodeDocument(doc map[string]interface{}) error
+}
+
+// DecodeEach calls fn with every document of the root table decoded into a
+// new value of the type target points to, passed as such a pointer. Types
+// implementing DocumentDecoder decode the document themselves; others are
+// filled by encoding/json, so struct fields take json tags.
+func (d *Dumper) DecodeEach(fn func(v any) error, target any) error {
+	t := reflect.TypeOf(target)
+	if t == nil || t.Kind() != reflect.Pointer {
+		return fmt.Errorf("DecodeEach: target must be a pointer, not %T", target)
+	}
+	return d.Each(func(doc map[string]interface{}) error {
+		v := reflect.New(t.Elem()).Interface()
+		if dec, ok := v.(DocumentDecoder); ok {
+			if err := dec.DecodeDocument(doc); err != nil {
+				return err
+			}
+			return fn(v)
+		}
+		js, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(js, v); err != nil {
+			return fmt.Errorf("decode %s: %v", js, err)
+		}
+		return fn(v)
+	})
+}
+
+// dumpTable dumps all rows from a table in the database, returning the id
+// of the last one
+func (d *Dumper) dumpTable(table *TableSchema, whereClause string, args []any) (int64, error) {
+	out := d.opts.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	w := NewDocWriter(out)
+	w.rawLen = d.opts.RawLen
+	last := d.opts.AfterID
+	err := d.eachRow(table, whereClause, args, func(id int64, obj map[string]interface{}) error {
+		last = id
+		layout := d.takeLayout(table, obj)
+		if d.opts.Script == nil {
+			return w.WriteLayout(obj, layout)
+		}
+		docs, err := d.opts.Script.Apply(obj)
+		if err != nil {
+			return fmt.Errorf("row %d: %v", id, err)
+		}
+		for _, doc := range docs {
+			if err := w.WriteLayout(doc, layout); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	return last, err
+}
+
+// eachDocument calls fn with every rehydrated row of a table
+func (d *Dumper) eachDocument(table *TableSchema, whereClause string, args []any, fn func(map[string]interface{}) error) error {
+	return d.eachRow(table, whereClause, args, func(id int64, obj map[string]interface{}) error {
+		return fn(obj)
+	})
+}
+
+// eachRow is eachDocument but also passes the row id
+func (d *Dumper) eachRow(table *TableSchema, whereClause string, args []any, fn func(int64, map[string]interface{}) error) error {
+	if pool, ok := d.db.(*sql.DB); ok {
+		conn, err := pinConn(d.ctx, pool)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		pd := *d
+		pd.db = conn
+		return pd.eachRow(table, whereClause, args, fn)
+	}
+	if d.cache == nil {
+		pd := *d
+		pd.cache = &dumpCache{symbols: map[string]map[int64]interface{}{}, refs: map[*TableSchema]tableRefs{}}
+		return pd.eachRow(table, whereClause, args, fn)
+	}
+	if d.opts.Explain != nil {
+		pd := *d
+		pd.db = newQueryExplainer(d.db, d.opts.Explain)
+		pd.opts.Explain = nil
+		return pd.eachRow(table, whereClause, args, fn)
+	}
+	db := d.db
+	query, args := d.selectQuery(table, whereClause, args)
+	start := time.Now()
 	rows, err := db.Query(query, args...)
 	if err != nil {
 		return err
 	}
+	tableQueries.observe(table.Name, start)
 	defer rows.Close()
 	columns, err := rows.Columns()
 	if err != nil {
 		return err
 	}
+	// Scanned values are copied into the documents, so one set serves all rows
+	valPtrs := make([]interface{}, len(columns))
+	vals := make([]interface{}, len(columns))
+	for i := range columns {
+		valPtrs[i] = &vals[i]
+	}
 	for rows.Next() {
-		valPtrs := make([]interface{}, len(columns))
-		vals := make([]interface{}, len(columns))
-		for i := range columns {
-			valPtrs[i] = &vals[i]
-		}
+		clear(vals)
 		if err := rows.Scan(valPtrs...); err != nil {
 			return err
 		}
-		obj, err := dumpRowValueSet(db, dbs, table, columns, vals)
+		var id int64
+		for i, col := range columns {
+			if col == "id" {
+				id = toInt64(vals[i])
+			}
+		}
+		obj, err := d.dumpRowValueSet(table, columns, vals)
 		if err != nil {
 			return err
 		}
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetEscapeHTML(false)
-		_ = enc.Encode(obj)
+		if d.opts.Anonymize != nil {
+			d.opts.Anonymize.Apply(obj)
+		}
+		if d.opts.Filter != nil {
+			// Layout columns are passed on to dumpTable, whatever the filter
+			layout := map[string]interface{}{}
+			for _, col := range []string{keyOrderColumn, numberTextColumn} {
+				if v, ok := obj[col]; ok && d.layoutColumn(table, col) {
+					layout[col] = v
+				}
+			}
+			obj = d.opts.Filter.Apply(obj)
+			maps.Copy(obj, layout)
+		}
+		if err := fn(id, obj); err != nil {
+			return err
+		}
 	}
-	return nil
+	return rows.Err()
+}
+
+// selectQuery builds the SELECT for dumpTable, applying sampling and
+// --head/--tail bounds on top of an optional WHERE clause
+func (d *Dumper) selectQuery(table *TableSchema, whereClause string, args []any) (string, []any) {
+	query := fmt.Sprintf("SELECT * FROM %s", quoteIdent(table.Name))
+	args = args[:len(args):len(args)]
+	var conds []string
+	if whereClause != "" {
+		conds = append(conds, "("+whereClause+")")
+	}
+	if table.softDeletes() && !d.opts.IncludeDeleted {
+		conds = append(conds, deletedAtColumn+" IS NULL")
+	}
+	if d.opts.AfterID > 0 {
+		conds = append(conds, "id > ?")
+		args = append(args, d.opts.AfterID)
+	}
+	if d.opts.Sample > 0 && d.opts.Sample < 1 {
+		// random() is uniform over int64; masking the sign bit keeps it non-negative
+		conds = append(conds, "(random() & 9223372036854775807) < ?")
+		args = append(args, int64(d.opts.Sample*math.MaxInt64))
+	}
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	order, reverse := "id", "id DESC"
+	if col := d.opts.OrderBy; col != "" && col != "id" {
+		order, reverse = quoteIdent(col)+", id", quoteIdent(col)+" DESC, id DESC"
+		if table.View {
+			order, reverse = quoteIdent(col), quoteIdent(col)+" DESC"
+		}
+	}
+	switch {
+	case d.opts.Head > 0 && table.View && d.opts.OrderBy == "":
+		query += " LIMIT ?"
+		args = append(args, d.opts.Head)
+	case d.opts.Head > 0:
+		query += " ORDER BY " + order + " LIMIT ?"
+		args = append(args, d.opts.Head)
+	case d.opts.Tail > 0:
+		query = fmt.Sprintf("SELECT * FROM (%s ORDER BY %s LIMIT ?) AS tail ORDER BY %s", query, reverse, order)
+		args = append(args, d.opts.Tail)
+	case d.opts.OrderBy != "", d.opts.AsOf != "" && !table.View:
+		// The versions of asof follow the current rows
+		query += " ORDER BY " + order
+	}
+	return query, args
 }
 
 // dumpRowByID dumps a single row from a table in the database
-func dumpRowByID(db *sql.DB, dbs *DatabaseSchema, table *TableSchema, id int64) (map[string]interface{}, error) {
-	query := fmt.Sprintf("SELECT * FROM %s WHERE id = ?", table.Name)
-	row := db.QueryRow(query, id)
-	cols, err := db.Query(fmt.Sprintf("SELECT * FROM %s LIMIT 1", table.Name))
+func (d *Dumper) dumpRowByID(table *TableSchema, id int64) (map[string]interface{}, error) {
+	return d.dumpRowWhere(table, "id = ?", id)
+}
+
+// dumpRowWhere dumps the first row of a table matching a WHERE condition
+func (d *Dumper) dumpRowWhere(table *TableSchema, where string, args ...any) (map[string]interface{}, error) {
+	db := d.db
+	start := time.Now()
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s", quoteIdent(table.Name), where)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
 	if err != nil {
 		return nil, err
 	}
-	defer cols.Close()
-	columns, _ := cols.Columns()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
 
 	vals := make([]interface{}, len(columns))
 	valPtrs := make([]interface{}, len(columns))
@@ -86,25 +696,21 @@ func dumpRowByID(db *sql.DB, dbs *DatabaseSchema, table *TableSchema, id int64)
 		valPtrs[i] = &vals[i]
 	}
 
-	err = row.Scan(valPtrs...)
+	err = rows.Scan(valPtrs...)
 	if err != nil {
 		return nil, err
 	}
-	return dumpRowValueSet(db, dbs, table, columns, vals)
+	rows.Close()
+	tableQueries.observe(table.Name, start)
+	return d.dumpRowValueSet(table, columns, vals)
 }
 
 // dumpRowValueSet processes a row's values and returns a map representation
-func dumpRowValueSet(db *sql.DB, dbs *DatabaseSchema, table *TableSchema, columns []string, vals []interface{}) (map[string]interface{}, error) {
-	obj := map[string]interface{}{}
-	fkFields := map[string]string{}
-	symbolFields := map[string]string{}
-	for col, ref := range table.FKs {
-		if strings.HasSuffix(col, "_symbol") {
-			symbolFields[col] = ref
-		} else if strings.HasSuffix(col, "_id") {
-			fkFields[col] = ref
-		}
-	}
+func (d *Dumper) dumpRowValueSet(table *TableSchema, columns []string, vals []interface{}) (map[string]interface{}, error) {
+	dbs := d.dbs
+	obj := make(map[string]interface{}, len(columns))
+	refs := d.refs(table)
+	fkFields, symbolFields := refs.objects, refs.symbols
 
 	for i, col := range columns {
 		if vals[i] == nil {
@@ -112,57 +718,98 @@ func dumpRowValueSet(db *sql.DB, dbs *DatabaseSchema, table *TableSchema, column
 		}
 		val := vals[i]
 
-		if col == "id" {
+		if _, isLink := table.Links[col]; col == "id" || isLink || table.Computed[col] != nil {
 			continue
 		}
-		// SYMBOL
-		if symtable, isSym := symbolFields[col]; isSym {
-			var symId int64
-			switch vv := val.(type) {
-			case int64:
-				symId = vv
-			case int:
-				symId = int64(vv)
-			case []byte:
-				fmt.Sscanf(string(vv), "%d", &symId)
+		if d.layoutColumn(table, col) {
+			if b, ok := val.([]byte); ok {
+				val = string(b)
 			}
-			s, err := getSymbolValue(db, symtable, symId)
+			obj[col] = val
+			continue
+		}
+		if table.Provenance && provenanceColumns[col] || table.Ord && col == ordColumn || table.KeyOrder && col == keyOrderColumn || table.NumberText && col == numberTextColumn || table.Timestamps && timestampColumns[col] || table.History && col == validFromColumn {
+			if d.opts.WithProvenance {
+				if b, ok := val.([]byte); ok {
+					val = string(b)
+				}
+				obj[col] = val
+			}
+			continue
+		}
+		// SYMBOL
+		if field, isSym := symbolFields[col]; isSym {
+			symId := toInt64(val)
+			s, err := d.symbolValue(table.FKs[col], symId)
 			if err == nil {
-				obj[strings.TrimSuffix(col, "_symbol")] = s
+				obj[field] = s
 			}
 			continue
 		}
 		// SUB-TABLE FK
-		if subtbl, isFK := fkFields[col]; isFK {
-			var subid int64
-			switch sv := val.(type) {
-			case int64:
-				subid = sv
-			case int:
-				subid = int64(sv)
-			case []byte:
-				fmt.Sscanf(string(sv), "%d", &subid)
-			}
+		if field, isFK := fkFields[col]; isFK {
+			subid := toInt64(val)
 			if subid == 0 {
 				// Do NOT assign anything if the field was NULL: faithfully omits the field.
 				continue
 			}
-			subTable := dbs.Tables[subtbl]
-			subObj, err := dumpRowByID(db, dbs, subTable, subid)
+			subTable := dbs.Tables[table.FKs[col]]
+			subObj, err := d.dumpRowByID(subTable, subid)
 			if err == nil && subObj != nil && len(subObj) > 0 {
-				obj[strings.TrimSuffix(col, "_id")] = subObj
+				obj[field] = subObj
 			}
 			// else: do not assign (omit). Faithfully omits if missing or could not resolve.
 			continue
 		}
+		if field, ok := fallbackField(table, col); ok {
+			if b, isBytes := val.([]byte); isBytes {
+				val = string(b)
+			}
+			var v interface{}
+			if text, _ := val.(string); decodeJSON([]byte(text), &v) == nil {
+				obj[field] = v
+			}
+			continue
+		}
+		if _, isOffset := timeColumnOf(table, col); isOffset {
+			continue
+		}
+		if table.Fields[col] == TypeUTCTime {
+			var offset interface{}
+			if offCol, ok := timeOffsetColumn(table, col); ok {
+				if j := slices.Index(columns, offCol); j >= 0 {
+					offset = vals[j]
+				}
+			}
+			obj[col] = decodeUTCTime(val, offset, d.opts.NormalizeTime == NormalizeTimeUTC)
+			continue
+		}
+		if table.Fields[col] == TypeGeoJSON || table.Fields[col] == TypeWKB {
+			geom, err := decodeGeometry(val)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", table.Name, col, err)
+			}
+			obj[col] = geom
+			continue
+		}
 		// JSON/TEXT columns that might be arrays/objects
 		if table.Fields[col] == TypeJSON || table.Fields[col] == TypeText {
+			// BLOBs in the form of a reference point into the blob store
+			if ref, isBlob := val.([]byte); isBlob && dbs.Blobs != nil {
+				if _, isRef := blobRef(ref); isRef {
+					text, err := dbs.Blobs.rehydrate(ref)
+					if err != nil {
+						return nil, fmt.Errorf("%s.%s: %v", table.Name, col, err)
+					}
+					val = text
+				}
+			}
 			switch vv := val.(type) {
 			case []byte:
 				text := string(vv)
 				if len(text) > 0 && (text[0] == '[' || text[0] == '{') {
 					var out interface{}
-					if err := json.Unmarshal([]byte(text), &out); err == nil {
+					if err := decodeJSON([]byte(text), &out); err == nil {
 						obj[col] = out
 						continue
 					}
@@ -172,7 +819,7 @@ func dumpRowValueSet(db *sql.DB, dbs *DatabaseSchema, table *TableSchema, column
 				text := vv
 				if len(text) > 0 && (text[0] == '[' || text[0] == '{') {
 					var out interface{}
-					if err := json.Unmarshal([]byte(text), &out); err == nil {
+					if err := decodeJSON([]byte(text), &out); err == nil {
 						obj[col] = out
 						continue
 					}
@@ -185,5 +832,50 @@ func dumpRowValueSet(db *sql.DB, dbs *DatabaseSchema, table *TableSchema, column
 		}
 		obj[col] = val
 	}
-	return obj, nil
-}
\ No newline at end of file
+	// Rows referenced by a composite key are nested in place of the key columns
+	for _, fk := range table.ForeignKeys {
+		keys := map[string]interface{}{}
+		for j, col := range fk.Columns {
+			if obj[col] == nil {
+				break
+			}
+			keys[fk.References[j]] = obj[col]
+		}
+		if len(keys) < len(fk.Columns) {
+			continue
+		}
+		where, args := keyCondition(fk.References, keys)
+		ref, err := d.dumpRowWhere(dbs.Tables[fk.Table], where, args...)
+		if err != nil {
+			continue
+		}
+		for _, col := range fk.Columns {
+			delete(obj, col)
+		}
+		obj[fk.Field] = ref
+	}
+	if d.opts.OmitDefaults {
+		for col, def := range table.Defaults {
+			if isDefault(obj[col], def) {
+				delete(obj, col)
+			}
+		}
+	}
+	return table.documentKeys(obj), nil
+}
+
+// toInt64 converts an id column value as returned by the driver
+func toInt64(val interface{}) int64 {
+	var n int64
+	switch vv := val.(type) {
+	case int64:
+		n = vv
+	case int:
+		n = int64(vv)
+	case []byte:
+		fmt.Sscanf(string(vv), "%d", &n)
+	case string:
+		fmt.Sscanf(vv, "%d", &n)
+	}
+	return n
+}
@@ -0,0 +1,111 @@
+package jsql
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// reAnyDefault matches any DEFAULT clause, such as DEFAULT CURRENT_TIMESTAMP
+var reAnyDefault = regexp.MustCompile(`(?i)\bDEFAULT\b`)
+
+// reDefault matches the DEFAULT clause of a column definition, with a
+// string, number or boolean literal
+var reDefault = regexp.MustCompile(`(?i)\bDEFAULT\s+('(?:[^']|'')*'|[-+]?[\d.]+(?:e[-+]?\d+)?|TRUE|FALSE)`)
+
+// LoadDefaults reads a YAML map of dotted field paths to the value a
+// document lacking the field gets
+func LoadDefaults(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	defaults := map[string]interface{}{}
+	for field, v := range raw {
+		switch vv := v.(type) {
+		case string, float64, bool:
+			defaults[field] = vv
+		case int:
+			defaults[field] = float64(vv) // as decoded from JSON
+		default:
+			return nil, fmt.Errorf("%s: field %s: default must be a string, number or boolean", path, field)
+		}
+	}
+	return defaults, nil
+}
+
+// parseDefault returns the value of the DEFAULT clause in a column
+// definition, if there is one
+func parseDefault(def string) (interface{}, bool) {
+	m := reDefault.FindStringSubmatch(def)
+	if m == nil {
+		return nil, false
+	}
+	lit := m[1]
+	switch {
+	case strings.HasPrefix(lit, "'"):
+		return strings.ReplaceAll(lit[1:len(lit)-1], "''", "'"), true
+	case strings.EqualFold(lit, "TRUE"):
+		return true, true
+	case strings.EqualFold(lit, "FALSE"):
+		return false, true
+	}
+	f, err := strconv.ParseFloat(lit, 64)
+	return f, err == nil
+}
+
+// sqlLiteral formats a default value for a DEFAULT clause
+func sqlLiteral(v interface{}) string {
+	switch vv := v.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(vv, "'", "''") + "'"
+	case bool:
+		return strings.ToUpper(strconv.FormatBool(vv))
+	case float64:
+		return strconv.FormatFloat(vv, 'g', -1, 64)
+	}
+	return "NULL"
+}
+
+// defaultColumns keys defaults by "table.column" and adds the columns the
+// sample lacks to their tables, typed by the default value
+func defaultColumns(schema map[string]*TableSchema, defaults map[string]interface{}) map[string]interface{} {
+	out := map[string]interface{}{}
+	for field, v := range defaults {
+		table, col := profileColumn(field)
+		out[table+"."+col] = v
+		ts := schema[table]
+		if ts == nil || ts.Fields[col] != "" {
+			continue
+		}
+		switch vv := v.(type) {
+		case string:
+			ts.Fields[col] = TypeText
+		case bool:
+			ts.Fields[col] = TypeBool
+		case float64:
+			if vv == float64(int64(vv)) {
+				ts.Fields[col] = TypeInt
+			} else {
+				ts.Fields[col] = TypeReal
+			}
+		}
+	}
+	return out
+}
+
+// isDefault reports whether a dumped column value equals its default
+func isDefault(val, def interface{}) bool {
+	if n, ok := val.(int64); ok {
+		val = float64(n)
+	}
+	return val == def
+}
@@ -0,0 +1,138 @@
+package jsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Denormalize writes the documents of the root table into the table out of
+// the same database, flattened as by FlattenRecord: one row per document,
+// keyed by the id of its root row, with symbols resolved and the fields of
+// nested objects in dotted columns such as "meta.city". Arrays are stored
+// as JSON text. The columns are those of the documents, typed by their
+// values. It returns the number of rows written; an existing table is only
+// overwritten if replace is set.
+func Denormalize(dbPath string, dbs *DatabaseSchema, out string, replace bool) (int64, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if dbs.Tables[out] != nil {
+		return 0, fmt.Errorf("%s is a table of the schema", out)
+	}
+	var exists bool
+	if err := tx.QueryRow("SELECT count(*) > 0 FROM sqlite_master WHERE name = ?", out).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists && !replace {
+		return 0, fmt.Errorf("table %s exists (--replace overwrites it)", out)
+	}
+	if _, err := tx.Exec("DROP TABLE IF EXISTS " + quoteIdent(out)); err != nil {
+		return 0, err
+	}
+
+	// The first pass finds the columns, the second writes the rows
+	d := &Dumper{db: tx, dbs: dbs}
+	root := dbs.RootTable()
+	var cols []string
+	types := map[string]FieldType{}
+	err = d.eachRow(root, "", nil, func(_ int64, obj map[string]interface{}) error {
+		flat := FlattenRecord(obj, FlattenOptions{})
+		for _, k := range sortedKeys(flat) {
+			if k == "id" || flat[k] == nil {
+				continue
+			}
+			typ, seen := types[k]
+			if !seen {
+				cols = append(cols, k)
+			}
+			types[k] = widenFlatType(typ, seen, flatType(flat[k]))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	defs := []string{"id INTEGER PRIMARY KEY"}
+	for _, col := range cols {
+		defs = append(defs, strings.TrimSpace(quoteIdent(col)+" "+string(types[col])))
+	}
+	if _, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (%s)", quoteIdent(out), strings.Join(defs, ", "))); err != nil {
+		return 0, err
+	}
+
+	insert, err := tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?%s)", quoteIdent(out), strings.Join(quoteIdents(append([]string{"id"}, cols...)), ", "), strings.Repeat(", ?", len(cols))))
+	if err != nil {
+		return 0, err
+	}
+	defer insert.Close()
+	var n int64
+	err = d.eachRow(root, "", nil, func(id int64, obj map[string]interface{}) error {
+		flat := FlattenRecord(obj, FlattenOptions{})
+		args := []any{id}
+		for _, col := range cols {
+			v := flat[col]
+			switch v.(type) {
+			case map[string]interface{}, []interface{}:
+				b, err := json.Marshal(v)
+				if err != nil {
+					return fmt.Errorf("row %d: %s: %v", id, col, err)
+				}
+				v = string(b)
+			}
+			args = append(args, v)
+		}
+		if _, err := insert.Exec(args...); err != nil {
+			return fmt.Errorf("row %d: %v", id, err)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := dbs.Audit.record(tx, n); err != nil {
+		return 0, fmt.Errorf("audit: %v", err)
+	}
+	return n, tx.Commit()
+}
+
+// flatType returns the column type of a flattened value
+func flatType(v interface{}) FieldType {
+	switch vv := v.(type) {
+	case bool:
+		return TypeBool
+	case int, int64:
+		return TypeInt
+	case float64:
+		if vv == float64(int64(vv)) {
+			return TypeInt
+		}
+		return TypeReal
+	case string:
+		return TypeText
+	}
+	return TypeJSON
+}
+
+// widenFlatType returns the type of a column holding values of both types:
+// integers widen to reals, other mixes get no declared type so SQLite
+// stores each value as it is
+func widenFlatType(have FieldType, seen bool, typ FieldType) FieldType {
+	switch {
+	case !seen || have == typ:
+		return typ
+	case have == TypeInt && typ == TypeReal, have == TypeReal && typ == TypeInt:
+		return TypeReal
+	}
+	return ""
+}
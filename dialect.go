@@ -0,0 +1,179 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsql writes its SQL once, in SQLite's terms: ? placeholders, the
+// schema's type names and SQLite's INSERT OR IGNORE. A Dialect adapts it to
+// another database engine, so that create-db, load and dump move documents
+// into and out of a PostgreSQL warehouse the way they do a SQLite file. The
+// schema stays jsql's DDL, which the dialect translates when it creates the
+// tables; the database stores the original, as a SQLite file does.
+
+// Dialect is the SQL of a database engine where engines differ
+type Dialect interface {
+	// Name is the engine, as --driver names it
+	Name() string
+	// Open opens the database a file name or connection string names
+	Open(dsn string) (*sql.DB, error)
+	// Placeholder returns the n-th parameter of a statement, from 1
+	Placeholder(n int) string
+	// Returning reports whether INSERT ... RETURNING hands back the ids of
+	// new rows, which LastInsertId does otherwise
+	Returning() bool
+	// ColumnType returns the engine's type of a column of the schema
+	ColumnType(t FieldType) string
+	// CreateDDL returns the statements creating the tables of a schema
+	CreateDDL(ddl string) (string, error)
+	// InsertIgnore returns an INSERT of rows rows into cols of table that
+	// skips those whose unique key is taken
+	InsertIgnore(table string, cols []string, rows int) string
+	// Upsert returns an INSERT of one row into cols of table that replaces
+	// the row with the same key
+	Upsert(table string, cols []string, key string) string
+	// AbortsOnError reports whether a failed statement aborts the whole
+	// transaction, so that documents are loaded in savepoints of their own
+	AbortsOnError() bool
+}
+
+// SQLite is the dialect of SQLite, jsql's own
+var SQLite Dialect = sqliteDialect{}
+
+// DialectNamed returns the dialect --driver names
+func DialectNamed(name string) (Dialect, error) {
+	switch name {
+	case "sqlite", "sqlite3":
+		return SQLite, nil
+	case "postgres", "postgresql":
+		return Postgres, nil
+	}
+	return nil, fmt.Errorf("unknown driver %q: use sqlite or postgres", name)
+}
+
+// dialect returns the dialect of the database the schema is loaded into or
+// dumped from
+func (ds *DatabaseSchema) dialect() Dialect {
+	if ds.Dialect == nil {
+		return SQLite
+	}
+	return ds.Dialect
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string { return "sqlite" }
+
+func (sqliteDialect) Open(dsn string) (*sql.DB, error) { return sql.Open("sqlite3", dsn) }
+
+func (sqliteDialect) Placeholder(int) string { return "?" }
+
+func (sqliteDialect) Returning() bool { return returningSupported }
+
+func (sqliteDialect) ColumnType(t FieldType) string { return string(t) }
+
+func (sqliteDialect) CreateDDL(ddl string) (string, error) { return ddl, nil }
+
+func (sqliteDialect) InsertIgnore(table string, cols []string, rows int) string {
+	return "INSERT OR IGNORE INTO " + valuesClause(table, cols, rows)
+}
+
+func (sqliteDialect) Upsert(table string, cols []string, key string) string {
+	return "INSERT OR REPLACE INTO " + valuesClause(table, cols, 1)
+}
+
+func (sqliteDialect) AbortsOnError() bool { return false }
+
+// valuesClause returns the table, columns and VALUES list of an INSERT of
+// rows rows
+func valuesClause(table string, cols []string, rows int) string {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(cols)), ", ") + ")"
+	return fmt.Sprintf("%s (%s) VALUES %s", quoteIdent(table), strings.Join(quoteIdents(cols), ", "), strings.TrimSuffix(strings.Repeat(row+", ", rows), ", "))
+}
+
+// rebind rewrites the ? and ?NNN placeholders of a query, outside string
+// literals and quoted identifiers, as placeholder makes them
+func rebind(query string, placeholder func(int) string) string {
+	if !strings.Contains(query, "?") {
+		return query
+	}
+	var sb strings.Builder
+	n := 0
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			j := i + 1
+			for j < len(query) && query[j] >= '0' && query[j] <= '9' {
+				j++
+			}
+			if j > i+1 {
+				num, _ := strconv.Atoi(query[i+1 : j])
+				sb.WriteString(placeholder(num))
+				i = j - 1
+			} else {
+				n++
+				sb.WriteString(placeholder(n))
+			}
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// CreateTables creates the tables of ddl, as translated by d, in the
+// database dsn names and stores ddl as its schema. With replace, the
+// schema's tables are dropped first, all in a transaction that ctx can
+// cancel. For SQLite files, CreateDatabase replaces the whole file instead.
+func CreateTables(ctx context.Context, d Dialect, dsn, ddl string, replace bool) error {
+	create, err := d.CreateDDL(ddl)
+	if err != nil {
+		return err
+	}
+	db, err := d.Open(dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if replace {
+		ds := ParseDDL(ddl)
+		for i := len(ds.TableOrder) - 1; i >= 0; i-- {
+			if _, err := tx.Exec("DROP TABLE IF EXISTS " + quoteIdent(ds.TableOrder[i])); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(create); err != nil {
+		return err
+	}
+	if err := storeSchemaIn(d, tx, ddl); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DatabaseName names the database of a command in messages, leaving out
+// the credentials a connection string may hold
+func DatabaseName(d Dialect, dbFile string) string {
+	if d == SQLite {
+		return dbFile
+	}
+	return "the " + d.Name() + " database"
+}
@@ -0,0 +1,236 @@
+package jsql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PatchOp is a single RFC 6902 JSON Patch operation
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// MarshalJSON always includes value for operations that require one, even
+// when it is null
+func (op PatchOp) MarshalJSON() ([]byte, error) {
+	type plain PatchOp
+	if op.Op != "add" && op.Op != "replace" && op.Op != "test" {
+		return json.Marshal(plain(op))
+	}
+	return json.Marshal(struct {
+		plain
+		Value interface{} `json:"value"`
+	}{plain(op), op.Value})
+}
+
+// DiffEntry is one line of the diff stream: a document added, removed or
+// changed between the two sides, identified by its key
+type DiffEntry struct {
+	Op    string      `json:"op"` // add, remove or change
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value,omitempty"` // add: the new document
+	Patch []PatchOp   `json:"patch,omitempty"` // change: turns the old document into the new one
+}
+
+// pointerEscape escapes a key for use as a JSON Pointer segment (RFC 6901)
+func pointerEscape(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+// DiffDocuments returns the patch that turns a into b. Objects are compared
+// key by key; arrays and scalars that differ are replaced whole.
+func DiffDocuments(a, b interface{}, path string) []PatchOp {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if reflect.DeepEqual(a, b) {
+			return nil
+		}
+		return []PatchOp{{Op: "replace", Path: path, Value: b}}
+	}
+	keys := make([]string, 0, len(am)+len(bm))
+	for k := range am {
+		keys = append(keys, k)
+	}
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var ops []PatchOp
+	for _, k := range keys {
+		p := path + "/" + pointerEscape(k)
+		av, inA := am[k]
+		bv, inB := bm[k]
+		switch {
+		case !inB:
+			ops = append(ops, PatchOp{Op: "remove", Path: p})
+		case !inA:
+			ops = append(ops, PatchOp{Op: "add", Path: p, Value: bv})
+		default:
+			ops = append(ops, DiffDocuments(av, bv, p)...)
+		}
+	}
+	return ops
+}
+
+// lookupPath returns the value at a dotted path such as meta.city
+func lookupPath(obj map[string]interface{}, path string) (interface{}, bool) {
+	var cur interface{} = obj
+	for _, seg := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if cur, ok = m[seg]; !ok {
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+// isSQLite reports whether path is a SQLite database rather than a dump
+func isSQLite(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header, []byte("SQLite format 3\x00"))
+}
+
+// eachSourceDocument calls fn for every document of a database (rehydrated
+// with dbs) or of a line-delimited dump file, reporting the lines skipped
+// on log
+func eachSourceDocument(path string, dbs *DatabaseSchema, log io.Writer, fn func(map[string]interface{}) error) error {
+	if isSQLite(path) {
+		if dbs == nil {
+			return fmt.Errorf("%s is a database: --schema is required", path)
+		}
+		db, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		d := &Dumper{ctx: context.Background(), db: db, dbs: dbs}
+		return d.eachDocument(dbs.RootTable(), "", nil, func(obj map[string]interface{}) error {
+			// Database values (int64, ...) must compare equal to the same
+			// values read from a dump
+			return fn(normalizeDocument(obj))
+		})
+	}
+	in, err := openInput(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return eachLine(in, func(line []byte, lineNum int, offset int64) error {
+		var obj map[string]interface{}
+		if err := decodeJSON(line, &obj); err != nil {
+			logf(log, "%s: skip JSON line %d: %v\n", path, lineNum, err)
+			return nil
+		}
+		return fn(obj)
+	}, func(lineNum int, offset int64) {
+		logf(log, "%s: skip JSON line %d (byte offset %d): invalid JSON\n", path, lineNum, offset)
+	})
+}
+
+// keyOf returns the canonical string form of a document's key
+func keyOf(obj map[string]interface{}, key string) (string, interface{}, bool) {
+	v, ok := lookupPath(obj, key)
+	if !ok || v == nil {
+		return "", nil, false
+	}
+	if f, isNum := v.(float64); isNum {
+		return strconv.FormatFloat(f, 'g', -1, 64), v, true
+	}
+	js, _ := json.Marshal(v)
+	return string(js), v, true
+}
+
+// DiffSources compares the documents of a and b keyed by the field key and
+// writes one DiffEntry per added, removed or changed document to w.
+// Documents only in a are reported after the others, ordered by key.
+// Documents skipped, and keys found twice, are reported on log, which may be
+// nil.
+func DiffSources(w, log io.Writer, a string, dbsA *DatabaseSchema, b string, dbsB *DatabaseSchema, key string) (changes int, err error) {
+	old := map[string]map[string]interface{}{}
+	oldKeys := map[string]interface{}{}
+	err = eachSourceDocument(a, dbsA, log, func(obj map[string]interface{}) error {
+		k, raw, ok := keyOf(obj, key)
+		if !ok {
+			logf(log, "%s: document without %s skipped\n", a, key)
+			return nil
+		}
+		if _, dup := old[k]; dup {
+			logf(log, "%s: duplicate key %s, keeping the last document\n", a, k)
+		}
+		old[k] = obj
+		oldKeys[k] = raw
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	seen := map[string]bool{}
+	err = eachSourceDocument(b, dbsB, log, func(obj map[string]interface{}) error {
+		k, raw, ok := keyOf(obj, key)
+		if !ok {
+			logf(log, "%s: document without %s skipped\n", b, key)
+			return nil
+		}
+		if seen[k] {
+			logf(log, "%s: duplicate key %s, comparing each occurrence\n", b, k)
+		}
+		seen[k] = true
+		prev, existed := old[k]
+		if !existed {
+			changes++
+			return enc.Encode(DiffEntry{Op: "add", Key: raw, Value: obj})
+		}
+		if patch := DiffDocuments(prev, obj, ""); len(patch) > 0 {
+			changes++
+			return enc.Encode(DiffEntry{Op: "change", Key: raw, Patch: patch})
+		}
+		return nil
+	})
+	if err != nil {
+		return changes, err
+	}
+
+	var removed []string
+	for k := range old {
+		if !seen[k] {
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	for _, k := range removed {
+		changes++
+		if err := enc.Encode(DiffEntry{Op: "remove", Key: oldKeys[k]}); err != nil {
+			return changes, err
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,207 @@
+package jsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/itchyny/gojq"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// DumpScript reshapes every document dump writes, as the last step before
+// output, so simple reshaping of an export needs no second process. It
+// returns the documents written in its place: none drops it.
+type DumpScript interface {
+	Apply(doc map[string]interface{}) ([]map[string]interface{}, error)
+}
+
+// jqScript runs a jq program, every object it outputs being written
+type jqScript struct {
+	code *gojq.Code
+}
+
+// NewJQScript compiles a jq program
+func NewJQScript(program string) (DumpScript, error) {
+	q, err := gojq.Parse(program)
+	if err != nil {
+		return nil, err
+	}
+	code, err := gojq.Compile(q)
+	if err != nil {
+		return nil, err
+	}
+	return &jqScript{code: code}, nil
+}
+
+func (s *jqScript) Apply(doc map[string]interface{}) ([]map[string]interface{}, error) {
+	var out []map[string]interface{}
+	iter := s.code.Run(scriptValue(doc))
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			return out, nil
+		}
+		switch v := v.(type) {
+		case error:
+			return nil, fmt.Errorf("jq: %v", v)
+		case map[string]interface{}:
+			out = append(out, v)
+		case nil: // drops the document like empty
+		default:
+			return nil, fmt.Errorf("jq: output %s is not an object", jqText(v))
+		}
+	}
+}
+
+// jqText formats a jq value for an error message
+func jqText(v interface{}) string {
+	s, err := gojq.Marshal(v)
+	if err != nil || len(s) > 80 {
+		return fmt.Sprintf("%.80v", v)
+	}
+	return string(s)
+}
+
+// scriptValue converts a dumped value to the types scripts take: ints
+// rather than int64s, and whatever encoding/json makes of other values,
+// such as blobs, with numbers kept as json.Numbers
+func scriptValue(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case nil, bool, string, int, float64, json.Number:
+		return v
+	case int64:
+		return int(vv)
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(vv))
+		for k, e := range vv {
+			m[k] = scriptValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(vv))
+		for i, e := range vv {
+			a[i] = scriptValue(e)
+		}
+		return a
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var out interface{}
+	if dec.Decode(&out) != nil {
+		return string(js)
+	}
+	return out
+}
+
+// luaScript calls the transform function a Lua script defines with every
+// document as a table, writing the table it returns, or nothing for nil
+type luaScript struct {
+	state *lua.LState
+	fn    lua.LValue
+}
+
+// NewLuaScript runs the script at path, which must define a global
+// function transform(doc)
+func NewLuaScript(path string) (DumpScript, error) {
+	L := lua.NewState()
+	if err := L.DoFile(path); err != nil {
+		L.Close()
+		return nil, err
+	}
+	fn := L.GetGlobal("transform")
+	if fn.Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("%s defines no function transform(doc)", path)
+	}
+	return &luaScript{state: L, fn: fn}, nil
+}
+
+func (s *luaScript) Apply(doc map[string]interface{}) ([]map[string]interface{}, error) {
+	err := s.state.CallByParam(lua.P{Fn: s.fn, NRet: 1, Protect: true}, toLua(s.state, scriptValue(doc)))
+	if err != nil {
+		return nil, err
+	}
+	ret := s.state.Get(-1)
+	s.state.Pop(1)
+	switch ret := ret.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case *lua.LTable:
+		if obj, ok := fromLua(ret).(map[string]interface{}); ok {
+			return []map[string]interface{}{obj}, nil
+		}
+	}
+	return nil, fmt.Errorf("lua: transform returned %s, not a table with string keys", ret.Type())
+}
+
+// toLua converts a document value to Lua. Arrays become tables indexed
+// from 1, and nulls nil, so null fields are absent.
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case int:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case json.Number:
+		f, _ := v.Float64()
+		return lua.LNumber(f)
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for k, e := range v {
+			t.RawSetString(k, toLua(L, e))
+		}
+		return t
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, e := range v {
+			t.Append(toLua(L, e))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value back. A table whose keys are 1 to n is an
+// array, and any other one, the empty table included, an object.
+func fromLua(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LString:
+		return string(v)
+	case lua.LNumber:
+		return float64(v)
+	case *lua.LTable:
+		if n := v.MaxN(); n > 0 && n == v.Len() && countLuaKeys(v) == n {
+			a := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				a = append(a, fromLua(v.RawGetInt(i)))
+			}
+			return a
+		}
+		obj := map[string]interface{}{}
+		v.ForEach(func(k, e lua.LValue) {
+			if k.Type() == lua.LTString || k.Type() == lua.LTNumber {
+				obj[k.String()] = fromLua(e)
+			}
+		})
+		return obj
+	}
+	return nil
+}
+
+// countLuaKeys returns the number of keys of a table
+func countLuaKeys(t *lua.LTable) int {
+	n := 0
+	t.ForEach(func(lua.LValue, lua.LValue) { n++ })
+	return n
+}
@@ -0,0 +1,110 @@
+package jsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// An object with a key twice decodes with encoding/json to the last value,
+// silently dropping the others. Dirty inputs are audited by decoding them
+// token by token instead, which load and import do with --duplicate-keys.
+const (
+	DuplicateKeysLast  = ""      // keep the last value, as encoding/json does
+	DuplicateKeysError = "error" // fail the line
+	DuplicateKeysArray = "array" // keep all values, in order, as an array
+)
+
+// decodeDocument decodes a line of input into obj, handling duplicate keys
+// as ds.DuplicateKeys asks
+func (ds *DatabaseSchema) decodeDocument(line []byte, obj *map[string]interface{}) error {
+	if ds.DuplicateKeys == DuplicateKeysLast {
+		return decodeJSON(line, obj)
+	}
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('{') {
+		return fmt.Errorf("document is not a JSON object")
+	}
+	doc, err := decodeObject(dec, "", ds.DuplicateKeys)
+	if err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after the document")
+	}
+	*obj = doc
+	return nil
+}
+
+// decodeObject decodes the members of an object whose { has been read, at
+// the dotted path prefix
+func decodeObject(dec *json.Decoder, prefix, mode string) (map[string]interface{}, error) {
+	obj := map[string]interface{}{}
+	var repeated map[string]bool // keys whose values were made arrays
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+		v, err := decodeValue(dec, prefix+key+".", mode)
+		if err != nil {
+			return nil, err
+		}
+		prev, dup := obj[key]
+		switch {
+		case !dup:
+			obj[key] = v
+		case mode == DuplicateKeysError:
+			return nil, fmt.Errorf("duplicate key %q", prefix+key)
+		case repeated[key]:
+			obj[key] = append(prev.([]interface{}), v)
+		default:
+			if repeated == nil {
+				repeated = map[string]bool{}
+			}
+			repeated[key] = true
+			obj[key] = []interface{}{prev, v}
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// decodeValue decodes the next value, as decodeJSON decodes it into an
+// interface{}
+func decodeValue(dec *json.Decoder, prefix, mode string) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		return decodeObject(dec, prefix, mode)
+	case json.Delim('['):
+		arr := []interface{}{}
+		for dec.More() {
+			v, err := decodeValue(dec, prefix, mode)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	}
+	if n, ok := tok.(json.Number); ok {
+		return numberValue(n)
+	}
+	return tok, nil
+}
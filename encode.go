@@ -0,0 +1,241 @@
+package jsql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// DocWriter writes documents as JSON lines, byte for byte as a
+// json.Encoder without HTML escaping would. Dumps of tens of millions of
+// rows spend much of their time encoding: documents are appended to one
+// buffer reused from line to line, the decoded JSON types are encoded
+// without reflection, and the lines reach the output in large writes.
+type DocWriter struct {
+	w        *bufio.Writer
+	rawLen   bool // write raw-len frames rather than lines
+	buf      []byte
+	keys     [][]string // reused to sort the keys of objects, by nesting depth
+	layout   docLayout  // of the document being written
+	fallback bytes.Buffer
+	enc      *json.Encoder // of values other than decoded JSON
+}
+
+// maxReusedDocBuffer is the largest buffer kept for the next document, so
+// that one huge document does not hold on to its memory
+const maxReusedDocBuffer = 1 << 20
+
+// NewDocWriter returns a DocWriter writing to w; Flush writes out the last
+// lines
+func NewDocWriter(w io.Writer) *DocWriter {
+	dw := &DocWriter{w: bufio.NewWriterSize(w, 64<<10)}
+	dw.enc = json.NewEncoder(&dw.fallback)
+	dw.enc.SetEscapeHTML(false)
+	return dw
+}
+
+// Write writes a document and a newline, or its raw-len frame
+func (dw *DocWriter) Write(doc map[string]interface{}) error {
+	return dw.WriteLayout(doc, docLayout{})
+}
+
+// docLayout is how a document was formatted when it was loaded, as far as
+// its root row records it
+type docLayout struct {
+	order   map[string]int    // positions of key paths, from _key_order
+	numbers map[string]string // original text of numbers by path, from _number_text
+}
+
+// tracked reports whether the writer needs the paths of values
+func (l docLayout) tracked() bool {
+	return l.order != nil || l.numbers != nil
+}
+
+// WriteLayout writes a document as it was formatted when loaded: the keys
+// whose paths have a recorded order come first, in that order, and the
+// others sorted after them, and numbers with a recorded text that still
+// holds their value are written as that text
+func (dw *DocWriter) WriteLayout(doc map[string]interface{}, layout docLayout) error {
+	dw.layout = layout
+	buf := dw.buf[:0]
+	if dw.rawLen {
+		buf = append(buf, 0, 0, 0, 0)
+	}
+	buf, err := dw.appendValue(buf, doc, 0, "")
+	if err != nil {
+		return err
+	}
+	if dw.rawLen {
+		binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	} else {
+		buf = append(buf, '\n')
+	}
+	if cap(buf) <= maxReusedDocBuffer {
+		dw.buf = buf
+	}
+	_, err = dw.w.Write(buf)
+	return err
+}
+
+// Flush writes out the buffered lines
+func (dw *DocWriter) Flush() error {
+	return dw.w.Flush()
+}
+
+// appendValue appends v, found at path followed by a dot; paths are only
+// tracked when the document has a layout
+func (dw *DocWriter) appendValue(b []byte, v interface{}, depth int, path string) ([]byte, error) {
+	if dw.layout.numbers != nil && path != "" {
+		if text, ok := dw.layout.numbers[path[:len(path)-1]]; ok && numberTextHolds(text, v) {
+			return append(b, text...), nil
+		}
+	}
+	switch vv := v.(type) {
+	case nil:
+		return append(b, "null"...), nil
+	case bool:
+		return strconv.AppendBool(b, vv), nil
+	case string:
+		return appendJSONString(b, vv), nil
+	case int64:
+		return strconv.AppendInt(b, vv, 10), nil
+	case int:
+		return strconv.AppendInt(b, int64(vv), 10), nil
+	case float64:
+		if !math.IsNaN(vv) && !math.IsInf(vv, 0) {
+			return appendJSONFloat(b, vv), nil
+		}
+	case map[string]interface{}:
+		for len(dw.keys) <= depth {
+			dw.keys = append(dw.keys, nil)
+		}
+		keys := dw.keys[depth][:0]
+		for k := range vv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if order := dw.layout.order; order != nil {
+			sort.SliceStable(keys, func(i, j int) bool {
+				ri, oki := order[path+escapeSegment(keys[i], ".")]
+				rj, okj := order[path+escapeSegment(keys[j], ".")]
+				return oki && (!okj || ri < rj)
+			})
+		}
+		dw.keys[depth] = keys
+		b = append(b, '{')
+		for i, k := range keys {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = appendJSONString(b, k)
+			b = append(b, ':')
+			var sub string
+			if dw.layout.tracked() {
+				sub = path + escapeSegment(k, ".") + "."
+			}
+			var err error
+			if b, err = dw.appendValue(b, vv[k], depth+1, sub); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, '}'), nil
+	case []interface{}:
+		b = append(b, '[')
+		for i, elem := range vv {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			var sub string
+			if dw.layout.tracked() {
+				sub = path + strconv.Itoa(i) + "."
+			}
+			var err error
+			if b, err = dw.appendValue(b, elem, depth+1, sub); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, ']'), nil
+	}
+	// Blobs, json.Numbers and whatever else encoding/json makes of them
+	dw.fallback.Reset()
+	if err := dw.enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return append(b, bytes.TrimSuffix(dw.fallback.Bytes(), []byte{'\n'})...), nil
+}
+
+// appendJSONFloat appends a finite float as encoding/json formats it
+func appendJSONFloat(b []byte, f float64) []byte {
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// e-09 becomes e-9
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b
+}
+
+// appendJSONString appends a quoted string as encoding/json does without
+// HTML escaping: invalid UTF-8 becomes U+FFFD, and U+2028 and U+2029 are
+// escaped for JavaScript
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\b':
+				b = append(b, '\\', 'b')
+			case '\f':
+				b = append(b, '\\', 'f')
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+		case r == '\u2028' || r == '\u2029':
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hex[r&0xF])
+		default:
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
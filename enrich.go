@@ -0,0 +1,180 @@
+package jsql
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Enrichment adds columns of an auxiliary table to every document whose
+// Field matches the table's key column. The values are written to the
+// document as <Name>_<column>, next to the original fields.
+type Enrichment struct {
+	Name    string   // table in a database source; prefix of the added fields
+	Source  string   // SQLite database or CSV file with a header row
+	Field   string   // dotted document path of the lookup value
+	Columns []string // columns to copy
+
+	key    string // key column of the source: the last segment of Field
+	rows   map[string][]interface{}
+	stmt   *sql.Stmt
+	cached map[string][]interface{}
+}
+
+var reEnrich = regexp.MustCompile(`^(\w+)=(.+):([\w.]+)->(\w+(?:,\w+)*)$`)
+
+// ParseEnrichment parses NAME=SOURCE:FIELD->COLUMN[,COLUMN...] and opens
+// the source. CSV files are read into memory; databases are queried per
+// distinct value.
+func ParseEnrichment(spec string) (*Enrichment, error) {
+	m := reEnrich.FindStringSubmatch(spec)
+	if m == nil {
+		return nil, fmt.Errorf("%q must be name=source:field->column[,column...]", spec)
+	}
+	e := &Enrichment{Name: m[1], Source: m[2], Field: m[3], Columns: strings.Split(m[4], ",")}
+	e.key = e.Field[strings.LastIndex(e.Field, ".")+1:]
+	if isSQLite(e.Source) {
+		return e, e.openDatabase()
+	}
+	return e, e.readCSV()
+}
+
+func (e *Enrichment) openDatabase() error {
+	db, err := sql.Open("sqlite3", "file:"+e.Source+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	e.stmt, err = db.Prepare(fmt.Sprintf("SELECT %s FROM %s WHERE %s = ? LIMIT 1", strings.Join(e.Columns, ", "), e.Name, e.key))
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("%s: %v", e.Source, err)
+	}
+	e.cached = map[string][]interface{}{}
+	return nil
+}
+
+func (e *Enrichment) readCSV() error {
+	f, err := os.Open(e.Source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("%s: header: %v", e.Source, err)
+	}
+	index := map[string]int{}
+	for i, col := range header {
+		index[strings.TrimSpace(col)] = i
+	}
+	keyAt, ok := index[e.key]
+	if !ok {
+		return fmt.Errorf("%s: no column %s", e.Source, e.key)
+	}
+	var cols []int
+	for _, col := range e.Columns {
+		i, ok := index[col]
+		if !ok {
+			return fmt.Errorf("%s: no column %s", e.Source, col)
+		}
+		cols = append(cols, i)
+	}
+	e.rows = map[string][]interface{}{}
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.Source, err)
+		}
+		if _, dup := e.rows[rec[keyAt]]; dup {
+			continue // first row wins, like the database lookup
+		}
+		vals := make([]interface{}, len(cols))
+		for i, c := range cols {
+			vals[i] = rec[c]
+		}
+		e.rows[rec[keyAt]] = vals
+	}
+}
+
+// lookup returns the columns of the row matching key, or nil
+func (e *Enrichment) lookup(key string) ([]interface{}, error) {
+	if e.stmt == nil {
+		return e.rows[key], nil
+	}
+	if vals, ok := e.cached[key]; ok {
+		return vals, nil
+	}
+	vals := make([]interface{}, len(e.Columns))
+	ptrs := make([]interface{}, len(vals))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	switch err := e.stmt.QueryRow(key).Scan(ptrs...); err {
+	case nil:
+		// Match what the same values parsed from JSON would be
+		for i, v := range vals {
+			switch vv := v.(type) {
+			case []byte:
+				vals[i] = string(vv)
+			case int64:
+				vals[i] = float64(vv)
+			}
+		}
+	case sql.ErrNoRows:
+		vals = nil
+	default:
+		return nil, fmt.Errorf("enrich %s: %v", e.Name, err)
+	}
+	e.cached[key] = vals
+	return vals, nil
+}
+
+// Apply adds the enriched fields to obj. Fields already present are kept,
+// so documents dumped from an enriched database load unchanged.
+func (e *Enrichment) Apply(obj map[string]interface{}) error {
+	v, ok := lookupPath(obj, e.Field)
+	if !ok {
+		return nil
+	}
+	var key string
+	switch vv := v.(type) {
+	case string:
+		key = vv
+	case float64:
+		key = strconv.FormatFloat(vv, 'f', -1, 64)
+	case bool:
+		key = strconv.FormatBool(vv)
+	default:
+		return nil
+	}
+	vals, err := e.lookup(key)
+	if err != nil || vals == nil {
+		return err
+	}
+	for i, col := range e.Columns {
+		field := e.Name + "_" + col
+		if _, exists := obj[field]; !exists && vals[i] != nil {
+			obj[field] = vals[i]
+		}
+	}
+	return nil
+}
+
+// enrichDocument applies every enrichment of dbs to a top-level document
+func enrichDocument(dbs *DatabaseSchema, obj map[string]interface{}) error {
+	for _, e := range dbs.Enrich {
+		if err := e.Apply(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package jsql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// enumFields returns the string fields whose sampled values are few enough,
+// and repeated enough, to be the closed set of values the field takes,
+// such as a status or a level: at most max distinct values, each held by
+// two rows on average.
+func enumFields(uniques map[string]stringSet, rows, max int) map[string][]string {
+	enums := map[string][]string{}
+	for field, values := range uniques {
+		if len(values) == 0 || len(values) > max || 2*len(values) > rows {
+			continue
+		}
+		list := make([]string, 0, len(values))
+		for v := range values {
+			list = append(list, v)
+		}
+		sort.Strings(list)
+		enums[field] = list
+	}
+	return enums
+}
+
+// enumCheck returns the CHECK clause of a column limited to values, which
+// rejects other values at load rather than storing them
+func enumCheck(col string, values []string) string {
+	lits := make([]string, len(values))
+	for i, v := range values {
+		lits[i] = sqlLiteral(v)
+	}
+	return fmt.Sprintf(" CHECK (%s IN (%s))", col, strings.Join(lits, ", "))
+}
@@ -0,0 +1,113 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// queryExplainer writes the plan of each distinct query it is given before
+// running it, with the index that would spare SQLite scanning a table for
+// a lookup: dump --explain shows where an export spends its time.
+type queryExplainer struct {
+	queryer
+	w    io.Writer
+	seen map[string]bool
+}
+
+func newQueryExplainer(db queryer, w io.Writer) *queryExplainer {
+	return &queryExplainer{queryer: db, w: w, seen: map[string]bool{}}
+}
+
+func (e *queryExplainer) Query(query string, args ...any) (*sql.Rows, error) {
+	e.explain(query, args)
+	return e.queryer.Query(query, args...)
+}
+
+func (e *queryExplainer) QueryRow(query string, args ...any) *sql.Row {
+	e.explain(query, args)
+	return e.queryer.QueryRow(query, args...)
+}
+
+// explain writes the plan of query the first time it is run
+func (e *queryExplainer) explain(query string, args []any) {
+	if e.seen[query] {
+		return
+	}
+	e.seen[query] = true
+	fmt.Fprintf(e.w, "-- %s\n", query)
+	plan, err := queryPlan(e.queryer, query, args)
+	if err != nil {
+		fmt.Fprintf(e.w, "cannot explain: %v\n\n", err)
+		return
+	}
+	for _, step := range plan {
+		fmt.Fprintf(e.w, "%s%s\n", strings.Repeat("  ", step.depth), step.detail)
+	}
+	for _, ix := range suggestIndexes(query, plan) {
+		fmt.Fprintf(e.w, "suggested: %s\n", ix)
+	}
+	fmt.Fprintln(e.w)
+}
+
+// planStep is a line of EXPLAIN QUERY PLAN, nested depth steps deep
+type planStep struct {
+	depth  int
+	detail string
+}
+
+// queryPlan returns the steps of the plan of query
+func queryPlan(db queryer, query string, args []any) ([]planStep, error) {
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	depths := map[int64]int{}
+	var plan []planStep
+	for rows.Next() {
+		var id, parent, notused int64
+		var detail string
+		if err := rows.Scan(&id, &parent, &notused, &detail); err != nil {
+			return nil, err
+		}
+		depth := 0
+		if d, ok := depths[parent]; ok {
+			depth = d + 1
+		}
+		depths[id] = depth
+		plan = append(plan, planStep{depth, detail})
+	}
+	return plan, rows.Err()
+}
+
+var (
+	reFromTable = regexp.MustCompile(`^SELECT .* FROM (` + identPattern + `) WHERE (.*)$`)
+	reEqualsArg = regexp.MustCompile(`(?:^|\(|AND )(` + identPattern + `) = \?`)
+	reScanTable = regexp.MustCompile(`^SCAN (\S+)$`)
+)
+
+// suggestIndexes returns the CREATE INDEX statements that would let a
+// lookup of rows by equal columns search the table rather than scan it
+func suggestIndexes(query string, plan []planStep) []string {
+	m := reFromTable.FindStringSubmatch(query)
+	if m == nil {
+		return nil
+	}
+	table := unquoteIdent(m[1])
+	var cols []string
+	for _, c := range reEqualsArg.FindAllStringSubmatch(m[2], -1) {
+		cols = append(cols, unquoteIdent(c[1]))
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+	for _, step := range plan {
+		if s := reScanTable.FindStringSubmatch(step.detail); s != nil && s[1] == table {
+			return []string{fmt.Sprintf("CREATE INDEX %s ON %s (%s);", quoteIdent(table+"_"+strings.Join(cols, "_")), quoteIdent(table), strings.Join(quoteIdents(cols), ", "))}
+		}
+	}
+	return nil
+}
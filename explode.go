@@ -0,0 +1,67 @@
+package jsql
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Exploded arrays are declared in the DDL as a comment directive
+//
+//	-- jsql:explode main.items
+//
+// on the root table. Every document loaded into it becomes one row per
+// element of its items array, so the schema describes the elements.
+var reExplodeDirective = regexp.MustCompile(`^--\s*jsql:explode\s+(\w+)\.(\w+)\s*$`)
+
+var reExplodeField = regexp.MustCompile(`^\w+$`)
+
+// CheckExplodeField rejects fields the explode directive cannot name
+func CheckExplodeField(field string) error {
+	if field != "" && !reExplodeField.MatchString(field) {
+		return fmt.Errorf("--explode %q must be a top-level field name", field)
+	}
+	return nil
+}
+
+// ExplodeRecord returns one document per element of the array in field,
+// each holding the element's fields and a copy of the scalar fields of obj.
+// An element that is not an object is kept under field, and a scalar field
+// of obj that the element also has is copied as parent_<name>. A document
+// without the array is returned as it is; an empty array yields the scalar
+// fields alone.
+func ExplodeRecord(obj map[string]interface{}, field string) []map[string]interface{} {
+	arr, ok := obj[field].([]interface{})
+	if field == "" || !ok {
+		return []map[string]interface{}{obj}
+	}
+	scalars := map[string]interface{}{}
+	for k, v := range obj {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+		default:
+			scalars[k] = v
+		}
+	}
+	if len(arr) == 0 {
+		return []map[string]interface{}{scalars}
+	}
+	docs := make([]map[string]interface{}, len(arr))
+	for i, elem := range arr {
+		doc := map[string]interface{}{}
+		if fields, ok := elem.(map[string]interface{}); ok {
+			for k, v := range fields {
+				doc[k] = v
+			}
+		} else {
+			doc[field] = elem
+		}
+		for k, v := range scalars {
+			if _, taken := doc[k]; taken {
+				k = "parent_" + k
+			}
+			doc[k] = v
+		}
+		docs[i] = doc
+	}
+	return docs
+}
@@ -0,0 +1,90 @@
+package jsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// With --fallback-json, a value that does not fit its column (an object
+// field holding a string, a STRICT column refusing the type) is stored as
+// JSON text in a <field>_fallback column instead of failing or dropping the row.
+// The column is added with ALTER TABLE the first time it is needed, and the
+// statement is recorded in the database's stored schema with the directive
+// marking the column as the field's fallback
+//
+//	-- jsql:fallback main.owner
+//
+// dump restores the field from it. Other columns named <field>_fallback are
+// the documents' own.
+var reFallbackDirective = regexp.MustCompile(`^--\s*jsql:fallback\s+(\w+)\.(\w+)\s*$`)
+
+// reAlterAdd matches the ALTER TABLE statements recorded in the DDL
+var reAlterAdd = regexp.MustCompile(`(?i)^ALTER\s+TABLE\s+` + qualifiedIdentPattern + `\s+ADD\s+COLUMN\s+(` + identPattern + `)\s+(\w+)`)
+
+// reStrictMismatch matches SQLite's error for a STRICT table refusing a value
+var reStrictMismatch = regexp.MustCompile(`cannot store \w+ value in \w+ column \w+\.(\w+)`)
+
+// fallbackColumn returns the column holding the downgraded values of field
+func fallbackColumn(field string) string {
+	return field + "_fallback"
+}
+
+// fallbackField returns the document field a fallback column belongs to
+func fallbackField(table *TableSchema, col string) (string, bool) {
+	field, ok := table.Fallbacks[col]
+	return field, ok
+}
+
+// downgrade records that a value of field could not be stored in its column,
+// adding the fallback column if the table lacks it
+func (ds *DatabaseSchema) downgrade(tx *sql.Tx, table *TableSchema, field string) error {
+	col := fallbackColumn(field)
+	if _, ok := table.Fallbacks[col]; !ok {
+		if table.Fields[col] != "" {
+			return fmt.Errorf("fallback %s.%s: column %s holds a field of the documents", table.Name, field, col)
+		}
+		// TEXT rather than JSON, which STRICT tables do not accept
+		stmt := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s TEXT;", quoteIdent(table.Name), quoteIdent(col))
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("fallback %s.%s: %v", table.Name, field, err)
+		}
+		if err := appendStoredSchema(tx, fmt.Sprintf("%s\n\n-- jsql:fallback %s.%s", stmt, table.Name, field)); err != nil {
+			return fmt.Errorf("fallback %s.%s: %v", table.Name, field, err)
+		}
+		table.Fields[col] = TypeText
+		if table.Fallbacks == nil {
+			table.Fallbacks = map[string]string{}
+		}
+		table.Fallbacks[col] = field
+		ds.Altered = append(ds.Altered, stmt)
+	}
+	if ds.Downgrades == nil {
+		ds.Downgrades = map[string]int64{}
+	}
+	ds.Downgrades[table.Name+"."+field]++
+	return nil
+}
+
+// fallbackValue encodes a downgraded value for its fallback column
+func fallbackValue(v interface{}) string {
+	js, _ := json.Marshal(v)
+	return string(js)
+}
+
+// printDowngrades reports the fields stored in fallback columns
+func (ds *DatabaseSchema) printDowngrades() {
+	fields := make([]string, 0, len(ds.Downgrades))
+	for f := range ds.Downgrades {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		table, field, _ := strings.Cut(f, ".")
+		logf(ds.Log, "%s: %d values stored as JSON in %s.%s\n", f, ds.Downgrades[f], table, fallbackColumn(field))
+	}
+	ds.Downgrades = nil
+}
@@ -0,0 +1,65 @@
+package jsql
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// On Windows a file cannot be removed or replaced while any process has it
+// open, and virus scanners and indexers briefly open files just written.
+// Files are therefore removed and renamed through these helpers, which retry
+// for a moment while the file is locked. Elsewhere they do not retry.
+
+// lockRetries bounds how long a locked file is waited for, doubling the
+// pause from 10ms each time (about 2.5s in all)
+const lockRetries = 8
+
+// retryLocked runs op until it succeeds, fails for another reason than a
+// locked file, or the retries run out
+func retryLocked(op func() error) error {
+	pause := 10 * time.Millisecond
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || i == lockRetries || !isLockedErr(err) {
+			return err
+		}
+		time.Sleep(pause)
+		pause *= 2
+	}
+}
+
+// replaceFile renames src to dst, replacing dst if it exists
+func replaceFile(src, dst string) error {
+	return retryLocked(func() error { return os.Rename(src, dst) })
+}
+
+// removeFile removes path, which need not exist
+func removeFile(path string) error {
+	err := retryLocked(func() error { return os.Remove(path) })
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// removeDatabase removes an SQLite database along with the journal and WAL
+// files SQLite keeps next to it, which would otherwise be applied to a new
+// database of the same name
+func removeDatabase(dbPath string) error {
+	if err := removeFile(dbPath); err != nil {
+		return err
+	}
+	return removeJournals(dbPath)
+}
+
+// removeJournals removes the journal and WAL files of a database
+func removeJournals(dbPath string) error {
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := removeFile(dbPath + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
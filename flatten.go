@@ -0,0 +1,162 @@
+package jsql
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FlattenOptions controls how nested keys are joined
+type FlattenOptions struct {
+	Sep         string // separator between path segments (default ".")
+	IndexArrays bool   // flatten array elements to key.0, key.1, ... instead of keeping arrays whole
+}
+
+func (o FlattenOptions) sep() string {
+	if o.Sep == "" {
+		return "."
+	}
+	return o.Sep
+}
+
+// escapeSegment protects separators and backslashes inside a key
+func escapeSegment(key, sep string) string {
+	key = strings.ReplaceAll(key, `\`, `\\`)
+	return strings.ReplaceAll(key, sep, `\`+sep)
+}
+
+// splitPath splits a flattened key into its unescaped segments
+func splitPath(key, sep string) []string {
+	var parts []string
+	var cur strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch {
+		case key[i] == '\\' && i+1 < len(key):
+			i++
+			cur.WriteByte(key[i])
+		case strings.HasPrefix(key[i:], sep):
+			parts = append(parts, cur.String())
+			cur.Reset()
+			i += len(sep) - 1
+		default:
+			cur.WriteByte(key[i])
+		}
+	}
+	return append(parts, cur.String())
+}
+
+// FlattenRecord turns nested objects into dotted keys. As in the analyzer,
+// objects are descended into while arrays are treated as single values
+// unless IndexArrays is set. Empty objects are kept as values so that
+// UnflattenRecord restores the original document.
+func FlattenRecord(obj map[string]interface{}, opts FlattenOptions) map[string]interface{} {
+	out := map[string]interface{}{}
+	walkDocument(obj, opts.IndexArrays, func(path []string, v interface{}) {
+		segs := make([]string, len(path))
+		for i, seg := range path {
+			segs[i] = escapeSegment(seg, opts.sep())
+		}
+		out[strings.Join(segs, opts.sep())] = v
+	})
+	return out
+}
+
+// UnflattenRecord rebuilds nested objects from dotted keys. With
+// IndexArrays, objects whose keys are exactly 0..n-1 become arrays.
+func UnflattenRecord(flat map[string]interface{}, opts FlattenOptions) (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	keys := make([]string, 0, len(flat))
+	for k := range flat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		path := splitPath(key, opts.sep())
+		curr := root
+		for _, seg := range path[:len(path)-1] {
+			next, ok := curr[seg].(map[string]interface{})
+			if !ok {
+				if _, exists := curr[seg]; exists {
+					return nil, fmt.Errorf("key %q conflicts with a value at %q", key, seg)
+				}
+				next = map[string]interface{}{}
+				curr[seg] = next
+			}
+			curr = next
+		}
+		curr[path[len(path)-1]] = flat[key]
+	}
+	if opts.IndexArrays {
+		// The document stays an object, even if its keys are 0..n-1
+		for k, sub := range root {
+			root[k] = restoreArrays(sub)
+		}
+	}
+	return root, nil
+}
+
+// restoreArrays converts objects keyed 0..n-1 back into arrays
+func restoreArrays(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	for k, sub := range m {
+		m[k] = restoreArrays(sub)
+	}
+	if len(m) == 0 {
+		return m
+	}
+	arr := make([]interface{}, len(m))
+	for k, sub := range m {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(m) || strconv.Itoa(i) != k {
+			return m
+		}
+		arr[i] = sub
+	}
+	return arr
+}
+
+// TransformLines applies fn to every document of input and writes the
+// documents it returns to w. The lines skipped are reported on log, which
+// may be nil.
+func TransformLines(w, log io.Writer, input string, fn func(map[string]interface{}) ([]map[string]interface{}, error)) error {
+	in, err := openInput(input)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	err = eachLine(in, func(line []byte, lineNum int, offset int64) error {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(line, &obj); err != nil {
+			logf(log, "skip JSON line %d: %v\n", lineNum, err)
+			return nil
+		}
+		docs, err := fn(obj)
+		if err != nil {
+			logf(log, "skip line %d: %v\n", lineNum, err)
+			return nil
+		}
+		for _, out := range docs {
+			if err := enc.Encode(out); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(lineNum int, offset int64) {
+		logf(log, "skip JSON line %d (byte offset %d): invalid JSON\n", lineNum, offset)
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,74 @@
+package jsql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Documents piped from one jsql to another can be framed rather than
+// delimited by newlines. In the raw-len format each document is a 4-byte
+// big-endian length followed by that many bytes of JSON, so no reader has
+// to look for the end of a document inside it: dump --format raw-len
+// writes it and load --format raw-len reads it.
+
+// maxFrameSize bounds the length of a frame, so that input that is not
+// framed fails rather than being read as one huge document
+const maxFrameSize = 1 << 30
+
+// RawLenSource reads documents from a file of raw-len frames
+type RawLenSource struct {
+	Path string
+	Log  io.Writer // receives the frames skipped; nil discards them
+}
+
+func (r *RawLenSource) String() string {
+	return r.Path
+}
+
+// Export writes each frame as a JSON line. Frames that do not hold JSON are
+// reported and skipped, keeping the line numbers of the others.
+func (r *RawLenSource) Export(w io.Writer, limit int) error {
+	in, err := openInput(r.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	br := bufio.NewReaderSize(in, 64<<10)
+	bw := bufio.NewWriter(w)
+	var header [4]byte
+	var frame []byte
+	var line bytes.Buffer
+	for n := 1; limit <= 0 || n <= limit; n++ {
+		if _, err := io.ReadFull(br, header[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: frame %d: %v", r.Path, n, err)
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxFrameSize {
+			return fmt.Errorf("%s: frame %d: length %d exceeds %d bytes; is the input raw-len framed?", r.Path, n, size, maxFrameSize)
+		}
+		if cap(frame) < int(size) {
+			frame = make([]byte, size)
+		}
+		frame = frame[:size]
+		if _, err := io.ReadFull(br, frame); err != nil {
+			return fmt.Errorf("%s: frame %d: %v", r.Path, n, err)
+		}
+		line.Reset()
+		if err := json.Compact(&line, frame); err != nil {
+			logf(r.Log, "skip raw-len frame %d: %v\n", n, err)
+			metrics.parseErrors.Add(1)
+			line.Reset()
+		}
+		line.WriteByte('\n')
+		if _, err := bw.Write(line.Bytes()); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,383 @@
+package jsql
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// GeoJSON geometries are stored in a single column instead of a sub-table.
+// GEOJSON columns hold the canonical (key-sorted) JSON text, WKB columns
+// hold ISO well-known binary that SpatiaLite and GDAL read directly.
+// Geometries WKB cannot represent exactly (bbox or other foreign members,
+// mixed dimensions) and non-geometry values fall back to JSON text in either
+// column; the dumper tells the two apart by the stored type.
+
+// wkbCodes maps GeoJSON geometry types to their WKB type codes
+var wkbCodes = map[string]uint32{
+	"Point": 1, "LineString": 2, "Polygon": 3,
+	"MultiPoint": 4, "MultiLineString": 5, "MultiPolygon": 6,
+	"GeometryCollection": 7,
+}
+
+// spatialiteDriver names the driver loading SpatiaLite, registered on first
+// use so importing the package leaves the global driver list alone
+const spatialiteDriver = "sqlite3_spatialite"
+
+var registerSpatialite sync.Once
+
+// SpatialiteAvailable reports whether the SpatiaLite extension can be loaded
+func SpatialiteAvailable() bool {
+	registerSpatialite.Do(func() {
+		sql.Register(spatialiteDriver, &sqlite3.SQLiteDriver{Extensions: []string{"mod_spatialite"}})
+	})
+	db, err := sql.Open(spatialiteDriver, ":memory:")
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	return db.Ping() == nil
+}
+
+// isGeometry reports whether v is a GeoJSON geometry object
+func isGeometry(v interface{}) bool {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	typ, _ := m["type"].(string)
+	if _, known := wkbCodes[typ]; !known {
+		return false
+	}
+	if typ == "GeometryCollection" {
+		geoms, ok := m["geometries"].([]interface{})
+		if !ok {
+			return false
+		}
+		for _, g := range geoms {
+			if !isGeometry(g) {
+				return false
+			}
+		}
+		return true
+	}
+	_, ok = m["coordinates"].([]interface{})
+	return ok
+}
+
+// geometryValue returns what the loader stores for val in a geometry column
+func geometryValue(val interface{}, typ FieldType) interface{} {
+	if typ == TypeWKB {
+		if wkb, err := encodeWKB(val); err == nil {
+			return wkb
+		}
+	}
+	js, _ := json.Marshal(val)
+	return string(js)
+}
+
+// decodeGeometry turns a stored geometry column value back into GeoJSON
+func decodeGeometry(val interface{}) (interface{}, error) {
+	var out interface{}
+	switch vv := val.(type) {
+	case []byte:
+		if len(vv) > 0 && (vv[0] == 0 || vv[0] == 1) {
+			return decodeWKB(vv)
+		}
+		return out, json.Unmarshal(vv, &out)
+	case string:
+		return out, json.Unmarshal([]byte(vv), &out)
+	}
+	return val, nil
+}
+
+// geometryBounds returns the bounding box of a geometry's positions
+func geometryBounds(v interface{}) (minX, minY, maxX, maxY float64, ok bool) {
+	minX, minY = math.Inf(1), math.Inf(1)
+	maxX, maxY = math.Inf(-1), math.Inf(-1)
+	var walk func(interface{})
+	walk = func(v interface{}) {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			if geoms, isColl := vv["geometries"].([]interface{}); isColl {
+				for _, g := range geoms {
+					walk(g)
+				}
+			} else {
+				walk(vv["coordinates"])
+			}
+		case []interface{}:
+			if len(vv) >= 2 {
+				x, xok := vv[0].(float64)
+				y, yok := vv[1].(float64)
+				if xok && yok {
+					minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+					minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+					ok = true
+					return
+				}
+			}
+			for _, e := range vv {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	return
+}
+
+// encodeWKB encodes a GeoJSON geometry as little-endian ISO WKB
+func encodeWKB(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeWKB(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeWKB(buf *bytes.Buffer, v interface{}) error {
+	if !isGeometry(v) {
+		return fmt.Errorf("not a GeoJSON geometry")
+	}
+	m := v.(map[string]interface{})
+	typ := m["type"].(string)
+	if typ == "GeometryCollection" {
+		if len(m) != 2 {
+			return fmt.Errorf("geometry has members other than type and geometries")
+		}
+		geoms := m["geometries"].([]interface{})
+		writeHeader(buf, wkbCodes[typ], 2)
+		binary.Write(buf, binary.LittleEndian, uint32(len(geoms)))
+		for _, g := range geoms {
+			if err := writeWKB(buf, g); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(m) != 2 {
+		return fmt.Errorf("geometry has members other than type and coordinates")
+	}
+	coords := m["coordinates"].([]interface{})
+	dims := positionDims(coords)
+	if dims != 2 && dims != 3 {
+		return fmt.Errorf("unsupported coordinate dimension")
+	}
+	writeHeader(buf, wkbCodes[typ], dims)
+	// depth of nesting below the geometry's coordinates array
+	depth := map[string]int{"Point": 0, "LineString": 1, "MultiPoint": 1, "Polygon": 2, "MultiLineString": 2, "MultiPolygon": 3}[typ]
+	switch typ {
+	case "MultiPoint", "MultiLineString", "MultiPolygon":
+		// Multi geometries are a count followed by complete WKB geometries
+		part := map[string]uint32{"MultiPoint": 1, "MultiLineString": 2, "MultiPolygon": 3}[typ]
+		binary.Write(buf, binary.LittleEndian, uint32(len(coords)))
+		for _, c := range coords {
+			writeHeader(buf, part, dims)
+			if err := writeCoords(buf, c, depth-1, dims); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return writeCoords(buf, coords, depth, dims)
+}
+
+// writeHeader writes the byte order and the type code, with Z as +1000
+func writeHeader(buf *bytes.Buffer, code uint32, dims int) {
+	buf.WriteByte(1)
+	if dims == 3 {
+		code += 1000
+	}
+	binary.Write(buf, binary.LittleEndian, code)
+}
+
+// positionDims returns the number of ordinates shared by every position, or
+// 0 when they differ
+func positionDims(v interface{}) int {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return 0
+	}
+	if len(arr) > 0 {
+		if _, isNum := arr[0].(float64); isNum {
+			return len(arr)
+		}
+	}
+	dims := -1
+	for _, e := range arr {
+		d := positionDims(e)
+		if dims != -1 && d != dims {
+			return 0
+		}
+		dims = d
+	}
+	return dims
+}
+
+// writeCoords writes a position (depth 0) or a counted list of depth-1 items
+func writeCoords(buf *bytes.Buffer, v interface{}, depth, dims int) error {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("invalid coordinates")
+	}
+	if depth == 0 {
+		if len(arr) != dims {
+			return fmt.Errorf("invalid position")
+		}
+		for _, c := range arr {
+			f, ok := c.(float64)
+			if !ok {
+				return fmt.Errorf("invalid position")
+			}
+			binary.Write(buf, binary.LittleEndian, f)
+		}
+		return nil
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(len(arr)))
+	for _, e := range arr {
+		if err := writeCoords(buf, e, depth-1, dims); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wkbReader decodes WKB written by encodeWKB or by other tools (ISO or
+// EWKB dimension flags, either byte order)
+type wkbReader struct {
+	data []byte
+	pos  int
+}
+
+var errShortWKB = fmt.Errorf("truncated WKB")
+
+func decodeWKB(data []byte) (map[string]interface{}, error) {
+	r := &wkbReader{data: data}
+	g, err := r.geometry()
+	if err == nil && r.pos != len(data) {
+		err = fmt.Errorf("trailing bytes after WKB geometry")
+	}
+	return g, err
+}
+
+func (r *wkbReader) uint32(order binary.ByteOrder) (uint32, error) {
+	if r.pos+4 > len(r.data) {
+		return 0, errShortWKB
+	}
+	v := order.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *wkbReader) float(order binary.ByteOrder) (float64, error) {
+	if r.pos+8 > len(r.data) {
+		return 0, errShortWKB
+	}
+	v := math.Float64frombits(order.Uint64(r.data[r.pos:]))
+	r.pos += 8
+	return v, nil
+}
+
+func (r *wkbReader) geometry() (map[string]interface{}, error) {
+	if r.pos >= len(r.data) {
+		return nil, errShortWKB
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if r.data[r.pos] == 0 {
+		order = binary.BigEndian
+	}
+	r.pos++
+	code, err := r.uint32(order)
+	if err != nil {
+		return nil, err
+	}
+	dims := 2
+	if code&0x80000000 != 0 {
+		dims++
+	}
+	if code&0x40000000 != 0 {
+		dims++
+	}
+	if code&0x20000000 != 0 {
+		if _, err := r.uint32(order); err != nil { // EWKB SRID
+			return nil, err
+		}
+	}
+	code &= 0x0fffffff
+	dims += []int{0, 1, 1, 2}[code/1000%4]
+	code %= 1000
+
+	var typ string
+	for name, c := range wkbCodes {
+		if c == code {
+			typ = name
+		}
+	}
+	switch typ {
+	case "":
+		return nil, fmt.Errorf("unsupported WKB geometry type %d", code)
+	case "MultiPoint", "MultiLineString", "MultiPolygon", "GeometryCollection":
+		n, err := r.uint32(order)
+		if err != nil {
+			return nil, err
+		}
+		parts := []interface{}{}
+		for i := uint32(0); i < n; i++ {
+			g, err := r.geometry()
+			if err != nil {
+				return nil, err
+			}
+			if typ == "GeometryCollection" {
+				parts = append(parts, g)
+			} else {
+				parts = append(parts, g["coordinates"])
+			}
+		}
+		if typ == "GeometryCollection" {
+			return map[string]interface{}{"type": typ, "geometries": parts}, nil
+		}
+		return map[string]interface{}{"type": typ, "coordinates": parts}, nil
+	}
+	depth := map[string]int{"Point": 0, "LineString": 1, "Polygon": 2}[typ]
+	coords, err := r.coords(order, depth, dims)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"type": typ, "coordinates": coords}, nil
+}
+
+func (r *wkbReader) coords(order binary.ByteOrder, depth, dims int) ([]interface{}, error) {
+	if depth == 0 {
+		pos := make([]interface{}, dims)
+		for i := range pos {
+			f, err := r.float(order)
+			if err != nil {
+				return nil, err
+			}
+			pos[i] = f
+		}
+		return pos, nil
+	}
+	n, err := r.uint32(order)
+	if err != nil {
+		return nil, err
+	}
+	if int(n) > len(r.data)-r.pos {
+		return nil, errShortWKB
+	}
+	out := make([]interface{}, 0, n)
+	for i := uint32(0); i < n; i++ {
+		c, err := r.coords(order, depth-1, dims)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
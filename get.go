@@ -0,0 +1,76 @@
+package jsql
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// get finds documents by a field of the root table, such as name=Alice,
+// without reading the others: the key becomes a condition on the root
+// table's column, or on the id of its symbol, which the symbol table's
+// UNIQUE index looks up, and only the matching rows are rehydrated.
+
+// FieldCondition returns the condition on the rows of root matching the
+// documents whose field holds value, and its arguments. id is the row id.
+func FieldCondition(root *TableSchema, dbs *DatabaseSchema, field, value string) (string, []any, error) {
+	if field == "id" {
+		return "id = ?", []any{SQLArg(value)}, nil
+	}
+	col := field
+	for c, f := range root.Renames {
+		if f == field {
+			col = c
+		}
+	}
+	if typ := root.Fields[col]; typ != "" && root.FKs[col] == "" {
+		return quoteIdent(col) + " = ?", []any{keyValue(typ, value)}, nil
+	}
+	sym := root.Naming.SymbolColumn(col)
+	if table := dbs.Tables[root.FKs[sym]]; table != nil {
+		// Symbols are stored as JSON: value is the text it reads as,
+		// or JSON such as an array
+		typ := table.Fields["value"]
+		args := []any{keyValue(typ, value)}
+		if typ != TypeInt && typ != TypeReal {
+			js, _ := json.Marshal(value)
+			args[0] = string(js)
+			if json.Valid([]byte(value)) {
+				args = append(args, value)
+			}
+		}
+		in := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+		return fmt.Sprintf("%s IN (SELECT id FROM %s WHERE value IN (%s))", quoteIdent(sym), quoteIdent(table.Name), in), args, nil
+	}
+	return "", nil, fmt.Errorf("table %s has no column holding %s", root.Name, field)
+}
+
+// keyValue returns the value of a key as a column of type typ holds it
+func keyValue(typ FieldType, value string) any {
+	switch typ {
+	case TypeInt, TypeReal:
+		return SQLArg(value)
+	case TypeBool:
+		switch strings.ToLower(value) {
+		case "true":
+			return 1
+		case "false":
+			return 0
+		}
+	}
+	return value
+}
+
+// SQLArg returns the value a command-line argument binds to a placeholder:
+// an integer or real if it reads as one, else the text
+func SQLArg(s string) any {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return f
+	}
+	return s
+}
@@ -0,0 +1,1301 @@
+package jsql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The GraphQL endpoint of serve is generated from the DatabaseSchema: one
+// object type per table, object fields following _id foreign keys, symbols
+// resolved to their values and equality filters on scalar columns. Only
+// queries are executed (fields, aliases, arguments, variables, fragments and
+// @skip/@include), along with __schema and __type introspection; GET
+// /graphql also returns the schema in SDL.
+//
+// A query is checked before it runs: its selections may nest
+// maxGraphQLDepth levels deep, and the rows it could resolve, estimated from
+// the limits of its list fields, may number maxGraphQLRows. The rows the
+// object fields of a list reference are read with one query per field and
+// level, not one per row.
+
+// gqlName matches valid GraphQL names
+var gqlName = regexp.MustCompile(`^[_A-Za-z][_0-9A-Za-z]*$`)
+
+// defaultGraphQLLimit is the number of rows a list field returns without limit
+const defaultGraphQLLimit = 100
+
+// maxGraphQLDepth is how deeply the selections of a query may nest
+const maxGraphQLDepth = 8
+
+// maxGraphQLRows caps the rows a query may resolve
+const maxGraphQLRows = 10000
+
+// gqlFetchBatch is the most ids read by one query of referenced rows
+const gqlFetchBatch = 500
+
+// gqlFieldDef is a field of a table's object type
+type gqlFieldDef struct {
+	name   string
+	col    string // underlying column
+	typ    string // Int, Float, String, Boolean, JSON or a table's type
+	object bool   // follows a foreign key to another table
+	symbol string // symbol table holding the value, if any
+}
+
+// GraphQL executes read-only queries against a database
+type GraphQL struct {
+	d      *Dumper
+	order  []string                // exposed tables, in schema order
+	tables map[string]*TableSchema // by type name
+	fields map[string][]gqlFieldDef
+	schema *gqlIntro            // __schema
+	types  map[string]*gqlIntro // __type, by name
+}
+
+// NewGraphQL derives the GraphQL schema of dbs. Symbol tables are not
+// exposed on their own, and names that GraphQL cannot express are skipped.
+func NewGraphQL(db queryer, dbs *DatabaseSchema) *GraphQL {
+	g := &GraphQL{
+		d:      &Dumper{ctx: context.Background(), db: db, dbs: dbs, opts: DumpOptions{WithProvenance: true}},
+		tables: map[string]*TableSchema{},
+		fields: map[string][]gqlFieldDef{},
+	}
+	symbolTables := map[string]bool{}
+	for _, t := range dbs.Tables {
+		for col, ref := range t.FKs {
+			if _, ok := t.Naming.symbolField(col); ok {
+				symbolTables[ref] = true
+			}
+		}
+	}
+	for _, name := range dbs.TableOrder {
+		if symbolTables[name] || !gqlName.MatchString(name) || strings.HasPrefix(name, "__") ||
+			name == "Query" || name == "JSON" || scalarTypes[name] {
+			continue
+		}
+		g.order = append(g.order, name)
+		g.tables[name] = dbs.Tables[name]
+	}
+	for _, name := range g.order {
+		t := g.tables[name]
+		cols := make([]string, 0, len(t.Fields))
+		for col := range t.Fields {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		defs := []gqlFieldDef{{name: "id", col: "id", typ: "Int"}}
+		for _, col := range cols {
+			def := gqlFieldDef{name: col, col: col, typ: gqlScalar(t.Fields[col])}
+			ref, isFK := t.FKs[col]
+			symField, isSym := t.Naming.symbolField(col)
+			objField, isObj := t.Naming.objectField(col)
+			switch {
+			case col == "id":
+				continue
+			case isFK && isSym:
+				def.name, def.typ, def.symbol = symField, "JSON", ref
+			case isFK && isObj:
+				if g.tables[ref] == nil {
+					continue
+				}
+				def.name, def.typ, def.object = objField, ref, true
+			}
+			if !gqlName.MatchString(def.name) || strings.HasPrefix(def.name, "__") {
+				continue
+			}
+			defs = append(defs, def)
+		}
+		g.fields[name] = defs
+	}
+	g.schema, g.types = g.introspection()
+	return g
+}
+
+var scalarTypes = map[string]bool{"Int": true, "Float": true, "String": true, "Boolean": true}
+
+// gqlScalar maps a column type to a GraphQL scalar
+func gqlScalar(t FieldType) string {
+	switch t {
+	case TypeInt:
+		return "Int"
+	case TypeReal:
+		return "Float"
+	case TypeBool:
+		return "Boolean"
+	case TypeJSON, TypeGeoJSON, TypeWKB:
+		return "JSON"
+	}
+	return "String"
+}
+
+// field returns the definition of a field of table
+func (g *GraphQL) field(table, name string) (gqlFieldDef, bool) {
+	for _, def := range g.fields[table] {
+		if def.name == name {
+			return def, true
+		}
+	}
+	return gqlFieldDef{}, false
+}
+
+// filterable reports whether a list field accepts an equality filter on def
+func (def gqlFieldDef) filterable() bool {
+	return !def.object && (def.typ != "JSON" || def.symbol != "")
+}
+
+// SDL renders the generated schema in the GraphQL schema definition language
+func (g *GraphQL) SDL() string {
+	var sb strings.Builder
+	sb.WriteString("scalar JSON\n\ntype Query {\n")
+	for _, name := range g.order {
+		var args []string
+		for _, a := range g.listArgs(name) {
+			if a.def != "" {
+				args = append(args, a.name+": "+a.typ+" = "+a.def)
+			} else {
+				args = append(args, a.name+": "+a.typ)
+			}
+		}
+		fmt.Fprintf(&sb, "  %s(%s): [%s!]!\n", name, strings.Join(args, ", "), name)
+		fmt.Fprintf(&sb, "  %s_by_id(id: Int!): %s\n", name, name)
+	}
+	sb.WriteString("}\n")
+	for _, name := range g.order {
+		fmt.Fprintf(&sb, "\ntype %s {\n", name)
+		for _, def := range g.fields[name] {
+			typ := def.typ
+			if def.name == "id" {
+				typ += "!"
+			}
+			fmt.Fprintf(&sb, "  %s: %s\n", def.name, typ)
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+// gqlRequest is the body of a GraphQL request
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlResponse carries either data or errors
+type gqlResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+type gqlError struct {
+	Message string `json:"message"`
+}
+
+// ServeHTTP answers GraphQL queries sent as POSTed JSON or GET parameters
+func (g *GraphQL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req gqlRequest
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if q.Get("query") == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, g.SDL())
+			return
+		}
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "GET or POST a GraphQL query", http.StatusMethodNotAllowed)
+		return
+	}
+	var resp gqlResponse
+	data, err := g.Execute(req)
+	if err != nil {
+		resp.Errors = []gqlError{{Message: err.Error()}}
+	} else {
+		resp.Data = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(resp)
+}
+
+// Execute runs a query. Any error aborts the whole request.
+func (g *GraphQL) Execute(req gqlRequest) (interface{}, error) {
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, err
+	}
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if req.OperationName == "" || o.name == req.OperationName {
+			if op != nil {
+				return nil, fmt.Errorf("operationName is required when the document has several operations")
+			}
+			op = o
+		}
+	}
+	if op == nil {
+		return nil, fmt.Errorf("unknown operation %q", req.OperationName)
+	}
+	if op.kind != "query" {
+		return nil, fmt.Errorf("%s operations are not supported", op.kind)
+	}
+	vars := map[string]interface{}{}
+	for _, v := range op.variables {
+		if val, ok := req.Variables[v.name]; ok {
+			vars[v.name] = val
+		} else if v.hasDefault {
+			vars[v.name] = v.def
+		} else if v.required {
+			return nil, fmt.Errorf("variable $%s is required", v.name)
+		}
+	}
+	ex := &gqlExec{g: g, doc: doc, vars: vars, cache: map[string]map[int64]map[string]interface{}{}}
+	if _, err := ex.cost(op.selections, "Query", 0); err != nil {
+		return nil, err
+	}
+	return ex.query(op.selections)
+}
+
+// gqlObject is a response object, keeping fields in selection order
+type gqlObject []gqlEntry
+
+type gqlEntry struct {
+	key   string
+	value interface{}
+}
+
+func (o gqlObject) MarshalJSON() ([]byte, error) {
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, e := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(e.key)
+		v, err := json.Marshal(e.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return []byte(buf.String()), nil
+}
+
+// gqlExec is the state of one request
+type gqlExec struct {
+	g     *GraphQL
+	doc   *gqlDocument
+	vars  map[string]interface{}
+	cache map[string]map[int64]map[string]interface{} // rows read by table and id; nil for none
+
+	introspected int // objects of the introspection schema resolved
+}
+
+// gqlGroup is the set of selections sharing one response key
+type gqlGroup struct {
+	key   string
+	field *gqlSelection
+	sub   []*gqlSelection // merged sub-selections
+}
+
+// collect flattens fragments and directives into the fields selected on typ
+func (ex *gqlExec) collect(sels []*gqlSelection, typ string) ([]*gqlGroup, error) {
+	var groups []*gqlGroup
+	index := map[string]*gqlGroup{}
+	visited := map[string]bool{}
+	var walk func([]*gqlSelection) error
+	walk = func(sels []*gqlSelection) error {
+		for _, s := range sels {
+			include, err := ex.included(s)
+			if err != nil {
+				return err
+			}
+			if !include {
+				continue
+			}
+			switch {
+			case s.spread != "":
+				frag, ok := ex.doc.fragments[s.spread]
+				if !ok {
+					return fmt.Errorf("unknown fragment %q", s.spread)
+				}
+				if visited[s.spread] {
+					continue
+				}
+				visited[s.spread] = true
+				if frag.on == typ {
+					if err := walk(frag.selections); err != nil {
+						return err
+					}
+				}
+			case s.inline:
+				if s.on == "" || s.on == typ {
+					if err := walk(s.selections); err != nil {
+						return err
+					}
+				}
+			default:
+				key := s.name
+				if s.alias != "" {
+					key = s.alias
+				}
+				gr, ok := index[key]
+				if !ok {
+					gr = &gqlGroup{key: key, field: s}
+					index[key] = gr
+					groups = append(groups, gr)
+				} else if gr.field.name != s.name {
+					return fmt.Errorf("fields %q and %q conflict on response key %q", gr.field.name, s.name, key)
+				}
+				gr.sub = append(gr.sub, s.selections...)
+			}
+		}
+		return nil
+	}
+	return groups, walk(sels)
+}
+
+// included evaluates @skip and @include
+func (ex *gqlExec) included(s *gqlSelection) (bool, error) {
+	for _, d := range s.directives {
+		if d.name != "skip" && d.name != "include" {
+			continue
+		}
+		v, err := ex.resolve(d.args["if"])
+		if err != nil {
+			return false, err
+		}
+		b, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s requires a Boolean if argument", d.name)
+		}
+		if b == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// resolve substitutes variables in an argument value
+func (ex *gqlExec) resolve(v interface{}) (interface{}, error) {
+	switch vv := v.(type) {
+	case gqlVariable:
+		return ex.vars[string(vv)], nil
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i, e := range vv {
+			r, err := ex.resolve(e)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := map[string]interface{}{}
+		for k, e := range vv {
+			r, err := ex.resolve(e)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// coerce checks an argument value against a scalar type
+func coerce(v interface{}, typ string) (interface{}, error) {
+	if v == nil || typ == "JSON" {
+		return v, nil
+	}
+	switch typ {
+	case "Int":
+		switch n := v.(type) {
+		case int64:
+			return n, nil
+		case float64:
+			if n == float64(int64(n)) {
+				return int64(n), nil
+			}
+		}
+	case "Float":
+		switch n := v.(type) {
+		case int64:
+			return float64(n), nil
+		case float64:
+			return n, nil
+		}
+	case "String":
+		if s, ok := v.(string); ok {
+			return s, nil
+		}
+	case "Boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("expected %s, got %v", typ, v)
+}
+
+// args resolves and type-checks the arguments of a field
+func (ex *gqlExec) args(s *gqlSelection, types map[string]string) (map[string]interface{}, error) {
+	out := map[string]interface{}{}
+	for name, raw := range s.args {
+		typ, ok := types[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown argument %q on field %q", name, s.name)
+		}
+		v, err := ex.resolve(raw)
+		if err != nil {
+			return nil, err
+		}
+		if out[name], err = coerce(v, typ); err != nil {
+			return nil, fmt.Errorf("argument %q of %q: %v", name, s.name, err)
+		}
+	}
+	return out, nil
+}
+
+// query resolves the fields of the Query type
+func (ex *gqlExec) query(sels []*gqlSelection) (gqlObject, error) {
+	groups, err := ex.collect(sels, "Query")
+	if err != nil {
+		return nil, err
+	}
+	out := gqlObject{}
+	for _, gr := range groups {
+		name := gr.field.name
+		var val interface{}
+		switch {
+		case name == "__typename":
+			val = "Query"
+		case name == "__schema":
+			val, err = ex.introspect(ex.g.schema, gr.sub)
+		case name == "__type":
+			var args map[string]interface{}
+			if args, err = ex.args(gr.field, map[string]string{"name": "String"}); err == nil {
+				typ, ok := args["name"].(string)
+				if !ok {
+					return nil, fmt.Errorf("argument \"name\" of %q is required", name)
+				}
+				val, err = ex.introspect(ex.g.types[typ], gr.sub)
+			}
+		case ex.g.tables[name] != nil:
+			val, err = ex.list(ex.g.tables[name], gr)
+		case strings.HasSuffix(name, "_by_id") && ex.g.tables[strings.TrimSuffix(name, "_by_id")] != nil:
+			val, err = ex.byID(ex.g.tables[strings.TrimSuffix(name, "_by_id")], gr)
+		default:
+			return nil, fmt.Errorf("cannot query field %q on type Query", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, gqlEntry{gr.key, val})
+	}
+	return out, nil
+}
+
+// cost returns the rows resolving sels on typ takes, at most, for one row of
+// the parent. It fails for selections nested deeper than maxGraphQLDepth or
+// resolving more than maxGraphQLRows rows. Fields it cannot resolve are
+// reported when the query runs.
+func (ex *gqlExec) cost(sels []*gqlSelection, typ string, depth int) (int64, error) {
+	if depth > maxGraphQLDepth {
+		return 0, fmt.Errorf("query nests deeper than %d levels", maxGraphQLDepth)
+	}
+	groups, err := ex.collect(sels, typ)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, gr := range groups {
+		name := gr.field.name
+		var rows int64
+		var sub string
+		switch {
+		case typ == "Query" && ex.g.tables[name] != nil:
+			_, limit, _, err := ex.page(ex.g.tables[name], gr)
+			if err != nil {
+				return 0, err
+			}
+			rows, sub = limit, name
+		case typ == "Query" && strings.HasSuffix(name, "_by_id") && ex.g.tables[strings.TrimSuffix(name, "_by_id")] != nil:
+			rows, sub = 1, strings.TrimSuffix(name, "_by_id")
+		case typ != "Query":
+			if def, ok := ex.g.field(typ, name); ok && def.object {
+				rows, sub = 1, def.typ
+			}
+		}
+		if sub == "" {
+			continue
+		}
+		n, err := ex.cost(gr.sub, sub, depth+1)
+		if err != nil {
+			return 0, err
+		}
+		if total += rows * (1 + n); total > maxGraphQLRows {
+			return 0, fmt.Errorf("query would resolve more than %d rows; lower the limits of its lists", maxGraphQLRows)
+		}
+	}
+	return total, nil
+}
+
+// page resolves the arguments of a list field: its filters, and its limit
+// and offset, checked
+func (ex *gqlExec) page(table *TableSchema, gr *gqlGroup) (args map[string]interface{}, limit, offset int64, err error) {
+	types := map[string]string{"limit": "Int", "offset": "Int"}
+	for _, def := range ex.g.fields[table.Name] {
+		if def.filterable() {
+			types[def.name] = def.typ
+		}
+	}
+	if args, err = ex.args(gr.field, types); err != nil {
+		return nil, 0, 0, err
+	}
+	limit = defaultGraphQLLimit
+	if v, ok := args["limit"].(int64); ok {
+		limit = v
+	}
+	if v, ok := args["offset"].(int64); ok {
+		offset = v
+	}
+	if limit < 0 || offset < 0 {
+		return nil, 0, 0, fmt.Errorf("limit and offset of %q must not be negative", gr.field.name)
+	}
+	if limit > maxPageRows {
+		return nil, 0, 0, fmt.Errorf("limit of %q must be at most %d", gr.field.name, maxPageRows)
+	}
+	return args, limit, offset, nil
+}
+
+// list resolves a list field with its filters, limit and offset
+func (ex *gqlExec) list(table *TableSchema, gr *gqlGroup) (interface{}, error) {
+	args, limit, offset, err := ex.page(table, gr)
+	if err != nil {
+		return nil, err
+	}
+	var conds []string
+	var params []any
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "limit" || name == "offset" {
+			continue
+		}
+		def, _ := ex.g.field(table.Name, name)
+		val := args[name]
+		switch {
+		case val == nil:
+			conds = append(conds, def.col+" IS NULL")
+		case def.symbol != "":
+			js, _ := json.Marshal(val)
+			conds = append(conds, fmt.Sprintf("%s = (SELECT id FROM %s WHERE value = ?)", def.col, def.symbol))
+			params = append(params, string(js))
+		default:
+			conds = append(conds, def.col+" = ?")
+			params = append(params, val)
+		}
+	}
+	query := "SELECT * FROM " + table.Name
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY id LIMIT ? OFFSET ?"
+	rows, err := queryRows(ex.g.d.db, query, append(params, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := ex.prefetch(table, rows, gr.sub); err != nil {
+		return nil, err
+	}
+	out := []interface{}{}
+	for _, row := range rows {
+		obj, err := ex.object(table, row, gr.sub)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, obj)
+	}
+	return out, nil
+}
+
+// byID resolves a single row by its id
+func (ex *gqlExec) byID(table *TableSchema, gr *gqlGroup) (interface{}, error) {
+	args, err := ex.args(gr.field, map[string]string{"id": "Int"})
+	if err != nil {
+		return nil, err
+	}
+	id, ok := args["id"].(int64)
+	if !ok {
+		return nil, fmt.Errorf("argument \"id\" of %q is required", gr.field.name)
+	}
+	return ex.row(table, id, gr.sub)
+}
+
+// row resolves the row of table with the given id, or null
+func (ex *gqlExec) row(table *TableSchema, id int64, sels []*gqlSelection) (interface{}, error) {
+	rows, err := ex.fetch(table, []int64{id})
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return ex.object(table, rows[0], sels)
+}
+
+// prefetch reads the rows the object fields of sels reference from rows of
+// table, and those theirs reference in turn, into the cache of the request
+func (ex *gqlExec) prefetch(table *TableSchema, rows []map[string]interface{}, sels []*gqlSelection) error {
+	groups, err := ex.collect(sels, table.Name)
+	if err != nil {
+		return err
+	}
+	for _, gr := range groups {
+		def, ok := ex.g.field(table.Name, gr.field.name)
+		if !ok || !def.object || len(gr.sub) == 0 {
+			continue
+		}
+		var ids []int64
+		for _, row := range rows {
+			if raw := row[def.col]; raw != nil {
+				ids = append(ids, toInt64(raw))
+			}
+		}
+		refs, err := ex.fetch(ex.g.tables[def.typ], ids)
+		if err != nil {
+			return err
+		}
+		if err := ex.prefetch(ex.g.tables[def.typ], refs, gr.sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch returns the rows of table with the given ids, reading those the
+// cache lacks gqlFetchBatch at a time
+func (ex *gqlExec) fetch(table *TableSchema, ids []int64) ([]map[string]interface{}, error) {
+	cached := ex.cache[table.Name]
+	if cached == nil {
+		cached = map[int64]map[string]interface{}{}
+		ex.cache[table.Name] = cached
+	}
+	var missing []int64
+	for _, id := range ids {
+		if _, ok := cached[id]; !ok {
+			cached[id] = nil
+			missing = append(missing, id)
+		}
+	}
+	for len(missing) > 0 {
+		chunk := missing[:min(len(missing), gqlFetchBatch)]
+		missing = missing[len(chunk):]
+		args := make([]any, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		query := fmt.Sprintf("SELECT * FROM %s WHERE id IN (?%s)", table.Name, strings.Repeat(", ?", len(chunk)-1))
+		rows, err := queryRows(ex.g.d.db, query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			cached[toInt64(row["id"])] = row
+		}
+	}
+	var out []map[string]interface{}
+	seen := map[int64]bool{}
+	for _, id := range ids {
+		if row := cached[id]; row != nil && !seen[id] {
+			seen[id] = true
+			out = append(out, row)
+		}
+	}
+	return out, nil
+}
+
+// object resolves the selected fields of one row
+func (ex *gqlExec) object(table *TableSchema, row map[string]interface{}, sels []*gqlSelection) (gqlObject, error) {
+	if len(sels) == 0 {
+		return nil, fmt.Errorf("type %s requires a selection of subfields", table.Name)
+	}
+	groups, err := ex.collect(sels, table.Name)
+	if err != nil {
+		return nil, err
+	}
+	out := gqlObject{}
+	for _, gr := range groups {
+		name := gr.field.name
+		if name == "__typename" {
+			out = append(out, gqlEntry{gr.key, table.Name})
+			continue
+		}
+		def, ok := ex.g.field(table.Name, name)
+		if !ok {
+			return nil, fmt.Errorf("cannot query field %q on type %s", name, table.Name)
+		}
+		if len(gr.field.args) > 0 {
+			return nil, fmt.Errorf("field %q of type %s takes no arguments", name, table.Name)
+		}
+		raw := row[def.col]
+		var val interface{}
+		switch {
+		case def.object:
+			if raw != nil {
+				if val, err = ex.row(ex.g.tables[def.typ], toInt64(raw), gr.sub); err != nil {
+					return nil, err
+				}
+			} else if len(gr.sub) == 0 {
+				return nil, fmt.Errorf("type %s requires a selection of subfields", def.typ)
+			}
+		case len(gr.sub) > 0:
+			return nil, fmt.Errorf("field %q of type %s has no subfields", name, def.typ)
+		case def.col == "id":
+			val = toInt64(raw)
+		case raw != nil:
+			// The dumper already knows how to decode symbols and JSON columns
+			obj, err := ex.g.d.dumpRowValueSet(table, []string{def.col}, []interface{}{raw})
+			if err != nil {
+				return nil, err
+			}
+			val = obj[def.name]
+		}
+		out = append(out, gqlEntry{gr.key, val})
+	}
+	return out, nil
+}
+
+// queryRows returns the rows of a query as column -> value maps
+func queryRows(db queryer, query string, args ...any) ([]map[string]interface{}, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var out []map[string]interface{}
+	for rows.Next() {
+		vals := make([]interface{}, len(columns))
+		valPtrs := make([]interface{}, len(columns))
+		for i := range columns {
+			valPtrs[i] = &vals[i]
+		}
+		if err := rows.Scan(valPtrs...); err != nil {
+			return nil, err
+		}
+		row := map[string]interface{}{}
+		for i, col := range columns {
+			row[col] = vals[i]
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+// --- Query language parser --- //
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string]*gqlFragment
+}
+
+type gqlOperation struct {
+	kind, name string
+	variables  []gqlVariableDef
+	selections []*gqlSelection
+}
+
+type gqlVariableDef struct {
+	name       string
+	required   bool
+	hasDefault bool
+	def        interface{}
+}
+
+type gqlFragment struct {
+	on         string
+	selections []*gqlSelection
+}
+
+// gqlSelection is a field, a fragment spread or an inline fragment
+type gqlSelection struct {
+	alias, name string
+	args        map[string]interface{}
+	directives  []gqlDirective
+	spread      string // named fragment spread
+	inline      bool   // inline fragment, with optional type condition on
+	on          string
+	selections  []*gqlSelection
+}
+
+type gqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+// gqlVariable is a $reference inside an argument value
+type gqlVariable string
+
+type gqlToken struct {
+	kind byte // 'n' name, 's' string, 'i' int, 'f' float, 'p' punctuator, 0 end
+	text string
+}
+
+type gqlParser struct {
+	src string
+	pos int
+	tok gqlToken
+}
+
+// parseGraphQL parses an executable GraphQL document
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{src: src}
+	doc := &gqlDocument{fragments: map[string]*gqlFragment{}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for p.tok.kind != 0 {
+		switch {
+		case p.is('p', "{"):
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{kind: "query", selections: sels})
+		case p.is('n', "query") || p.is('n', "mutation") || p.is('n', "subscription"):
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case p.is('n', "fragment"):
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectName("on"); err != nil {
+				return nil, err
+			}
+			on, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			sels, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.fragments[name] = &gqlFragment{on: on, selections: sels}
+		default:
+			return nil, p.errorf("unexpected %q", p.tok.text)
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("document contains no operation")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) errorf(format string, args ...interface{}) error {
+	line := 1 + strings.Count(p.src[:p.pos], "\n")
+	return fmt.Errorf("syntax error on line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *gqlParser) is(kind byte, text string) bool {
+	return p.tok.kind == kind && p.tok.text == text
+}
+
+// skip consumes the punctuator text if it is next
+func (p *gqlParser) skip(text string) (bool, error) {
+	if !p.is('p', text) {
+		return false, nil
+	}
+	return true, p.next()
+}
+
+func (p *gqlParser) expect(text string) error {
+	if !p.is('p', text) {
+		return p.errorf("expected %q, found %q", text, p.tok.text)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) expectName(name string) error {
+	if !p.is('n', name) {
+		return p.errorf("expected %q, found %q", name, p.tok.text)
+	}
+	return p.next()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if p.tok.kind != 'n' {
+		return "", p.errorf("expected a name, found %q", p.tok.text)
+	}
+	name := p.tok.text
+	return name, p.next()
+}
+
+// next reads the following token, skipping whitespace, commas and comments
+func (p *gqlParser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = gqlToken{}
+		return nil
+	}
+	start, c := p.pos, p.src[p.pos]
+	isDigit := func(c byte) bool { return c >= '0' && c <= '9' }
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = gqlToken{'p', "..."}
+	case strings.IndexByte("{}()[]:!$=@", c) >= 0:
+		p.pos++
+		p.tok = gqlToken{'p', string(c)}
+	case c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z'):
+		for p.pos < len(p.src) {
+			c := p.src[p.pos]
+			if c != '_' && !isDigit(c) && !(c|0x20 >= 'a' && c|0x20 <= 'z') {
+				break
+			}
+			p.pos++
+		}
+		p.tok = gqlToken{'n', p.src[start:p.pos]}
+	case c == '-' || isDigit(c):
+		kind := byte('i')
+		for p.pos++; p.pos < len(p.src); p.pos++ {
+			c := p.src[p.pos]
+			prev := p.src[p.pos-1]
+			if c == '.' || c == 'e' || c == 'E' || ((c == '+' || c == '-') && (prev == 'e' || prev == 'E')) {
+				kind = 'f'
+			} else if !isDigit(c) {
+				break
+			}
+		}
+		p.tok = gqlToken{kind, p.src[start:p.pos]}
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			return p.errorf("unterminated block string")
+		}
+		p.tok = gqlToken{'s', p.src[p.pos+3 : p.pos+3+end]}
+		p.pos += end + 6
+	case c == '"':
+		for p.pos++; p.pos < len(p.src) && p.src[p.pos] != '"'; p.pos++ {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+		}
+		if p.pos >= len(p.src) {
+			return p.errorf("unterminated string")
+		}
+		p.pos++
+		// GraphQL string escapes are those of JSON
+		var s string
+		if err := json.Unmarshal([]byte(p.src[start:p.pos]), &s); err != nil {
+			return p.errorf("invalid string %s", p.src[start:p.pos])
+		}
+		p.tok = gqlToken{'s', s}
+	default:
+		return p.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+// operation parses query/mutation/subscription Name($var: Type = default) { ... }
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: p.tok.text}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == 'n' {
+		op.name = p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := p.skip("("); err != nil {
+		return nil, err
+	} else if ok {
+		for !p.is('p', ")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			var v gqlVariableDef
+			var err error
+			if v.name, err = p.name(); err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if v.required, err = p.typeRef(); err != nil {
+				return nil, err
+			}
+			if ok, err := p.skip("="); err != nil {
+				return nil, err
+			} else if ok {
+				v.hasDefault = true
+				if v.def, err = p.value(true); err != nil {
+					return nil, err
+				}
+			}
+			op.variables = append(op.variables, v)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selections, err = p.selectionSet()
+	return op, err
+}
+
+// typeRef parses a variable type, reporting whether it is non-null
+func (p *gqlParser) typeRef() (bool, error) {
+	if ok, err := p.skip("["); err != nil {
+		return false, err
+	} else if ok {
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	return p.skip("!")
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sels []*gqlSelection
+	for !p.is('p', "}") {
+		if p.tok.kind == 0 {
+			return nil, p.errorf("unterminated selection set")
+		}
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		sels = append(sels, s)
+	}
+	if len(sels) == 0 {
+		return nil, p.errorf("empty selection set")
+	}
+	return sels, p.next()
+}
+
+func (p *gqlParser) selection() (*gqlSelection, error) {
+	s := &gqlSelection{}
+	var err error
+	if ok, err := p.skip("..."); err != nil {
+		return nil, err
+	} else if ok {
+		if p.tok.kind == 'n' && p.tok.text != "on" {
+			s.spread = p.tok.text
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			s.directives, err = p.directives()
+			return s, err
+		}
+		s.inline = true
+		if p.is('n', "on") {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if s.on, err = p.name(); err != nil {
+				return nil, err
+			}
+		}
+		if s.directives, err = p.directives(); err != nil {
+			return nil, err
+		}
+		s.selections, err = p.selectionSet()
+		return s, err
+	}
+	if s.name, err = p.name(); err != nil {
+		return nil, err
+	}
+	if ok, err := p.skip(":"); err != nil {
+		return nil, err
+	} else if ok {
+		s.alias = s.name
+		if s.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if s.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if s.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if p.is('p', "{") {
+		s.selections, err = p.selectionSet()
+	}
+	return s, err
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	if ok, err := p.skip("("); err != nil || !ok {
+		return args, err
+	}
+	for !p.is('p', ")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.next()
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var ds []gqlDirective
+	for p.is('p', "@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, gqlDirective{name: name, args: args})
+	}
+	return ds, nil
+}
+
+// value parses an argument value; constant values may not use variables.
+// Enum values are returned as strings.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == 'p' && tok.text == "$" && !constant:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case tok.kind == 'p' && tok.text == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.is('p', "]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case tok.kind == 'p' && tok.text == "{":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{}
+		for !p.is('p', "}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.next()
+	case tok.kind == 'i':
+		n, err := strconv.ParseInt(tok.text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("invalid integer %s", tok.text)
+		}
+		return n, p.next()
+	case tok.kind == 'f':
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", tok.text)
+		}
+		return f, p.next()
+	case tok.kind == 's':
+		return tok.text, p.next()
+	case tok.kind == 'n':
+		var v interface{} = tok.text
+		switch tok.text {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		}
+		return v, p.next()
+	}
+	return nil, p.errorf("unexpected %q in value", tok.text)
+}
@@ -0,0 +1,76 @@
+package jsql
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+)
+
+// healthStatus is the JSON body returned by /healthz and /readyz
+type healthStatus struct {
+	Status      string `json:"status"`
+	DBWritable  bool   `json:"db_writable"`
+	DBError     string `json:"db_error,omitempty"`
+	PendingRows int64  `json:"pending_rows"`
+	Queued      int64  `json:"queued_batches"`
+	LastCommit  string `json:"last_commit,omitempty"`
+}
+
+// checkHealth reports on the database and the loader's progress
+func checkHealth() healthStatus {
+	hs := healthStatus{
+		Status:      "ok",
+		DBWritable:  true,
+		PendingRows: metrics.pendingRows.Load(),
+		Queued:      metrics.queuedBatches.Load(),
+	}
+	if capacity := metrics.queueCapacity.Load(); capacity > 0 && hs.Queued >= capacity {
+		hs.Status = "busy"
+	}
+	if ts := metrics.lastCommit.Load(); ts != 0 {
+		hs.LastCommit = time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	metrics.mu.Lock()
+	path := metrics.databasePath
+	metrics.mu.Unlock()
+	if path != "" {
+		// Opening for writing checks permissions and the filesystem without
+		// taking a SQLite lock that would compete with the loader
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			hs.DBWritable = false
+			hs.DBError = err.Error()
+			hs.Status = "unavailable"
+		} else {
+			f.Close()
+		}
+	}
+	return hs
+}
+
+// writeHealth encodes hs, using 503 for anything that is not ok
+func writeHealth(w http.ResponseWriter, hs healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if hs.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(hs)
+}
+
+// handleHealthz reports liveness: the process is serving requests and its
+// database can be written. A full write queue does not fail it, since
+// restarting the process would drop the batches queued.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	hs := checkHealth()
+	if hs.Status == "busy" {
+		hs.Status = "ok"
+	}
+	writeHealth(w, hs)
+}
+
+// handleReadyz reports readiness: the database can currently be written and,
+// in serve mode, the write queue has room
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, checkHealth())
+}
@@ -0,0 +1,140 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Tables with history keep every version of their rows. Each row records
+// in _valid_from since when it has held its values; updating or deleting
+// it copies the old version, with the time it ended as _valid_to, into a
+// shadow <table>_history table by triggers, declared in the DDL next to
+// the directive
+//
+//	-- jsql:history orders
+//
+// Patch and sync replace a document's rows, so every change leaves the
+// document's former rows in the history tables. asof dumps the documents
+// as they were at a point in time, reading each table with history
+// through a temporary view of the versions valid at that time, which
+// takes the table's name for the Dumper's queries.
+var reHistoryDirective = regexp.MustCompile(`^--\s*jsql:history\s+(\w+)\s*$`)
+
+const (
+	validFromColumn = "_valid_from"
+	validToColumn   = "_valid_to"
+)
+
+// historyNow is the current time as history columns hold it, to the
+// millisecond, so that the times compare as text
+const historyNow = "strftime('%Y-%m-%dT%H:%M:%fZ', 'now')"
+
+// asOfLayout is the layout of historyNow
+const asOfLayout = "2006-01-02T15:04:05.000Z"
+
+// historyTable returns the name of the table holding the history of table
+func historyTable(table string) string {
+	return table + "_history"
+}
+
+// writeHistory writes the directive, history table and triggers keeping
+// the history of a table with the columns cols
+func writeHistory(sb *strings.Builder, table string, cols map[string]FieldType) {
+	history := historyTable(table)
+	names := sortedKeys(cols)
+	defs := make([]string, len(names), len(names)+1)
+	old := make([]string, len(names))
+	for i, col := range names {
+		defs[i] = quoteIdent(col) + " " + string(cols[col])
+		old[i] = "OLD." + quoteIdent(col)
+	}
+	defs = append(defs, validToColumn+" TEXT")
+	insert := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES (%s, %s);", history, strings.Join(quoteIdents(names), ", "), validToColumn, strings.Join(old, ", "), historyNow)
+	fmt.Fprintf(sb, "-- jsql:history %s\n\n", table)
+	fmt.Fprintf(sb, "CREATE TABLE %s (\n  %s\n);\n\n", history, strings.Join(defs, ",\n  "))
+	fmt.Fprintf(sb, "CREATE INDEX %[1]s_id ON %[1]s (id);\n\n", history)
+	fmt.Fprintf(sb, `CREATE TRIGGER %[1]s_update AFTER UPDATE ON %[2]s FOR EACH ROW WHEN NEW.%[3]s IS OLD.%[3]s
+BEGIN
+  %[4]s
+  UPDATE %[2]s SET %[3]s = %[5]s WHERE id = NEW.id;
+END;
+
+CREATE TRIGGER %[1]s_delete AFTER DELETE ON %[2]s FOR EACH ROW
+BEGIN
+  %[4]s
+END;
+
+`, history, table, validFromColumn, insert, historyNow)
+}
+
+// ParseAsOf returns the time of asof --at as history columns hold it. A
+// time without a zone is taken as UTC.
+func ParseAsOf(s string) (string, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC().Format(asOfLayout), nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a time such as 2024-05-01T12:00:00Z or a date", s)
+}
+
+// openAsOf opens the database at dbPath for reading the documents as they
+// were at the time at: on every connection, a temporary view of each table
+// with history holds its rows valid at that time, the current ones since
+// then unchanged and the versions of the history table
+func openAsOf(dbPath string, dbs *DatabaseSchema, at string, mmapSize int64) (*sql.DB, error) {
+	db, err := OpenReadOnly(dbPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var setup []string
+	for _, name := range dbs.TableOrder {
+		if !dbs.Tables[name].History {
+			continue
+		}
+		cols, err := columnTypes(db, name)
+		if err != nil {
+			return nil, err
+		}
+		kept, err := columnTypes(db, historyTable(name))
+		if err != nil {
+			return nil, err
+		}
+		if len(kept) == 0 {
+			return nil, fmt.Errorf("table %s has no history table %s", name, historyTable(name))
+		}
+		names := sortedKeys(cols)
+		versions := make([]string, len(names))
+		for i, col := range names {
+			// Columns added since the history table was created were
+			// empty in its versions
+			versions[i] = quoteIdent(col)
+			if kept[col] == "" {
+				versions[i] = "NULL AS " + quoteIdent(col)
+			}
+		}
+		setup = append(setup, fmt.Sprintf("CREATE TEMP VIEW %[1]s AS SELECT %[2]s FROM main.%[1]s WHERE %[4]s <= %[6]s UNION ALL SELECT %[3]s FROM main.%[5]s WHERE %[4]s <= %[6]s AND %[7]s > %[6]s",
+			quoteIdent(name), strings.Join(quoteIdents(names), ", "), strings.Join(versions, ", "), validFromColumn, quoteIdent(historyTable(name)), sqlLiteral(at), validToColumn))
+	}
+	if len(setup) == 0 {
+		return nil, fmt.Errorf("the schema keeps no history: create the database from a schema analyzed with --history")
+	}
+	if mmapSize != 0 {
+		setup = append(setup, fmt.Sprintf("PRAGMA mmap_size = %d", mmapSize))
+	}
+	drv := &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		for _, stmt := range setup {
+			if _, err := conn.Exec(stmt, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+	return sql.OpenDB(hookConnector{dsn: sqliteURI(dbPath, "mode=ro"), drv: drv}), nil
+}
@@ -0,0 +1,85 @@
+package jsql
+
+import (
+	"regexp"
+	"strings"
+)
+
+// identPattern matches an SQL identifier: bare, or quoted "like this",
+// [like this] or `like this`
+const identPattern = "(?:\"(?:[^\"]|\"\")+\"|\\[[^\\]]+\\]|`(?:[^`]|``)+`|\\w+)"
+
+// qualifiedIdentPattern matches an identifier, capturing it, after an
+// optional schema name such as main.
+const qualifiedIdentPattern = "(?:" + identPattern + "\\.)?(" + identPattern + ")"
+
+var rePlainIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// unquoteIdent returns the name an identifier matched by identPattern
+// stands for
+func unquoteIdent(ident string) string {
+	if len(ident) < 2 {
+		return ident
+	}
+	switch ident[0] {
+	case '"':
+		return strings.ReplaceAll(ident[1:len(ident)-1], `""`, `"`)
+	case '`':
+		return strings.ReplaceAll(ident[1:len(ident)-1], "``", "`")
+	case '[':
+		return ident[1 : len(ident)-1]
+	}
+	return ident
+}
+
+// identList returns the names of a comma-separated list of identifiers
+func identList(list string) []string {
+	var names []string
+	for _, ident := range strings.Split(list, ",") {
+		if ident = strings.TrimSpace(ident); ident != "" {
+			names = append(names, unquoteIdent(ident))
+		}
+	}
+	return names
+}
+
+// quoteIdent returns name as an SQL identifier, quoted if it is not a
+// plain word or is a keyword
+func quoteIdent(name string) string {
+	if rePlainIdent.MatchString(name) && !sqliteKeywords[strings.ToUpper(name)] {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteIdents quotes each of names
+func quoteIdents(names []string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteIdent(name)
+	}
+	return quoted
+}
+
+// sqliteKeywords are the words SQLite reserves, which must be quoted to
+// name a table or column
+var sqliteKeywords = map[string]bool{}
+
+func init() {
+	for _, kw := range strings.Fields(`ABORT ACTION ADD AFTER ALL ALTER ALWAYS ANALYZE AND AS ASC
+		ATTACH AUTOINCREMENT BEFORE BEGIN BETWEEN BY CASCADE CASE CAST CHECK COLLATE
+		COLUMN COMMIT CONFLICT CONSTRAINT CREATE CROSS CURRENT CURRENT_DATE
+		CURRENT_TIME CURRENT_TIMESTAMP DATABASE DEFAULT DEFERRABLE DEFERRED DELETE
+		DESC DETACH DISTINCT DO DROP EACH ELSE END ESCAPE EXCEPT EXCLUDE EXCLUSIVE
+		EXISTS EXPLAIN FAIL FILTER FIRST FOLLOWING FOR FOREIGN FROM FULL GENERATED
+		GLOB GROUP GROUPS HAVING IF IGNORE IMMEDIATE IN INDEX INDEXED INITIALLY
+		INNER INSERT INSTEAD INTERSECT INTO IS ISNULL JOIN KEY LAST LEFT LIKE LIMIT
+		MATCH MATERIALIZED NATURAL NO NOT NOTHING NOTNULL NULL NULLS OF OFFSET ON OR
+		ORDER OTHERS OUTER OVER PARTITION PLAN PRAGMA PRECEDING PRIMARY QUERY RAISE
+		RANGE RECURSIVE REFERENCES REGEXP REINDEX RELEASE RENAME REPLACE RESTRICT
+		RETURNING RIGHT ROLLBACK ROW ROWS SAVEPOINT SELECT SET TABLE TEMP TEMPORARY
+		THEN TIES TO TRANSACTION TRIGGER UNBOUNDED UNION UNIQUE UPDATE USING VACUUM
+		VALUES VIEW VIRTUAL WHEN WHERE WINDOW WITH WITHOUT`) {
+		sqliteKeywords[kw] = true
+	}
+}
@@ -0,0 +1,250 @@
+// Package pathspec parses the key paths naming fields of a document, and
+// filters documents by them.
+package pathspec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Path addresses fields of a document, in the syntax shared by every flag
+// naming fields: meta.city is the city field of the meta object and
+// items[].price the price field of every element of the items array. A
+// backslash escapes '.', '[', ',' or '\' inside a key.
+type Path []Step
+
+// Step is one key of a Path
+type Step struct {
+	Key  string
+	Each bool // the value is an array whose elements the rest of the path addresses
+}
+
+// Parse parses a key path
+func Parse(s string) (Path, error) {
+	var p Path
+	var key strings.Builder
+	step := func(each bool) error {
+		if key.Len() == 0 {
+			return fmt.Errorf("path %q: empty key", s)
+		}
+		p = append(p, Step{Key: key.String(), Each: each})
+		key.Reset()
+		return nil
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			key.WriteByte(s[i])
+		case c == '.':
+			if len(p) > 0 && p[len(p)-1].Each && key.Len() == 0 && s[i-1] == ']' {
+				continue // items[].price
+			}
+			if err := step(false); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(s[i:], "[]"):
+			if err := step(true); err != nil {
+				return nil, err
+			}
+			i++
+			if i+1 < len(s) && s[i+1] != '.' {
+				return nil, fmt.Errorf("path %q: [] must end a key", s)
+			}
+		default:
+			key.WriteByte(c)
+		}
+	}
+	if key.Len() > 0 || len(p) == 0 || !p[len(p)-1].Each {
+		if err := step(false); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ParseList parses comma-separated key paths, as given to a flag
+func ParseList(specs []string) ([]Path, error) {
+	var paths []Path
+	for _, spec := range specs {
+		for _, s := range splitUnescaped(spec, ',') {
+			p, err := Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+// splitUnescaped splits s at the seps not preceded by a backslash, keeping
+// the escapes for Parse
+func splitUnescaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func (p Path) String() string {
+	var sb strings.Builder
+	for i, st := range p {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		for j := 0; j < len(st.Key); j++ {
+			if strings.IndexByte(`.[,\`, st.Key[j]) >= 0 {
+				sb.WriteByte('\\')
+			}
+			sb.WriteByte(st.Key[j])
+		}
+		if st.Each {
+			sb.WriteString("[]")
+		}
+	}
+	return sb.String()
+}
+
+// Keys returns the keys of the path without the array steps
+func (p Path) Keys() []string {
+	keys := make([]string, len(p))
+	for i, st := range p {
+		keys[i] = st.Key
+	}
+	return keys
+}
+
+// Column returns the path as the dotted table.column form used by profiles.
+// Fields inside arrays have no column of their own.
+func (p Path) Column() (string, error) {
+	for _, st := range p[:len(p)-1] {
+		if st.Each {
+			return "", fmt.Errorf("%s: fields inside arrays are stored in the array's JSON column", p)
+		}
+	}
+	return strings.Join(p.Keys(), "."), nil
+}
+
+// Select returns the part of v the path addresses, keeping the objects and
+// arrays leading to it
+func (p Path) Select(v interface{}) (interface{}, bool) {
+	if len(p) == 0 {
+		return v, true
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	val, ok := m[p[0].Key]
+	if !ok {
+		return nil, false
+	}
+	if !p[0].Each {
+		sub, ok := p[1:].Select(val)
+		if !ok {
+			return nil, false
+		}
+		return map[string]interface{}{p[0].Key: sub}, true
+	}
+	arr, ok := val.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	// Elements stay in place, empty where the rest of the path is missing,
+	// so selections of several paths line up
+	out := make([]interface{}, len(arr))
+	for i, elem := range arr {
+		if sub, ok := p[1:].Select(elem); ok {
+			out[i] = sub
+		} else {
+			out[i] = map[string]interface{}{}
+		}
+	}
+	return map[string]interface{}{p[0].Key: out}, true
+}
+
+// Delete removes the addressed fields from v
+func (p Path) Delete(v interface{}) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(p) == 0 {
+		return
+	}
+	if len(p) == 1 {
+		delete(m, p[0].Key)
+		return
+	}
+	if !p[0].Each {
+		p[1:].Delete(m[p[0].Key])
+		return
+	}
+	arr, _ := m[p[0].Key].([]interface{})
+	for _, elem := range arr {
+		p[1:].Delete(elem)
+	}
+}
+
+// mergeSelections merges the selections of several paths from the same
+// document
+func mergeSelections(a, b interface{}) interface{} {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			return a
+		}
+		for k, v := range bv {
+			if prev, ok := av[k]; ok {
+				av[k] = mergeSelections(prev, v)
+			} else {
+				av[k] = v
+			}
+		}
+		return av
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return a
+		}
+		for i := range av {
+			av[i] = mergeSelections(av[i], bv[i])
+		}
+		return av
+	}
+	return a
+}
+
+// Filter keeps only the Include paths of documents, if there are any,
+// then removes the Exclude paths
+type Filter struct {
+	Include []Path
+	Exclude []Path
+}
+
+// Apply filters a document, returning the result
+func (f *Filter) Apply(doc map[string]interface{}) map[string]interface{} {
+	if f == nil {
+		return doc
+	}
+	if len(f.Include) > 0 {
+		out := map[string]interface{}{}
+		for _, p := range f.Include {
+			if sel, ok := p.Select(doc); ok {
+				mergeSelections(out, sel)
+			}
+		}
+		doc = out
+	}
+	for _, p := range f.Exclude {
+		p.Delete(doc)
+	}
+	return doc
+}
@@ -0,0 +1,238 @@
+package jsql
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Introspection answers __schema and __type from a description of the
+// generated schema built once by NewGraphQL. Types, fields and arguments are
+// gqlIntro objects whose fields hold the values of the introspection schema,
+// so resolving a selection on them is a walk over maps; the objects a query
+// may resolve are capped by maxGraphQLIntrospection, since the type
+// references between objects let a query repeat itself.
+
+// maxGraphQLIntrospection caps the objects an introspection query resolves
+const maxGraphQLIntrospection = 100000
+
+// gqlIntro is an object of the introspection schema: __Schema, __Type,
+// __Field, __InputValue, __EnumValue or __Directive. Its fields hold nil, a
+// string, a bool, a []string, a *gqlIntro or a []*gqlIntro.
+type gqlIntro struct {
+	typename string
+	fields   map[string]interface{}
+}
+
+// gqlArgDef is an argument of a field of the Query type
+type gqlArgDef struct {
+	name, typ string
+	def       string // default value, in GraphQL syntax; "" for none
+}
+
+// gqlMetaTypes are the types of the introspection schema, with their fields
+var gqlMetaTypes = []struct {
+	name   string
+	fields [][2]string // name and type
+}{
+	{"__Schema", [][2]string{{"description", "String"}, {"types", "[__Type!]!"}, {"queryType", "__Type!"},
+		{"mutationType", "__Type"}, {"subscriptionType", "__Type"}, {"directives", "[__Directive!]!"}}},
+	{"__Type", [][2]string{{"kind", "__TypeKind!"}, {"name", "String"}, {"description", "String"},
+		{"specifiedByURL", "String"}, {"fields", "[__Field!]"}, {"interfaces", "[__Type!]"},
+		{"possibleTypes", "[__Type!]"}, {"enumValues", "[__EnumValue!]"}, {"inputFields", "[__InputValue!]"},
+		{"ofType", "__Type"}}},
+	{"__Field", [][2]string{{"name", "String!"}, {"description", "String"}, {"args", "[__InputValue!]!"},
+		{"type", "__Type!"}, {"isDeprecated", "Boolean!"}, {"deprecationReason", "String"}}},
+	{"__InputValue", [][2]string{{"name", "String!"}, {"description", "String"}, {"type", "__Type!"},
+		{"defaultValue", "String"}, {"isDeprecated", "Boolean!"}, {"deprecationReason", "String"}}},
+	{"__EnumValue", [][2]string{{"name", "String!"}, {"description", "String"}, {"isDeprecated", "Boolean!"},
+		{"deprecationReason", "String"}}},
+	{"__Directive", [][2]string{{"name", "String!"}, {"description", "String"},
+		{"locations", "[__DirectiveLocation!]!"}, {"args", "[__InputValue!]!"}, {"isRepeatable", "Boolean!"}}},
+}
+
+// gqlMetaEnums are the enum types of the introspection schema
+var gqlMetaEnums = []struct {
+	name   string
+	values []string
+}{
+	{"__TypeKind", []string{"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL"}},
+	{"__DirectiveLocation", []string{"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION",
+		"FRAGMENT_SPREAD", "INLINE_FRAGMENT", "VARIABLE_DEFINITION", "SCHEMA", "SCALAR", "OBJECT",
+		"FIELD_DEFINITION", "ARGUMENT_DEFINITION", "INTERFACE", "UNION", "ENUM_VALUE", "ENUM", "INPUT_OBJECT",
+		"INPUT_FIELD_DEFINITION"}},
+}
+
+// listArgs returns the arguments of the list field of table
+func (g *GraphQL) listArgs(table string) []gqlArgDef {
+	args := []gqlArgDef{{"limit", "Int", fmt.Sprint(defaultGraphQLLimit)}, {"offset", "Int", "0"}}
+	for _, def := range g.fields[table] {
+		if def.filterable() {
+			args = append(args, gqlArgDef{name: def.name, typ: def.typ})
+		}
+	}
+	return args
+}
+
+// introspection builds the description of the generated schema, and the
+// types it holds by name
+func (g *GraphQL) introspection() (*gqlIntro, map[string]*gqlIntro) {
+	types := map[string]*gqlIntro{}
+	var order []*gqlIntro
+	named := func(kind, name string) *gqlIntro {
+		t := &gqlIntro{typename: "__Type", fields: map[string]interface{}{"kind": kind, "name": name}}
+		types[name] = t
+		order = append(order, t)
+		return t
+	}
+	// ref resolves a type reference such as [String!]!; the named types it
+	// refers to are all declared before any is referenced
+	var ref func(typ string) *gqlIntro
+	ref = func(typ string) *gqlIntro {
+		switch {
+		case strings.HasSuffix(typ, "!"):
+			return &gqlIntro{typename: "__Type", fields: map[string]interface{}{"kind": "NON_NULL", "ofType": ref(strings.TrimSuffix(typ, "!"))}}
+		case strings.HasPrefix(typ, "["):
+			return &gqlIntro{typename: "__Type", fields: map[string]interface{}{"kind": "LIST", "ofType": ref(typ[1 : len(typ)-1])}}
+		}
+		return types[typ]
+	}
+	value := func(name, typ, def string) *gqlIntro {
+		v := &gqlIntro{typename: "__InputValue", fields: map[string]interface{}{"name": name, "type": ref(typ), "isDeprecated": false}}
+		if def != "" {
+			v.fields["defaultValue"] = def
+		}
+		return v
+	}
+	field := func(name, typ string, args []*gqlIntro) *gqlIntro {
+		return &gqlIntro{typename: "__Field", fields: map[string]interface{}{
+			"name": name, "type": ref(typ), "args": append([]*gqlIntro{}, args...), "isDeprecated": false,
+		}}
+	}
+	object := func(t *gqlIntro, fields []*gqlIntro) {
+		t.fields["fields"], t.fields["interfaces"] = fields, []*gqlIntro{}
+	}
+
+	named("OBJECT", "Query")
+	for _, name := range g.order {
+		named("OBJECT", name)
+	}
+	for _, name := range []string{"Int", "Float", "String", "Boolean", "JSON"} {
+		named("SCALAR", name)
+	}
+	for _, m := range gqlMetaTypes {
+		named("OBJECT", m.name)
+	}
+	for _, e := range gqlMetaEnums {
+		var values []*gqlIntro
+		for _, v := range e.values {
+			values = append(values, &gqlIntro{typename: "__EnumValue", fields: map[string]interface{}{"name": v, "isDeprecated": false}})
+		}
+		named("ENUM", e.name).fields["enumValues"] = values
+	}
+
+	var query []*gqlIntro
+	for _, name := range g.order {
+		var args []*gqlIntro
+		for _, a := range g.listArgs(name) {
+			args = append(args, value(a.name, a.typ, a.def))
+		}
+		query = append(query, field(name, "["+name+"!]!", args), field(name+"_by_id", name, []*gqlIntro{value("id", "Int!", "")}))
+		var fields []*gqlIntro
+		for _, def := range g.fields[name] {
+			typ := def.typ
+			if def.name == "id" {
+				typ += "!"
+			}
+			fields = append(fields, field(def.name, typ, nil))
+		}
+		object(types[name], fields)
+	}
+	object(types["Query"], query)
+	for _, m := range gqlMetaTypes {
+		var fields []*gqlIntro
+		for _, f := range m.fields {
+			fields = append(fields, field(f[0], f[1], nil))
+		}
+		object(types[m.name], fields)
+	}
+
+	var directives []*gqlIntro
+	for _, name := range []string{"skip", "include"} {
+		directives = append(directives, &gqlIntro{typename: "__Directive", fields: map[string]interface{}{
+			"name":         name,
+			"locations":    []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+			"args":         []*gqlIntro{value("if", "Boolean!", "")},
+			"isRepeatable": false,
+		}})
+	}
+	schema := &gqlIntro{typename: "__Schema", fields: map[string]interface{}{
+		"types": order, "queryType": types["Query"], "directives": directives,
+	}}
+	return schema, types
+}
+
+// metaField reports whether typename, a type of the introspection schema,
+// has the field name
+func metaField(typename, name string) bool {
+	for _, m := range gqlMetaTypes {
+		if m.name == typename {
+			for _, f := range m.fields {
+				if f[0] == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// introspect resolves sels on v, a value of the introspection schema
+func (ex *gqlExec) introspect(v interface{}, sels []*gqlSelection) (interface{}, error) {
+	switch vv := v.(type) {
+	case *gqlIntro:
+		if vv == nil {
+			return nil, nil
+		}
+		if len(sels) == 0 {
+			return nil, fmt.Errorf("type %s requires a selection of subfields", vv.typename)
+		}
+		if ex.introspected++; ex.introspected > maxGraphQLIntrospection {
+			return nil, fmt.Errorf("introspection query would resolve more than %d objects", maxGraphQLIntrospection)
+		}
+		groups, err := ex.collect(sels, vv.typename)
+		if err != nil {
+			return nil, err
+		}
+		out := gqlObject{}
+		for _, gr := range groups {
+			name := gr.field.name
+			if name == "__typename" {
+				out = append(out, gqlEntry{gr.key, vv.typename})
+				continue
+			}
+			if !metaField(vv.typename, name) {
+				return nil, fmt.Errorf("cannot query field %q on type %s", name, vv.typename)
+			}
+			val, err := ex.introspect(vv.fields[name], gr.sub)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, gqlEntry{gr.key, val})
+		}
+		return out, nil
+	case []*gqlIntro:
+		out := []interface{}{}
+		for _, e := range vv {
+			r, err := ex.introspect(e, sels)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, r)
+		}
+		return out, nil
+	}
+	if v != nil && len(sels) > 0 {
+		return nil, fmt.Errorf("scalar and enum fields of the introspection schema have no subfields")
+	}
+	return v, nil
+}
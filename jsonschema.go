@@ -0,0 +1,330 @@
+package jsql
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jsonSchema is the part of a JSON Schema document that determines tables
+// and columns. Validation keywords other than enum and const are ignored.
+type jsonSchema struct {
+	Ref        string                 `json:"$ref"`
+	Type       interface{}            `json:"type"` // a type name or a list of them
+	Properties map[string]*jsonSchema `json:"properties"`
+	Enum       []interface{}          `json:"enum"`
+	Const      json.RawMessage        `json:"const"`
+	Default    json.RawMessage        `json:"default"`
+	AllOf      []*jsonSchema          `json:"allOf"`
+	AnyOf      []*jsonSchema          `json:"anyOf"`
+	OneOf      []*jsonSchema          `json:"oneOf"`
+}
+
+// fromJSONSchema converts a JSON Schema into the tables the analyzer would
+// infer from documents matching it
+type fromJSONSchema struct {
+	doc        interface{}            // the whole document, for resolving references
+	refs       map[string]*jsonSchema // decoded schemas by reference
+	schema     map[string]*TableSchema
+	textFields map[string]bool // string field -> every occurrence is an enum
+	jsonFields map[string]bool
+	defaults   map[string]interface{} // dotted field path -> default value
+	overrides  map[string]FieldType
+	visiting   map[*jsonSchema]bool // objects being converted, to stop at recursive references
+}
+
+// SchemaFromJSONSchema generates DDL from a JSON Schema document instead of
+// sampled documents. Nested objects with properties become tables, other
+// objects and arrays JSON columns, and strings limited to an enum symbol
+// candidates. Scalar defaults become DEFAULT clauses.
+//
+// The document may be JSON or YAML. A fragment (file#/components/schemas/Order)
+// selects the records' schema within it, as for an OpenAPI description.
+func SchemaFromJSONSchema(path string, opts AnalyzeOptions) (string, error) {
+	path, fragment, _ := strings.Cut(path, "#")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	c := &fromJSONSchema{
+		doc:        doc,
+		refs:       map[string]*jsonSchema{},
+		schema:     map[string]*TableSchema{},
+		textFields: map[string]bool{},
+		jsonFields: map[string]bool{},
+		defaults:   map[string]interface{}{},
+		overrides:  opts.Profile.typeOverrides(),
+		visiting:   map[*jsonSchema]bool{},
+	}
+	s, err := c.resolve(&jsonSchema{Ref: "#" + fragment})
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	props, err := c.properties(s)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	if props == nil {
+		return "", fmt.Errorf("%s: the root schema must be an object with properties", path)
+	}
+	if err := c.table("main", "", s); err != nil {
+		return "", fmt.Errorf("%s: %v", path, err)
+	}
+	// Defaults given on the command line win over the schema's
+	for field, v := range opts.Defaults {
+		c.defaults[field] = v
+	}
+	opts.Defaults = c.defaults
+	return schemaDDL(c.schema, c.textFields, c.jsonFields, nil, opts), nil
+}
+
+// resolve follows references within the document (#, #/$defs/...,
+// #/components/schemas/...)
+func (c *fromJSONSchema) resolve(s *jsonSchema) (*jsonSchema, error) {
+	for i := 0; s.Ref != ""; i++ {
+		if i == 32 {
+			return nil, fmt.Errorf("$ref %s: too many references", s.Ref)
+		}
+		next, err := c.lookup(s.Ref)
+		if err != nil {
+			return nil, fmt.Errorf("$ref %s: %v", s.Ref, err)
+		}
+		s = next
+	}
+	return s, nil
+}
+
+// lookup decodes the schema a JSON pointer reference points to. The same
+// reference always yields the same *jsonSchema, so recursion is detected.
+func (c *fromJSONSchema) lookup(ref string) (*jsonSchema, error) {
+	if s, ok := c.refs[ref]; ok {
+		return s, nil
+	}
+	pointer, ok := strings.CutPrefix(ref, "#")
+	if !ok {
+		return nil, fmt.Errorf("only references within the same document are supported")
+	}
+	node := c.doc
+	if pointer != "" {
+		for _, key := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+			key = strings.NewReplacer("~1", "/", "~0", "~").Replace(key)
+			m, _ := node.(map[string]interface{})
+			if node, ok = m[key]; !ok {
+				return nil, fmt.Errorf("no %q", key)
+			}
+		}
+	}
+	js, err := json.Marshal(node)
+	if err != nil {
+		return nil, err
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(js, &s); err != nil {
+		return nil, err
+	}
+	c.refs[ref] = &s
+	return &s, nil
+}
+
+// properties returns the properties of an object schema, including those of
+// its allOf branches, or nil if it declares none
+func (c *fromJSONSchema) properties(s *jsonSchema) (map[string]*jsonSchema, error) {
+	var props map[string]*jsonSchema
+	for name, p := range s.Properties {
+		if props == nil {
+			props = map[string]*jsonSchema{}
+		}
+		props[name] = p
+	}
+	for _, branch := range s.AllOf {
+		b, err := c.resolve(branch)
+		if err != nil {
+			return nil, err
+		}
+		more, err := c.properties(b)
+		if err != nil {
+			return nil, err
+		}
+		for name, p := range more {
+			if props == nil {
+				props = map[string]*jsonSchema{}
+			}
+			if _, ok := props[name]; !ok {
+				props[name] = p
+			}
+		}
+	}
+	return props, nil
+}
+
+// types returns the non-null types a schema allows, taking them from enum
+// or const values if it has no type
+func (s *jsonSchema) types() []string {
+	var types []string
+	switch t := s.Type.(type) {
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			if name, ok := v.(string); ok {
+				types = append(types, name)
+			}
+		}
+	}
+	if types == nil {
+		vals := s.Enum
+		var v interface{}
+		if json.Unmarshal(s.Const, &v) == nil {
+			vals = append(vals, v)
+		}
+		for _, v := range vals {
+			switch v.(type) {
+			case string:
+				types = append(types, "string")
+			case float64:
+				types = append(types, "number")
+			case bool:
+				types = append(types, "boolean")
+			}
+		}
+	}
+	var out []string
+	for _, t := range types {
+		if t != "null" && !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// nonNull picks the only non-null branch of an anyOf or oneOf, the way
+// nullable fields are commonly written
+func (c *fromJSONSchema) nonNull(s *jsonSchema) (*jsonSchema, bool, error) {
+	branches := append(append([]*jsonSchema{}, s.AnyOf...), s.OneOf...)
+	if len(branches) == 0 {
+		return s, true, nil
+	}
+	var only *jsonSchema
+	for _, branch := range branches {
+		b, err := c.resolve(branch)
+		if err != nil {
+			return nil, false, err
+		}
+		if b.Type != nil && len(b.types()) == 0 {
+			continue // the null branch
+		}
+		if only != nil {
+			return nil, false, nil
+		}
+		only = b
+	}
+	if only == nil {
+		return nil, false, nil
+	}
+	return only, true, nil
+}
+
+// table adds the columns of an object schema to the table named name, at
+// the dotted document path prefix
+func (c *fromJSONSchema) table(name, prefix string, s *jsonSchema) error {
+	if _, ok := c.schema[name]; !ok {
+		c.schema[name] = &TableSchema{Name: name, Fields: map[string]FieldType{}, FKs: map[string]string{}}
+	}
+	curr := c.schema[name]
+	props, err := c.properties(s)
+	if err != nil {
+		return err
+	}
+	c.visiting[s] = true
+	defer delete(c.visiting, s)
+	for k, p := range props {
+		if err := c.field(curr, k, prefix+k, p); err != nil {
+			return fmt.Errorf("%s: %v", prefix+k, err)
+		}
+	}
+	curr.Fields["id"] = TypeInt
+	return nil
+}
+
+// field adds the column of one property to curr
+func (c *fromJSONSchema) field(curr *TableSchema, k, path string, p *jsonSchema) error {
+	p, err := c.resolve(p)
+	if err != nil {
+		return err
+	}
+	if typ, ok := c.overrides[curr.Name+"."+k]; ok {
+		curr.Fields[k] = typ
+		c.candidate(k, typ, false)
+		return nil
+	}
+	p, single, err := c.nonNull(p)
+	if err != nil {
+		return err
+	}
+	if !single {
+		curr.Fields[k] = TypeJSON
+		c.candidate(k, TypeJSON, false)
+		return nil
+	}
+	types := p.types()
+	props, err := c.properties(p)
+	if err != nil {
+		return err
+	}
+	if len(types) == 0 && props != nil {
+		types = []string{"object"}
+	}
+	var typ FieldType
+	switch {
+	case len(types) == 1 && types[0] == "object" && props != nil && !c.visiting[p]:
+		curr.Fields[k+"_id"] = TypeInt
+		curr.FKs[k+"_id"] = k
+		return c.table(k, path+".", p)
+	case len(types) == 1 && types[0] == "string":
+		typ = TypeText
+	case len(types) == 1 && types[0] == "integer":
+		typ = TypeInt
+	case len(types) == 1 && types[0] == "boolean":
+		typ = TypeBool
+	case len(types) > 0 && !slices.Contains(types, "string") && !slices.Contains(types, "boolean") &&
+		!slices.Contains(types, "object") && !slices.Contains(types, "array"):
+		typ = TypeReal // number, or integer and number
+	default:
+		typ = TypeJSON
+	}
+	if prev := curr.Fields[k]; prev != "" && prev != typ {
+		typ = TypeJSON // the same table reached through different properties
+	}
+	curr.Fields[k] = typ
+	c.candidate(k, typ, len(p.Enum) > 0 || len(p.Const) > 0)
+	var def interface{}
+	if typ != TypeJSON && json.Unmarshal(p.Default, &def) == nil && def != nil {
+		c.defaults[path] = def
+	}
+	return nil
+}
+
+// candidate records a text or JSON field; it is a symbol candidate only if
+// every property of that name is limited to a few values
+func (c *fromJSONSchema) candidate(k string, typ FieldType, enum bool) {
+	fields := c.textFields
+	switch typ {
+	case TypeText:
+	case TypeJSON:
+		fields, enum = c.jsonFields, false
+	default:
+		return
+	}
+	if prev, seen := fields[k]; seen {
+		enum = enum && prev
+	}
+	fields[k] = enum
+}
@@ -0,0 +1,155 @@
+package jsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+)
+
+// keyOrderColumn is the optional root-table column recording the order of
+// the keys of each document as it was loaded, so that dump
+// --preserve-key-order writes them back in that order rather than sorted,
+// for consumers diffing dumps textually against their sources. It holds
+// the dotted paths of the document's keys, array elements numbered, in
+// the order they appear, as a JSON array. Like _ord it is filled by the
+// loader, never from the input.
+const keyOrderColumn = "_key_order"
+
+// reKeyOrderDirective matches the directive marking the root table of a
+// schema analyzed with --preserve-key-order
+//
+//	-- jsql:key-order main
+var reKeyOrderDirective = regexp.MustCompile(`^--\s*jsql:key-order\s+(\w+)\s*$`)
+
+// keyOrder returns the JSON array of the paths of the keys of a line, in
+// the order they appear in it
+func keyOrder(line []byte) (string, error) {
+	paths := []string{}
+	seen := map[string]bool{}
+	err := walkTokens(line, func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+	js, err := json.Marshal(paths)
+	return string(js), err
+}
+
+// walkTokens calls key with the path of every key of a line and scalar
+// with the path and token of every other value, in the order they appear.
+// Paths are dotted, with array elements numbered; numbers are json.Numbers.
+func walkTokens(line []byte, key func(path string), scalar func(path string, tok json.Token)) error {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+	join := func(path, seg string) string {
+		if path == "" {
+			return seg
+		}
+		return path + "." + seg
+	}
+	var walk func(path string) error
+	walk = func(path string) error {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'):
+			for dec.More() {
+				tok, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				sub := join(path, escapeSegment(tok.(string), "."))
+				if key != nil {
+					key(sub)
+				}
+				if err := walk(sub); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(join(path, strconv.Itoa(i))); err != nil {
+					return err
+				}
+			}
+		default:
+			if scalar != nil {
+				scalar(path, tok)
+			}
+			return nil
+		}
+		_, err = dec.Token()
+		return err
+	}
+	return walk("")
+}
+
+// recordLayout adds the key order and number texts of line to the
+// provenance values of its rows, if the root table keeps them
+func (dbs *DatabaseSchema) recordLayout(prov map[string]interface{}, line []byte) error {
+	root := dbs.Tables[dbs.Root]
+	if root == nil {
+		return nil
+	}
+	if root.KeyOrder {
+		order, err := keyOrder(line)
+		if err != nil {
+			return err
+		}
+		prov[keyOrderColumn] = order
+	}
+	if root.NumberText {
+		texts, err := numberTexts(line)
+		if err != nil {
+			return err
+		}
+		prov[numberTextColumn] = texts
+	}
+	return nil
+}
+
+// layoutColumn reports whether col of table records a layout the dump
+// writes documents in, and is passed on to dumpTable rather than left out
+func (d *Dumper) layoutColumn(table *TableSchema, col string) bool {
+	return table.KeyOrder && col == keyOrderColumn && d.opts.PreserveKeyOrder || table.NumberText && col == numberTextColumn && d.opts.NumberMode == NumberModeString
+}
+
+// takeLayout removes the layout columns from a dumped document of table
+// and returns the layout they record
+func (d *Dumper) takeLayout(table *TableSchema, obj map[string]interface{}) docLayout {
+	var l docLayout
+	if v, ok := obj[keyOrderColumn]; ok && d.layoutColumn(table, keyOrderColumn) {
+		l.order = keyRanks(v)
+		delete(obj, keyOrderColumn)
+	}
+	if v, ok := obj[numberTextColumn]; ok && d.layoutColumn(table, numberTextColumn) {
+		l.numbers = numberTextsOf(v)
+		delete(obj, numberTextColumn)
+	}
+	return l
+}
+
+// keyRanks returns the position of each path recorded in a _key_order
+// value, or nil if it holds none
+func keyRanks(v interface{}) map[string]int {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	var paths []string
+	if err := json.Unmarshal([]byte(s), &paths); err != nil || len(paths) == 0 {
+		return nil
+	}
+	ranks := make(map[string]int, len(paths))
+	for i, p := range paths {
+		ranks[p] = i
+	}
+	return ranks
+}
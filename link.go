@@ -0,0 +1,135 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Links between datasets are declared in the DDL as comment directives
+//
+//	-- jsql:link orders.user -> users.name
+//
+// next to a column user_ref INTEGER REFERENCES users(id). The loader keeps
+// the user field as it is and, after every load, sets user_ref to the id of
+// the users row whose name equals it. References that do not match yet stay
+// NULL and are retried on the next load, so datasets can be loaded in any
+// order.
+var reLinkDirective = regexp.MustCompile(`^--\s*jsql:link\s+(\w+)\.(\w+)\s*->\s*(\w+)\.(\w+)\s*$`)
+
+// Link resolves a field to the row of another table holding the same value
+type Link struct {
+	Field string `json:"field"` // field of the referencing documents
+	Table string `json:"table"` // referenced table
+	Key   string `json:"key"`   // natural key field of the referenced table
+}
+
+// linkColumn returns the column holding the resolved row id of field
+func linkColumn(field string) string {
+	return field + "_ref"
+}
+
+// LoadLinks reads a YAML map of "table.field: table.key" declarations
+func LoadLinks(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var links map[string]string
+	if err := yaml.Unmarshal(data, &links); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	reRef := regexp.MustCompile(`^\w+\.\w+$`)
+	for from, to := range links {
+		if !reRef.MatchString(from) || !reRef.MatchString(to) {
+			return nil, fmt.Errorf("%s: %s: %s must be table.field: table.field", path, from, to)
+		}
+	}
+	return links, nil
+}
+
+// sortedLinks returns the links of a table ordered by column
+func sortedLinks(t *TableSchema) []Link {
+	cols := make([]string, 0, len(t.Links))
+	for col := range t.Links {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	links := make([]Link, len(cols))
+	for i, col := range cols {
+		links[i] = t.Links[col]
+	}
+	return links
+}
+
+// fieldValueExpr returns SQL for the value of field in table row qual,
+// looking symbolized fields up in their symbol table
+func fieldValueExpr(t *TableSchema, field, qual string) string {
+	if col := t.Naming.SymbolColumn(field); t.FKs[col] != "" {
+		return fmt.Sprintf("(SELECT json_extract(value, '$') FROM %[1]s WHERE %[1]s.id = %[2]s.%[3]s)", t.FKs[col], qual, col)
+	}
+	return qual + "." + field
+}
+
+// resolveLinks fills the unresolved link columns of every table, returning
+// how many references of each "table.field" still have no match
+func resolveLinks(tx *sql.Tx, dbs *DatabaseSchema) (map[string]int64, error) {
+	pending := map[string]int64{}
+	for _, name := range dbs.TableOrder {
+		t := dbs.Tables[name]
+		for _, l := range sortedLinks(t) {
+			target := dbs.Tables[l.Table]
+			if target == nil {
+				return nil, fmt.Errorf("link %s.%s: schema has no table %s", name, l.Field, l.Table)
+			}
+			src := fieldValueExpr(t, l.Field, name)
+			where := fmt.Sprintf("%s IS NULL AND %s IS NOT NULL", linkColumn(l.Field), src)
+			q := fmt.Sprintf("UPDATE %s SET %s = (SELECT target.id FROM %s AS target WHERE %s = %s LIMIT 1) WHERE %s",
+				name, linkColumn(l.Field), l.Table, fieldValueExpr(target, l.Key, "target"), src, where)
+			if _, err := tx.Exec(q); err != nil {
+				return nil, fmt.Errorf("link %s.%s: %v", name, l.Field, err)
+			}
+			var n int64
+			if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", name, where)).Scan(&n); err != nil {
+				return nil, fmt.Errorf("link %s.%s: %v", name, l.Field, err)
+			}
+			if n > 0 {
+				pending[name+"."+l.Field] = n
+			}
+		}
+	}
+	return pending, nil
+}
+
+// declaredLinks returns the links (as read by LoadLinks) from those fields
+// of table that are in fields
+func declaredLinks(links map[string]string, table string, fields map[string]FieldType) []Link {
+	var out []Link
+	for from, to := range links {
+		fromTable, field, _ := strings.Cut(from, ".")
+		toTable, key, _ := strings.Cut(to, ".")
+		if fromTable == table && fields[field] != "" {
+			out = append(out, Link{Field: field, Table: toTable, Key: key})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Field < out[j].Field })
+	return out
+}
+
+// linkedKeys returns the natural key fields of table that links refer to
+func linkedKeys(links map[string]string, table string) []string {
+	var keys []string
+	for _, to := range links {
+		if toTable, key, _ := strings.Cut(to, "."); toTable == table {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return slices.Compact(keys)
+}
@@ -1,31 +1,163 @@
-package main
+package jsql
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io"
+	"io/fs"
+	"maps"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// reProvenanceDirective matches the directive marking the root table of a
+// schema analyzed with --provenance
+//
+//	-- jsql:provenance main
+var reProvenanceDirective = regexp.MustCompile(`^--\s*jsql:provenance\s+(\w+)\s*$`)
+
+// provenanceColumns are the optional root-table columns recording where
+// each row came from. They are filled by the loader, never from the input.
+var provenanceColumns = map[string]bool{
+	"_line":        true,
+	"_source":      true,
+	"_ingested_at": true,
+}
+
+// provenance returns the values for the provenance columns of one record
+func provenance(source string, line int) map[string]interface{} {
+	return map[string]interface{}{
+		"_line":        line,
+		"_source":      source,
+		"_ingested_at": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// returningSupported reports whether the linked SQLite (3.35 or later)
+// accepts INSERT ... RETURNING, which hands back the id of a new row in the
+// same round trip
+var returningSupported = func() bool {
+	_, n, _ := sqlite3.Version()
+	return n >= 3035000
+}()
+
+// insertID runs the INSERT q of one row and returns the row's id, with
+// RETURNING if the dialect supports it and the table has an id column, and
+// LastInsertId otherwise
+func insertID(tx *sql.Tx, d Dialect, q string, hasID bool, args ...any) (int64, error) {
+	var id int64
+	if d.Returning() && hasID {
+		err := tx.QueryRow(q+" RETURNING id", args...).Scan(&id)
+		return id, err
+	}
+	res, err := tx.Exec(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
 // InsertRow inserts a row into a table
 // Shorter, always uses consistent marshaling for arrays/objects
 func InsertRow(tx *sql.Tx, table *TableSchema, obj map[string]interface{}, dbs *DatabaseSchema) (int64, error) {
+	return insertRow(tx, table, obj, dbs, nil)
+}
+
+// insertRow inserts a row, taking provenance column values from prov, and
+// its id and ord too if prov has them, as for a row replaced in place
+func insertRow(tx *sql.Tx, table *TableSchema, obj map[string]interface{}, dbs *DatabaseSchema, prov map[string]interface{}) (int64, error) {
+	doc := obj
+	obj = table.columnKeys(obj)
+	// Rows referenced by a composite key are found or inserted first, and
+	// their keys copied into the referencing columns
+	cloned := false
+	for _, fk := range table.ForeignKeys {
+		ref, ok := obj[fk.Field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if err := insertReferenced(tx, dbs, fk, ref); err != nil {
+			return 0, err
+		}
+		if !cloned {
+			obj, cloned = maps.Clone(obj), true
+		}
+		for j, col := range fk.Columns {
+			obj[col] = ref[fk.References[j]]
+		}
+	}
 	cols := []string{}
 	vals := []interface{}{}
+	fallbacks := map[string]interface{}{}
 
 	for field := range table.Fields {
-		if field == "id" {
+		if id, ok := prov["id"]; ok && field == "id" {
+			cols = append(cols, field)
+			vals = append(vals, id)
+			continue
+		}
+		if _, isFallback := fallbackField(table, field); field == "id" || isFallback {
 			continue
 		}
-		
+		if table.Provenance && provenanceColumns[field] || table.KeyOrder && field == keyOrderColumn || table.NumberText && field == numberTextColumn {
+			cols = append(cols, field)
+			vals = append(vals, prov[field])
+			continue
+		}
+		if table.Ord && field == ordColumn {
+			ord, ok := prov[ordColumn]
+			if !ok {
+				var err error
+				if ord, err = nextOrd(tx, table); err != nil {
+					return 0, err
+				}
+			}
+			cols = append(cols, field)
+			vals = append(vals, ord)
+			continue
+		}
+		if base, ok := timeColumnOf(table, field); ok {
+			_, offset := utcTimeValues(obj[base])
+			cols = append(cols, field)
+			vals = append(vals, offset)
+			continue
+		}
+		if c := table.Computed[field]; c != nil {
+			val, err := c.eval(doc)
+			if err != nil {
+				return 0, err
+			}
+			cols = append(cols, field)
+			vals = append(vals, val)
+			continue
+		}
+
 		// Symbol table lookups
-		if fk := table.FKs[field]; fk != "" && strings.HasSuffix(field, "_symbol") {
-			val := obj[strings.TrimSuffix(field, "_symbol")]
+		if base, isSym := table.Naming.symbolField(field); isSym && table.FKs[field] != "" {
+			fk := table.FKs[field]
+			val := obj[base]
 			symTab := dbs.Tables[fk]
-			id, err := getOrInsertSymbol(tx, symTab, val)
+			id, err := dbs.symbolID(tx, symTab, val)
+			if err != nil {
+				return 0, err
+			}
+			cols = append(cols, field)
+			vals = append(vals, id)
+			continue
+		}
+
+		// Lookup tables of a mapping
+		if l, ok := table.Lookups[field]; ok {
+			id, err := l.rowID(tx, obj[field])
 			if err != nil {
 				return 0, err
 			}
@@ -35,8 +167,8 @@ func InsertRow(tx *sql.Tx, table *TableSchema, obj map[string]interface{}, dbs *
 		}
 
 		// Nested subtable
-		if fk := table.FKs[field]; fk != "" && strings.HasSuffix(field, "_id") {
-			base := strings.TrimSuffix(field, "_id")
+		if base, isObj := table.Naming.objectField(field); isObj && table.FKs[field] != "" {
+			fk := table.FKs[field]
 			if v, ok := obj[base].(map[string]interface{}); ok && v != nil {
 				subTab := dbs.Tables[fk]
 				subID, err := InsertRow(tx, subTab, v, dbs)
@@ -47,6 +179,9 @@ func InsertRow(tx *sql.Tx, table *TableSchema, obj map[string]interface{}, dbs *
 				vals = append(vals, subID)
 				continue
 			}
+			if v := obj[base]; v != nil && dbs.FallbackJSON {
+				fallbacks[base] = v
+			}
 			cols = append(cols, field)
 			vals = append(vals, nil)
 			continue
@@ -55,73 +190,412 @@ func InsertRow(tx *sql.Tx, table *TableSchema, obj map[string]interface{}, dbs *
 		// Normal field
 		raw, ok := obj[field]
 		if !ok {
+			raw, ok = table.Defaults[field]
+		}
+		if !ok && table.ExprDefaults[field] {
+			continue
+		}
+		if !ok || raw == nil {
 			cols = append(cols, field)
 			vals = append(vals, nil)
 			continue
 		}
-		switch raw.(type) {
+		if table.Fields[field] == TypeUTCTime {
+			epoch, _ := utcTimeValues(raw)
+			cols = append(cols, field)
+			vals = append(vals, epoch)
+			continue
+		}
+		if typ := table.Fields[field]; typ == TypeGeoJSON || typ == TypeWKB {
+			cols = append(cols, field)
+			vals = append(vals, geometryValue(raw, typ))
+			continue
+		}
+		switch v := raw.(type) {
 		case []interface{}, map[string]interface{}:
 			js, _ := json.Marshal(raw)
+			stored, err := dbs.Blobs.externalize(string(js))
+			if err != nil {
+				return 0, err
+			}
+			cols = append(cols, field)
+			vals = append(vals, stored)
+		case string:
+			stored, err := dbs.Blobs.externalize(v)
+			if err != nil {
+				return 0, err
+			}
 			cols = append(cols, field)
-			vals = append(vals, string(js))
+			vals = append(vals, stored)
 		default:
 			cols = append(cols, field)
 			vals = append(vals, raw)
 		}
 	}
 
+	for field, v := range fallbacks {
+		if err := dbs.downgrade(tx, table, field); err != nil {
+			return 0, err
+		}
+		cols = append(cols, fallbackColumn(field))
+		vals = append(vals, fallbackValue(v))
+	}
+
 	if len(cols) == 0 {
 		return 0, nil
 	}
-	q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
-		table.Name,
-		strings.Join(cols, ", "),
-		strings.TrimRight(strings.Repeat("?,", len(cols)), ","),
-	)
-	res, err := tx.Exec(q, vals...)
+	insert := func() (int64, error) {
+		defer tableQueries.observe(table.Name, time.Now())
+		q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+			quoteIdent(table.Name),
+			strings.Join(quoteIdents(cols), ", "),
+			strings.TrimRight(strings.Repeat("?,", len(cols)), ","),
+		)
+		return insertID(tx, dbs.dialect(), q, table.Fields["id"] != "", vals...)
+	}
+	id, err := insert()
+	// Values a STRICT table refuses move to the field's fallback column
+	for err != nil && dbs.FallbackJSON {
+		m := reStrictMismatch.FindStringSubmatch(err.Error())
+		if m == nil || table.FKs[m[1]] != "" || slices.Contains(cols, fallbackColumn(m[1])) {
+			break
+		}
+		i := slices.Index(cols, m[1])
+		if i < 0 {
+			break
+		}
+		if err := dbs.downgrade(tx, table, m[1]); err != nil {
+			return 0, err
+		}
+		cols = append(cols, fallbackColumn(m[1]))
+		vals = append(vals, fallbackValue(obj[m[1]]))
+		vals[i] = nil
+		id, err = insert()
+	}
 	if err != nil {
 		return 0, fmt.Errorf("insert %s: %v (cols=%v vals=%v)", table.Name, err, cols, vals)
 	}
-	return res.LastInsertId()
+	for col, rtree := range table.SpatialIndexes {
+		minX, minY, maxX, maxY, ok := geometryBounds(obj[col])
+		if !ok || !isGeometry(obj[col]) {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s VALUES (?, ?, ?, ?, ?)", rtree), id, minX, maxX, minY, maxY); err != nil {
+			return 0, fmt.Errorf("index %s: %v", rtree, err)
+		}
+	}
+	return id, nil
+}
+
+// insertReferenced inserts ref into the table fk references unless a row
+// with its key is there already
+func insertReferenced(tx *sql.Tx, dbs *DatabaseSchema, fk ForeignKey, ref map[string]interface{}) error {
+	target := dbs.Tables[fk.Table]
+	if target == nil {
+		return fmt.Errorf("%s references unknown table %s", fk.Field, fk.Table)
+	}
+	where, args := keyCondition(fk.References, target.columnKeys(ref))
+	var n int
+	if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", quoteIdent(target.Name), where), args...).Scan(&n); err != nil {
+		return fmt.Errorf("%s: %v", fk.Field, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	_, err := insertRow(tx, target, ref, dbs, nil)
+	return err
 }
 
-// LoadData loads data from a JSON file into the database
-func LoadData(jsonPath, dbPath string, dbs *DatabaseSchema) error {
-	db, err := sql.Open("sqlite3", dbPath)
+// keyCondition returns the WHERE condition matching the values of the key
+// columns in row, and its arguments
+func keyCondition(columns []string, row map[string]interface{}) (string, []any) {
+	conds := make([]string, len(columns))
+	args := make([]any, len(columns))
+	for i, col := range columns {
+		conds[i] = quoteIdent(col) + " = ?"
+		args[i] = row[col]
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// LoadData loads data from a JSON file, or standard input for "-", into
+// the database. Cancelling ctx interrupts the load and rolls back the
+// transaction in progress.
+func LoadData(ctx context.Context, jsonPath, dbPath string, dbs *DatabaseSchema) error {
+	f, err := openInputFile(jsonPath)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	defer f.Close()
+	return loadReader(ctx, f, InputName(jsonPath), dbPath, dbs)
+}
 
-	f, err := os.Open(jsonPath)
+// LoadDataFS loads data from a JSON file of fsys into the database, as
+// LoadData does
+func LoadDataFS(ctx context.Context, fsys fs.FS, name, dbPath string, dbs *DatabaseSchema) error {
+	f, err := fsys.Open(name)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	return loadReader(ctx, f, name, dbPath, dbs)
+}
+
+// loadReader loads the line-delimited JSON documents of r, recording
+// source as their provenance
+func loadReader(ctx context.Context, r io.Reader, source, dbPath string, dbs *DatabaseSchema) (err error) {
+	defer func() { err = timedOut(ctx, err) }()
+	db, err := dbs.dialect().Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	load := startPhase("load", attribute.String("jsql.input", source), attribute.String("jsql.db", dbPath))
+	defer load.end()
+	return loadDB(ctx, db, r, source, dbs, load)
+}
+
+// Load loads the documents of r, one JSON object per line, into the root
+// table of dbs in db, in one transaction that ctx can cancel, or in one
+// every dbs.BatchSize lines if it is set. Documents that fail to load are
+// left out, as by the load command: reported on dbs.Log, or quarantined if
+// dbs.Quarantine is set.
+func Load(ctx context.Context, db *sql.DB, r io.Reader, dbs *DatabaseSchema) error {
+	load := startPhase("load")
+	defer load.end()
+	return loadDB(ctx, db, r, "reader", dbs, load)
+}
 
-	scanner := bufio.NewScanner(f)
-	tx, err := db.Begin()
+// maxLineBytes bounds a line of input, which is held in memory whole. It
+// is well above the default --blob-threshold, so that values large enough
+// to go to a blob store can be read.
+const maxLineBytes = 256 << 20
+
+// loadDB loads the documents of r into db, recording source as their
+// provenance and the number of lines read in load
+func loadDB(ctx context.Context, db *sql.DB, r io.Reader, source string, dbs *DatabaseSchema, load *phase) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineBytes)
+	start := time.Now()
+	var tx *sql.Tx
+	var deferred *deferredTriggers
+	var txRows int64 // rows ingested when the transaction began
+	begin := func() error {
+		var err error
+		if tx, err = db.BeginTx(ctx, nil); err != nil {
+			return err
+		}
+		txRows = metrics.rowsIngested.Load()
+		if dbs.DeferTriggers {
+			if deferred, err = deferTriggers(tx, dbs); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		return nil
+	}
+	if err := begin(); err != nil {
+		return err
+	}
+	lookups, err := createLookupIndexes(tx, dbs)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	mainTable := dbs.Tables["main"]
+	// The symbol ids of the load are cached on a copy of dbs, so that loads
+	// sharing it do not share the cache; the statements the load altered
+	// the tables with are reported on dbs
+	own := *dbs
+	own.symbols = &symbolCache{ids: map[string]int64{}}
+	defer func(caller *DatabaseSchema) { caller.Altered = own.Altered }(dbs)
+	dbs = &own
+	chunks := newChunker(tx, dbs)
 
+	// Lines are read symbolBatch at a time and their documents prepared, so
+	// that the symbols of all of them are resolved with a few queries
+	// before the documents are inserted one by one
+	type pendingLine struct {
+		num      int
+		line     []byte
+		obj      map[string]interface{}
+		rows     []map[string]interface{}
+		parseErr error
+		err      error // preparing the document
+	}
+	var batch []pendingLine
+	loadBatch := func() error {
+		var rows []map[string]interface{}
+		for i := range batch {
+			p := &batch[i]
+			if p.parseErr = dbs.decodeDocument(p.line, &p.obj); p.parseErr != nil {
+				continue
+			}
+			if p.rows, p.err = dbs.prepareRows(p.obj); p.err == nil {
+				rows = append(rows, p.rows...)
+			}
+		}
+		// Strict loads resolve symbols row by row, inside the savepoints
+		// of their chunks
+		var inserted map[string]int64
+		if !dbs.Strict {
+			var err error
+			if inserted, err = dbs.resolveSymbols(tx, rows); err != nil {
+				return err
+			}
+		}
+		var failed []map[string]interface{}
+		for _, p := range batch {
+			if err := chunks.next(p.num); err != nil {
+				return err
+			}
+			if chunks.skipping() {
+				continue
+			}
+			if p.parseErr != nil {
+				logf(dbs.Log, "skip JSON line %d: %v\n", p.num, p.parseErr)
+				metrics.parseErrors.Add(1)
+				if err := dbs.quarantine(tx, p.line, p.parseErr, source, p.num); err != nil {
+					return err
+				}
+				if err := dbs.failChunk(chunks, p.num, p.parseErr); err != nil {
+					return err
+				}
+				continue
+			}
+			err := p.err
+			if err == nil {
+				prov := provenance(source, p.num)
+				if err = dbs.recordLayout(prov, p.line); err == nil {
+					err = dbs.insertPrepared(tx, p.rows, prov)
+				}
+			}
+			if err != nil {
+				dbs.symbols.rollbackDocument()
+				failed = append(failed, p.rows...)
+				logf(dbs.Log, "Load row %d: %v\n", p.num, err)
+				metrics.rowErrors.Add(1)
+				if err := dbs.quarantine(tx, p.line, err, source, p.num); err != nil {
+					return err
+				}
+				if err := dbs.failChunk(chunks, p.num, err); err != nil {
+					return err
+				}
+				continue
+			}
+			dbs.symbols.releaseDocument()
+			chunks.inserted()
+			metrics.rowsIngested.Add(1)
+			metrics.pendingRows.Add(1)
+		}
+		batch = batch[:0]
+		return dbs.dropUnusedSymbols(tx, inserted, failed)
+	}
+	// With dbs.BatchSize, a transaction is committed every BatchSize
+	// input lines, so that a failure keeps the batches committed before
+	batches, lastLine, committedLine := 0, 0, 0
+	// fail rolls back the transaction. The lookup indexes committed with
+	// the batches before are dropped on their own.
+	fail := func(err error) error {
+		tx.Rollback()
+		if batches > 0 {
+			if derr := lookups.dropDB(db); derr != nil {
+				err = fmt.Errorf("%v; %v", err, derr)
+			}
+			return fmt.Errorf("%v (%s)", err, batchSummary(batches, committedLine))
+		}
+		return err
+	}
+	// commit ends the transaction: the triggers deferred are restored, the
+	// links of its rows resolved, the write recorded in the audit log and,
+	// at the end of the load, the lookup indexes dropped
+	commit := func(last bool) error {
+		if err := chunks.close(); err != nil {
+			return fail(err)
+		}
+		if deferred != nil {
+			if err := deferred.restore(tx); err != nil {
+				return fail(err)
+			}
+		}
+		pending, err := resolveLinks(tx, dbs)
+		if err != nil {
+			return fail(err)
+		}
+		if last {
+			for ref, n := range pending {
+				logf(dbs.Log, "%s: %d references without a match yet\n", ref, n)
+			}
+			if err := lookups.drop(tx); err != nil {
+				return fail(err)
+			}
+		}
+		// A last transaction reading no lines after others has no entry
+		if batches == 0 || lastLine > committedLine {
+			if err := dbs.Audit.record(tx, metrics.rowsIngested.Load()-txRows); err != nil {
+				return fail(fmt.Errorf("audit: %v", err))
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return fail(err)
+		}
+		dbs.symbols.commit()
+		batches, committedLine = batches+1, lastLine
+		metrics.pendingRows.Store(0)
+		metrics.lastCommit.Store(time.Now().UnixNano())
+		metrics.observeBatch(time.Since(start))
+		start = time.Now()
+		return nil
+	}
 	lineNum := 0
 	for scanner.Scan() {
 		lineNum++
 		line := scanner.Bytes()
-		if len(bytes.TrimSpace(line)) == 0 {
-			continue
-		}
-		var obj map[string]interface{}
-		if err := json.Unmarshal(line, &obj); err != nil {
-			fmt.Fprintf(os.Stderr, "skip JSON line %d: %v\n", lineNum, err)
-			continue
+		if len(bytes.TrimSpace(line)) > 0 {
+			batch = append(batch, pendingLine{num: lineNum, line: bytes.Clone(line)})
+			lastLine = lineNum
 		}
-		if _, err := InsertRow(tx, mainTable, obj, dbs); err != nil {
-			fmt.Fprintf(os.Stderr, "Load row %d: %v\n", lineNum, err)
-			continue
+		if dbs.BatchSize > 0 && lineNum%dbs.BatchSize == 0 {
+			if err := loadBatch(); err != nil {
+				return fail(err)
+			}
+			if err := commit(false); err != nil {
+				return err
+			}
+			if err := begin(); err != nil {
+				return fail(err)
+			}
+			// Batches end at the end of a chunk, so the next line
+			// takes a savepoint in the new transaction
+			if chunks != nil {
+				chunks.tx = tx
+			}
+		} else if len(batch) == symbolBatch {
+			if err := loadBatch(); err != nil {
+				return fail(err)
+			}
 		}
 	}
-	return tx.Commit()
+	if err := scanner.Err(); err != nil {
+		return fail(err)
+	}
+	if err := loadBatch(); err != nil {
+		return fail(err)
+	}
+	if err := commit(true); err != nil {
+		return err
+	}
+	dbs.printDowngrades()
+	if dbs.BatchSize > 0 {
+		logf(dbs.Log, "Committed %s\n", batchSummary(batches, committedLine))
+	}
+	load.set(attribute.Int("jsql.lines", lineNum))
+	return chunks.err()
+}
+
+// batchSummary describes the batches committed by a load with a batch size
+func batchSummary(batches, line int) string {
+	if line == 0 {
+		return fmt.Sprintf("%d batches, no rows", batches)
+	}
+	return fmt.Sprintf("%d batches, the last row at line %d", batches, line)
 }
\ No newline at end of file
@@ -0,0 +1,94 @@
+package jsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// SQLite lets one connection write at a time, but a load commits as it
+// goes: two processes loading into one database would take turns at its
+// write lock and interleave their work, or one would fail midway with
+// "database is locked". Commands that write or replace a database
+// therefore first take an advisory lock of the whole database, held until
+// they exit (an import into memory locks the file it serializes to): an
+// exclusive lock (flock, or LockFileEx on Windows) of the sidecar file
+// <db>.lock, which records the process holding it. The lock file is left
+// in place, as removing it would let a waiting process lock a file no one
+// else opens.
+
+// ErrLocked is returned by LockDatabase while another process holds the
+// lock of the database
+var ErrLocked = errors.New("database is being written by another process")
+
+// lockPoll is how often a locked database is tried again
+const lockPoll = 100 * time.Millisecond
+
+// DatabaseLock is the held write lock of a database
+type DatabaseLock struct {
+	f *os.File
+}
+
+// lockPath returns the lock file of a database
+func lockPath(dbPath string) string {
+	return dbPath + ".lock"
+}
+
+// LockDatabase takes the write lock of the database at dbPath, waiting up
+// to wait for another process to release it. It returns an error wrapping
+// ErrLocked and naming the holder if the lock is still held then, or ctx's
+// error if ctx is done first.
+func LockDatabase(ctx context.Context, dbPath string, wait time.Duration) (*DatabaseLock, error) {
+	f, err := os.OpenFile(lockPath(dbPath), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.After(wait)
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("lock %s: %v", f.Name(), err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-time.After(lockPoll):
+			continue
+		case <-timeout:
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		}
+		f.Close()
+		return nil, fmt.Errorf("%s: %w (%s)", dbPath, ErrLocked, LockHolder(dbPath))
+	}
+	holder := fmt.Sprintf("pid %d, jsql %s, since %s\n", os.Getpid(), strings.Join(os.Args[1:min(2, len(os.Args))], " "), time.Now().UTC().Format(time.RFC3339))
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(holder), 0)
+	}
+	return &DatabaseLock{f: f}, nil
+}
+
+// LockHolder describes the process holding the lock of a database, as it
+// recorded itself
+func LockHolder(dbPath string) string {
+	data, err := os.ReadFile(lockPath(dbPath))
+	if holder := strings.TrimSpace(string(data)); err == nil && holder != "" {
+		return holder
+	}
+	return "holder unknown"
+}
+
+// Unlock releases the lock
+func (l *DatabaseLock) Unlock() error {
+	if l == nil {
+		return nil
+	}
+	l.f.Truncate(0)
+	return l.f.Close()
+}
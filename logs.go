@@ -0,0 +1,212 @@
+package jsql
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// logParsers turn one line of a log format into a document
+var logParsers = map[string]func(string) (map[string]interface{}, error){
+	"logfmt": parseLogfmt,
+	"clf":    parseCLF,
+	"syslog": parseSyslog,
+}
+
+// LogSource reads a log file, parsing each line into a document. Lines that
+// do not parse are reported and skipped, keeping the line numbers of the
+// others.
+type LogSource struct {
+	Path   string
+	Format string    // a key of logParsers
+	Log    io.Writer // receives the lines skipped; nil discards them
+}
+
+func (l *LogSource) String() string {
+	return l.Path
+}
+
+// Export writes each parsed line as a JSON line
+func (l *LogSource) Export(w io.Writer, limit int) error {
+	f, err := openInputFile(l.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	parse := logParsers[l.Format]
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for n := 1; (limit <= 0 || n <= limit) && sc.Scan(); n++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			bw.WriteByte('\n')
+			continue
+		}
+		doc, err := parse(line)
+		if err != nil {
+			logf(l.Log, "skip %s line %d: %v\n", l.Format, n, err)
+			metrics.parseErrors.Add(1)
+			bw.WriteByte('\n')
+			continue
+		}
+		if err := enc.Encode(doc); err != nil {
+			return fmt.Errorf("%s: line %d: %v", l.Path, n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %v", l.Path, err)
+	}
+	return bw.Flush()
+}
+
+// parseLogfmt parses key=value pairs. Values may be double-quoted with Go
+// escapes; a key without a value is true. Values stay strings.
+func parseLogfmt(line string) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	for i := 0; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		start := i
+		for i < len(line) && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		key := line[start:i]
+		if key == "" {
+			return nil, fmt.Errorf("column %d: missing key", start+1)
+		}
+		if i == len(line) || line[i] != '=' {
+			doc[key] = true
+			continue
+		}
+		i++ // '='
+		if i < len(line) && line[i] == '"' {
+			end := i + 1
+			for end < len(line) && line[end] != '"' {
+				if line[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("column %d: unterminated quote", i+1)
+			}
+			v, err := strconv.Unquote(line[i : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("column %d: %v", i+1, err)
+			}
+			doc[key] = v
+			i = end + 1
+			continue
+		}
+		start = i
+		for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		doc[key] = line[start:i]
+	}
+	if len(doc) == 0 {
+		return nil, fmt.Errorf("no key=value pairs")
+	}
+	return doc, nil
+}
+
+// reCLF matches the Common Log Format, optionally followed by the referer
+// and user agent of the Combined Log Format
+var reCLF = regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "((?:[^"\\]|\\.)*)" (\d{3}|-) (\d+|-)(?: "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)")?`)
+
+// parseCLF parses a Common (or Combined) Log Format line into host, ident,
+// user, time (RFC 3339), request with its method, path and protocol, status,
+// bytes, referer and user_agent. Fields logged as "-" are left out.
+func parseCLF(line string) (map[string]interface{}, error) {
+	m := reCLF.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("not in common log format")
+	}
+	doc := map[string]interface{}{}
+	set := func(key, v string) {
+		if v != "-" && v != "" {
+			doc[key] = v
+		}
+	}
+	set("host", m[1])
+	set("ident", m[2])
+	set("user", m[3])
+	if t, err := time.Parse("02/Jan/2006:15:04:05 -0700", m[4]); err == nil {
+		doc["time"] = t.Format(time.RFC3339)
+	} else {
+		doc["time"] = m[4]
+	}
+	request := strings.ReplaceAll(m[5], `\"`, `"`)
+	set("request", request)
+	if parts := strings.Fields(request); len(parts) == 3 {
+		doc["method"], doc["path"], doc["protocol"] = parts[0], parts[1], parts[2]
+	}
+	for key, v := range map[string]string{"status": m[6], "bytes": m[7]} {
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			doc[key] = n
+		}
+	}
+	set("referer", strings.ReplaceAll(m[8], `\"`, `"`))
+	set("user_agent", strings.ReplaceAll(m[9], `\"`, `"`))
+	return doc, nil
+}
+
+var (
+	// RFC 5424: <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]
+	reSyslog5424 = regexp.MustCompile(`^<(\d{1,3})>(\d{1,2}) (\S+) (\S+) (\S+) (\S+) (\S+) (-|(?:\[(?:[^\]"\\]|"(?:[^"\\]|\\.)*"|\\.)*\])+)(?: (.*))?$`)
+	// RFC 3164 and syslog files: [<PRI>]Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+	reSyslog3164 = regexp.MustCompile(`^(?:<(\d{1,3})>)?([A-Z][a-z]{2} [ \d]\d \d\d:\d\d:\d\d) (\S+) ([^:\[\s]+)(?:\[([^\]]*)\])?: ?(.*)$`)
+
+	syslogFacilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+)
+
+// parseSyslog parses RFC 5424 and RFC 3164 syslog lines into facility and
+// severity (by name), timestamp, hostname, app, procid, msgid,
+// structured_data and message. Fields logged as "-" are left out.
+func parseSyslog(line string) (map[string]interface{}, error) {
+	doc := map[string]interface{}{}
+	set := func(key, v string) {
+		if v != "-" && v != "" {
+			doc[key] = v
+		}
+	}
+	var pri string
+	if m := reSyslog5424.FindStringSubmatch(line); m != nil {
+		pri = m[1]
+		set("timestamp", m[3])
+		set("hostname", m[4])
+		set("app", m[5])
+		set("procid", m[6])
+		set("msgid", m[7])
+		set("structured_data", m[8])
+		set("message", strings.TrimPrefix(m[9], "\uFEFF"))
+	} else if m := reSyslog3164.FindStringSubmatch(line); m != nil {
+		pri = m[1]
+		set("timestamp", m[2])
+		set("hostname", m[3])
+		set("app", m[4])
+		set("procid", m[5])
+		set("message", m[6])
+	} else {
+		return nil, fmt.Errorf("not a syslog line")
+	}
+	if pri != "" {
+		n, _ := strconv.Atoi(pri)
+		if n/8 >= len(syslogFacilities) {
+			return nil, fmt.Errorf("priority %d out of range", n)
+		}
+		doc["facility"], doc["severity"] = syslogFacilities[n/8], syslogSeverities[n%8]
+	}
+	return doc, nil
+}
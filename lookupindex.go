@@ -0,0 +1,137 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Loading looks rows up by value: symbols by the value column of their
+// table, link targets by their natural key, the lookups of a mapping by
+// their key column, and the rows a FOREIGN KEY references by its referenced
+// columns, together. Generated schemas index these
+// columns, but a schema written by hand may not, making every lookup a full
+// scan. For the duration of a load such columns get an index, dropped again
+// before the load commits so the schema is left as it was. A load committed
+// in batches that fails drops them after its rollback, and one that finds
+// them left behind by a killed load adopts and drops them.
+
+// lookupIndexPrefix starts the names of the indexes created for a load
+const lookupIndexPrefix = "_jsql_lookup_"
+
+// lookupIndexes are the indexes created for one load
+type lookupIndexes []string
+
+// lookupKey is the columns of a table loading looks its rows up by
+type lookupKey struct {
+	table   string
+	columns []string
+}
+
+// lookupColumns returns the keys loading dbs looks rows up by, ordered by
+// table and columns
+func lookupColumns(dbs *DatabaseSchema) []lookupKey {
+	seen := map[string]lookupKey{}
+	add := func(table string, columns ...string) {
+		seen[table+"."+strings.Join(columns, ",")] = lookupKey{table, columns}
+	}
+	for _, name := range dbs.TableOrder {
+		t := dbs.Tables[name]
+		for col, fk := range t.FKs {
+			if _, ok := t.Naming.symbolField(col); ok && dbs.Tables[fk] != nil {
+				add(fk, "value")
+			}
+		}
+		for _, l := range t.Lookups {
+			add(l.Table, l.Key)
+		}
+		for _, l := range t.Links {
+			if target := dbs.Tables[l.Table]; target != nil && target.Fields[l.Key] != "" {
+				add(l.Table, l.Key)
+			}
+		}
+		for _, fk := range t.ForeignKeys {
+			if dbs.Tables[fk.Table] != nil && len(fk.References) > 0 {
+				add(fk.Table, fk.References...)
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := make([]lookupKey, len(names))
+	for i, name := range names {
+		keys[i] = seen[name]
+	}
+	return keys
+}
+
+// createLookupIndexes indexes the lookup keys of dbs whose columns no index
+// of their table leads with, in any order. Only SQLite databases are looked at: the schemas
+// of other engines hold no mapping, and their symbol values are UNIQUE and
+// so indexed.
+func createLookupIndexes(tx *sql.Tx, dbs *DatabaseSchema) (lookupIndexes, error) {
+	var created lookupIndexes
+	if dbs.dialect() != SQLite {
+		return nil, nil
+	}
+	for _, key := range lookupColumns(dbs) {
+		name := lookupIndexPrefix + key.table + "_" + strings.Join(key.columns, "_")
+		quoted := make([]string, len(key.columns))
+		args := []any{name, key.table, len(key.columns)}
+		for i, col := range key.columns {
+			quoted[i] = quoteIdent(col)
+			args = append(args, col)
+		}
+		// The indexes whose first len(columns) columns are the key's
+		var n, ours int
+		err := tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*), COUNT(*) FILTER (WHERE name = ?) FROM (
+SELECT l.name FROM pragma_index_list(?) AS l, pragma_index_info(l.name) AS i
+WHERE i.seqno < ? AND i.name IN (%s) GROUP BY l.name HAVING COUNT(*) = %d)`,
+			strings.TrimSuffix(strings.Repeat("?, ", len(key.columns)), ", "), len(key.columns)), args...).Scan(&n, &ours)
+		if err != nil {
+			return nil, fmt.Errorf("indexes of %s: %v", key.table, err)
+		}
+		if ours > 0 {
+			created = append(created, name)
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := tx.Exec(fmt.Sprintf("CREATE INDEX %s ON %s (%s)", quoteIdent(name), quoteIdent(key.table), strings.Join(quoted, ", "))); err != nil {
+			return nil, fmt.Errorf("index %s.%s: %v", key.table, strings.Join(key.columns, ","), err)
+		}
+		created = append(created, name)
+	}
+	return created, nil
+}
+
+// drop removes the indexes again
+func (l lookupIndexes) drop(tx *sql.Tx) error {
+	for _, name := range l {
+		if _, err := tx.Exec("DROP INDEX IF EXISTS " + quoteIdent(name)); err != nil {
+			return fmt.Errorf("drop index %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// dropDB removes the indexes in a transaction of their own, after the load
+// that created them failed
+func (l lookupIndexes) dropDB(db *sql.DB) error {
+	if len(l) == 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := l.drop(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,15 +1,51 @@
-package main
+package jsql
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+
+	"filippo.io/age"
+	sqlite3 "github.com/mattn/go-sqlite3"
+	"github.com/tomberek/jsql/internal/pathspec"
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 // Helper for tests
@@ -78,7 +114,7 @@ func decodeAllLines(t *testing.T, b []byte) []map[string]interface{} {
 func roundtripTest(t *testing.T, testJSON string, testFile string, testName string, validateSchema func(string, *testing.T)) {
 	var content []byte
 	var err error
-	
+
 	if testJSON != "" {
 		// Use inline JSON
 		content = []byte(testJSON)
@@ -89,7 +125,7 @@ func roundtripTest(t *testing.T, testJSON string, testFile string, testName stri
 			t.Skipf("%s not found, skipping test", testFile)
 			return
 		}
-		
+
 		content, err = os.ReadFile(testFile)
 		if err != nil {
 			t.Fatalf("Failed to read test file: %v", err)
@@ -99,7 +135,7 @@ func roundtripTest(t *testing.T, testJSON string, testFile string, testName stri
 		t.Fatal("Either testJSON or testFile must be provided")
 		return
 	}
-	
+
 	// Create temp file if using inline JSON
 	var dataPath string
 	if testJSON != "" {
@@ -113,20 +149,14 @@ func roundtripTest(t *testing.T, testJSON string, testFile string, testName stri
 	tmp := t.TempDir()
 	dbPath := filepath.Join(tmp, "test-"+testName+".db")
 	ddlPath := filepath.Join(tmp, "test-"+testName+".sql")
-	binPath := filepath.Join(tmp, "cli-"+testName)
-
-	// Build CLI
-	if out, err := exec.Command("go", "build", "-o", binPath, ".").CombinedOutput(); err != nil {
-		t.Fatalf("build: %v\n%s", err, out)
-	}
-	defer removeFiles(binPath)
+	binPath := buildCLI(t)
 
 	// Import data
-	cmd := exec.Command(binPath, "import", 
-		"--input", dataPath, 
-		"--db", dbPath, 
+	cmd := exec.Command(binPath, "import",
+		"--input", dataPath,
+		"--db", dbPath,
 		"--schema", ddlPath)
-	
+
 	if out, err := cmd.CombinedOutput(); err != nil {
 		t.Fatalf("import: %v\n%s", err, out)
 	}
@@ -182,7 +212,7 @@ func roundtripTest(t *testing.T, testJSON string, testFile string, testName stri
 				continue
 			}
 			g := normGot[i]
-			
+
 			// Compare each field
 			for k, wv := range w {
 				gv, exists := g[k]
@@ -190,18 +220,18 @@ func roundtripTest(t *testing.T, testJSON string, testFile string, testName stri
 					t.Errorf("Record %d: Missing field %q", i, k)
 					continue
 				}
-				
+
 				// Special handling for deeply nested structures
 				if !reflect.DeepEqual(gv, wv) {
-					t.Errorf("Record %d, field %q: values don't match\nGot: %#v\nWant: %#v", 
+					t.Errorf("Record %d, field %q: values don't match\nGot: %#v\nWant: %#v",
 						i, k, gv, wv)
 				}
 			}
 		}
-		
+
 		t.Errorf("%s roundtrip failed", testName)
 	} else {
-		t.Logf("Successfully preserved %d records through SQLite roundtrip for %s test", 
+		t.Logf("Successfully preserved %d records through SQLite roundtrip for %s test",
 			len(normWant), testName)
 	}
 }
@@ -232,7 +262,7 @@ func TestRoundtripNixJSON(t *testing.T) {
 		tableCount := strings.Count(schema, "CREATE TABLE")
 		t.Logf("Nix JSON schema contains %d tables", tableCount)
 	}
-	
+
 	roundtripTest(t, "", "nix.json", "nix", validateSchema)
 }
 
@@ -242,7 +272,7 @@ func TestRoundtripSimpleStructures(t *testing.T) {
 		tableCount := strings.Count(schema, "CREATE TABLE")
 		t.Logf("Schema contains %d tables", tableCount)
 	}
-	
+
 	roundtripTest(t, "", "test_simple.json", "simple", validateSchema)
 }
 
@@ -252,7 +282,7 @@ func TestRoundtripModerateStructures(t *testing.T) {
 		tableCount := strings.Count(schema, "CREATE TABLE")
 		t.Logf("Schema contains %d tables", tableCount)
 	}
-	
+
 	roundtripTest(t, "", "test_moderate.json", "moderate", validateSchema)
 }
 
@@ -261,10 +291,6021 @@ func TestRoundtripHighComplexity(t *testing.T) {
 	validateSchema := func(schema string, t *testing.T) {
 		tableCount := strings.Count(schema, "CREATE TABLE")
 		t.Logf("Schema contains %d tables for highly complex data", tableCount)
-		
+
 		indexCount := strings.Count(schema, "CREATE INDEX")
 		t.Logf("Schema contains %d indexes", indexCount)
 	}
-	
+
 	roundtripTest(t, "", "test_high_revised.json", "high-complex", validateSchema)
 }
+
+// cliPath is the command built once for all tests by TestMain, or the
+// error building it
+var cliPath string
+var cliErr error
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "jsql-cli")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	cliPath = filepath.Join(dir, "cli")
+	if runtime.GOOS == "windows" {
+		cliPath += ".exe"
+	}
+	if out, err := exec.Command("go", "build", "-o", cliPath, "./cmd/jsql").CombinedOutput(); err != nil {
+		cliErr = fmt.Errorf("%v\n%s", err, out)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// buildCLI returns the path of the command built by TestMain
+func buildCLI(t *testing.T) string {
+	if cliErr != nil {
+		t.Fatalf("build: %v", cliErr)
+	}
+	return cliPath
+}
+
+// --- ENVIRONMENT CONFIGURATION TEST --- //
+func TestEnvironmentConfiguration(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dataPath := filepath.Join(tmp, "data.json")
+	if err := os.WriteFile(dataPath, []byte(`{"name": "Alice", "age": 30}`+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	// --schema comes from .env, --db from the environment, --input from the command line
+	if err := os.WriteFile(filepath.Join(tmp, ".env"), []byte("# test\nJSQL_SCHEMA=\"schema.sql\"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(bin, "import", "--input", dataPath)
+	cmd.Dir = tmp
+	cmd.Env = append(os.Environ(), "JSQL_DB=env.db")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	for _, name := range []string{"env.db", "schema.sql"} {
+		if _, err := os.Stat(filepath.Join(tmp, name)); err != nil {
+			t.Errorf("expected %s to be written: %v", name, err)
+		}
+	}
+
+	// An explicit flag wins over the environment
+	cmd = exec.Command(bin, "dump", "--db", "env.db")
+	cmd.Dir = tmp
+	cmd.Env = append(os.Environ(), "JSQL_DB=missing.db")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	got := decodeAllLines(t, out)
+	if len(got) != 1 || got[0]["name"] != "Alice" {
+		t.Errorf("unexpected dump output: %s", out)
+	}
+}
+
+// freeAddr returns a localhost address with an unused port
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startServe runs the serve command and waits until it answers /healthz
+func startServe(t *testing.T, bin string, args ...string) string {
+	addr := freeAddr(t)
+	cmd := exec.Command(bin, append([]string{"serve", "--addr", addr}, args...)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	base := "http://" + addr
+	for i := 0; i < 100; i++ {
+		if resp, err := http.Get(base + "/healthz"); err == nil {
+			resp.Body.Close()
+			return base
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("serve did not start")
+	return ""
+}
+
+// --- SERVE INGESTION TEST --- //
+func TestServeIngest(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "serve.db")
+	ddlPath := filepath.Join(tmp, "serve.sql")
+	ddl := "CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  name TEXT,\n  age INTEGER\n);\n"
+	if err := os.WriteFile(ddlPath, []byte(ddl), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	base := startServe(t, bin, "--db", dbPath, "--schema", ddlPath, "--max-batch-bytes", "100")
+
+	body := `{"name": "Alice", "age": 30}` + "\n" + `{"name": "Bob", "age": 31}` + "\n"
+	resp, err := http.Post(base+"/ingest", "application/x-ndjson", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res struct{ Rows int }
+	json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || res.Rows != 2 {
+		t.Fatalf("ingest: status %d, rows %d", resp.StatusCode, res.Rows)
+	}
+
+	// Bodies over --max-batch-bytes are refused outright
+	big := bytes.Repeat([]byte(fmt.Sprintf(`{"name": %q}`+"\n", "x")), 20)
+	resp, err = http.Post(base+"/ingest", "application/x-ndjson", bytes.NewReader(big))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized ingest: got status %d, want 413", resp.StatusCode)
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if got := decodeAllLines(t, out); len(got) != 2 {
+		t.Errorf("dump after ingest: got %d rows, want 2", len(got))
+	}
+}
+
+// --- MULTI-TENANT TEST --- //
+func TestTenantPrefixing(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "shared.db")
+	tenants := map[string]string{
+		"acme":   `{"name": "Alice", "meta": {"city": "Wonderland"}}`,
+		"globex": `{"name": "Bob", "meta": {"city": "Builderland"}}`,
+	}
+	for tenant, data := range tenants {
+		dataPath := filepath.Join(tmp, tenant+".json")
+		ddlPath := filepath.Join(tmp, tenant+".sql")
+		if err := os.WriteFile(dataPath, []byte(data+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(bin, "import", "--tenant", tenant, "--input", dataPath, "--db", dbPath, "--schema", ddlPath).CombinedOutput()
+		if err != nil {
+			t.Fatalf("import %s: %v\n%s", tenant, err, out)
+		}
+		ddl, _ := os.ReadFile(ddlPath)
+		if !strings.Contains(string(ddl), "CREATE TABLE "+tenant+"_main") || !strings.Contains(string(ddl), "REFERENCES "+tenant+"_meta(id)") {
+			t.Errorf("%s schema is not prefixed:\n%s", tenant, ddl)
+		}
+	}
+	for tenant, data := range tenants {
+		out, err := exec.Command(bin, "dump", "--tenant", tenant, "--db", dbPath, "--schema", filepath.Join(tmp, tenant+".sql")).Output()
+		if err != nil {
+			t.Fatalf("dump %s: %v", tenant, err)
+		}
+		var want map[string]interface{}
+		json.Unmarshal([]byte(data), &want)
+		got := normalizeJSON(decodeAllLines(t, out))
+		if len(got) != 1 || !reflect.DeepEqual(got[0], normalizeJSON([]map[string]interface{}{want})[0]) {
+			t.Errorf("dump %s: got %s", tenant, out)
+		}
+	}
+}
+
+// --- PROVENANCE COLUMNS TEST --- //
+func TestProvenanceColumns(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dataPath := filepath.Join(tmp, "data.json")
+	dbPath := filepath.Join(tmp, "prov.db")
+	ddlPath := filepath.Join(tmp, "prov.sql")
+	if err := os.WriteFile(dataPath, []byte("{\"name\": \"Alice\"}\n\n{\"name\": \"Bob\"}\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(bin, "import", "--provenance", "--input", dataPath, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	for _, row := range decodeAllLines(t, out) {
+		if _, ok := row["_line"]; ok {
+			t.Errorf("provenance included by default: %v", row)
+		}
+	}
+
+	out, err = exec.Command(bin, "dump", "--with-provenance", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump --with-provenance: %v", err)
+	}
+	lines := map[string]float64{}
+	for _, row := range decodeAllLines(t, out) {
+		if row["_source"] != dataPath || row["_ingested_at"] == nil {
+			t.Errorf("missing provenance: %v", row)
+		}
+		lines[row["name"].(string)], _ = row["_line"].(float64)
+	}
+	if lines["Alice"] != 1 || lines["Bob"] != 3 {
+		t.Errorf("unexpected line numbers: %v", lines)
+	}
+}
+
+// --- DUMP ANONYMIZATION TEST --- //
+func TestDumpAnonymize(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dataPath := filepath.Join(tmp, "people.json")
+	dbPath := filepath.Join(tmp, "people.db")
+	ddlPath := filepath.Join(tmp, "people.sql")
+	profilePath := filepath.Join(tmp, "profile.yaml")
+	data := `{"name": "Alice", "email": "alice@corp.com", "ssn": "123-45-6789", "meta": {"city": "Wonderland"}}
+{"name": "Bob", "email": "alice@corp.com", "ssn": "987-65-4321", "meta": {"city": "Builderland"}}
+`
+	profile := `salt: s3cret
+fields:
+  name: {strategy: fake, kind: name}
+  email: hash
+  ssn: {strategy: mask, keep: 4}
+  meta.city: drop
+`
+	os.WriteFile(dataPath, []byte(data), 0666)
+	os.WriteFile(profilePath, []byte(profile), 0666)
+	if out, err := exec.Command(bin, "import", "--input", dataPath, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--anonymize", profilePath, "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	rows := decodeAllLines(t, out)
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows", len(rows))
+	}
+	for _, row := range rows {
+		if row["name"] == "Alice" || row["name"] == "Bob" {
+			t.Errorf("name not replaced: %v", row)
+		}
+		if ssn, _ := row["ssn"].(string); !strings.HasPrefix(ssn, "*******") || len(ssn) != 11 {
+			t.Errorf("ssn not masked: %v", row["ssn"])
+		}
+		if meta, _ := row["meta"].(map[string]interface{}); meta != nil && meta["city"] != nil {
+			t.Errorf("city not dropped: %v", row)
+		}
+	}
+	// Hashing is deterministic, so equal inputs stay equal
+	if rows[0]["email"] != rows[1]["email"] || rows[0]["email"] == "alice@corp.com" {
+		t.Errorf("email not hashed consistently: %v / %v", rows[0]["email"], rows[1]["email"])
+	}
+
+	// Hashing without a salt is refused
+	os.WriteFile(profilePath, []byte("fields:\n  email: hash\n"), 0666)
+	if out, err := exec.Command(bin, "dump", "--anonymize", profilePath, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err == nil || !strings.Contains(string(out), "hash requires a salt") {
+		t.Errorf("dump with an unsalted hash: %v\n%s", err, out)
+	}
+}
+
+// importLines writes lines as an input file and imports it, returning the db and schema paths
+func importLines(t *testing.T, bin string, lines []string, extraArgs ...string) (string, string) {
+	tmp := t.TempDir()
+	dataPath := filepath.Join(tmp, "data.json")
+	dbPath := filepath.Join(tmp, "data.db")
+	ddlPath := filepath.Join(tmp, "data.sql")
+	if err := os.WriteFile(dataPath, []byte(strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	args := append([]string{"import", "--input", dataPath, "--db", dbPath, "--schema", ddlPath}, extraArgs...)
+	if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	return dbPath, ddlPath
+}
+
+// --- DUMP SAMPLING TEST --- //
+func TestDumpHeadTailSample(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 50; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d}`, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	dump := func(args ...string) []map[string]interface{} {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath, "--schema", ddlPath}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("dump %v: %v", args, err)
+		}
+		return decodeAllLines(t, out)
+	}
+	if got := dump("--head", "3"); len(got) != 3 || got[0]["n"] != 1.0 || got[2]["n"] != 3.0 {
+		t.Errorf("--head 3: %v", got)
+	}
+	if got := dump("--tail", "2"); len(got) != 2 || got[0]["n"] != 49.0 || got[1]["n"] != 50.0 {
+		t.Errorf("--tail 2: %v", got)
+	}
+	if got := dump("--sample", "0.5"); len(got) == 0 || len(got) == 50 {
+		t.Logf("--sample 0.5 returned %d of 50 rows", len(got))
+	}
+	if got := dump("--sample", "1"); len(got) != 50 {
+		t.Errorf("--sample 1: got %d rows, want 50", len(got))
+	}
+
+	// Keyset chunks: each dump resumes after the last id the previous printed
+	var chunks [][]map[string]interface{}
+	after := "0"
+	for len(chunks) < 10 {
+		cmd := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--after-id", after, "--limit", "20")
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("dump --after-id %s: %v\n%s", after, err, stderr.String())
+		}
+		last, ok := strings.CutPrefix(strings.TrimSpace(stderr.String()), "last-id ")
+		if !ok {
+			t.Fatalf("dump --limit printed %q", stderr.String())
+		}
+		if last == after {
+			break
+		}
+		chunks = append(chunks, decodeAllLines(t, out))
+		after = last
+	}
+	if len(chunks) != 3 || len(chunks[0]) != 20 || len(chunks[2]) != 10 || chunks[1][0]["n"] != 21.0 || chunks[2][9]["n"] != 50.0 {
+		t.Errorf("--after-id/--limit chunks: %v", chunks)
+	}
+}
+
+// --- DIFF AND PATCH TEST --- //
+func TestDiffThenPatch(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{
+		`{"name": "Alice", "age": 30, "meta": {"city": "Wonderland"}}`,
+		`{"name": "Bob", "age": 25}`,
+		`{"name": "Carol", "age": 41}`,
+	})
+	newer := []string{
+		`{"name": "Alice", "age": 30, "meta": {"city": "Paris"}}`,
+		`{"name": "Carol", "age": 42}`,
+		`{"name": "Dave", "age": 40}`,
+	}
+	newPath := writeTempFile(t, "new_*.json", strings.Join(newer, "\n"))
+	defer removeFiles(newPath)
+
+	diff := exec.Command(bin, "diff", "--a", dbPath, "--schema", ddlPath, "--b", newPath, "--key", "name")
+	changes, _ := diff.Output()
+	if diff.ProcessState.ExitCode() != 1 {
+		t.Fatalf("diff exit code %d, want 1", diff.ProcessState.ExitCode())
+	}
+	if n := len(decodeAllLines(t, changes)); n != 4 {
+		t.Fatalf("diff: got %d entries, want 4:\n%s", n, changes)
+	}
+	patchPath := writeTempFile(t, "patch_*.json", string(changes))
+	defer removeFiles(patchPath)
+	if out, err := exec.Command(bin, "patch", "--db", dbPath, "--schema", ddlPath, "--key", "name", "--input", patchPath).CombinedOutput(); err != nil {
+		t.Fatalf("patch: %v\n%s", err, out)
+	}
+
+	diff = exec.Command(bin, "diff", "--a", dbPath, "--schema", ddlPath, "--b", newPath, "--key", "name")
+	if out, err := diff.Output(); err != nil || len(out) != 0 {
+		t.Errorf("after patch: diff %v\n%s", err, out)
+	}
+}
+
+// --- PATCH BY ID TEST --- //
+func TestPatchByID(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`})
+	patches := writeTempFile(t, "patches_*.json", strings.Join([]string{
+		`{"op": "remove", "key": 2}`,
+		`{"op": "remove", "key": "3"}`,
+		`{"op": "remove", "key": 1.5}`,
+	}, "\n")+"\n")
+	defer removeFiles(patches)
+	out, err := exec.Command(bin, "patch", "--db", dbPath, "--schema", ddlPath, "--key", "id", "--input", patches).CombinedOutput()
+	if err != nil {
+		t.Fatalf("patch: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), `line 2: key "3" is not a row id`) || !strings.Contains(string(out), "line 3: key 1.5 is not a row id") ||
+		!strings.Contains(string(out), "Applied 1 patches") {
+		t.Errorf("patch output:\n%s", out)
+	}
+	dump, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeAllLines(t, dump); len(got) != 2 || got[0]["n"] != 1.0 || got[1]["n"] != 3.0 {
+		t.Errorf("dump after removing id 2 = %s", dump)
+	}
+}
+
+func TestPatchFailureKeepsDocument(t *testing.T) {
+	ddl := `CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  n INTEGER NOT NULL
+);
+`
+	dbPath := filepath.Join(t.TempDir(), "data.db")
+	if err := CreateDatabase(dbPath, ddl); err != nil {
+		t.Fatal(err)
+	}
+	dbs := ParseDDL(ddl)
+	input := writeTempFile(t, "data_*.json", `{"name": "alice", "n": 1}`+"\n"+`{"name": "bob", "n": 2}`+"\n")
+	// The replacement of alice violates NOT NULL after her rows are deleted;
+	// bob's patch still applies
+	patches := writeTempFile(t, "patches_*.json", `{"key": "alice", "merge": {"n": null}}`+"\n"+`{"key": "bob", "merge": {"n": 3}}`+"\n")
+	defer removeFiles(input, patches)
+	if err := LoadData(context.Background(), input, dbPath, dbs); err != nil {
+		t.Fatal(err)
+	}
+	applied, failed, err := PatchDocuments(dbPath, dbs, "name", patches)
+	if err != nil || applied != 1 || failed != 1 {
+		t.Fatalf("patch: applied %d, failed %d, %v", applied, failed, err)
+	}
+	var out bytes.Buffer
+	if _, err := DumpRows(context.Background(), dbPath, dbs, DumpOptions{Output: &out}); err != nil {
+		t.Fatal(err)
+	}
+	got := decodeAllLines(t, out.Bytes())
+	if len(got) != 2 || got[0]["name"] != "alice" || got[0]["n"] != 1.0 || got[1]["n"] != 3.0 {
+		t.Errorf("dump after a failed patch = %s", out.String())
+	}
+}
+
+// --- GRAPHQL TEST --- //
+func TestServeGraphQL(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf(`{"name": "n%d", "kind": %q, "age": %d, "meta": {"city": "c%d"}}`, i, []string{"a", "b"}[i%2], i, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	base := startServe(t, bin, "--db", dbPath, "--schema", ddlPath, "--graphql")
+
+	query := func(q string, vars map[string]interface{}) map[string]interface{} {
+		body, _ := json.Marshal(map[string]interface{}{"query": q, "variables": vars})
+		resp, err := http.Post(base+"/graphql", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var res map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := query(`query ($k: JSON) { rows: main(kind: $k, limit: 2, offset: 1) { name kind meta { city } } }`,
+		map[string]interface{}{"k": "b"})
+	want := `{"data":{"rows":[{"kind":"b","meta":{"city":"c3"},"name":"n3"},{"kind":"b","meta":{"city":"c5"},"name":"n5"}]}}`
+	if got, _ := json.Marshal(res); string(got) != want {
+		t.Errorf("list query:\n got %s\nwant %s", got, want)
+	}
+
+	res = query(`{ main_by_id(id: 1) { ...F } } fragment F on main { name age }`, nil)
+	if got, _ := json.Marshal(res); string(got) != `{"data":{"main_by_id":{"age":0,"name":"n0"}}}` {
+		t.Errorf("by id query: %s", got)
+	}
+
+	if res := query(`{ main { missing } }`, nil); res["errors"] == nil {
+		t.Errorf("unknown field: expected an error, got %v", res)
+	}
+
+	// Limits, and the rows a query could resolve, are capped
+	if res := query(`{ main(limit: 1001) { name } }`, nil); !strings.Contains(fmt.Sprint(res["errors"]), "at most 1000") {
+		t.Errorf("limit over the cap: %v", res)
+	}
+	var many []string
+	for i := 0; i < 6; i++ {
+		many = append(many, fmt.Sprintf("m%d: main(limit: 1000) { name meta { city } }", i))
+	}
+	if res := query("{ "+strings.Join(many, " ")+" }", nil); !strings.Contains(fmt.Sprint(res["errors"]), "more than 10000 rows") {
+		t.Errorf("costly query: %v", res)
+	}
+	res = query(`{ main(limit: 10) { name meta { city } } }`, nil)
+	if rows, _ := res["data"].(map[string]interface{})["main"].([]interface{}); len(rows) != 10 || fmt.Sprint(rows[9]) != "map[meta:map[city:c9] name:n9]" {
+		t.Errorf("nested objects of a list: %v", res)
+	}
+
+	// Introspection describes the same schema as the SDL
+	res = query(`{ __type(name: "main") { kind fields { name type { kind name ofType { name } } } } }`, nil)
+	if res["errors"] != nil {
+		t.Fatalf("__type(name: \"main\"): %v", res)
+	}
+	typ, _ := res["data"].(map[string]interface{})["__type"].(map[string]interface{})
+	fields := map[string]string{}
+	for _, f := range typ["fields"].([]interface{}) {
+		f := f.(map[string]interface{})
+		fields[fmt.Sprint(f["name"])] = fmt.Sprint(f["type"])
+	}
+	if typ["kind"] != "OBJECT" || fields["meta"] != "map[kind:OBJECT name:meta ofType:<nil>]" ||
+		fields["id"] != "map[kind:NON_NULL name:<nil> ofType:map[name:Int]]" || fields["age"] != "map[kind:SCALAR name:Int ofType:<nil>]" {
+		t.Errorf("__type(name: \"main\"): %v", res)
+	}
+	res = query(`query IntrospectionQuery {
+		__schema {
+			queryType { name }
+			mutationType { name }
+			types { ...FullType }
+			directives { name locations args { ...InputValue } }
+		}
+	}
+	fragment FullType on __Type {
+		kind name description
+		fields(includeDeprecated: true) { name args { ...InputValue } type { ...TypeRef } isDeprecated deprecationReason }
+		inputFields { ...InputValue }
+		interfaces { ...TypeRef }
+		enumValues(includeDeprecated: true) { name isDeprecated }
+		possibleTypes { ...TypeRef }
+	}
+	fragment InputValue on __InputValue { name type { ...TypeRef } defaultValue }
+	fragment TypeRef on __Type { kind name ofType { kind name ofType { kind name ofType { kind name } } } }`, nil)
+	schema, _ := res["data"].(map[string]interface{})["__schema"].(map[string]interface{})
+	if res["errors"] != nil || schema == nil || fmt.Sprint(schema["queryType"]) != "map[name:Query]" || schema["mutationType"] != nil {
+		t.Fatalf("introspection query: %v", res)
+	}
+	var listField interface{}
+	for _, ty := range schema["types"].([]interface{}) {
+		ty := ty.(map[string]interface{})
+		if ty["name"] != "Query" {
+			continue
+		}
+		for _, f := range ty["fields"].([]interface{}) {
+			if f := f.(map[string]interface{}); f["name"] == "main" {
+				listField = f
+			}
+		}
+	}
+	js, _ := json.Marshal(listField)
+	if !strings.Contains(string(js), `"type":{"kind":"NON_NULL","name":null,"ofType":{"kind":"LIST","name":null,"ofType":{"kind":"NON_NULL","name":null,"ofType":{"kind":"OBJECT","name":"main"}}}}`) ||
+		!strings.Contains(string(js), `{"defaultValue":"100","name":"limit","type":{"kind":"SCALAR","name":"Int","ofType":null}}`) {
+		t.Errorf("list field in the introspection query: %s", js)
+	}
+	var schemas []string
+	for i := 0; i < 1000; i++ {
+		schemas = append(schemas, fmt.Sprintf("s%d: __schema { types { fields { type { name } } } }", i))
+	}
+	if res := query("{ "+strings.Join(schemas, " ")+" }", nil); !strings.Contains(fmt.Sprint(res["errors"]), "more than 100000 objects") {
+		t.Errorf("costly introspection query: %v", res)
+	}
+
+	resp, err := http.Get(base + "/graphql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sdl, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(sdl), "main_by_id(id: Int!): main") {
+		t.Errorf("schema SDL:\n%s", sdl)
+	}
+
+	// Selections nest 8 levels deep at most
+	deepPath, deepDDL := importLines(t, bin, []string{`{"a": {"b": {"c": {"d": {"e": {"f": {"g": {"h": {"i": 1}}}}}}}}}`})
+	deep := startServe(t, bin, "--db", deepPath, "--schema", deepDDL, "--graphql")
+	body := `{"query": "{ main { a { b { c { d { e { f { g { h { i } } } } } } } } } }"}`
+	resp, err = http.Post(deep+"/graphql", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(out), "deeper than 8 levels") {
+		t.Errorf("deep query: %s", out)
+	}
+}
+
+// --- METRICS TEST --- //
+// scrapeMetrics returns the samples of /metrics on mux by name and labels
+func scrapeMetrics(t *testing.T, mux http.Handler) map[string]float64 {
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	samples := map[string]float64{}
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("metrics line %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	ddl := `CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  n INTEGER NOT NULL
+);
+`
+	dbPath := filepath.Join(t.TempDir(), "data.db")
+	if err := CreateDatabase(dbPath, ddl); err != nil {
+		t.Fatal(err)
+	}
+	dbs := ParseDDL(ddl)
+	dbs.BatchSize = 2
+	// Three rows load, one fails NOT NULL and one is not JSON
+	input := writeTempFile(t, "data_*.json", `{"name": "a", "n": 1}
+{"name": "b", "n": null}
+{"name": "c", "n": 3}
+{"name":
+{"name": "e", "n": 5}
+`)
+	defer removeFiles(input)
+	mux := MonitorMux(dbPath)
+	defer MonitorMux("")
+	before := scrapeMetrics(t, mux)
+	if err := LoadData(context.Background(), input, dbPath, dbs); err != nil {
+		t.Fatal(err)
+	}
+	after := scrapeMetrics(t, mux)
+	delta := func(name string) float64 { return after[name] - before[name] }
+
+	if got := delta("jsql_rows_ingested_total"); got != 3 {
+		t.Errorf("rows ingested: %v, want 3", got)
+	}
+	if got := delta("jsql_row_errors_total"); got != 1 {
+		t.Errorf("row errors: %v, want 1", got)
+	}
+	if got := delta("jsql_parse_errors_total"); got != 1 {
+		t.Errorf("parse errors: %v, want 1", got)
+	}
+	// Five lines in batches of two commit three times
+	if got := delta("jsql_batch_duration_seconds_count"); got != 3 {
+		t.Errorf("batches observed: %v, want 3", got)
+	}
+	if after[`jsql_batch_duration_seconds_bucket{le="+Inf"}`] != after["jsql_batch_duration_seconds_count"] ||
+		after[`jsql_batch_duration_seconds_bucket{le="0.005"}`] > after[`jsql_batch_duration_seconds_bucket{le="60"}`] ||
+		delta("jsql_batch_duration_seconds_sum") <= 0 {
+		t.Errorf("batch latency histogram: %v", after)
+	}
+	if after["jsql_pending_rows"] != 0 {
+		t.Errorf("pending rows after the load: %v", after["jsql_pending_rows"])
+	}
+	var size int64
+	for _, p := range []string{dbPath, dbPath + "-wal"} {
+		if st, err := os.Stat(p); err == nil {
+			size += st.Size()
+		}
+	}
+	if got := after["jsql_database_size_bytes"]; size == 0 || got != float64(size) {
+		t.Errorf("database size: %v, want %d", got, size)
+	}
+}
+
+// --- HEALTH TEST --- //
+func TestHealth(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "data.db")
+	if err := CreateDatabase(dbPath, "CREATE TABLE main (id INTEGER PRIMARY KEY, n INTEGER);"); err != nil {
+		t.Fatal(err)
+	}
+	probe := func(mux http.Handler, path string) (int, healthStatus) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var hs healthStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &hs); err != nil {
+			t.Fatalf("%s: %v\n%s", path, err, rec.Body)
+		}
+		return rec.Code, hs
+	}
+
+	mux := MonitorMux(dbPath)
+	defer MonitorMux("")
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code, hs := probe(mux, path); code != http.StatusOK || hs.Status != "ok" || !hs.DBWritable {
+			t.Errorf("%s of a writable database: %d %+v", path, code, hs)
+		}
+	}
+
+	// A full serve queue makes the process busy: not ready, still live
+	capacity, queued := metrics.queueCapacity.Load(), metrics.queuedBatches.Load()
+	metrics.queueCapacity.Store(2)
+	metrics.queuedBatches.Store(2)
+	if code, hs := probe(mux, "/readyz"); code != http.StatusServiceUnavailable || hs.Status != "busy" || hs.Queued != 2 {
+		t.Errorf("/readyz with a full queue: %d %+v", code, hs)
+	}
+	if code, hs := probe(mux, "/healthz"); code != http.StatusOK || hs.Status != "ok" {
+		t.Errorf("/healthz with a full queue: %d %+v", code, hs)
+	}
+	metrics.queueCapacity.Store(capacity)
+	metrics.queuedBatches.Store(queued)
+
+	// A database that cannot be written fails both
+	mux = MonitorMux(filepath.Join(dir, "gone", "data.db"))
+	for _, path := range []string{"/healthz", "/readyz"} {
+		if code, hs := probe(mux, path); code != http.StatusServiceUnavailable || hs.Status != "unavailable" || hs.DBWritable || hs.DBError == "" {
+			t.Errorf("%s of a database that cannot be written: %d %+v", path, code, hs)
+		}
+	}
+}
+
+// --- GEOJSON TEST --- //
+func TestGeoJSONColumns(t *testing.T) {
+	// The SpatiaLite driver is registered by its first use, once
+	if slices.Contains(sql.Drivers(), spatialiteDriver) {
+		t.Errorf("%s registered on import", spatialiteDriver)
+	}
+	SpatialiteAvailable()
+	SpatialiteAvailable()
+	if !slices.Contains(sql.Drivers(), spatialiteDriver) {
+		t.Errorf("%s not registered by SpatialiteAvailable", spatialiteDriver)
+	}
+
+	bin := buildCLI(t)
+	lines := []string{
+		`{"name": "a", "geom": {"type": "Point", "coordinates": [1.5, 2]}}`,
+		`{"name": "b", "geom": {"type": "Polygon", "coordinates": [[[0, 0], [4, 0], [4, 3], [0, 0]]]}}`,
+		`{"name": "c", "geom": {"type": "MultiLineString", "coordinates": [[[1, 2, 3], [4, 5, 6]]]}}`,
+		`{"name": "d", "geom": {"type": "Point", "coordinates": [7, 8], "bbox": [7, 8, 7, 8]}}`,
+		`{"name": "e"}`,
+	}
+	for _, format := range []string{"json", "wkb"} {
+		dbPath, ddlPath := importLines(t, bin, lines, "--geometry", format, "--spatial-index")
+		ddl, _ := os.ReadFile(ddlPath)
+		if strings.Contains(string(ddl), "geom_id") || !strings.Contains(string(ddl), "main_geom_rtree") {
+			t.Errorf("%s: geometry not stored in an indexed column:\n%s", format, ddl)
+		}
+		out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+		if err != nil {
+			t.Fatalf("%s: dump: %v", format, err)
+		}
+		got := decodeAllLines(t, out)
+		want := decodeAllLines(t, []byte(strings.Join(lines, "\n")))
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: roundtrip mismatch\n got %v\nwant %v", format, got, want)
+		}
+	}
+
+	// Without --geometry, geometries are objects like any other
+	_, ddlPath := importLines(t, bin, lines[:1])
+	if ddl, _ := os.ReadFile(ddlPath); !strings.Contains(string(ddl), "geom_id") || strings.Contains(string(ddl), "GEOJSON") || strings.Contains(string(ddl), "WKB") {
+		t.Errorf("default import stored the geometry in a column:\n%s", ddl)
+	}
+	geo := writeTempFile(t, "geo_*.json", lines[0])
+	defer removeFiles(geo)
+	if out, err := exec.Command(bin, "analyze", "--input", geo, "--spatial-index").CombinedOutput(); err == nil || !strings.Contains(string(out), "--spatial-index requires --geometry") {
+		t.Errorf("--spatial-index without --geometry: %v\n%s", err, out)
+	}
+}
+
+// --- BLOB STORE TEST --- //
+func TestBlobStore(t *testing.T) {
+	bin := buildCLI(t)
+	big := strings.Repeat("x", 4096)
+	lines := []string{
+		fmt.Sprintf(`{"name": "a", "body": %q, "nums": [%s1]}`, big, strings.Repeat("1,", 2048)),
+		`{"name": "b", "body": "small", "nums": [1]}`,
+		fmt.Sprintf(`{"name": "c", "body": %q}`, big),
+	}
+
+	// An object store answering PUT and GET of /<hash>
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer srv.Close()
+
+	for _, store := range []string{filepath.Join(t.TempDir(), "blobs"), srv.URL} {
+		dbPath, ddlPath := importLines(t, bin, lines, "--blob-store", store, "--blob-threshold", "1KiB")
+		out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--blob-store", store).Output()
+		if err != nil {
+			t.Fatalf("%s: dump: %v", store, err)
+		}
+		want := decodeAllLines(t, []byte(strings.Join(lines, "\n")))
+		if got := decodeAllLines(t, out); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: roundtrip mismatch", store)
+		}
+		// Without --blob-store, references dump as they are
+		out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+		if err != nil {
+			t.Fatalf("%s: dump without --blob-store: %v", store, err)
+		}
+		if got := decodeAllLines(t, out); !strings.HasPrefix(fmt.Sprint(got[0]["body"]), "sha256:") || got[1]["body"] != "small" {
+			t.Errorf("%s: dump without --blob-store = %v", store, got)
+		}
+	}
+	if len(objects) != 2 {
+		t.Errorf("object store holds %d blobs, want 2 (identical values stored once)", len(objects))
+	}
+
+	// BLOBs that are no reference are kept with a store configured
+	dbPath, ddlPath := importLines(t, bin, []string{`{"body": "text"}`})
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("UPDATE main SET body = CAST('raw bytes' AS BLOB)"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--blob-store", t.TempDir()).CombinedOutput()
+	if err != nil || !strings.Contains(string(out), `"body":"raw bytes"`) {
+		t.Errorf("dump of a BLOB that is no reference: %v\n%s", err, out)
+	}
+
+	// A line longer than bufio.Scanner's default limit goes to the store
+	// at the default threshold
+	huge := writeTempFile(t, "huge_*.json", fmt.Sprintf(`{"body": %q}`, strings.Repeat("y", 2<<20))+"\n")
+	defer removeFiles(huge)
+	store := t.TempDir()
+	if out, err := exec.Command(bin, "load", "--input", huge, "--db", dbPath, "--schema", ddlPath, "--blob-store", store).CombinedOutput(); err != nil {
+		t.Fatalf("load of a 2MiB value: %v\n%s", err, out)
+	}
+	var ref string
+	if err := db.QueryRow("SELECT body FROM main ORDER BY id DESC LIMIT 1").Scan(&ref); err != nil || !strings.HasPrefix(ref, "sha256:") {
+		t.Errorf("2MiB value stored as %.40q, %v", ref, err)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--blob-store", store, "--tail", "1").Output()
+	if got := decodeAllLines(t, out); err != nil || len(got) != 1 || len(fmt.Sprint(got[0]["body"])) != 2<<20 {
+		t.Errorf("dump of a 2MiB value: %v", err)
+	}
+}
+
+// --- OPTIMIZE TEST --- //
+func TestOptimize(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"name": "Alice"}`, `{"name": "Bob"}`}, "--optimize")
+	if out, err := exec.Command(bin, "optimize", "--db", dbPath).CombinedOutput(); err != nil || !strings.Contains(string(out), "Optimized") {
+		t.Fatalf("optimize: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil || len(decodeAllLines(t, out)) != 2 {
+		t.Errorf("dump after optimize: %v\n%s", err, out)
+	}
+	if err := exec.Command(bin, "optimize", "--db", filepath.Join(t.TempDir(), "missing.db")).Run(); err == nil {
+		t.Error("optimize of a missing database should fail")
+	}
+}
+
+// --- CHECK INVARIANTS TEST --- //
+func TestCheckInvariants(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"kind": "k%d", "tags": [%d], "meta": {"n": %d}}`, i%2, i, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	check := func() (string, int) {
+		cmd := exec.Command(bin, "check", "--db", dbPath, "--schema", ddlPath)
+		out, _ := cmd.Output()
+		return string(out), cmd.ProcessState.ExitCode()
+	}
+	if out, code := check(); code != 0 {
+		t.Fatalf("fresh import: exit %d\n%s", code, out)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"UPDATE main SET kind_symbol = 99 WHERE id <= 2",
+		"UPDATE main SET meta_id = 500 WHERE id = 3",
+		"UPDATE main SET tags = '[1,' WHERE id = 4",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	out, code := check()
+	if code != 1 {
+		t.Fatalf("corrupted database: exit %d\n%s", code, out)
+	}
+	for _, want := range []string{"kind_symbol  dangling-symbol  2", "meta_id      dangling-fk      1", "tags         invalid-json     1"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("check output lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+// --- REPAIR TEST --- //
+func TestRepair(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"kind": "k%d", "meta": {"sub": {"n": %d}}}`, i%2, i))
+	}
+	for _, mode := range []string{"null", "delete"} {
+		dbPath, ddlPath := importLines(t, bin, lines)
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range []string{
+			// Rebuild the symbol table without its UNIQUE constraint, with a duplicate of k0
+			"CREATE TABLE kind_copy AS SELECT * FROM kind_symbol",
+			"DROP TABLE kind_symbol",
+			"CREATE TABLE kind_symbol (id INTEGER PRIMARY KEY, value TEXT)",
+			"INSERT INTO kind_symbol SELECT * FROM kind_copy",
+			`INSERT INTO kind_symbol (id, value) VALUES (10, '"k0"')`,
+			"UPDATE main SET kind_symbol = 10 WHERE id = 1",
+			// A nested row pointing nowhere
+			"UPDATE meta SET sub_id = 999 WHERE id = 2",
+		} {
+			if _, err := db.Exec(stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		args := []string{"repair", "--db", dbPath, "--schema", ddlPath}
+		if mode == "delete" {
+			args = append(args, "--delete")
+		}
+		if out, err := exec.Command(bin, append(args, "--dry-run")...).Output(); err != nil || !strings.Contains(string(out), "Dry run") {
+			t.Fatalf("%s: dry run: %v\n%s", mode, err, out)
+		}
+		if err := exec.Command(bin, "check", "--db", dbPath, "--schema", ddlPath).Run(); err == nil {
+			t.Fatalf("%s: dry run changed the database", mode)
+		}
+		if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: repair: %v\n%s", mode, err, out)
+		}
+		if out, err := exec.Command(bin, "check", "--db", dbPath, "--schema", ddlPath).Output(); err != nil {
+			t.Fatalf("%s: check after repair: %v\n%s", mode, err, out)
+		}
+		out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+		if err != nil {
+			t.Fatalf("%s: dump: %v", mode, err)
+		}
+		docs := decodeAllLines(t, out)
+		want := map[string]int{"null": 20, "delete": 19}[mode]
+		if len(docs) != want || docs[0]["kind"] != "k0" {
+			t.Errorf("%s: got %d documents (first %v), want %d", mode, len(docs), docs[0], want)
+		}
+	}
+}
+
+// --- ONLINE BACKUP TEST --- //
+func TestBackupWhileServing(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"name": "seed", "n": 0}`})
+	base := startServe(t, bin, "--db", dbPath, "--schema", ddlPath)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			body := fmt.Sprintf(`{"name": "row", "n": %d}`+"\n", i)
+			if resp, err := http.Post(base+"/ingest", "application/x-ndjson", strings.NewReader(body)); err == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	snapshot := filepath.Join(t.TempDir(), "snapshot.db")
+	out, err := exec.Command(bin, "backup", "--db", dbPath, "--out", snapshot).CombinedOutput()
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatalf("backup: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(bin, "optimize", "--db", snapshot).CombinedOutput(); err != nil {
+		t.Fatalf("snapshot integrity: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin, "dump", "--db", snapshot, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump snapshot: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) < 1 || docs[0]["name"] != "seed" {
+		t.Errorf("snapshot: got %d documents", len(docs))
+	}
+}
+
+func TestBundle(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"name": "a", "n": 1}`, `{"name": "b", "n": 2}`})
+	dir := t.TempDir()
+
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idFile := filepath.Join(dir, "key.txt")
+	os.WriteFile(idFile, []byte(id.String()+"\n"), 0600)
+	writeKey := func(name string) (string, string) {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+		pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+		privFile, pubFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".pub")
+		os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+		os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+		return privFile, pubFile
+	}
+	signKey, verifyKey := writeKey("sign")
+	_, otherKey := writeKey("other")
+
+	bundle := filepath.Join(dir, "data.tar.zst.age")
+	if out, err := exec.Command(bin, "export-bundle", "--db", dbPath, "--schema", ddlPath, "--out", bundle,
+		"--recipient", id.Recipient().String(), "--sign-key", signKey, "--description", "test").CombinedOutput(); err != nil {
+		t.Fatalf("export-bundle: %v\n%s", err, out)
+	}
+
+	unpacked := filepath.Join(dir, "unpacked")
+	if out, err := exec.Command(bin, "import-bundle", "--bundle", bundle, "--out", unpacked,
+		"--identity", idFile, "--verify-key", verifyKey).CombinedOutput(); err != nil {
+		t.Fatalf("import-bundle: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", filepath.Join(unpacked, "data.db"), "--schema", filepath.Join(unpacked, "schema.sql")).Output()
+	if err != nil {
+		t.Fatalf("dump unpacked: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 2 || docs[1]["name"] != "b" {
+		t.Errorf("unpacked dump: %s", out)
+	}
+	var meta struct {
+		Description string
+		Rows        map[string]int64
+	}
+	data, _ := os.ReadFile(filepath.Join(unpacked, "metadata.json"))
+	if err := json.Unmarshal(data, &meta); err != nil || meta.Description != "test" || len(meta.Rows) == 0 {
+		t.Errorf("metadata.json: %s", data)
+	}
+
+	rejected := func(name string, args ...string) {
+		t.Helper()
+		target := filepath.Join(dir, name)
+		args = append([]string{"import-bundle", "--out", target}, args...)
+		if out, err := exec.Command(bin, args...).CombinedOutput(); err == nil {
+			t.Errorf("%s: import-bundle succeeded\n%s", name, out)
+		}
+		if _, err := os.Stat(filepath.Join(target, "data.db")); err == nil {
+			t.Errorf("%s: data.db unpacked despite failure", name)
+		}
+	}
+	rejected("no-identity", "--bundle", bundle)
+	rejected("wrong-signer", "--bundle", bundle, "--identity", idFile, "--verify-key", otherKey)
+
+	// Unencrypted, unsigned bundle with a flipped byte
+	plain := filepath.Join(dir, "plain.tar.zst")
+	if out, err := exec.Command(bin, "export-bundle", "--db", dbPath, "--schema", ddlPath, "--out", plain).CombinedOutput(); err != nil {
+		t.Fatalf("export-bundle: %v\n%s", err, out)
+	}
+	rejected("unsigned", "--bundle", plain, "--verify-key", verifyKey)
+	data, _ = os.ReadFile(plain)
+	data[len(data)/2] ^= 0xff
+	tampered := filepath.Join(dir, "tampered.tar.zst")
+	os.WriteFile(tampered, data, 0644)
+	rejected("tampered", "--bundle", tampered)
+}
+
+func TestProfile(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"order_no": "o%d", "status": "s%d", "count": %d, "payload": {"a": %d}, "customer": {"email": "c%d@example.com"}}`, i, i, i, i, i%3))
+	}
+	profile := writeTempFile(t, "profile-*.yaml", `
+types:
+  payload: JSON
+  count: INTEGER
+symbols: [status]
+keys: [order_no]
+indexes: [customer.email, status]
+`)
+	defer os.Remove(profile)
+	dbPath, ddlPath := importLines(t, bin, lines, "--profile", profile)
+	ddl, _ := os.ReadFile(ddlPath)
+	for _, want := range []string{
+		"payload JSON",
+		"count INTEGER",
+		"status_symbol INTEGER REFERENCES status_symbol(id)",
+		"CREATE UNIQUE INDEX main_order_no_key ON main (order_no);",
+		"CREATE INDEX customer_email_idx ON customer (email_symbol);",
+		"CREATE INDEX main_status_idx ON main (status_symbol);",
+	} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	var want []map[string]interface{}
+	for _, l := range lines {
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(l), &doc)
+		want = append(want, doc)
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("roundtrip:\ngot  %v\nwant %v", docs, want)
+	}
+
+	// The key rejects duplicates
+	dup := writeTempFile(t, "dup-*.json", lines[0]+"\n")
+	defer os.Remove(dup)
+	if out, _ := exec.Command(bin, "load", "--input", dup, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); !strings.Contains(string(out), "UNIQUE constraint failed") {
+		t.Errorf("loading a duplicate key was not rejected:\n%s", out)
+	}
+
+	if out, err := exec.Command(bin, "analyze", "--input", dup, "--profile", "no-such-profile").CombinedOutput(); err == nil || !strings.Contains(string(out), "github-events") {
+		t.Errorf("unknown profile: %v\n%s", err, out)
+	}
+}
+
+func TestMultipleRoots(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	orders := filepath.Join(tmp, "orders.json")
+	users := filepath.Join(tmp, "users.json")
+	os.WriteFile(orders, []byte(`{"no": 1, "user": "ann", "meta": {"channel": "web"}}
+{"no": 2, "user": "bob", "meta": {"channel": "shop"}}
+`), 0666)
+	os.WriteFile(users, []byte(`{"name": "ann", "meta": {"city": "Oslo"}}
+{"name": "bob", "meta": {"city": "Rome"}}
+`), 0666)
+	dbPath := filepath.Join(tmp, "shop.db")
+	ddlPath := filepath.Join(tmp, "shop.sql")
+	if out, err := exec.Command(bin, "import", "--db", dbPath, "--schema", ddlPath,
+		"--map", orders+"=orders", "--map", users+"=users").CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	ddl, _ := os.ReadFile(ddlPath)
+	dbs := ParseDDL(string(ddl))
+	for _, table := range []string{"orders", "orders_meta", "users", "users_meta"} {
+		if dbs.Tables[table] == nil {
+			t.Errorf("schema lacks table %s", table)
+		}
+	}
+	dump := func(root string) []map[string]interface{} {
+		out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--root", root).Output()
+		if err != nil {
+			t.Fatalf("dump --root %s: %v", root, err)
+		}
+		return decodeAllLines(t, out)
+	}
+	if got := dump("users"); len(got) != 2 || got[1]["name"] != "bob" || got[1]["meta"].(map[string]interface{})["city"] != "Rome" {
+		t.Errorf("users: %v", got)
+	}
+
+	// load appends to each root independently
+	if out, err := exec.Command(bin, "load", "--db", dbPath, "--schema", ddlPath, "--map", orders+"=orders").CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	if got := dump("orders"); len(got) != 4 || got[3]["user"] != "bob" {
+		t.Errorf("orders: %v", got)
+	}
+	if got := dump("users"); len(got) != 2 {
+		t.Errorf("users after loading orders: %d documents", len(got))
+	}
+	if out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err == nil {
+		t.Errorf("dump without --root succeeded on a schema without main:\n%s", out)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(tmp, name)
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	// 20 orders over 2 users symbolizes orders.user
+	var orders []string
+	for i := 0; i < 20; i++ {
+		orders = append(orders, fmt.Sprintf(`{"no": %d, "user": "%s"}`, i, []string{"ann", "bob"}[i%2]))
+	}
+	ordersPath := write("orders.json", strings.Join(orders, "\n")+"\n")
+	usersPath := write("users.json", `{"name": "ann", "age": 30}`+"\n")
+	laterUsers := write("later.json", `{"name": "bob", "age": 40}`+"\n")
+	links := write("links.yaml", "orders.user: users.name\n")
+	dbPath := filepath.Join(tmp, "shop.db")
+	ddlPath := filepath.Join(tmp, "shop.sql")
+
+	out, err := exec.Command(bin, "import", "--db", dbPath, "--schema", ddlPath, "--links", links,
+		"--map", ordersPath+"=orders", "--map", usersPath+"=users").CombinedOutput()
+	if err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	ddl, _ := os.ReadFile(ddlPath)
+	for _, want := range []string{"user_symbol INTEGER", "user_ref INTEGER REFERENCES users(id)", "-- jsql:link orders.user -> users.name", "name TEXT"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	refs := func() map[string]int {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		rows, err := db.Query(`SELECT u.name, COUNT(*) FROM orders o JOIN users u ON u.id = o.user_ref GROUP BY u.name`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		got := map[string]int{}
+		for rows.Next() {
+			var name string
+			var n int
+			rows.Scan(&name, &n)
+			got[name] = n
+		}
+		return got
+	}
+	if got := refs(); !reflect.DeepEqual(got, map[string]int{"ann": 10}) {
+		t.Errorf("after import: %v", got)
+	}
+	// bob arrives later: the pending references are fixed up
+	if out, err := exec.Command(bin, "load", "--db", dbPath, "--schema", ddlPath, "--map", laterUsers+"=users").CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	if got := refs(); !reflect.DeepEqual(got, map[string]int{"ann": 10, "bob": 10}) {
+		t.Errorf("after loading bob: %v", got)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--root", "orders").Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 20 || !reflect.DeepEqual(docs[1], map[string]interface{}{"no": 1.0, "user": "bob"}) {
+		t.Errorf("dump: %s", out)
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	csvPath := filepath.Join(tmp, "owners.csv")
+	os.WriteFile(csvPath, []byte("host,team,tier\nweb1,frontend,1\ndb1,storage,2\n"), 0666)
+	geoPath := filepath.Join(tmp, "geoip.db")
+	geo, err := sql.Open("sqlite3", geoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := geo.Exec(`CREATE TABLE geo (ip TEXT PRIMARY KEY, country TEXT, asn INTEGER);
+		INSERT INTO geo VALUES ('10.0.0.1', 'NL', 1136), ('10.0.0.2', 'FR', 3215);`); err != nil {
+		t.Fatal(err)
+	}
+	geo.Close()
+
+	enrich := []string{
+		"--enrich", "geo=" + geoPath + ":req.ip->country,asn",
+		"--enrich", "owner=" + csvPath + ":host->team",
+	}
+	dbPath, ddlPath := importLines(t, bin, []string{
+		`{"host": "web1", "req": {"ip": "10.0.0.1"}}`,
+		`{"host": "db1", "req": {"ip": "10.0.0.9"}}`,
+	}, enrich...)
+	more := writeTempFile(t, "more-*.json", `{"host": "web2", "req": {"ip": "10.0.0.2"}}`+"\n")
+	defer os.Remove(more)
+	if out, err := exec.Command(bin, append([]string{"load", "--input", more, "--db", dbPath, "--schema", ddlPath}, enrich...)...).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	want := []map[string]interface{}{
+		{"host": "web1", "req": map[string]interface{}{"ip": "10.0.0.1"}, "geo_country": "NL", "geo_asn": 1136.0, "owner_team": "frontend"},
+		{"host": "db1", "req": map[string]interface{}{"ip": "10.0.0.9"}, "owner_team": "storage"},
+		{"host": "web2", "req": map[string]interface{}{"ip": "10.0.0.2"}, "geo_country": "FR", "geo_asn": 3215.0},
+	}
+	if got := decodeAllLines(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("dump:\ngot  %v\nwant %v", got, want)
+	}
+	if out, err := exec.Command(bin, "load", "--input", more, "--db", dbPath, "--schema", ddlPath,
+		"--enrich", "owner="+csvPath+":host->missing").CombinedOutput(); err == nil {
+		t.Errorf("unknown enrichment column accepted:\n%s", out)
+	}
+}
+
+func TestComputed(t *testing.T) {
+	bin := buildCLI(t)
+	computed := writeTempFile(t, "computed-*.yaml", `duration_ms:
+  expr: end - start
+  index: true
+req.url: host + path
+`)
+	defer os.Remove(computed)
+	dbPath, ddlPath := importLines(t, bin, []string{
+		`{"start": 100, "end": 250, "req": {"host": "example.com", "path": "/a"}}`,
+		`{"start": 300, "req": {"host": "example.org", "path": "/b"}}`,
+	}, "--computed", computed)
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"-- jsql:computed main.duration_ms = end - start",
+		"CREATE INDEX main_duration_ms_computed ON main (duration_ms);",
+		"-- jsql:computed req.url = host + path",
+	} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var durations []interface{}
+	rows, err := db.Query("SELECT main.duration_ms, req.url FROM main JOIN req ON req.id = main.req_id ORDER BY main.id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urls []string
+	for rows.Next() {
+		var d interface{}
+		var u string
+		if err := rows.Scan(&d, &u); err != nil {
+			t.Fatal(err)
+		}
+		durations = append(durations, d)
+		urls = append(urls, u)
+	}
+	rows.Close()
+	if want := []interface{}{150.0, nil}; !reflect.DeepEqual(durations, want) {
+		t.Errorf("duration_ms = %v, want %v", durations, want)
+	}
+	if want := []string{"example.com/a", "example.org/b"}; !reflect.DeepEqual(urls, want) {
+		t.Errorf("req.url = %v, want %v", urls, want)
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if strings.Contains(string(out), "duration_ms") || strings.Contains(string(out), "url") {
+		t.Errorf("dump includes computed columns:\n%s", out)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	bin := buildCLI(t)
+	defaults := writeTempFile(t, "defaults-*.yaml", "status: unknown\nretries: 0\nreq.scheme: https\n")
+	defer os.Remove(defaults)
+	lines := []string{
+		`{"name": "a", "status": "ok", "retries": 2, "req": {"scheme": "http"}}`,
+		`{"name": "b", "req": {"host": "example.com"}}`,
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--defaults", defaults)
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"status TEXT DEFAULT 'unknown'", "retries INTEGER DEFAULT 0", "scheme TEXT DEFAULT 'https'"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	want := []map[string]interface{}{
+		{"name": "a", "status": "ok", "retries": 2.0, "req": map[string]interface{}{"scheme": "http"}},
+		{"name": "b", "status": "unknown", "retries": 0.0, "req": map[string]interface{}{"host": "example.com", "scheme": "https"}},
+	}
+	if got := decodeAllLines(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("dump:\ngot  %v\nwant %v", got, want)
+	}
+
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--omit-defaults").Output()
+	if err != nil {
+		t.Fatalf("dump --omit-defaults: %v", err)
+	}
+	var orig []map[string]interface{}
+	for _, line := range lines {
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(line), &doc)
+		orig = append(orig, doc)
+	}
+	if got := decodeAllLines(t, out); !reflect.DeepEqual(got, orig) {
+		t.Errorf("dump --omit-defaults:\ngot  %v\nwant %v", got, orig)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "q.db")
+	ddlPath := filepath.Join(tmp, "q.sql")
+	ddl := "CREATE TABLE tags (\n  id INTEGER PRIMARY KEY,\n  label TEXT\n);\n\n" +
+		"CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  name TEXT UNIQUE,\n  tags_id INTEGER REFERENCES tags(id)\n);\n"
+	os.WriteFile(ddlPath, []byte(ddl), 0666)
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	dataPath := filepath.Join(tmp, "data.json")
+	os.WriteFile(dataPath, []byte(`{"name": "a", "tags": {"label": "x"}}
+{"name": "a", "tags": {"label": "y"}}
+{"name": 
+{"name": "b"}
+`), 0666)
+	if out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath, "--schema", ddlPath, "--quarantine").CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := func(q string) int {
+		var n int
+		if err := db.QueryRow(q).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count("SELECT COUNT(*) FROM main"); n != 2 {
+		t.Errorf("loaded %d rows, want 2", n)
+	}
+	// The failed row's nested object was rolled back with it
+	if n := count("SELECT COUNT(*) FROM tags"); n != 1 {
+		t.Errorf("tags has %d rows, want 1", n)
+	}
+	var line int
+	var raw, msg string
+	if err := db.QueryRow("SELECT line, raw, error FROM _quarantine WHERE error LIKE '%UNIQUE%'").Scan(&line, &raw, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if line != 2 || raw != `{"name": "a", "tags": {"label": "y"}}` {
+		t.Errorf("quarantined line %d %q", line, raw)
+	}
+	if n := count("SELECT COUNT(*) FROM _quarantine"); n != 2 {
+		t.Errorf("quarantined %d rows, want 2", n)
+	}
+
+	// Fix the data in place and retry
+	if _, err := db.Exec(`UPDATE _quarantine SET raw = '{"name": "c"}' WHERE line = 3`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`DELETE FROM main WHERE name = 'a'`); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(bin, "retry-quarantine", "--db", dbPath, "--schema", ddlPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("retry-quarantine: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Loaded 2 quarantined rows") {
+		t.Errorf("retry-quarantine output:\n%s", out)
+	}
+	if n := count("SELECT COUNT(*) FROM _quarantine"); n != 0 {
+		t.Errorf("%d rows still quarantined", n)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	want := []map[string]interface{}{
+		{"name": "b"},
+		{"name": "a", "tags": map[string]interface{}{"label": "y"}},
+		{"name": "c"},
+	}
+	if got := decodeAllLines(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("dump:\ngot  %v\nwant %v", got, want)
+	}
+}
+
+func TestFallbackJSON(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "f.db")
+	ddlPath := filepath.Join(tmp, "f.sql")
+	ddl := "CREATE TABLE owner (\n  id INTEGER PRIMARY KEY,\n  name TEXT\n);\n\n" +
+		"CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  age INTEGER,\n  owner_id INTEGER REFERENCES owner(id)\n) STRICT;\n"
+	os.WriteFile(ddlPath, []byte(ddl), 0666)
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	lines := []string{
+		`{"age": 30, "owner": {"name": "ann"}}`,
+		`{"age": "thirty", "owner": "bob"}`,
+		`{"age": 40, "owner": ["carol", "dave"]}`,
+	}
+	dataPath := filepath.Join(tmp, "data.json")
+	os.WriteFile(dataPath, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+	out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath, "--schema", ddlPath, "--fallback-json").CombinedOutput()
+	if err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	for _, want := range []string{"main.age: 1 values stored as JSON in main.age_fallback", "main.owner: 2 values stored as JSON in main.owner_fallback"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("load output lacks %q:\n%s", want, out)
+		}
+	}
+	// The columns are recorded in the stored schema, not the --schema file
+	if got, _ := os.ReadFile(ddlPath); string(got) != ddl {
+		t.Errorf("load rewrote the --schema file:\n%s", got)
+	}
+	stored, _, err := StoredSchema(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"age_fallback TEXT", "-- jsql:fallback main.age", "owner_fallback TEXT", "-- jsql:fallback main.owner"} {
+		if !strings.Contains(stored, want) {
+			t.Errorf("stored schema lacks %q:\n%s", want, stored)
+		}
+	}
+
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	var want []map[string]interface{}
+	for _, line := range lines {
+		var doc map[string]interface{}
+		json.Unmarshal([]byte(line), &doc)
+		want = append(want, doc)
+	}
+	if got := decodeAllLines(t, out); !reflect.DeepEqual(got, want) {
+		t.Errorf("dump:\ngot  %v\nwant %v", got, want)
+	}
+
+	// Without the flag the STRICT mismatch fails the row
+	if out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil || !strings.Contains(string(out), "cannot store") {
+		t.Errorf("load without --fallback-json: %v\n%s", err, out)
+	}
+
+	// Columns named like fallback columns are otherwise the documents' own
+	own := []string{`{"x":"a","x_fallback":"hello"}`, `{"x":"b","x_fallback":"bye"}`}
+	dbPath, ddlPath = importLines(t, bin, own)
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if got := strings.TrimSpace(string(out)); got != strings.Join(own, "\n") {
+		t.Errorf("dump of x_fallback fields:\n%s", got)
+	}
+}
+
+func TestServeRowsPagination(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 7; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "meta": {"even": %t}}`, i, i%2 == 0))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	base := startServe(t, bin, "--db", dbPath, "--schema", ddlPath)
+
+	var got []float64
+	cursor, pages := "", 0
+	for {
+		resp, err := http.Get(base + "/rows?limit=3&cursor=" + cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page struct {
+			Rows       []map[string]interface{} `json:"rows"`
+			NextCursor string                   `json:"next_cursor"`
+		}
+		json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /rows: status %d", resp.StatusCode)
+		}
+		pages++
+		for _, row := range page.Rows {
+			got = append(got, row["n"].(float64))
+			if _, ok := row["meta"].(map[string]interface{}); !ok {
+				t.Errorf("row %v not rehydrated", row)
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if want := []float64{0, 1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(got, want) || pages != 3 {
+		t.Errorf("paged %v in %d pages, want %v in 3", got, pages, want)
+	}
+
+	for _, query := range []string{"limit=0", "limit=5000", "cursor=bogus"} {
+		resp, err := http.Get(base + "/rows?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET /rows?%s: status %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestSymbolsFrom(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "status": %q}`, i, []string{"new", "open", "closed"}[i%3]))
+	}
+	dict := writeTempFile(t, "symbols-*.txt", "# field, value, count\nstatus\tclosed\t100\nstatus\topen\t250\nstatus\tarchived\nowner\tnobody\n")
+	defer os.Remove(dict)
+	dbPath, ddlPath := importLines(t, bin, lines, "--symbols-from", dict)
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT value FROM status_symbol ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var v string
+		rows.Scan(&v)
+		got = append(got, v)
+	}
+	rows.Close()
+	// By count, then in file order; values only seen while loading come last
+	if want := []string{`"open"`, `"closed"`, `"archived"`, `"new"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("status_symbol values = %v, want %v", got, want)
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 20 || docs[2]["status"] != "closed" {
+		t.Errorf("dump: %v", docs)
+	}
+}
+
+func TestSymbolIDHash(t *testing.T) {
+	bin := buildCLI(t)
+	statuses := []string{"new", "open", "closed"}
+	var a, b []string
+	for i := 0; i < 20; i++ {
+		a = append(a, fmt.Sprintf(`{"n": %d, "status": %q}`, i, statuses[i%3]))
+		// The same values first seen in another order
+		b = append(b, fmt.Sprintf(`{"n": %d, "status": %q}`, i, statuses[2-i%3]))
+	}
+	symbolIDs := func(dbPath string) map[string]int64 {
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		rows, err := db.Query("SELECT value, id FROM status_symbol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		ids := map[string]int64{}
+		for rows.Next() {
+			var v string
+			var id int64
+			rows.Scan(&v, &id)
+			ids[v] = id
+		}
+		return ids
+	}
+	dbA, ddlA := importLines(t, bin, a, "--symbol-id", "hash")
+	dbB, _ := importLines(t, bin, b, "--symbol-id", "hash")
+	idsA, idsB := symbolIDs(dbA), symbolIDs(dbB)
+	if len(idsA) != 3 || !reflect.DeepEqual(idsA, idsB) {
+		t.Errorf("hashed ids differ: %v and %v", idsA, idsB)
+	}
+	if idsA[`"new"`] == 1 {
+		t.Errorf("ids look sequential: %v", idsA)
+	}
+	ddl, _ := os.ReadFile(ddlA)
+	if !strings.Contains(string(ddl), "-- jsql:symbol-id hash") {
+		t.Errorf("DDL lacks the symbol-id directive:\n%s", ddl)
+	}
+
+	// Later loads keep hashing from the directive in the schema
+	more := writeTempFile(t, "more-*.json", `{"n": 20, "status": "archived"}`+"\n")
+	defer os.Remove(more)
+	if out, err := exec.Command(bin, "load", "--input", more, "--db", dbA, "--schema", ddlA).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	if id := symbolIDs(dbA)[`"archived"`]; id != symbolHash(`"archived"`) {
+		t.Errorf("archived got id %d, want %d", id, symbolHash(`"archived"`))
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbA, "--schema", ddlA, "--tail", "1").Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 1 || docs[0]["status"] != "archived" {
+		t.Errorf("dump: %v", docs)
+	}
+}
+
+func TestRecompactSymbols(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	// rare is seen first, so it got id 1; common is referenced the most
+	for i := 0; i < 30; i++ {
+		status := "common"
+		switch {
+		case i == 0:
+			status = "rare"
+		case i%5 == 0:
+			status = "medium"
+		}
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "status": %q, "meta": {"status": %q}}`, i, status, status))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	before, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	out, err := exec.Command(bin, "recompact-symbols", "--db", dbPath, "--schema", ddlPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("recompact-symbols: %v\n%s", err, out)
+	}
+	if !strings.Contains(strings.Join(strings.Fields(string(out)), " "), "status_symbol 3 3") {
+		t.Errorf("recompact-symbols output:\n%s", out)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT value FROM status_symbol ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var v string
+		rows.Scan(&v)
+		got = append(got, v)
+	}
+	rows.Close()
+	if want := []string{`"common"`, `"medium"`, `"rare"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("symbols by id = %v, want %v", got, want)
+	}
+	after, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("documents changed:\n%s\nbecame\n%s", before, after)
+	}
+	if out, err := exec.Command(bin, "check", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Errorf("check after recompact: %v\n%s", err, out)
+	}
+}
+
+func TestDeferTriggers(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "t.db")
+	ddlPath := filepath.Join(tmp, "t.sql")
+	ddl := `CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  title TEXT,
+  body TEXT
+);
+
+CREATE VIRTUAL TABLE main_fts USING fts4(title, body, content='main');
+
+CREATE TRIGGER main_fts_insert AFTER INSERT ON main BEGIN
+  INSERT INTO main_fts(docid, title, body) VALUES (new.id, new.title, new.body);
+END;
+
+CREATE TABLE audit (id INTEGER PRIMARY KEY, row_id INTEGER, title TEXT);
+
+CREATE TRIGGER main_audit AFTER INSERT ON main WHEN new.title LIKE 'secret%' BEGIN
+  INSERT INTO audit (row_id, title) VALUES (new.id, new.title);
+END;
+`
+	os.WriteFile(ddlPath, []byte(ddl), 0666)
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	load := func(lines string, args ...string) {
+		dataPath := writeTempFile(t, "data-*.json", lines)
+		defer os.Remove(dataPath)
+		args = append([]string{"load", "--input", dataPath, "--db", dbPath, "--schema", ddlPath}, args...)
+		if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+			t.Fatalf("load: %v\n%s", err, out)
+		}
+	}
+	load(`{"title": "first", "body": "plain words"}`+"\n", "--defer-triggers")
+	load(`{"title": "secret plan", "body": "hidden words"}`+"\n"+`{"title": "third", "body": "more words"}`+"\n", "--defer-triggers")
+	load(`{"title": "secret two", "body": "last words"}` + "\n")
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM main_fts WHERE main_fts MATCH 'words'").Scan(&n); err != nil || n != 4 {
+		t.Errorf("full-text matches: %d, %v; want 4", n, err)
+	}
+	var audited []string
+	rows, err := db.Query("SELECT title FROM audit ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		audited = append(audited, s)
+	}
+	rows.Close()
+	if want := []string{"secret plan", "secret two"}; !reflect.DeepEqual(audited, want) {
+		t.Errorf("audited %v, want %v", audited, want)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger'").Scan(&n); err != nil || n != 2 {
+		t.Errorf("%d triggers after loading, want 2", n)
+	}
+}
+
+func TestStrictChunks(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "s.db")
+	ddlPath := filepath.Join(tmp, "s.sql")
+	os.WriteFile(ddlPath, []byte("CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  n INTEGER UNIQUE\n);\n"), 0666)
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	// Line 5 repeats n=1 and line 9 is not JSON: chunks 2 and 3 of 3 lines are lost
+	lines := []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`, `{"n": 4}`, `{"n": 1}`, `{"n": 6}`, `{"n": 7}`, `{"n": 8}`, `{"n": `, `{"n": 10}`}
+	dataPath := filepath.Join(tmp, "data.json")
+	os.WriteFile(dataPath, []byte(strings.Join(lines, "\n")+"\n"), 0666)
+	out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath, "--schema", ddlPath, "--strict", "--chunk-size", "3").CombinedOutput()
+	if err == nil {
+		t.Errorf("strict load with failing rows succeeded:\n%s", out)
+	}
+	for _, want := range []string{"Chunk 2 (lines 4-6) rolled back: line 5", "Chunk 3 (lines 7-9) rolled back: line 9", "chunks not committed: lines 4-6, lines 7-9"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("load output lacks %q:\n%s", want, out)
+		}
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	var got []float64
+	for _, doc := range decodeAllLines(t, out) {
+		got = append(got, doc["n"].(float64))
+	}
+	if want := []float64{1, 2, 3, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("committed %v, want %v", got, want)
+	}
+}
+
+func TestSourceQuery(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "source.db")
+	src, err := sql.Open("sqlite3", srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Exec(`CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL, doc TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 10; i++ {
+		doc := fmt.Sprintf("{\"user\": %d,\n \"tags\": [\"t%d\"]}", i, i%2)
+		if i == 10 {
+			doc = "not json"
+		}
+		if _, err := src.Exec(`INSERT INTO users VALUES (?, ?, ?, ?)`, i, fmt.Sprintf("user%d", i), float64(i)/2, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.Close()
+
+	// Rows as documents of their columns
+	dbPath := filepath.Join(dir, "rows.db")
+	ddlPath := filepath.Join(dir, "rows.sql")
+	out, err := exec.Command(bin, "import", "--source-db", srcPath, "--source-sql", "SELECT id AS uid, name, score FROM users WHERE id <= 5",
+		"--db", dbPath, "--schema", ddlPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 5 || docs[1]["uid"] != 2.0 || docs[1]["name"] != "user2" || docs[1]["score"] != 1.0 {
+		t.Errorf("dump of rows: %v", docs)
+	}
+
+	// Rows holding a JSON document, loaded into an existing schema
+	dbPath = filepath.Join(dir, "docs.db")
+	ddlPath = filepath.Join(dir, "docs.sql")
+	args := []string{"--source-db", srcPath, "--source-sql", "SELECT doc FROM users ORDER BY id", "--source-json-column", "doc"}
+	ddl, err := exec.Command(bin, append([]string{"analyze"}, args...)...).Output()
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	if err := os.WriteFile(ddlPath, ddl, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(bin, "create-db", "--schema", ddlPath, "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin, append([]string{"load", "--db", dbPath, "--schema", ddlPath}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	// The row that is not JSON is reported by its row number
+	if !strings.Contains(string(out), "skip JSON line 10") {
+		t.Errorf("load output: %s", out)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs = decodeAllLines(t, out)
+	if len(docs) != 9 || docs[2]["user"] != 3.0 || !reflect.DeepEqual(docs[2]["tags"], []interface{}{"t1"}) {
+		t.Errorf("dump of documents: %v", docs)
+	}
+
+	// Query errors fail the load
+	out, err = exec.Command(bin, "load", "--db", dbPath, "--schema", ddlPath, "--source-db", srcPath, "--source-sql", "SELECT nope FROM users").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "no such column") {
+		t.Errorf("load of a bad query: %v\n%s", err, out)
+	}
+}
+
+func TestSchemaFromJSONSchema(t *testing.T) {
+	bin := buildCLI(t)
+	model := writeTempFile(t, "model-*.schema.json", `{
+  "type": "object",
+  "properties": {
+    "status": {"type": "string", "enum": ["new", "open", "closed"]},
+    "title": {"type": "string"},
+    "count": {"type": "integer"},
+    "score": {"type": ["number", "null"]},
+    "retries": {"type": "integer", "default": 0},
+    "tags": {"type": "array", "items": {"type": "string"}},
+    "owner": {"$ref": "#/$defs/user"},
+    "reviewer": {"anyOf": [{"$ref": "#/$defs/user"}, {"type": "null"}]}
+  },
+  "$defs": {
+    "user": {"type": "object", "properties": {"name": {"type": "string"}}}
+  }
+}`)
+	defer os.Remove(model)
+	ddl, err := exec.Command(bin, "schema-from-jsonschema", "--input", model).Output()
+	if err != nil {
+		t.Fatalf("schema-from-jsonschema: %v", err)
+	}
+	for _, want := range []string{
+		"status_symbol INTEGER REFERENCES status_symbol(id)",
+		"title TEXT",
+		"count INTEGER",
+		"score REAL",
+		"retries INTEGER DEFAULT 0",
+		"tags JSON",
+		"owner_id INTEGER REFERENCES owner(id)",
+		"reviewer_id INTEGER REFERENCES reviewer(id)",
+		"CREATE TABLE owner (",
+	} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+
+	ddlPath := writeTempFile(t, "schema-*.sql", string(ddl))
+	defer os.Remove(ddlPath)
+	dbPath := filepath.Join(t.TempDir(), "model.db")
+	if out, err := exec.Command(bin, "create-db", "--schema", ddlPath, "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	input := writeTempFile(t, "input-*.json", `{"status": "open", "title": "a", "count": 3, "score": 1.5, "tags": ["x"], "owner": {"name": "ann"}}
+{"status": "new", "title": "b", "count": 4, "score": null, "retries": 2, "tags": [], "owner": {"name": "bob"}, "reviewer": {"name": "ann"}}
+`)
+	defer os.Remove(input)
+	if out, err := exec.Command(bin, "load", "--input", input, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 2 || docs[0]["status"] != "open" || docs[0]["retries"] != 0.0 || docs[1]["reviewer"].(map[string]interface{})["name"] != "ann" {
+		t.Errorf("dump: %v", docs)
+	}
+}
+
+func TestImportOpenAPI(t *testing.T) {
+	bin := buildCLI(t)
+	spec := writeTempFile(t, "api-*.yaml", `openapi: 3.0.3
+info: {title: Shop, version: "1"}
+paths:
+  /orders:
+    get:
+      responses:
+        "200":
+          description: Orders
+          content:
+            application/json:
+              schema:
+                type: array
+                items: {$ref: "#/components/schemas/Order"}
+components:
+  schemas:
+    Order:
+      type: object
+      properties:
+        number: {type: integer}
+        state: {type: string, enum: [placed, shipped]}
+        total: {type: number}
+        customer: {$ref: "#/components/schemas/Customer"}
+    Customer:
+      type: object
+      properties:
+        email: {type: string}
+        vip: {type: boolean, nullable: true}
+`)
+	defer os.Remove(spec)
+	ddl, err := exec.Command(bin, "schema-from-jsonschema", "--openapi", spec+"#/components/schemas/Order").Output()
+	if err != nil {
+		t.Fatalf("schema-from-jsonschema: %v", err)
+	}
+	for _, want := range []string{"number INTEGER", "state_symbol INTEGER", "total REAL", "customer_id INTEGER REFERENCES customer(id)", "vip BOOLEAN"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	if out, err := exec.Command(bin, "schema-from-jsonschema", "--openapi", spec).CombinedOutput(); err == nil {
+		t.Errorf("--openapi without a schema pointer succeeded:\n%s", out)
+	}
+
+	// A dump of API responses, imported with the authoritative types
+	input := writeTempFile(t, "orders-*.json", `{"number": 1, "state": "placed", "total": 10, "customer": {"email": "a@example.com", "vip": true}}
+{"number": 2, "state": "shipped", "total": 2.5, "customer": {"email": "b@example.com"}}
+`)
+	defer os.Remove(input)
+	dir := t.TempDir()
+	dbPath, ddlPath := filepath.Join(dir, "orders.db"), filepath.Join(dir, "orders.sql")
+	if out, err := exec.Command(bin, "import", "--openapi", spec+"#/components/schemas/Order", "--input", input, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 2 || docs[0]["number"] != 1.0 || docs[1]["state"] != "shipped" || docs[0]["customer"].(map[string]interface{})["vip"] != true {
+		t.Errorf("dump: %v", docs)
+	}
+}
+
+func TestProtoInput(t *testing.T) {
+	bin := buildCLI(t)
+	// pkg.Event { string kind; Level level; int64 count; repeated string tags; User user; }
+	str := descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+	opt := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("event.proto"),
+		Package: proto.String("pkg"),
+		Syntax:  proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Level"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("INFO"), Number: proto.Int32(0)},
+				{Name: proto.String("WARN"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:  proto.String("User"),
+			Field: []*descriptorpb.FieldDescriptorProto{{Name: proto.String("login"), Number: proto.Int32(1), Type: str, Label: opt, JsonName: proto.String("login")}},
+		}, {
+			Name: proto.String("Event"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("kind"), Number: proto.Int32(1), Type: str, Label: opt, JsonName: proto.String("kind")},
+				{Name: proto.String("level"), Number: proto.Int32(2), Type: descriptorpb.FieldDescriptorProto_TYPE_ENUM.Enum(), TypeName: proto.String(".pkg.Level"), Label: opt, JsonName: proto.String("level")},
+				{Name: proto.String("count"), Number: proto.Int32(3), Type: descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum(), Label: opt, JsonName: proto.String("count")},
+				{Name: proto.String("tags"), Number: proto.Int32(4), Type: str, Label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(), JsonName: proto.String("tags")},
+				{Name: proto.String("user"), Number: proto.Int32(5), Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".pkg.User"), Label: opt, JsonName: proto.String("user")},
+			},
+		}},
+	}
+	set, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	descPath := filepath.Join(dir, "event.pb")
+	if err := os.WriteFile(descPath, set, 0666); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, user := fd.Messages().ByName("Event"), fd.Messages().ByName("User")
+	var input bytes.Buffer
+	for i := 0; i < 20; i++ {
+		msg := dynamicpb.NewMessage(event)
+		msg.Set(event.Fields().ByName("kind"), protoreflect.ValueOfString([]string{"push", "pull"}[i%2]))
+		msg.Set(event.Fields().ByName("level"), protoreflect.ValueOfEnum(protoreflect.EnumNumber(i%2)))
+		msg.Set(event.Fields().ByName("count"), protoreflect.ValueOfInt64(int64(i)))
+		tags := msg.Mutable(event.Fields().ByName("tags")).List()
+		tags.Append(protoreflect.ValueOfString(fmt.Sprintf("t%d", i)))
+		u := dynamicpb.NewMessage(user)
+		u.Set(user.Fields().ByName("login"), protoreflect.ValueOfString(fmt.Sprintf("user%d", i)))
+		msg.Set(event.Fields().ByName("user"), protoreflect.ValueOfMessage(u))
+		if _, err := protodelim.MarshalTo(&input, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inputPath := filepath.Join(dir, "events.bin")
+	if err := os.WriteFile(inputPath, input.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath, ddlPath := filepath.Join(dir, "events.db"), filepath.Join(dir, "events.sql")
+	if out, err := exec.Command(bin, "import", "--input", inputPath, "--proto", descPath, "--message", "pkg.Event", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	ddl, _ := os.ReadFile(ddlPath)
+	for _, want := range []string{"kind_symbol INTEGER", "level_symbol INTEGER", "user_id INTEGER REFERENCES user(id)"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	want := map[string]interface{}{"kind": "push", "level": "INFO", "count": 0.0, "tags": []interface{}{"t0"}, "user": map[string]interface{}{"login": "user0"}}
+	if len(docs) != 20 || !reflect.DeepEqual(docs[0], want) || docs[3]["level"] != "WARN" {
+		t.Errorf("dump: %v", docs)
+	}
+
+	if out, err := exec.Command(bin, "analyze", "--input", inputPath, "--proto", descPath, "--message", "pkg.Nope").CombinedOutput(); err == nil {
+		t.Errorf("analyze with an unknown message succeeded:\n%s", out)
+	}
+}
+
+func TestXMLInput(t *testing.T) {
+	bin := buildCLI(t)
+	var sb strings.Builder
+	sb.WriteString("<?xml version=\"1.0\"?>\n<catalog>\n  <meta><generated>today</generated></meta>\n")
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&sb, "  <item id=\"%d\" status=\"%s\">\n    <title>Item %d</title>\n    <price currency=\"EUR\">%d.50</price>\n    <tag>a</tag><tag>b%d</tag>\n  </item>\n",
+			i, []string{"new", "sold"}[i%2], i, i, i)
+	}
+	sb.WriteString("</catalog>\n")
+	input := writeTempFile(t, "catalog-*.xml", sb.String())
+	defer os.Remove(input)
+
+	dir := t.TempDir()
+	dbPath, ddlPath := filepath.Join(dir, "catalog.db"), filepath.Join(dir, "catalog.sql")
+	if out, err := exec.Command(bin, "import", "--input", input, "--format", "xml", "--record-element", "item", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	want := map[string]interface{}{
+		"attr_id":     "1",
+		"attr_status": "sold",
+		"title":       "Item 1",
+		"price":       map[string]interface{}{"attr_currency": "EUR", "text": "1.50"},
+		"tag":         []interface{}{"a", "b1"},
+	}
+	if len(docs) != 20 || !reflect.DeepEqual(docs[1], want) {
+		t.Errorf("dump: %d documents, second %v", len(docs), docs[1])
+	}
+
+	if out, err := exec.Command(bin, "analyze", "--input", input, "--format", "xml").CombinedOutput(); err == nil {
+		t.Errorf("--format xml without --record-element succeeded:\n%s", out)
+	}
+}
+
+func TestLogFormats(t *testing.T) {
+	bin := buildCLI(t)
+	tests := []struct {
+		format, lines string
+		want          map[string]interface{} // the first document
+		docs          int
+	}{
+		{
+			format: "logfmt",
+			lines: `level=info msg="request done" path=/api status=200 cached
+level=warn msg="slow \"query\"" path=/db status=500
+this is not = logfmt=
+level=info msg=ok path=/ status=200
+`,
+			want: map[string]interface{}{"level": "info", "msg": "request done", "path": "/api", "status": "200", "cached": true},
+			docs: 3,
+		},
+		{
+			format: "clf",
+			lines: `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326
+10.0.0.2 - - [10/Oct/2000:13:56:01 -0700] "POST /login HTTP/1.1" 302 - "https://example.com/" "curl/8.0"
+`,
+			want: map[string]interface{}{"host": "127.0.0.1", "user": "frank", "time": "2000-10-10T13:55:36-07:00", "request": "GET /apache_pb.gif HTTP/1.0",
+				"method": "GET", "path": "/apache_pb.gif", "protocol": "HTTP/1.0", "status": 200.0, "bytes": 2326.0},
+			docs: 2,
+		},
+		{
+			format: "syslog",
+			lines: `<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - 'su root' failed for lonvick on /dev/pts/8
+<165>Aug 24 05:34:00 host1 sshd[1234]: Accepted publickey for root
+Oct 11 22:14:15 host2 cron: job done
+`,
+			want: map[string]interface{}{"facility": "auth", "severity": "crit", "timestamp": "2003-10-11T22:14:15.003Z", "hostname": "mymachine.example.com",
+				"app": "su", "msgid": "ID47", "message": "'su root' failed for lonvick on /dev/pts/8"},
+			docs: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			input := writeTempFile(t, "log-*.log", tt.lines)
+			defer os.Remove(input)
+			dir := t.TempDir()
+			dbPath, ddlPath := filepath.Join(dir, "logs.db"), filepath.Join(dir, "logs.sql")
+			out, err := exec.Command(bin, "import", "--input", input, "--format", tt.format, "--provenance", "--db", dbPath, "--schema", ddlPath).CombinedOutput()
+			if err != nil {
+				t.Fatalf("import: %v\n%s", err, out)
+			}
+			out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--with-provenance").Output()
+			if err != nil {
+				t.Fatalf("dump: %v", err)
+			}
+			docs := decodeAllLines(t, out)
+			if len(docs) != tt.docs {
+				t.Fatalf("got %d documents, want %d: %v", len(docs), tt.docs, docs)
+			}
+			got := docs[0]
+			for _, col := range []string{"_line", "_source", "_ingested_at"} {
+				delete(got, col)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("first document = %v, want %v", got, tt.want)
+			}
+			// Skipped lines keep the line numbers of the others
+			if last := docs[len(docs)-1]; last["_line"] != float64(strings.Count(tt.lines, "\n")) {
+				t.Errorf("last document from line %v", last["_line"])
+			}
+		})
+	}
+}
+
+func TestExplode(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf(`{"order_no": %d, "customer": "c%d", "shipping": {"city": "x"}, "lines": [{"sku": "a%d", "qty": 1}, {"sku": "b", "qty": 2, "customer": "gift"}]}`, i, i, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--explode", "lines")
+	ddl, _ := os.ReadFile(ddlPath)
+	if !strings.Contains(string(ddl), "-- jsql:explode main.lines") || !strings.Contains(string(ddl), "parent_customer TEXT") {
+		t.Errorf("DDL:\n%s", ddl)
+	}
+
+	// The directive makes later loads explode too
+	more := writeTempFile(t, "more-*.json", `{"order_no": 10, "customer": "c10", "lines": [{"sku": "z", "qty": 5}]}
+{"order_no": 11, "customer": "c11", "lines": []}
+`)
+	defer os.Remove(more)
+	if out, err := exec.Command(bin, "load", "--input", more, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 22 {
+		t.Fatalf("got %d rows, want 22: %v", len(docs), docs)
+	}
+	if want := map[string]interface{}{"order_no": 0.0, "customer": "gift", "parent_customer": "c0", "sku": "b", "qty": 2.0}; !reflect.DeepEqual(docs[1], want) {
+		t.Errorf("second row = %v, want %v", docs[1], want)
+	}
+	if want := map[string]interface{}{"order_no": 11.0, "customer": "c11"}; !reflect.DeepEqual(docs[21], want) {
+		t.Errorf("row of an empty array = %v, want %v", docs[21], want)
+	}
+
+	out, err = exec.Command(bin, "flatten", "--input", more, "--explode", "lines").Output()
+	if err != nil {
+		t.Fatalf("flatten: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 2 || docs[0]["sku"] != "z" || docs[0]["order_no"] != 10.0 {
+		t.Errorf("flatten --explode: %v", docs)
+	}
+}
+
+func TestRename(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "type": "t%d", "user": {"name": "u%d", "role": "r%d"}}`, i, i%2, i, i%2))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--rename", "user.name=username", "--rename", "user=account", "--rename", "type=event_type")
+	ddl, _ := os.ReadFile(ddlPath)
+	for _, want := range []string{"-- jsql:rename account.name -> username", "-- jsql:rename main.user -> account", "-- jsql:rename main.type -> event_type"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var username, eventType string
+	err = db.QueryRow(`SELECT account.username, json_extract(event_type_symbol.value, '$') FROM main
+		JOIN account ON account.id = main.account_id JOIN event_type_symbol ON event_type_symbol.id = main.event_type_symbol WHERE main.n = 3`).Scan(&username, &eventType)
+	if err != nil || username != "u3" || eventType != "t1" {
+		t.Errorf("renamed columns: %q %q %v", username, eventType, err)
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	for i, line := range lines {
+		var want map[string]interface{}
+		json.Unmarshal([]byte(line), &want)
+		if i >= len(docs) || !reflect.DeepEqual(docs[i], want) {
+			t.Fatalf("document %d does not round-trip: %v", i, docs)
+		}
+	}
+}
+
+func TestKeyPaths(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want pathspec.Path
+	}{
+		{"city", pathspec.Path{{Key: "city"}}},
+		{"meta.city", pathspec.Path{{Key: "meta"}, {Key: "city"}}},
+		{"items[].price", pathspec.Path{{Key: "items", Each: true}, {Key: "price"}}},
+		{"items[]", pathspec.Path{{Key: "items", Each: true}}},
+		{`a\.b.c`, pathspec.Path{{Key: "a.b"}, {Key: "c"}}},
+	} {
+		got, err := pathspec.Parse(tc.in)
+		if err != nil || !reflect.DeepEqual(got, tc.want) || got.String() != tc.in {
+			t.Errorf("Parse(%q) = %v, %v", tc.in, got, err)
+		}
+	}
+	for _, bad := range []string{"", "a..b", "[]", "a[]b", ".a"} {
+		if _, err := pathspec.Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "secret": "s%d", "meta": {"city": "c%d", "zip": "%d"}, "items": [{"sku": "k%d", "price": %d}]}`, i, i, i, i, i%3, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--exclude", "secret,meta.zip", "--types", "n=TEXT", "--symbolize", "meta.city")
+	ddl, _ := os.ReadFile(ddlPath)
+	for _, want := range []string{"n TEXT", "city_symbol INTEGER"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	for _, unwanted := range []string{"secret", "zip"} {
+		if strings.Contains(string(ddl), unwanted) {
+			t.Errorf("DDL has excluded %q:\n%s", unwanted, ddl)
+		}
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--fields", "meta.city", "--fields", "items[].price").Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	want := map[string]interface{}{"meta": map[string]interface{}{"city": "c4"}, "items": []interface{}{map[string]interface{}{"price": 4.0}}}
+	if len(docs) != 20 || !reflect.DeepEqual(docs[4], want) {
+		t.Errorf("dump --fields: %v", docs)
+	}
+
+	if out, err := exec.Command(bin, "analyze", "--input", ddlPath, "--symbolize", "items[].sku").CombinedOutput(); err == nil {
+		t.Errorf("--symbolize inside an array succeeded: %s", out)
+	}
+}
+
+func TestImportReview(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test editor is a sed command")
+	}
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d"}`, i, i%2))
+	}
+	dataPath := writeTempFile(t, "review-*.json", strings.Join(lines, "\n")+"\n")
+	dbPath := filepath.Join(tmp, "data.db")
+	ddlPath := filepath.Join(tmp, "data.sql")
+	review := func(answers string) ([]byte, error) {
+		cmd := exec.Command(bin, "import", "--input", dataPath, "--db", dbPath, "--schema", ddlPath, "--review")
+		cmd.Stdin = strings.NewReader(answers)
+		cmd.Env = append(os.Environ(), `EDITOR=sed -i 's/kind_symbol INTEGER REFERENCES kind_symbol(id)/kind TEXT/'`)
+		return cmd.CombinedOutput()
+	}
+
+	out, err := review("n\n")
+	if err == nil || !strings.Contains(string(out), "-- review:   kind: symbolized, values stored once in kind_symbol") {
+		t.Fatalf("declined review: %v\n%s", err, out)
+	}
+	if _, err := os.Stat(dbPath); err == nil {
+		t.Error("declined review created the database")
+	}
+
+	if out, err := review("e\ny\n"); err != nil {
+		t.Fatalf("import --review: %v\n%s", err, out)
+	}
+	ddl, _ := os.ReadFile(ddlPath)
+	if !strings.Contains(string(ddl), "kind TEXT") || strings.Contains(string(ddl), "review:") {
+		t.Errorf("reviewed DDL:\n%s", ddl)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 20 || docs[3]["kind"] != "k1" {
+		t.Errorf("dump after review: %v", docs)
+	}
+}
+
+func TestSchemaModel(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "meta": {"city": "c%d"}, "tags": ["t%d"]}`, i, i%2, i%3, i))
+	}
+	dataPath := filepath.Join(tmp, "data.json")
+	if err := os.WriteFile(dataPath, []byte(strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(bin, "analyze", "--input", dataPath, "--output", "json", "--rename", "n=num").Output()
+	if err != nil {
+		t.Fatalf("analyze --output json: %v", err)
+	}
+	var model SchemaModel
+	if err := json.Unmarshal(out, &model); err != nil {
+		t.Fatalf("model: %v\n%s", err, out)
+	}
+	tables := map[string]TableModel{}
+	for _, tm := range model.Tables {
+		tables[tm.Name] = tm
+	}
+	if !tables["kind_symbol"].SymbolTable || tables["main"].Renames["num"] != "n" {
+		t.Errorf("model: %s", out)
+	}
+	var kind ColumnModel
+	for _, c := range tables["main"].Columns {
+		if c.Name == "kind_symbol" {
+			kind = c
+		}
+	}
+	if !kind.Symbol || kind.References != "kind_symbol" {
+		t.Errorf("kind column: %+v", kind)
+	}
+
+	modelPath := filepath.Join(tmp, "schema.json")
+	dbPath := filepath.Join(tmp, "data.db")
+	if err := os.WriteFile(modelPath, out, 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"create-db", "--schema", modelPath, "--db", dbPath},
+		{"load", "--input", dataPath, "--schema", modelPath, "--db", dbPath},
+	} {
+		if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", args[0], err, out)
+		}
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", modelPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	for i, line := range lines {
+		var want map[string]interface{}
+		json.Unmarshal([]byte(line), &want)
+		if i >= len(docs) || !reflect.DeepEqual(docs[i], want) {
+			t.Fatalf("document %d does not round-trip: %v", i, docs)
+		}
+	}
+}
+
+func TestStoredSchema(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "data.db")
+	for _, tenant := range []string{"a", "b"} {
+		var lines []string
+		for i := 0; i < 20; i++ {
+			lines = append(lines, fmt.Sprintf(`{"%s": %d, "meta": {"city": "c%d"}}`, tenant, i, i%3))
+		}
+		dataPath := filepath.Join(tmp, tenant+".json")
+		if err := os.WriteFile(dataPath, []byte(strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(bin, "import", "--input", dataPath, "--db", dbPath, "--tenant", tenant).CombinedOutput(); err != nil {
+			t.Fatalf("import --tenant %s: %v\n%s", tenant, err, out)
+		}
+	}
+	ddl, ok, err := StoredSchema(dbPath)
+	if err != nil || !ok || !strings.Contains(ddl, "CREATE TABLE a_main") || !strings.Contains(ddl, "CREATE TABLE b_main") {
+		t.Fatalf("stored schema: %v %v\n%s", ok, err, ddl)
+	}
+
+	// A value that does not fit its column adds a fallback column to the
+	// stored schema
+	badPath := writeTempFile(t, "bad-*.json", `{"a": 20, "meta": "none"}`+"\n")
+	if out, err := exec.Command(bin, "load", "--input", badPath, "--db", dbPath, "--tenant", "a", "--fallback-json").CombinedOutput(); err != nil {
+		t.Fatalf("load without --schema: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--tenant", "a").Output()
+	if err != nil {
+		t.Fatalf("dump without --schema: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 21 || docs[20]["meta"] != "none" || docs[4]["a"] != 4.0 {
+		t.Errorf("dump --tenant a: %v", docs)
+	}
+
+	// The stored schema wins over a --schema file that differs
+	stale := writeTempFile(t, "stale-*.sql", "CREATE TABLE b_main (\n  id INTEGER PRIMARY KEY,\n  x TEXT\n);\n")
+	cmd := exec.Command(bin, "dump", "--db", dbPath, "--tenant", "b", "--schema", stale)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil || !strings.Contains(stderr.String(), "table b_main differs") {
+		t.Fatalf("dump with a stale --schema: %v\n%s", err, stderr.String())
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 20 || docs[2]["b"] != 2.0 {
+		t.Errorf("dump --tenant b: %v", docs)
+	}
+}
+
+func TestLoaderConcurrent(t *testing.T) {
+	ddl := `CREATE TABLE kind_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  kind_symbol INTEGER REFERENCES kind_symbol(id),
+  n INTEGER NOT NULL
+);
+`
+	dbPath := filepath.Join(t.TempDir(), "data.db")
+	if err := CreateDatabase(dbPath, ddl); err != nil {
+		t.Fatal(err)
+	}
+	loader, err := NewLoader(dbPath, ParseDDL(ddl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loader.BatchSize = 7
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	count := func(err error) {
+		if err != nil {
+			failed.Add(int64(strings.Count(err.Error(), "document ")))
+		}
+	}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				doc := map[string]any{"n": float64(g*25 + i), "kind": fmt.Sprintf("k%d", i%3)}
+				if i == 0 {
+					// Fails after its new symbol may have been inserted
+					doc = map[string]any{"kind": fmt.Sprintf("bad%d", g)}
+				}
+				count(loader.Add(context.Background(), doc))
+			}
+		}(g)
+	}
+	wg.Wait()
+	count(loader.Close())
+	if failed.Load() != 8 {
+		t.Errorf("%d documents reported failing, want 8", failed.Load())
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var rows, kinds, dangling int
+	db.QueryRow("SELECT count(*) FROM main").Scan(&rows)
+	db.QueryRow("SELECT count(*) FROM kind_symbol").Scan(&kinds)
+	db.QueryRow("SELECT count(*) FROM main LEFT JOIN kind_symbol k ON k.id = main.kind_symbol WHERE k.id IS NULL").Scan(&dangling)
+	if rows != 8*24 || kinds != 3 || dangling != 0 {
+		t.Errorf("rows %d, kinds %d, rows without their kind %d", rows, kinds, dangling)
+	}
+}
+
+// Loaders sharing a schema keep symbol ids of their own database each
+func TestLoaderSharedSchema(t *testing.T) {
+	ddl := `CREATE TABLE kind_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  kind_symbol INTEGER REFERENCES kind_symbol(id),
+  n INTEGER
+);
+`
+	dbs := ParseDDL(ddl)
+	var paths []string
+	var loaders []*Loader
+	for i := 0; i < 2; i++ {
+		dbPath := filepath.Join(t.TempDir(), "data.db")
+		if err := CreateDatabase(dbPath, ddl); err != nil {
+			t.Fatal(err)
+		}
+		loader, err := NewLoader(dbPath, dbs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths, loaders = append(paths, dbPath), append(loaders, loader)
+	}
+	if dbs.symbols != nil {
+		t.Error("NewLoader set the symbol cache of the caller's schema")
+	}
+	// "y" is symbol 2 in the second database, and symbol 1 in the first
+	for i, kinds := range [][]string{{"y"}, {"x", "y"}} {
+		for _, k := range kinds {
+			if err := loaders[i].Add(context.Background(), map[string]any{"kind": k}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := loaders[1].Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loaders[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+	loaders[1].Close()
+	var out bytes.Buffer
+	if _, err := DumpRows(context.Background(), paths[0], dbs, DumpOptions{Output: &out}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(out.String()); got != `{"kind":"y"}` {
+		t.Errorf("dump of the first database = %s", got)
+	}
+}
+
+// cityOnly decodes documents itself
+type cityOnly string
+
+func (c *cityOnly) DecodeDocument(doc map[string]interface{}) error {
+	meta, _ := doc["meta"].(map[string]interface{})
+	city, ok := meta["city"].(string)
+	if !ok {
+		return fmt.Errorf("no city in %v", doc)
+	}
+	*c = cityOnly(city)
+	return nil
+}
+
+func TestDecodeEach(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "meta": {"city": "c%d"}}`, i, i%2, i%3))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	ddl, _ := os.ReadFile(ddlPath)
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d := NewDumper(db, ParseDDL(string(ddl)), DumpOptions{})
+
+	type event struct {
+		N    int    `json:"n"`
+		Kind string `json:"kind"`
+		Meta struct {
+			City string `json:"city"`
+		} `json:"meta"`
+	}
+	var events []*event
+	err = d.DecodeEach(func(v any) error {
+		events = append(events, v.(*event))
+		return nil
+	}, (*event)(nil))
+	if err != nil || len(events) != 20 || events[7].N != 7 || events[7].Kind != "k1" || events[7].Meta.City != "c1" {
+		t.Fatalf("DecodeEach: %v %+v", err, events)
+	}
+
+	var cities []cityOnly
+	err = d.DecodeEach(func(v any) error {
+		cities = append(cities, *v.(*cityOnly))
+		return nil
+	}, new(cityOnly))
+	if err != nil || len(cities) != 20 || cities[5] != "c2" {
+		t.Errorf("DecodeEach with DocumentDecoder: %v %v", err, cities)
+	}
+
+	if err := d.DecodeEach(func(any) error { return nil }, event{}); err == nil {
+		t.Error("DecodeEach accepted a non-pointer target")
+	}
+}
+
+func TestSchemaFS(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "meta": {"city": "c%d"}}`, i, i%3))
+	}
+	_, ddlPath := importLines(t, bin, lines)
+	ddl, _ := os.ReadFile(ddlPath)
+	fsys := fstest.MapFS{
+		"events.sql":  {Data: ddl},
+		"events.json": {Data: []byte(strings.Join(lines, "\n") + "\n")},
+	}
+	defer func(saved fs.FS) { EmbeddedSchemas = saved }(EmbeddedSchemas)
+	EmbeddedSchemas = fsys
+
+	got, err := ReadDDL("embed:events")
+	if err != nil || got != string(ddl) {
+		t.Fatalf("ReadDDL embed:events: %v\n%s", err, got)
+	}
+	dbPath := filepath.Join(t.TempDir(), "fs.db")
+	if err := CreateDatabase(dbPath, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadDataFS(context.Background(), fsys, "events.json", dbPath, ParseDDL(got)); err != nil {
+		t.Fatalf("LoadDataFS: %v", err)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 10 || docs[4]["meta"].(map[string]interface{})["city"] != "c1" {
+		t.Errorf("dump: %v", docs)
+	}
+	if _, err := ReadDDL("embed:missing"); err == nil || !strings.Contains(err.Error(), "events.sql") {
+		t.Errorf("ReadDDL embed:missing: %v", err)
+	}
+
+	// The jsql binary only embeds its schemas directory
+	out, err = exec.Command(bin, "create-db", "--db", filepath.Join(t.TempDir(), "x.db"), "--schema", "embed:missing").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), `no embedded schema "missing"`) {
+		t.Errorf("create-db --schema embed:missing: %v\n%s", err, out)
+	}
+}
+
+func TestReplaceDatabaseFiles(t *testing.T) {
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "data.db")
+	if err := CreateDatabase(dbPath, "CREATE TABLE a (id INTEGER PRIMARY KEY);"); err != nil {
+		t.Fatal(err)
+	}
+	// A journal left by a crashed writer must not be applied to the new
+	// database
+	if err := os.WriteFile(dbPath+"-journal", []byte("stale journal"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateDatabase(dbPath, "CREATE TABLE b (id INTEGER PRIMARY KEY);"); err != nil {
+		t.Fatalf("CreateDatabase over an existing database: %v", err)
+	}
+	if _, err := os.Stat(dbPath + "-journal"); !os.IsNotExist(err) {
+		t.Errorf("stale journal kept: %v", err)
+	}
+	ddl, _, err := StoredSchema(dbPath)
+	if err != nil || strings.Contains(ddl, "CREATE TABLE a") || !strings.Contains(ddl, "CREATE TABLE b") {
+		t.Errorf("stored schema: %v\n%s", err, ddl)
+	}
+
+	// Backups replace an existing file
+	dst := filepath.Join(tmp, "copy.db")
+	if err := os.WriteFile(dst, []byte("old"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Backup(context.Background(), dbPath, dst); err != nil {
+		t.Fatalf("Backup over an existing file: %v", err)
+	}
+	if ddl, _, err := StoredSchema(dst); err != nil || !strings.Contains(ddl, "CREATE TABLE b") {
+		t.Errorf("backup: %v\n%s", err, ddl)
+	}
+	if err := removeFile(filepath.Join(tmp, "missing")); err != nil {
+		t.Errorf("removeFile of a missing file: %v", err)
+	}
+}
+
+func TestMmapSize(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 30; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d"}`, i, i%3))
+	}
+	dbPath, _ := importLines(t, bin, lines)
+	plain, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	mapped, err := exec.Command(bin, "dump", "--db", dbPath, "--mmap-size", "64MiB").Output()
+	if err != nil || !bytes.Equal(plain, mapped) {
+		t.Fatalf("dump --mmap-size: %v\n%s", err, mapped)
+	}
+	if out, err := exec.Command(bin, "dump", "--db", dbPath, "--mmap-size", "lots").CombinedOutput(); err == nil {
+		t.Errorf("dump --mmap-size lots succeeded:\n%s", out)
+	}
+
+	db, err := OpenReadOnly(dbPath, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var size int64
+	if err := db.QueryRow("PRAGMA mmap_size").Scan(&size); err != nil || size != 64<<20 {
+		t.Errorf("mmap_size = %d, %v", size, err)
+	}
+	if _, err := db.Exec("DELETE FROM main"); err == nil {
+		t.Error("read-only connection deleted rows")
+	}
+}
+
+func TestImportInMemory(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 30; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "meta": {"city": "c%d"}}`, i, i%3, i%4))
+	}
+	dataPath := writeTempFile(t, "mem-*.json", strings.Join(lines, "\n")+"\n")
+	out := filepath.Join(t.TempDir(), "out.db")
+	if msg, err := exec.Command(bin, "import", "--input", dataPath, "--db", ":memory:", "--serialize", out).CombinedOutput(); err != nil {
+		t.Fatalf("import --db :memory:: %v\n%s", err, msg)
+	}
+	dump, err := exec.Command(bin, "dump", "--db", out).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if docs := decodeAllLines(t, dump); len(docs) != 30 || docs[5]["kind"] != "k2" || docs[5]["meta"].(map[string]interface{})["city"] != "c1" {
+		t.Fatalf("dump: %v", docs)
+	}
+
+	// A tenant is added to the tables already in the --serialize file
+	if msg, err := exec.Command(bin, "import", "--input", dataPath, "--db", ":memory:", "--serialize", out, "--tenant", "b").CombinedOutput(); err != nil {
+		t.Fatalf("import --tenant: %v\n%s", err, msg)
+	}
+	for _, args := range [][]string{{}, {"--tenant", "b"}} {
+		dump, err := exec.Command(bin, append([]string{"dump", "--db", out}, args...)...).Output()
+		if err != nil || len(decodeAllLines(t, dump)) != 30 {
+			t.Errorf("dump %v: %v\n%s", args, err, dump)
+		}
+	}
+
+	if msg, err := exec.Command(bin, "import", "--input", dataPath, "--db", ":memory:").CombinedOutput(); err == nil || !strings.Contains(string(msg), "--serialize") {
+		t.Errorf("import --db :memory: without --serialize: %v\n%s", err, msg)
+	}
+}
+
+func TestLookupIndexes(t *testing.T) {
+	bin := buildCLI(t)
+	// Hand-written tables without indexes on the looked-up columns
+	ddl := `CREATE TABLE users (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  kind_symbol INTEGER REFERENCES kind_symbol(id)
+);
+
+CREATE TABLE kind_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT
+);
+
+-- jsql:link main.boss -> users.name
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  boss TEXT,
+  boss_ref INTEGER REFERENCES users(id)
+);
+
+CREATE TABLE country (
+  code TEXT,
+  region TEXT,
+  name TEXT
+);
+
+CREATE TABLE office (
+  id INTEGER PRIMARY KEY,
+  country_code TEXT,
+  country_region TEXT,
+  FOREIGN KEY (country_code, country_region) REFERENCES country(code, region)
+);
+`
+	dbPath := filepath.Join(t.TempDir(), "data.db")
+	if err := CreateDatabase(dbPath, ddl); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := createLookupIndexes(tx, ParseDDL(ddl))
+	if err != nil || !reflect.DeepEqual(created, lookupIndexes{"_jsql_lookup_country_code_region", "_jsql_lookup_kind_symbol_value", "_jsql_lookup_users_name"}) {
+		t.Fatalf("createLookupIndexes: %v %v", created, err)
+	}
+	var id, parent, notused int
+	var plan string
+	if err := tx.QueryRow("EXPLAIN QUERY PLAN SELECT id FROM kind_symbol WHERE value = ?", `"a"`).Scan(&id, &parent, &notused, &plan); err != nil || !strings.Contains(plan, "_jsql_lookup_kind_symbol_value") {
+		t.Errorf("symbol lookup plan: %q %v", plan, err)
+	}
+	// A composite key is looked up by all its columns at once
+	if err := tx.QueryRow("EXPLAIN QUERY PLAN SELECT COUNT(*) FROM country WHERE code = ? AND region = ?", "no", "03").Scan(&id, &parent, &notused, &plan); err != nil || !strings.Contains(plan, "_jsql_lookup_country_code_region (code=? AND region=?)") {
+		t.Errorf("composite key lookup plan: %q %v", plan, err)
+	}
+	again, err := createLookupIndexes(tx, ParseDDL(ddl))
+	if err != nil || !reflect.DeepEqual(again, created) {
+		t.Errorf("createLookupIndexes again: %v %v", again, err)
+	}
+	if err := created.drop(tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	// A load leaves no index behind
+	dataPath := writeTempFile(t, "users-*.json", `{"name": "ann", "kind": "staff"}`+"\n"+`{"name": "bob", "kind": "staff"}`+"\n")
+	if out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath, "--root", "users").CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name LIKE '_jsql_lookup_%'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("lookup indexes left: %d %v", n, err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM kind_symbol").Scan(&n); err != nil || n != 1 {
+		t.Errorf("kind symbols: %d %v", n, err)
+	}
+
+	// Nor does a batched load failing after its first batch, and a load
+	// drops the indexes a killed one left
+	if _, err := db.Exec("CREATE INDEX _jsql_lookup_users_name ON users (name)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TRIGGER no_boom BEFORE INSERT ON kind_symbol WHEN NEW.value LIKE '%boom%' BEGIN SELECT RAISE(ABORT, 'boom'); END"); err != nil {
+		t.Fatal(err)
+	}
+	failing := writeTempFile(t, "users-*.json", `{"name": "cy", "kind": "staff"}`+"\n"+`{"name": "dd", "kind": "boom"}`+"\n")
+	if out, err := exec.Command(bin, "load", "--input", failing, "--db", dbPath, "--root", "users", "--batch-size", "1").CombinedOutput(); err == nil {
+		t.Fatalf("load failing to insert a symbol succeeded:\n%s", out)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name LIKE '_jsql_lookup_%'").Scan(&n); err != nil || n != 0 {
+		t.Errorf("lookup indexes left by a failed batched load: %d %v", n, err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil || n != 3 {
+		t.Errorf("users after the first batch: %d %v", n, err)
+	}
+}
+
+func TestBulkSymbols(t *testing.T) {
+	bin := buildCLI(t)
+	ddl := `CREATE TABLE kind_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE city_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE meta (
+  id INTEGER PRIMARY KEY,
+  city_symbol INTEGER REFERENCES city_symbol(id)
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  n INTEGER NOT NULL,
+  kind_symbol INTEGER REFERENCES kind_symbol(id),
+  meta_id INTEGER REFERENCES meta(id)
+);
+`
+	ddlPath := writeTempFile(t, "bulk-*.sql", ddl)
+	var lines []string
+	for i := 0; i < 2500; i++ {
+		if i%400 == 399 {
+			// Fails on NOT NULL, with a kind of its own
+			lines = append(lines, fmt.Sprintf(`{"kind": "lost%d", "meta": {"city": "c%d"}}`, i, i%5))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "meta": {"city": "c%d"}}`, i, i%7, i%5))
+	}
+	dataPath := writeTempFile(t, "bulk-*.json", strings.Join(lines, "\n")+"\n")
+
+	for _, args := range [][]string{{"--quarantine"}, {"--strict", "--chunk-size", "300"}} {
+		dbPath := filepath.Join(t.TempDir(), "data.db")
+		if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+			t.Fatalf("create-db: %v\n%s", err, out)
+		}
+		exec.Command(bin, append([]string{"load", "--input", dataPath, "--db", dbPath}, args...)...).Run()
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n, dangling int
+		db.QueryRow("SELECT COUNT(*) FROM main").Scan(&n)
+		db.QueryRow(`SELECT (SELECT COUNT(*) FROM main WHERE kind_symbol NOT IN (SELECT id FROM kind_symbol)) +
+  (SELECT COUNT(*) FROM meta WHERE city_symbol NOT IN (SELECT id FROM city_symbol))`).Scan(&dangling)
+		if dangling != 0 || n == 0 {
+			t.Errorf("%v: %d rows, %d dangling symbol ids", args, n, dangling)
+		}
+		if args[0] == "--quarantine" {
+			// Ids follow the order the values first appear in
+			var kinds []string
+			rows, err := db.Query("SELECT value FROM kind_symbol ORDER BY id LIMIT 7")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var v string
+				rows.Scan(&v)
+				kinds = append(kinds, v)
+			}
+			rows.Close()
+			// The kinds of failed documents are not kept
+			var total int
+			db.QueryRow("SELECT COUNT(*) FROM kind_symbol").Scan(&total)
+			if n != 2494 || total != 7 || strings.Join(kinds, ",") != `"k0","k1","k2","k3","k4","k5","k6"` {
+				t.Errorf("--quarantine: %d rows, %d kinds %v", n, total, kinds)
+			}
+			out, err := exec.Command(bin, "dump", "--db", dbPath, "--head", "3").Output()
+			if err != nil || !strings.Contains(string(out), `{"kind":"k2","meta":{"city":"c2"},"n":2}`) {
+				t.Errorf("dump: %v\n%s", err, out)
+			}
+		}
+		db.Close()
+	}
+}
+
+func TestInsertReturning(t *testing.T) {
+	if !returningSupported {
+		t.Fatal("the bundled SQLite should support RETURNING")
+	}
+	ddl := `CREATE TABLE kind_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE meta (
+  id INTEGER PRIMARY KEY,
+  city TEXT
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  n INTEGER,
+  kind_symbol INTEGER REFERENCES kind_symbol(id),
+  meta_id INTEGER REFERENCES meta(id)
+);
+`
+	defer func(saved bool) { returningSupported = saved }(returningSupported)
+	var dumps [2]string
+	for i, returning := range []bool{true, false} {
+		returningSupported = returning
+		dbPath := filepath.Join(t.TempDir(), "data.db")
+		if err := CreateDatabase(dbPath, ddl); err != nil {
+			t.Fatal(err)
+		}
+		dbs := ParseDDL(ddl)
+		loader, err := NewLoader(dbPath, dbs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n := 0; n < 10; n++ {
+			doc := map[string]any{"n": float64(n), "kind": fmt.Sprintf("k%d", n%3), "meta": map[string]any{"city": fmt.Sprintf("c%d", n)}}
+			if err := loader.Add(context.Background(), doc); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := loader.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		old, err1 := getOrInsertSymbol(tx, SQLite, dbs.Tables["kind_symbol"], "k1")
+		added, err2 := getOrInsertSymbol(tx, SQLite, dbs.Tables["kind_symbol"], "k9")
+		metaID, err3 := InsertRow(tx, dbs.Tables["meta"], map[string]interface{}{"city": "x"}, dbs)
+		if err1 != nil || err2 != nil || err3 != nil || old != 2 || added != 4 || metaID != 11 {
+			t.Errorf("returning=%v: symbol ids %d %d, meta id %d: %v %v %v", returning, old, added, metaID, err1, err2, err3)
+		}
+		tx.Rollback()
+		var out bytes.Buffer
+		err = NewDumper(db, dbs, DumpOptions{}).Each(func(doc map[string]interface{}) error {
+			js, _ := json.Marshal(doc)
+			out.Write(append(js, '\n'))
+			return nil
+		})
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dumps[i] = out.String()
+	}
+	if dumps[0] != dumps[1] || !strings.Contains(dumps[0], `{"kind":"k2","meta":{"city":"c5"},"n":5}`) {
+		t.Errorf("dumps differ:\n%s\n%s", dumps[0], dumps[1])
+	}
+}
+
+func TestServeConnectionPool(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "meta": {"city": "c%d"}}`, i, i%3, i%4))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	// Nested lookups share the connection of the documents' query, so a
+	// single connection serves concurrent readers without deadlocking
+	base := startServe(t, bin, "--db", dbPath, "--schema", ddlPath, "--max-open-conns", "1", "--max-idle-conns", "1")
+	client := &http.Client{Timeout: 20 * time.Second}
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(base + "/rows?limit=50")
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			var page struct {
+				Rows []map[string]interface{} `json:"rows"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+				errs <- err
+				return
+			}
+			if len(page.Rows) != 20 || page.Rows[7]["meta"].(map[string]interface{})["city"] != "c3" {
+				errs <- fmt.Errorf("rows: %v", page.Rows)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn, err := pinConn(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		var n int
+		if err := conn.QueryRow("SELECT count(*) FROM main WHERE id > ?", i).Scan(&n); err != nil || n != 20-i {
+			t.Fatalf("count = %d, %v", n, err)
+		}
+	}
+	if len(conn.stmts) != 1 {
+		t.Errorf("%d statements prepared for one query", len(conn.stmts))
+	}
+	if out, err := exec.Command(bin, "serve", "--db", dbPath, "--max-open-conns", "-1").CombinedOutput(); err == nil {
+		t.Errorf("serve --max-open-conns -1 succeeded:\n%s", out)
+	}
+}
+
+func TestTraceSpans(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "meta": {"city": "c%d"}}`, i, i%3, i%4))
+	}
+	dataPath := writeTempFile(t, "trace-*.json", strings.Join(lines, "\n")+"\n")
+	dir := t.TempDir()
+	dbPath, spansPath := filepath.Join(dir, "t.db"), filepath.Join(dir, "spans.json")
+	if out, err := exec.Command(bin, "import", "--input", dataPath, "--db", dbPath, "--trace", spansPath).CombinedOutput(); err != nil {
+		t.Fatalf("import --trace: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(spansPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type span struct {
+		Name   string
+		Parent struct{ SpanID string }
+		Events []struct {
+			Attributes []struct {
+				Key   string
+				Value struct{ Value interface{} }
+			}
+		}
+	}
+	spans := map[string]span{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var s span
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		spans[s.Name] = s
+	}
+	for _, name := range []string{"jsql import", "analyze.read", "analyze.infer", "analyze.ddl", "load"} {
+		if _, ok := spans[name]; !ok {
+			t.Errorf("no %q span in %v", name, sortedKeys(spans))
+		}
+	}
+	queries := map[string]float64{}
+	for _, e := range spans["load"].Events {
+		attrs := map[string]interface{}{}
+		for _, a := range e.Attributes {
+			attrs[a.Key] = a.Value.Value
+		}
+		queries[attrs["jsql.table"].(string)] = attrs["jsql.queries"].(float64)
+	}
+	if queries["main"] != 20 || queries["meta"] != 20 || queries["kind_symbol"] == 0 {
+		t.Errorf("load queries = %v", queries)
+	}
+
+	// Without --trace the tracer records nothing
+	if p := startPhase("idle"); p.span.IsRecording() {
+		t.Error("phase recorded without a tracer provider")
+	}
+	// --pprof serves the profiles while the command runs, here an analyze
+	// waiting on its input
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	addr := freeAddr(t)
+	analyze := exec.Command(buildCLI(t), "analyze", "--input", "-", "--pprof", addr)
+	analyze.Stdin = r
+	if err := analyze.Start(); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	defer func() {
+		analyze.Process.Kill()
+		analyze.Wait()
+	}()
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + addr + "/debug/pprof/cmdline"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /debug/pprof/cmdline: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("reads /dev/stdin")
+	}
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 10; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d"}`, i, i%3))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+
+	// A load whose input never ends is stopped, its transaction rolled back
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	fmt.Fprintln(w, `{"n": 10, "kind": "k0"}`)
+	load := exec.Command(bin, "load", "--input", "/dev/stdin", "--db", dbPath, "--schema", ddlPath, "--timeout", "300ms")
+	load.Stdin = r
+	var stderr bytes.Buffer
+	load.Stderr = &stderr
+	start := time.Now()
+	err = load.Run()
+	r.Close()
+	if err == nil || load.ProcessState.ExitCode() != 124 || !strings.Contains(stderr.String(), "Timed out after 300ms") {
+		t.Fatalf("load --timeout: %v\n%s", err, stderr.String())
+	}
+	if elapsed := time.Since(start); elapsed > 20*time.Second {
+		t.Errorf("load took %s to time out", elapsed)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil || len(decodeAllLines(t, out)) != 10 {
+		t.Errorf("dump after timeout: %v\n%s", err, out)
+	}
+
+	// Work interrupted at the deadline reports it
+	msg, err := exec.Command(bin, "dump", "--db", dbPath, "--timeout", "1ns").CombinedOutput()
+	if err == nil || !strings.Contains(string(msg), "timed out") {
+		t.Errorf("dump --timeout 1ns: %v\n%s", err, msg)
+	}
+	if msg, err := exec.Command(bin, "dump", "--db", dbPath, "--max-duration", "1m").CombinedOutput(); err != nil {
+		t.Errorf("dump --max-duration 1m: %v\n%s", err, msg)
+	}
+}
+
+func TestCreateDBExisting(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"n": 1, "kind": "a"}`, `{"n": 2, "kind": "b"}`})
+	dump := func() []map[string]interface{} {
+		out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+		if err != nil {
+			t.Fatalf("dump: %v", err)
+		}
+		return decodeAllLines(t, out)
+	}
+
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err == nil || !strings.Contains(string(out), "--if-not-exists") {
+		t.Fatalf("create-db over a database succeeded: %v\n%s", err, out)
+	}
+	if docs := dump(); len(docs) != 2 {
+		t.Fatalf("refused create-db changed the database: %v", docs)
+	}
+
+	// --if-not-exists adds the missing table and index and keeps the rows
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more := string(ddl) + "\nCREATE TABLE notes (\n  id INTEGER PRIMARY KEY,\n  body TEXT\n);\n\nCREATE INDEX main_n ON main(n);\n"
+	morePath := writeTempFile(t, "more-*.sql", more)
+	out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", morePath, "--if-not-exists").CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "Created notes, main_n") {
+		t.Fatalf("create-db --if-not-exists: %v\n%s", err, out)
+	}
+	if docs := dump(); len(docs) != 2 || docs[1]["kind"] != "b" {
+		t.Fatalf("dump after --if-not-exists: %v", docs)
+	}
+	stored, _, err := StoredSchema(dbPath)
+	if err != nil || !strings.Contains(stored, "CREATE TABLE notes") || !strings.Contains(stored, "main_n") || !strings.Contains(stored, "CREATE TABLE main") {
+		t.Errorf("stored schema: %v\n%s", err, stored)
+	}
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", morePath, "--if-not-exists").CombinedOutput(); err != nil || !strings.Contains(string(out), "already has every table") {
+		t.Errorf("second create-db --if-not-exists: %v\n%s", err, out)
+	}
+
+	// A table whose columns differ from the schema's is refused, and
+	// nothing is created
+	changed := strings.Replace(more, "body TEXT", "body INTEGER,\n  title TEXT", 1) + "\nCREATE TABLE tags (\n  id INTEGER PRIMARY KEY\n);\n"
+	changedPath := writeTempFile(t, "changed-*.sql", changed)
+	defer removeFiles(changedPath)
+	out, err = exec.Command(bin, "create-db", "--db", dbPath, "--schema", changedPath, "--if-not-exists").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "notes.body is TEXT, not INTEGER; notes has no column title") {
+		t.Errorf("create-db --if-not-exists over a different table: %v\n%s", err, out)
+	}
+	if stored, _, err := StoredSchema(dbPath); err != nil || strings.Contains(stored, "tags") {
+		t.Errorf("refused create-db changed the stored schema: %v\n%s", err, stored)
+	}
+
+	// --force starts over; a file that is not a database is not replaced
+	// without it
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath, "--force").CombinedOutput(); err != nil {
+		t.Fatalf("create-db --force: %v\n%s", err, out)
+	}
+	if docs := dump(); len(docs) != 0 {
+		t.Errorf("dump after --force: %v", docs)
+	}
+	notDB := writeTempFile(t, "notes-*.db", "not a database at all, but long enough to look like a file header\n")
+	if out, err := exec.Command(bin, "create-db", "--db", notDB, "--schema", ddlPath).CombinedOutput(); err == nil {
+		t.Errorf("create-db over a text file succeeded:\n%s", out)
+	}
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath, "--force", "--if-not-exists").CombinedOutput(); err == nil {
+		t.Errorf("create-db --force --if-not-exists succeeded:\n%s", out)
+	}
+}
+
+func TestHandWrittenDDL(t *testing.T) {
+	ddl := `CREATE TABLE meta (
+  id INTEGER PRIMARY KEY,
+  city VARCHAR(40) NOT NULL COLLATE NOCASE
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  n INTEGER CHECK (n >= 0),
+  kind TEXT DEFAULT 'x',
+  created TEXT DEFAULT CURRENT_TIMESTAMP,
+  meta_id INTEGER,
+  UNIQUE (n, kind),
+  CONSTRAINT meta_fk FOREIGN KEY (meta_id) REFERENCES meta(id)
+) STRICT;
+
+CREATE INDEX main_kind ON main(kind);
+`
+	ds := ParseDDL(ddl)
+	main := ds.Tables["main"]
+	if _, ok := main.Fields["UNIQUE"]; ok || len(main.Fields) != 5 || main.FKs["meta_id"] != "meta" || main.Options != "STRICT" || len(main.Constraints) != 2 {
+		t.Fatalf("main = %+v", main)
+	}
+
+	// The DDL made from the model creates the same tables
+	model := NewSchemaModel(ddl)
+	data, err := json.Marshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back SchemaModel
+	if err := json.Unmarshal(data, &back); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"city VARCHAR(40) NOT NULL COLLATE NOCASE", "n INTEGER CHECK (n >= 0)", "id INTEGER PRIMARY KEY AUTOINCREMENT", "kind TEXT DEFAULT 'x'", "  meta_id INTEGER,\n", "UNIQUE (n, kind)", "REFERENCES meta(id)\n) STRICT;", "CREATE INDEX main_kind"} {
+		if !strings.Contains(back.DDL(), want) {
+			t.Errorf("model DDL lacks %q:\n%s", want, back.DDL())
+		}
+	}
+	if col := back.Tables[1].Columns[2]; col.SQL != "" || col.Default != "x" {
+		t.Errorf("kind = %+v, want it described by the model alone", col)
+	}
+
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "h.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "hand-*.sql", ddl)).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	dataPath := writeTempFile(t, "hand-*.json", `{"n": 1, "kind": "a", "meta": {"city": "Oslo"}}
+{"n": 2, "meta": {"city": "Rome"}}
+{"n": -1}
+`)
+	out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath).CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "CHECK constraint failed") {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 2 || docs[1]["kind"] != "x" || docs[1]["meta"].(map[string]interface{})["city"] != "Rome" || docs[0]["created"] == nil {
+		t.Errorf("dump: %v", docs)
+	}
+}
+
+func TestQuotedIdentifiers(t *testing.T) {
+	ddl := "CREATE TABLE IF NOT EXISTS \"main\".\"Address Book\" (\n  [id] INTEGER PRIMARY KEY,\n  \"street name\" TEXT,\n  `order` INTEGER\n);\n\n" +
+		"CREATE TABLE main.main (\n  \"id\" INTEGER PRIMARY KEY,\n  \"full name\" TEXT NOT NULL,\n  [key] TEXT,\n  addr_id INTEGER,\n  FOREIGN KEY (\"addr_id\") REFERENCES \"Address Book\"(id)\n);\n"
+	ds := ParseDDL(ddl)
+	book := ds.Tables["Address Book"]
+	if book == nil || book.Fields["street name"] != TypeText || book.Fields["order"] != TypeInt {
+		t.Fatalf("Address Book = %+v", book)
+	}
+	if main := ds.Tables["main"]; main == nil || main.Fields["full name"] != TypeText || main.FKs["addr_id"] != "Address Book" {
+		t.Fatalf("main = %+v", main)
+	}
+	if got := NewSchemaModel(ddl).DDL(); !strings.Contains(got, "CREATE TABLE \"Address Book\" (") || !strings.Contains(got, "\"order\" INTEGER") || !strings.Contains(got, "\"key\" TEXT") {
+		t.Errorf("model DDL:\n%s", got)
+	}
+
+	bin := buildCLI(t)
+	dbPath := filepath.Join(t.TempDir(), "q.db")
+	ddlPath := writeTempFile(t, "quoted-*.sql", ddl)
+	for _, args := range [][]string{{}, {"--if-not-exists"}} {
+		if out, err := exec.Command(bin, append([]string{"create-db", "--db", dbPath, "--schema", ddlPath}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("create-db %v: %v\n%s", args, err, out)
+		}
+	}
+	dataPath := writeTempFile(t, "quoted-*.json", `{"full name": "Ann", "key": "k1", "addr": {"street name": "Elm", "order": 2}}`+"\n")
+	if out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	want := map[string]interface{}{"full name": "Ann", "key": "k1", "addr": map[string]interface{}{"street name": "Elm", "order": float64(2)}}
+	if docs := decodeAllLines(t, out); len(docs) != 1 || !reflect.DeepEqual(docs[0], want) {
+		t.Errorf("dump: %v", docs)
+	}
+}
+
+func TestDumpView(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 6; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "tags": ["t%d"]}`, i, i%2, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := "CREATE VIEW \"odd rows\" AS\n  SELECT n, kind, tags\n  FROM main\n  WHERE n % 2 = 1;\n"
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "view-*.sql", string(ddl)+"\n"+view), "--if-not-exists").CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	if ds := ParseDDL(string(ddl) + "\n" + view); ds.Views["odd rows"] == nil || ds.Tables["odd rows"] != nil {
+		t.Fatalf("views = %v", ds.Views)
+	}
+
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--table", "odd rows").CombinedOutput()
+	if err != nil {
+		t.Fatalf("dump --table: %v\n%s", err, out)
+	}
+	want := []map[string]interface{}{
+		{"n": float64(1), "kind": "k1", "tags": []interface{}{"t1"}},
+		{"n": float64(3), "kind": "k1", "tags": []interface{}{"t3"}},
+		{"n": float64(5), "kind": "k1", "tags": []interface{}{"t5"}},
+	}
+	if docs := decodeAllLines(t, out); !reflect.DeepEqual(docs, want) {
+		t.Errorf("dump --table: %v", docs)
+	}
+	if out, err := exec.Command(bin, "dump", "--db", dbPath, "--table", "odd rows", "--head", "1").Output(); err != nil || len(decodeAllLines(t, out)) != 1 {
+		t.Errorf("dump --table --head 1: %v\n%s", err, out)
+	}
+	for _, args := range [][]string{{"--table", "missing"}, {"--table", "odd rows", "--tail", "1"}} {
+		if out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath}, args...)...).CombinedOutput(); err == nil {
+			t.Errorf("dump %v succeeded:\n%s", args, out)
+		}
+	}
+}
+
+func TestCompositeForeignKeys(t *testing.T) {
+	ddl := `CREATE TABLE country (
+  code TEXT NOT NULL,
+  region TEXT NOT NULL,
+  name TEXT,
+  PRIMARY KEY (code, region)
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  city TEXT,
+  country_code TEXT,
+  country_region TEXT,
+  CONSTRAINT country FOREIGN KEY (country_code, country_region) REFERENCES country(code, region) ON DELETE CASCADE
+);
+`
+	ds := ParseDDL(ddl)
+	fks := ds.Tables["main"].ForeignKeys
+	if len(fks) != 1 || fks[0].Field != "country" || fks[0].Table != "country" || !reflect.DeepEqual(fks[0].References, []string{"code", "region"}) || fks[0].Clauses != "ON DELETE CASCADE" || len(ds.Tables["main"].Constraints) != 0 {
+		t.Fatalf("foreign keys = %+v", fks)
+	}
+	if order := resolveTableOrder(ds.Tables); !reflect.DeepEqual(order, []string{"country", "main"}) {
+		t.Errorf("table order = %v", order)
+	}
+	if got := NewSchemaModel(ddl).DDL(); !strings.Contains(got, "  FOREIGN KEY (country_code, country_region) REFERENCES country(code, region) ON DELETE CASCADE\n)") {
+		t.Errorf("model DDL:\n%s", got)
+	}
+
+	bin := buildCLI(t)
+	dbPath := filepath.Join(t.TempDir(), "fk.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "fk-*.sql", ddl)).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	// Referenced rows are inserted once; flat key columns are accepted too
+	dataPath := writeTempFile(t, "fk-*.json", `{"city": "Lyon", "country": {"code": "FR", "region": "EU", "name": "France"}}
+{"city": "Nice", "country": {"code": "FR", "region": "EU", "name": "France"}}
+{"city": "Metz", "country_code": "FR", "country_region": "EU"}
+{"city": "Nowhere"}
+`)
+	if out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM country").Scan(&n); err != nil || n != 1 {
+		t.Errorf("country rows = %d, %v", n, err)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 4 {
+		t.Fatalf("dump: %v", docs)
+	}
+	for _, doc := range docs[:3] {
+		country, _ := doc["country"].(map[string]interface{})
+		if country["name"] != "France" || country["code"] != "FR" || doc["country_code"] != nil {
+			t.Errorf("dump: %v", doc)
+		}
+	}
+	if _, ok := docs[3]["country"]; ok {
+		t.Errorf("dump: %v", docs[3])
+	}
+}
+
+func TestNamingConvention(t *testing.T) {
+	ddl := `-- jsql:naming object=fk_* symbol=*_sym
+
+CREATE TABLE tags (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE users (
+  id INTEGER PRIMARY KEY,
+  name TEXT
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  title TEXT,
+  tag_sym INTEGER REFERENCES tags(id),
+  fk_author INTEGER REFERENCES users(id)
+);
+`
+	ds := ParseDDL(ddl)
+	if n := ds.RootTable().Naming; n.SymbolColumn("tag") != "tag_sym" || n.ObjectColumn("author") != "fk_author" {
+		t.Fatalf("naming = %+v", n)
+	}
+	model := NewSchemaModel(ddl)
+	if model.Naming == nil || model.Naming.Object != "fk_*" || !strings.HasPrefix(model.DDL(), "-- jsql:naming object=fk_* symbol=*_sym\n") {
+		t.Errorf("model: %+v\n%s", model.Naming, model.DDL())
+	}
+	for _, tm := range model.Tables {
+		if tm.SymbolTable != (tm.Name == "tags") {
+			t.Errorf("%s: symbol table %v", tm.Name, tm.SymbolTable)
+		}
+	}
+	for _, spec := range []string{"object=*", "object=fk_**", "symbol=*_id", "key=*_key"} {
+		if _, err := ParseNaming(spec); err == nil {
+			t.Errorf("ParseNaming(%q) succeeded", spec)
+		}
+	}
+
+	bin := buildCLI(t)
+	dbPath := filepath.Join(t.TempDir(), "n.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "naming-*.sql", ddl)).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	input := `{"title": "a", "tag": "go", "author": {"name": "ann"}}
+{"title": "b", "tag": "go"}
+`
+	if out, err := exec.Command(bin, "load", "--input", writeTempFile(t, "naming-*.json", input), "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var tags, authors int
+	if err := db.QueryRow("SELECT COUNT(DISTINCT tag_sym), COUNT(fk_author) FROM main").Scan(&tags, &authors); err != nil || tags != 1 || authors != 1 {
+		t.Errorf("tags %d, authors %d, %v", tags, authors, err)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if got := decodeAllLines(t, out); len(got) != 2 || got[0]["tag"] != "go" || got[0]["author"].(map[string]interface{})["name"] != "ann" || got[0]["fk_author"] != nil {
+		t.Errorf("dump: %v", got)
+	}
+
+	// analyze names the columns it generates after --naming
+	out, err = exec.Command(bin, "analyze", "--input", writeTempFile(t, "naming-*.json", input), "--naming", "object=*_ref_id").Output()
+	if err != nil || !strings.Contains(string(out), "author_ref_id INTEGER REFERENCES author(id)") || !strings.Contains(string(out), "-- jsql:naming object=*_ref_id\n") {
+		t.Errorf("analyze: %v\n%s", err, out)
+	}
+}
+
+func TestLoadMapping(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "legacy.db")
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`CREATE TABLE statuses (status_pk INTEGER PRIMARY KEY, label TEXT NOT NULL);
+CREATE TABLE orders (order_pk INTEGER PRIMARY KEY, order_ref TEXT, customer_name VARCHAR(40), status_id INTEGER REFERENCES statuses(status_pk), note TEXT DEFAULT 'none');
+INSERT INTO statuses (label) VALUES ('open');`); err != nil {
+		t.Fatal(err)
+	}
+	mapping := writeTempFile(t, "map-*.yaml", `id: orders.order_ref
+customer.name: orders.customer_name
+status:
+  column: orders.status_id
+  lookup: statuses.label
+`)
+	input := writeTempFile(t, "orders-*.json", `{"id": "A1", "customer": {"name": "ann"}, "status": "open", "extra": 1}
+{"id": "A2", "customer": {"name": "bob"}, "status": "shipped"}
+{"id": "A3", "status": "shipped"}
+`)
+	if out, err := exec.Command(bin, "load", "--input", input, "--db", dbPath, "--mapping", mapping).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	rows, err := db.Query("SELECT order_ref, IFNULL(customer_name, ''), label, note FROM orders JOIN statuses ON status_pk = status_id ORDER BY order_pk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var ref, name, label, note string
+		if err := rows.Scan(&ref, &name, &label, &note); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.Join([]string{ref, name, label, note}, " "))
+	}
+	rows.Close()
+	want := []string{"A1 ann open none", "A2 bob shipped none", "A3  shipped none"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("orders = %q, want %q", got, want)
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables); err != nil || tables != 2 {
+		t.Errorf("tables = %d, %v; want the schema left as it was", tables, err)
+	}
+
+	for spec, want := range map[string]string{
+		"id: orders.order_ref\nname: customers.name\n": "is not a column of",
+		"id: orders.missing\n":                         "table orders has no column missing",
+		"id: orders.id\n":                              "row ids are assigned by SQLite",
+	} {
+		out, err := exec.Command(bin, "load", "--input", input, "--db", dbPath, "--mapping", writeTempFile(t, "map-*.yaml", spec)).CombinedOutput()
+		if err == nil || !strings.Contains(string(out), want) {
+			t.Errorf("mapping %q: %v\n%s", spec, err, out)
+		}
+	}
+}
+
+func TestORMSchema(t *testing.T) {
+	for in, want := range map[string]string{"userName": "user_name", "HTTPStatus": "http_status", "UserID": "user_id", "zip_code": "zip_code"} {
+		if got := snakeCase(in); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", in, got, want)
+		}
+	}
+	for one, many := range map[string]string{"category": "categories", "box": "boxes", "ship_to": "ship_tos", "person": "people", "status": "statuses", "key": "keys", "address": "addresses"} {
+		if got := plural(one); got != many || plural(many) != many {
+			t.Errorf("plural(%q) = %q, want %q", one, got, many)
+		}
+		if got := singular(many); got != one || singular(one) != one {
+			t.Errorf("singular(%q) = %q, want %q", many, got, one)
+		}
+	}
+
+	var lines []string
+	for i := 1; i <= 12; i++ {
+		lines = append(lines, fmt.Sprintf(`{"orderId": %d, "shipTo": {"cityName": "c%d"}}`, i, i))
+	}
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	sqlcPath := filepath.Join(dir, "queries.sql")
+	input := writeTempFile(t, "orm-*.json", strings.Join(lines, "\n")+"\n")
+	out, err := exec.Command(bin, "analyze", "--input", input, "--snake-case", "--table-names", "plural", "--timestamps", "--sqlc", sqlcPath).Output()
+	if err != nil {
+		t.Fatalf("analyze: %v", err)
+	}
+	for _, want := range []string{"CREATE TABLE ship_tos (\n  city_name TEXT", "ship_to_id INTEGER REFERENCES ship_tos(id)", "order_id INTEGER", "updated_at TEXT DEFAULT CURRENT_TIMESTAMP", "-- jsql:timestamps main", "CREATE TRIGGER main_updated_at"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("schema lacks %q:\n%s", want, out)
+		}
+	}
+	queries, err := os.ReadFile(sqlcPath)
+	if err != nil || !strings.Contains(string(queries), "-- name: GetShipTo :one\nSELECT * FROM ship_tos\nWHERE id = sqlc.arg(id) LIMIT 1;") || !strings.Contains(string(queries), "-- name: ListShipTos :many") {
+		t.Errorf("sqlc queries: %v\n%s", err, queries)
+	}
+
+	// The documents keep their fields; the timestamps stay in the database
+	dbPath := filepath.Join(dir, "orm.db")
+	if out, err := exec.Command(bin, "import", "--input", input, "--db", dbPath, "--snake-case", "--table-names", "plural", "--timestamps").CombinedOutput(); err != nil {
+		t.Fatalf("import: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--head", "1").Output()
+	if err != nil || strings.TrimSpace(string(out)) != `{"orderId":1,"shipTo":{"cityName":"c1"}}` {
+		t.Errorf("dump: %v\n%s", err, out)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var updated string
+	if _, err := db.Exec("UPDATE main SET updated_at = '2000-01-01' WHERE id = 1; UPDATE main SET order_id = 100 WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("SELECT updated_at FROM main WHERE id = 1").Scan(&updated); err != nil || updated == "2000-01-01" {
+		t.Errorf("updated_at = %q, %v; want it set by the trigger", updated, err)
+	}
+}
+
+func TestSqlcQueries(t *testing.T) {
+	ddl := `CREATE TABLE tag_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  title TEXT,
+  email TEXT UNIQUE,
+  tag_symbol INTEGER REFERENCES tag_symbol(id)
+);
+
+CREATE INDEX main_title ON main (title);
+CREATE INDEX main_tag ON main (tag_symbol);
+`
+	queries := SqlcQueries(ddl)
+	for _, want := range []string{"-- name: UpsertTagSymbol :exec", "-- name: GetMain :one", "-- name: ListMainsByTitle :many", "-- name: GetMainByEmail :one", "-- name: ListMainsByTag :many", "-- name: InsertMain :one\nWITH sym_tag AS (SELECT id FROM tag_symbol WHERE value = json_quote(sqlc.arg(tag)))\nINSERT INTO main", "-- name: UpdateMain :exec", "-- name: DeleteMain :exec"} {
+		if !strings.Contains(queries, want) {
+			t.Errorf("queries lack %q:\n%s", want, queries)
+		}
+	}
+
+	// Run the queries with sqlc's parameters as named ones
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "q.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(ddl); err != nil {
+		t.Fatal(err)
+	}
+	named := map[string]string{}
+	reArg := regexp.MustCompile(`sqlc\.arg\((\w+)\)`)
+	for _, q := range strings.Split(queries, "\n-- name: ")[1:] {
+		name, body, _ := strings.Cut(q, "\n")
+		named[strings.Fields(name)[0]] = reArg.ReplaceAllString(body, ":$1")
+	}
+	args := []any{sql.Named("id", 1), sql.Named("title", "hello"), sql.Named("email", "a@b"), sql.Named("tag", "go"), sql.Named("value", "go")}
+	if _, err := db.Exec(named["UpsertTagSymbol"], args...); err != nil {
+		t.Fatalf("upsert: %v", err)
+	}
+	var id int64
+	if err := db.QueryRow(named["InsertMain"], args...).Scan(&id); err != nil || id != 1 {
+		t.Fatalf("insert: %d, %v", id, err)
+	}
+	var tag sql.NullInt64
+	if err := db.QueryRow("SELECT tag_symbol FROM main WHERE id = 1").Scan(&tag); err != nil || !tag.Valid {
+		t.Errorf("tag_symbol = %v, %v", tag, err)
+	}
+	for _, q := range []string{"GetMain", "ListMainsByTitle", "GetMainByEmail", "ListMainsByTag"} {
+		var n int
+		rows, err := db.Query(named[q], args...)
+		if err != nil {
+			t.Fatalf("%s: %v", q, err)
+		}
+		for rows.Next() {
+			n++
+		}
+		rows.Close()
+		if n != 1 {
+			t.Errorf("%s: %d rows", q, n)
+		}
+	}
+	if _, err := db.Exec(named["UpdateMain"], sql.Named("id", 1), sql.Named("title", "bye"), sql.Named("email", "a@b"), sql.Named("tag", "go")); err != nil {
+		t.Errorf("update: %v", err)
+	}
+	if _, err := db.Exec(named["DeleteMain"], sql.Named("id", 1)); err != nil {
+		t.Errorf("delete: %v", err)
+	}
+}
+
+func TestDenormalize(t *testing.T) {
+	ddl := `CREATE TABLE tags (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE meta (
+  id INTEGER PRIMARY KEY,
+  city TEXT,
+  zip INTEGER
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  score REAL,
+  tag_symbol INTEGER REFERENCES tags(id),
+  meta_id INTEGER REFERENCES meta(id),
+  ids JSON
+);
+`
+	bin := buildCLI(t)
+	dbPath := filepath.Join(t.TempDir(), "d.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "denorm-*.sql", ddl)).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	input := `{"name": "ann", "score": 1, "tag": "go", "meta": {"city": "Oslo", "zip": 150}, "ids": [1, 2]}
+{"name": "bob", "score": 2.5, "tag": "go"}
+`
+	if out, err := exec.Command(bin, "load", "--input", writeTempFile(t, "denorm-*.json", input), "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(bin, "denormalize", "--db", dbPath).CombinedOutput(); err != nil || !strings.Contains(string(out), "Wrote 2 rows to main_flat") {
+		t.Fatalf("denormalize: %v\n%s", err, out)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	types, err := columnTypes(db, "main_flat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]FieldType{"id": TypeInt, "name": TypeText, "score": TypeReal, "tag": TypeText, "meta.city": TypeText, "meta.zip": TypeInt, "ids": TypeJSON}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("columns = %v, want %v", types, want)
+	}
+	var got []string
+	rows, err := db.Query(`SELECT name, score, tag, IFNULL("meta.city", ''), IFNULL(ids, '') FROM main_flat ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var name, tag, city, ids string
+		var score float64
+		if err := rows.Scan(&name, &score, &tag, &city, &ids); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %g %s %s %s", name, score, tag, city, ids))
+	}
+	rows.Close()
+	if w := []string{"ann 1 go Oslo [1,2]", "bob 2.5 go  "}; !reflect.DeepEqual(got, w) {
+		t.Errorf("rows = %q, want %q", got, w)
+	}
+
+	// The table is only overwritten when asked
+	if out, err := exec.Command(bin, "denormalize", "--db", dbPath).CombinedOutput(); err == nil || !strings.Contains(string(out), "--replace") {
+		t.Errorf("second denormalize: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(bin, "denormalize", "--db", dbPath, "--out-table", "main_flat", "--replace").CombinedOutput(); err != nil {
+		t.Errorf("denormalize --replace: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(bin, "denormalize", "--db", dbPath, "--out-table", "meta").CombinedOutput(); err == nil {
+		t.Errorf("denormalize into a schema table succeeded:\n%s", out)
+	}
+}
+
+func TestProfileTable(t *testing.T) {
+	ddl := `CREATE TABLE tags (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  n REAL,
+  tag_symbol INTEGER REFERENCES tags(id)
+);
+`
+	bin := buildCLI(t)
+	dbPath := filepath.Join(t.TempDir(), "p.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "stats-*.sql", ddl)).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	input := `{"name": "ann", "n": 1, "tag": "go"}
+{"name": "bob", "n": 2.5, "tag": "go"}
+{"name": "christopher", "tag": "rust"}
+{"n": 4}
+`
+	if out, err := exec.Command(bin, "load", "--input", writeTempFile(t, "stats-*.json", input), "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "profile", "--db", dbPath, "--output", "json", "--top", "1").Output()
+	if err != nil {
+		t.Fatalf("profile: %v", err)
+	}
+	var stats TableStats
+	if err := json.Unmarshal(out, &stats); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if stats.Rows != 4 || len(stats.Columns) != 4 {
+		t.Fatalf("stats: %+v", stats)
+	}
+	name, n, tag := stats.Columns[1], stats.Columns[2], stats.Columns[3]
+	if name.Nulls != 1 || name.Distinct != 3 || name.Min != "ann" || name.Max != "christopher" {
+		t.Errorf("name: %+v", name)
+	}
+	if l := name.Lengths; l == nil || l.Min != 3 || l.Max != 11 || !reflect.DeepEqual(l.Histogram, []LengthBucket{{UpTo: 4, Rows: 2}, {UpTo: 16, Rows: 1}}) {
+		t.Errorf("name lengths: %+v", name.Lengths)
+	}
+	if n.Nulls != 1 || n.Min != 1.0 || n.Max != 4.0 || n.Lengths != nil {
+		t.Errorf("n: %+v", n)
+	}
+	// Symbols are profiled by their values
+	if tag.Symbols != "tags" || tag.Distinct != 2 || tag.Max != "rust" || !reflect.DeepEqual(tag.Top, []ValueCount{{Value: "go", Rows: 2}}) {
+		t.Errorf("tag: %+v", tag)
+	}
+
+	out, err = exec.Command(bin, "profile", "--db", dbPath).Output()
+	if err != nil || !strings.Contains(string(out), "main: 4 rows") || !regexp.MustCompile(`tag_symbol +symbol tags +1 +2 +go +rust`).Match(out) {
+		t.Errorf("profile: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(bin, "profile", "--db", dbPath, "--table", "nope").CombinedOutput(); err == nil {
+		t.Errorf("profile of a missing table succeeded:\n%s", out)
+	}
+}
+
+func TestDumpExplain(t *testing.T) {
+	ddl := `CREATE TABLE tags (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE region (
+  country TEXT,
+  code TEXT,
+  name TEXT
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  tag_symbol INTEGER REFERENCES tags(id),
+  region_country TEXT,
+  region_code TEXT,
+  FOREIGN KEY (region_country, region_code) REFERENCES region(country, code)
+);
+`
+	bin := buildCLI(t)
+	dbPath := filepath.Join(t.TempDir(), "e.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "explain-*.sql", ddl)).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	input := `{"name": "a", "tag": "go", "region": {"country": "no", "code": "03", "name": "Oslo"}}
+{"name": "b", "tag": "go", "region": {"country": "no", "code": "03", "name": "Oslo"}}
+`
+	if out, err := exec.Command(bin, "load", "--input", writeTempFile(t, "explain-*.json", input), "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	cmd := exec.Command(bin, "dump", "--db", dbPath, "--explain", "--preload-symbols", "0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("dump: %v\n%s", err, stderr.String())
+	}
+	if docs := decodeAllLines(t, out); len(docs) != 2 {
+		t.Errorf("dump: %s", out)
+	}
+	plans := stderr.String()
+	// Each query is explained once however many rows run it
+	for _, want := range []string{
+		"-- SELECT * FROM main\nSCAN main\n",
+		"-- SELECT value FROM tags WHERE id = ?\nSEARCH tags USING INTEGER PRIMARY KEY",
+		"-- SELECT * FROM region WHERE country = ? AND code = ?\nSCAN region\nsuggested: CREATE INDEX region_country_code ON region (country, code);\n",
+	} {
+		if strings.Count(plans, want) != 1 {
+			t.Errorf("plans lack %q once:\n%s", want, plans)
+		}
+	}
+	if strings.Contains(plans, "suggested: CREATE INDEX main") || strings.Contains(plans, "suggested: CREATE INDEX tags") {
+		t.Errorf("plans suggest needless indexes:\n%s", plans)
+	}
+}
+
+// countingQueryer counts the queries run per table
+type countingQueryer struct {
+	queryer
+	tables map[string]int
+}
+
+func (c *countingQueryer) count(query string) {
+	if m := regexp.MustCompile(`FROM (\w+)`).FindStringSubmatch(query); m != nil {
+		c.tables[m[1]]++
+	}
+}
+
+func (c *countingQueryer) Query(query string, args ...any) (*sql.Rows, error) {
+	c.count(query)
+	return c.queryer.Query(query, args...)
+}
+
+func (c *countingQueryer) QueryRow(query string, args ...any) *sql.Row {
+	c.count(query)
+	return c.queryer.QueryRow(query, args...)
+}
+
+func TestDumpSymbolCache(t *testing.T) {
+	ddl := `CREATE TABLE tags (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  n INTEGER,
+  tag_symbol INTEGER REFERENCES tags(id)
+);
+`
+	bin := buildCLI(t)
+	dbPath := filepath.Join(t.TempDir(), "c.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", writeTempFile(t, "cache-*.sql", ddl)).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	var input strings.Builder
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&input, `{"n": %d, "tag": %q}`+"\n", i, []string{"go", "rust"}[i%2])
+	}
+	if out, err := exec.Command(bin, "load", "--input", writeTempFile(t, "cache-*.json", input.String()), "--db", dbPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Without preloading each symbol is read once; with it, the whole table
+	for preload, want := range map[int]int{0: 2, 10: 2, 1: 3} {
+		q := &countingQueryer{queryer: db, tables: map[string]int{}}
+		d := &Dumper{db: q, dbs: ParseDDL(ddl), opts: DumpOptions{PreloadSymbols: preload}}
+		var docs int
+		err := d.Each(func(doc map[string]interface{}) error {
+			if doc["tag"] != []string{"go", "rust"}[docs%2] {
+				t.Errorf("document %d: %v", docs, doc)
+			}
+			docs++
+			return nil
+		})
+		if err != nil || docs != 50 {
+			t.Fatalf("preload %d: %d documents, %v", preload, docs, err)
+		}
+		if q.tables["tags"] != want {
+			t.Errorf("preload %d: %d queries of tags, want %d", preload, q.tables["tags"], want)
+		}
+	}
+}
+
+func TestDocWriterMatchesEncoding(t *testing.T) {
+	docs := []map[string]interface{}{
+		{},
+		{"name": "Alice", "n": int64(-42), "i": 7, "ok": true, "none": nil},
+		{"floats": []interface{}{0.0, 1.0, -2.5, 1e-7, 123456789e15, 1e21, 3.14159, 5e-324, 1.7976931348623157e308}},
+		{"text": "<a href=\"x\">&amp;</a>\\ \b\f\n\r\t\x00\x1f\x7f é 世 \u2028\u2029 \xff\xfe end"},
+		{"nested": map[string]interface{}{"b": []interface{}{map[string]interface{}{"z": 1.0, "a": "x"}, []interface{}{}}, "a": map[string]interface{}{}}, "": "empty key", "é": 1.0},
+		{"blob": []byte("raw\x00bytes"), "number": json.Number("12.50")},
+		{"items": []interface{}{map[string]interface{}{"price": 4.0}}},
+	}
+	var want, got bytes.Buffer
+	enc := json.NewEncoder(&want)
+	enc.SetEscapeHTML(false)
+	w := NewDocWriter(&got)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Write(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("DocWriter wrote\n%s\nencoding/json\n%s", got.String(), want.String())
+	}
+	if err := w.Write(map[string]interface{}{"nan": math.NaN()}); err == nil {
+		t.Error("NaN was encoded")
+	}
+}
+
+func TestRawLenFraming(t *testing.T) {
+	bin := buildCLI(t)
+	lines := []string{
+		`{"note": "two\nlines", "n": 1, "meta": {"city": "Oslo"}}`,
+		`{"note": "tab\there", "n": 2, "meta": {"city": "Bergen"}}`,
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	want, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	framed, err := exec.Command(bin, "dump", "--db", dbPath, "--format", "raw-len").Output()
+	if err != nil {
+		t.Fatalf("dump --format raw-len: %v", err)
+	}
+	// Each frame is its line without the newline, after a big-endian length
+	var lengths []int
+	for rest := framed; len(rest) > 0; {
+		n := int(rest[0])<<24 | int(rest[1])<<16 | int(rest[2])<<8 | int(rest[3])
+		lengths = append(lengths, n)
+		rest = rest[4+n:]
+	}
+	if len(lengths) != 2 || lengths[0]+lengths[1]+2 != len(want) {
+		t.Fatalf("frame lengths %v, lines %q", lengths, want)
+	}
+
+	copyPath := filepath.Join(t.TempDir(), "copy.db")
+	if out, err := exec.Command(bin, "create-db", "--db", copyPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	frames := writeTempFile(t, "frames-*.bin", string(framed))
+	if out, err := exec.Command(bin, "load", "--db", copyPath, "--input", frames, "--format", "raw-len").CombinedOutput(); err != nil {
+		t.Fatalf("load --format raw-len: %v\n%s", err, out)
+	}
+	got, err := exec.Command(bin, "dump", "--db", copyPath).Output()
+	if err != nil || string(got) != string(want) {
+		t.Errorf("round trip: %v\n%s\nwant\n%s", err, got, want)
+	}
+
+	truncated := writeTempFile(t, "frames-*.bin", string(framed[:len(framed)-3]))
+	if out, err := exec.Command(bin, "load", "--db", copyPath, "--input", truncated, "--format", "raw-len").CombinedOutput(); err == nil || !strings.Contains(string(out), "frame 2") {
+		t.Errorf("load of a truncated frame: %v\n%s", err, out)
+	}
+}
+
+func TestOrdColumn(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 5; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "_ord": 99}`, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--ord")
+	ddl, _ := os.ReadFile(ddlPath)
+	if !strings.Contains(string(ddl), "_ord INTEGER") || !strings.Contains(string(ddl), "CREATE INDEX main_ord ON main (_ord);") {
+		t.Errorf("DDL:\n%s", ddl)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Move the first document to the end of the row ids
+	if _, err := db.Exec("UPDATE main SET id = 100 WHERE n = 1"); err != nil {
+		t.Fatal(err)
+	}
+	dump := func(args ...string) []float64 {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("dump %v: %v", args, err)
+		}
+		var ns []float64
+		for _, doc := range decodeAllLines(t, out) {
+			if _, ok := doc["_ord"]; ok {
+				t.Errorf("dump %v has _ord: %v", args, doc)
+			}
+			ns = append(ns, doc["n"].(float64))
+		}
+		return ns
+	}
+	for _, c := range []struct {
+		args []string
+		want []float64
+	}{
+		{nil, []float64{2, 3, 4, 5, 1}},
+		{[]string{"--order-by", "_ord"}, []float64{1, 2, 3, 4, 5}},
+		{[]string{"--order-by", "_ord", "--head", "2"}, []float64{1, 2}},
+		{[]string{"--order-by", "_ord", "--tail", "2"}, []float64{4, 5}},
+	} {
+		if got := dump(c.args...); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("dump %v = %v, want %v", c.args, got, c.want)
+		}
+	}
+
+	// More documents follow the loaded ones, and patched ones keep their place
+	more := writeTempFile(t, "more-*.json", `{"n": 6}`+"\n")
+	if out, err := exec.Command(bin, "load", "--db", dbPath, "--input", more).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	patch := writeTempFile(t, "patch-*.json", `{"key": 3, "merge": {"x": 1}}`+"\n")
+	if out, err := exec.Command(bin, "patch", "--db", dbPath, "--key", "n", "--input", patch).CombinedOutput(); err != nil {
+		t.Fatalf("patch: %v\n%s", err, out)
+	}
+	if got := dump("--order-by", "_ord"); !reflect.DeepEqual(got, []float64{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("dump after load and patch = %v", got)
+	}
+	var ords []int
+	rows, err := db.Query("SELECT _ord FROM main ORDER BY _ord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var ord int
+		rows.Scan(&ord)
+		ords = append(ords, ord)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(ords, []int{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("_ord = %v", ords)
+	}
+	if out, err := exec.Command(bin, "dump", "--db", dbPath, "--order-by", "nope").CombinedOutput(); err == nil {
+		t.Errorf("dump --order-by nope succeeded:\n%s", out)
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	line := []byte(`{"a": 1, "meta": {"b": "x", "b": "y", "c": [{"d": 1, "d": 2, "d": 3}]}, "a": 2}`)
+	for mode, want := range map[string]string{
+		DuplicateKeysLast:  `{"a":2,"meta":{"b":"y","c":[{"d":3}]}}`,
+		DuplicateKeysArray: `{"a":[1,2],"meta":{"b":["x","y"],"c":[{"d":[1,2,3]}]}}`,
+	} {
+		var obj map[string]interface{}
+		ds := &DatabaseSchema{DuplicateKeys: mode}
+		if err := ds.decodeDocument(line, &obj); err != nil {
+			t.Fatalf("%q: %v", mode, err)
+		}
+		if got, _ := json.Marshal(obj); string(got) != want {
+			t.Errorf("%q: %s, want %s", mode, got, want)
+		}
+	}
+	strict := &DatabaseSchema{DuplicateKeys: DuplicateKeysError}
+	var obj map[string]interface{}
+	if err := strict.decodeDocument(line, &obj); err == nil || !strings.Contains(err.Error(), `"meta.b"`) {
+		t.Errorf("error mode: %v", err)
+	}
+	for _, bad := range []string{`[1]`, `{"a": 1} {"b": 2}`, `{"a": }`, `{"a": 1`} {
+		if err := strict.decodeDocument([]byte(bad), &obj); err == nil {
+			t.Errorf("%s decoded", bad)
+		}
+	}
+
+	bin := buildCLI(t)
+	ddl := writeTempFile(t, "dup-*.sql", `CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  tags JSON
+);
+`)
+	input := writeTempFile(t, "dup-*.json", `{"name": "a", "tags": "x"}
+{"name": "b", "tags": "x", "tags": "y"}
+`)
+	load := func(args ...string) []map[string]interface{} {
+		dbPath := filepath.Join(t.TempDir(), "dup.db")
+		if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddl).CombinedOutput(); err != nil {
+			t.Fatalf("create-db: %v\n%s", err, out)
+		}
+		if out, err := exec.Command(bin, append([]string{"load", "--db", dbPath, "--input", input}, args...)...).CombinedOutput(); err != nil {
+			t.Fatalf("load %v: %v\n%s", args, err, out)
+		}
+		out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+		if err != nil {
+			t.Fatalf("dump: %v", err)
+		}
+		return decodeAllLines(t, out)
+	}
+	if docs := load("--duplicate-keys", "error"); len(docs) != 1 || docs[0]["name"] != "a" {
+		t.Errorf("error mode loaded %v", docs)
+	}
+	if docs := load("--duplicate-keys", "array"); len(docs) != 2 || !reflect.DeepEqual(docs[1]["tags"], []interface{}{"x", "y"}) {
+		t.Errorf("array mode loaded %v", docs)
+	}
+	if docs := load(); len(docs) != 2 || docs[1]["tags"] != "y" {
+		t.Errorf("default loaded %v", docs)
+	}
+}
+
+func TestPreserveKeyOrder(t *testing.T) {
+	bin := buildCLI(t)
+	lines := []string{
+		`{"name":"a","zeta":1,"meta":{"z":1,"b":2},"items":[{"y":1,"x":2},{"x":3,"y":4}]}`,
+		`{"zeta":2,"name":"b"}`,
+	}
+	dbPath, _ := importLines(t, bin, lines, "--preserve-key-order")
+	dump := func(args ...string) string {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("dump %v: %v", args, err)
+		}
+		return string(out)
+	}
+	if got, want := dump("--preserve-key-order"), strings.Join(lines, "\n")+"\n"; got != want {
+		t.Errorf("dump --preserve-key-order:\n%s\nwant:\n%s", got, want)
+	}
+	sorted := "{\"items\":[{\"x\":2,\"y\":1},{\"x\":3,\"y\":4}],\"meta\":{\"b\":2,\"z\":1},\"name\":\"a\",\"zeta\":1}\n{\"name\":\"b\",\"zeta\":2}\n"
+	if got := dump(); got != sorted {
+		t.Errorf("dump:\n%s\nwant:\n%s", got, sorted)
+	}
+	if got, want := dump("--preserve-key-order", "--fields", "zeta,meta"), "{\"zeta\":1,\"meta\":{\"z\":1,\"b\":2}}\n{\"zeta\":2}\n"; got != want {
+		t.Errorf("dump --preserve-key-order --fields:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestNumberModeString(t *testing.T) {
+	bin := buildCLI(t)
+	lines := []string{
+		`{"a":10.0,"b":1E-7,"c":[1.50,2],"d":{"e":12345678901234567890},"f":3}`,
+		`{"a":1}`,
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--number-mode", "string")
+	ddl, _ := os.ReadFile(ddlPath)
+	if !strings.Contains(string(ddl), "_number_text TEXT") {
+		t.Errorf("DDL:\n%s", ddl)
+	}
+	dump := func(args ...string) string {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("dump %v: %v", args, err)
+		}
+		return string(out)
+	}
+	if got, want := dump("--number-mode", "string"), strings.Join(lines, "\n")+"\n"; got != want {
+		t.Errorf("dump --number-mode string:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := dump(), "{\"a\":10,\"b\":1e-7,\"c\":[1.5,2],\"d\":{\"e\":12345678901234567000},\"f\":3}\n{\"a\":1}\n"; got != want {
+		t.Errorf("dump:\n%s\nwant:\n%s", got, want)
+	}
+
+	// A changed value is written from the value, not the stale text
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("UPDATE main SET a = 11 WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := dump("--number-mode", "string"); !strings.HasPrefix(got, `{"a":11,"b":1E-7,`) {
+		t.Errorf("dump after UPDATE:\n%s", got)
+	}
+}
+
+func TestNormalizeTime(t *testing.T) {
+	bin := buildCLI(t)
+	lines := []string{
+		`{"at":"2024-03-01T10:00:00+02:00","msg":"a","ev":{"t":"2024-03-01 08:30:00.25Z"}}`,
+		`{"at":"2024-03-01T01:00:00-05:30","msg":"b","ev":{"t":"2024-03-01T08:30:00Z"}}`,
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--normalize-time", "utc")
+	ddl, _ := os.ReadFile(ddlPath)
+	for _, want := range []string{"at UTCTIME", "at_offset INTEGER", "t UTCTIME"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var msgs []string
+	rows, err := db.Query("SELECT msg FROM main ORDER BY at")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var m string
+		rows.Scan(&m)
+		msgs = append(msgs, m)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(msgs, []string{"b", "a"}) {
+		t.Errorf("ordered by time: %v", msgs)
+	}
+	var offset int64
+	if err := db.QueryRow("SELECT at_offset FROM main WHERE msg = 'b'").Scan(&offset); err != nil || offset != -19800 {
+		t.Errorf("offset %d, %v", offset, err)
+	}
+
+	dump := func(args ...string) []map[string]interface{} {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("dump %v: %v", args, err)
+		}
+		return decodeAllLines(t, out)
+	}
+	original := dump()
+	if original[0]["at"] != "2024-03-01T10:00:00+02:00" || original[1]["at"] != "2024-03-01T01:00:00-05:30" {
+		t.Errorf("original times: %v", original)
+	}
+	if ev := original[0]["ev"].(map[string]interface{}); ev["t"] != "2024-03-01T08:30:00.25Z" {
+		t.Errorf("nested time: %v", ev)
+	}
+	if _, ok := original[0]["at_offset"]; ok {
+		t.Errorf("dump has the offset column: %v", original[0])
+	}
+	utc := dump("--normalize-time", "utc")
+	if utc[0]["at"] != "2024-03-01T08:00:00Z" || utc[1]["at"] != "2024-03-01T06:30:00Z" {
+		t.Errorf("UTC times: %v", utc)
+	}
+}
+
+func TestEnumCheck(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 10; i++ {
+		status := "ok"
+		if i%3 == 0 {
+			status = "fail"
+		}
+		lines = append(lines, fmt.Sprintf(`{"status":%q,"name":"n%d"}`, status, i))
+	}
+	lines = append(lines, `{"status":"bogus","name":"x"}`)
+	dbPath, ddlPath := importLines(t, bin, lines, "--enum-max", "4", "--sample", "10")
+	ddl, _ := os.ReadFile(ddlPath)
+	if !strings.Contains(string(ddl), "status TEXT CHECK (status IN ('fail', 'ok'))") {
+		t.Errorf("DDL:\n%s", ddl)
+	}
+	if strings.Contains(string(ddl), "name TEXT CHECK") {
+		t.Errorf("distinct names got a CHECK:\n%s", ddl)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 10 {
+		t.Errorf("loaded %d documents, want the 10 with known statuses", len(docs))
+	}
+	for _, doc := range docs {
+		if doc["status"] == "bogus" {
+			t.Errorf("loaded %v", doc)
+		}
+	}
+}
+
+func TestSymbolizeNumbers(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 30; i++ {
+		lines = append(lines, fmt.Sprintf(`{"code":%d,"w":%d.5,"n":%d}`, i%3*100+200, i%2, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines, "--symbolize-numbers")
+	ddl, _ := os.ReadFile(ddlPath)
+	for _, want := range []string{"CREATE TABLE code_symbol (\n  id INTEGER PRIMARY KEY,\n  value INTEGER UNIQUE\n);", "CREATE TABLE w_symbol (\n  id INTEGER PRIMARY KEY,\n  value REAL UNIQUE\n);", "  n INTEGER,"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var symbols, high int
+	if err := db.QueryRow("SELECT count(*) FROM code_symbol WHERE typeof(value) = 'integer'").Scan(&symbols); err != nil || symbols != 3 {
+		t.Errorf("%d integer symbols, %v", symbols, err)
+	}
+	if err := db.QueryRow("SELECT count(*) FROM main JOIN code_symbol s ON s.id = main.code_symbol WHERE s.value >= 300").Scan(&high); err != nil || high != 20 {
+		t.Errorf("%d rows with code >= 300, %v", high, err)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 30 {
+		t.Fatalf("dumped %d documents", len(docs))
+	}
+	for i, doc := range docs {
+		var want map[string]interface{}
+		json.Unmarshal([]byte(lines[i]), &want)
+		if !reflect.DeepEqual(doc, want) {
+			t.Errorf("document %d: %v, want %v", i, doc, want)
+		}
+	}
+}
+
+func TestAnalyzeSubtree(t *testing.T) {
+	bin := buildCLI(t)
+	input := writeTempFile(t, "subtree.jsonl", strings.Join([]string{
+		`{"id":1,"meta":{"owner":{"name":"a","team":"x"},"tags":["p"],"size":3}}`,
+		`{"id":2,"meta":{"owner":{"name":"b","team":"y"},"size":4}}`,
+		`{"id":3}`,
+		`{"id":4,"items":[{"sku":"a","qty":1},{"sku":"b","qty":2}]}`,
+	}, "\n")+"\n")
+	analyze := func(subtree string) (string, error) {
+		out, err := exec.Command(bin, "analyze", "--input", input, "--subtree", subtree).CombinedOutput()
+		return string(out), err
+	}
+	ddl, err := analyze("meta")
+	if err != nil {
+		t.Fatalf("%v: %s", err, ddl)
+	}
+	for _, want := range []string{"CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  owner_id INTEGER REFERENCES owner(id),\n  size INTEGER,\n  tags JSON\n);", "CREATE TABLE owner ("} {
+		if !strings.Contains(ddl, want) {
+			t.Errorf("--subtree meta lacks %q:\n%s", want, ddl)
+		}
+	}
+	if ddl, err = analyze("meta.owner"); err != nil || !strings.Contains(ddl, "CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  name TEXT,\n  team TEXT\n);") {
+		t.Errorf("--subtree meta.owner: %v\n%s", err, ddl)
+	}
+	if ddl, err = analyze("items"); err != nil || !strings.Contains(ddl, "  qty INTEGER,\n  sku TEXT\n") {
+		t.Errorf("--subtree items: %v\n%s", err, ddl)
+	}
+	if out, err := analyze("nope"); err == nil || !strings.Contains(out, "No objects at nope") {
+		t.Errorf("--subtree nope: %v\n%s", err, out)
+	}
+}
+
+func TestSchemaMerge(t *testing.T) {
+	bin := buildCLI(t)
+	a := writeTempFile(t, "a.sql", `CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  a INTEGER NOT NULL,
+  flag BOOLEAN,
+  status_symbol INTEGER REFERENCES status_symbol(id),
+  level TEXT CHECK (level IN ('info'))
+);
+
+CREATE TABLE status_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+`)
+	b := writeTempFile(t, "b.sql", `CREATE TABLE owner (
+  id INTEGER PRIMARY KEY,
+  name TEXT
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  a REAL NOT NULL,
+  flag TEXT,
+  status TEXT,
+  level TEXT,
+  owner_id INTEGER REFERENCES owner(id)
+);
+`)
+	out, err := exec.Command(bin, "schema-merge", a, b).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	want := `CREATE TABLE status_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE owner (
+  id INTEGER PRIMARY KEY,
+  name TEXT
+);
+
+CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  a REAL NOT NULL,
+  flag TEXT,
+  status_symbol INTEGER REFERENCES status_symbol(id),
+  level TEXT,
+  owner_id INTEGER REFERENCES owner(id)
+);
+
+`
+	if string(out) != want {
+		t.Errorf("schema-merge:\n%s\nwant:\n%s", out, want)
+	}
+	if _, err := exec.Command(bin, "schema-merge", a).CombinedOutput(); err == nil {
+		t.Error("schema-merge of one schema succeeded")
+	}
+}
+
+// --- WASM TRANSFORM TEST --- //
+const wasmTransformSource = `package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"unsafe"
+)
+
+var buffers [][]byte
+
+//go:wasmexport alloc
+func alloc(size int32) int32 {
+	b := make([]byte, size)
+	buffers = append(buffers, b)
+	return int32(uintptr(unsafe.Pointer(unsafe.SliceData(b))))
+}
+
+//go:wasmexport transform
+func transform(ptr, size int32) int64 {
+	in := unsafe.Slice((*byte)(unsafe.Pointer(uintptr(ptr))), size)
+	var doc map[string]interface{}
+	if json.Unmarshal(in, &doc) != nil || doc["skip"] == true {
+		return 0
+	}
+	doc["name"] = strings.ToUpper(doc["name"].(string))
+	doc["tagged"] = true
+	out, _ := json.Marshal(doc)
+	buffers = append(buffers[:0], out)
+	return int64(uintptr(unsafe.Pointer(unsafe.SliceData(out))))<<32 | int64(len(out))
+}
+
+func main() {}
+`
+
+func TestWasmTransform(t *testing.T) {
+	bin := buildCLI(t)
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "go.mod"), []byte("module transform\n\ngo 1.24\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "main.go"), []byte(wasmTransformSource), 0666); err != nil {
+		t.Fatal(err)
+	}
+	wasmPath := filepath.Join(src, "transform.wasm")
+	build := exec.Command("go", "build", "-buildmode=c-shared", "-o", wasmPath, ".")
+	build.Dir = src
+	build.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Skipf("build wasm transform: %v\n%s", err, out)
+	}
+	dbPath, ddlPath := importLines(t, bin, []string{
+		`{"name": "ada"}`,
+		`{"name": "bob", "skip": true}`,
+		`{"name": "cy"}`,
+	}, "--wasm-transform", wasmPath)
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(ddl), "tagged BOOLEAN") {
+		t.Errorf("schema lacks the field the transform adds:\n%s", ddl)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 2 || docs[0]["name"] != "ADA" || docs[1]["name"] != "CY" || docs[0]["tagged"] != true {
+		t.Errorf("dump = %v, want ADA and CY tagged, bob dropped", docs)
+	}
+	bad := writeTempFile(t, "bad.wasm", "not wasm")
+	defer removeFiles(bad)
+	if out, err := exec.Command(bin, "import", "--input", bad, "--db", filepath.Join(src, "bad.db"), "--wasm-transform", bad).CombinedOutput(); err == nil {
+		t.Errorf("import with an invalid module succeeded: %s", out)
+	}
+}
+
+// --- DUMP SCRIPT TEST --- //
+func TestDumpScripts(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{
+		`{"name": "ada", "age": 30, "tags": ["a", "b"]}`,
+		`{"name": "bob", "age": 41, "tags": ["c"]}`,
+	})
+	dump := func(args ...string) []map[string]interface{} {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath, "--schema", ddlPath}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("dump %v: %v\n%s", args, err, out)
+		}
+		return decodeAllLines(t, out)
+	}
+	docs := dump("--jq", `select(.age > 35) | {who: .name, tag: .tags[]}`)
+	if len(docs) != 1 || docs[0]["who"] != "bob" || docs[0]["tag"] != "c" {
+		t.Errorf("--jq = %v", docs)
+	}
+	script := writeTempFile(t, "transform.lua", `function transform(doc)
+  if doc.age > 35 then return nil end
+  doc.name = string.upper(doc.name)
+  doc.count = #doc.tags
+  return doc
+end
+`)
+	defer removeFiles(script)
+	docs = dump("--lua", script)
+	if len(docs) != 1 || docs[0]["name"] != "ADA" || docs[0]["count"] != 2.0 || len(docs[0]["tags"].([]interface{})) != 2 {
+		t.Errorf("--lua = %v", docs)
+	}
+	if out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--jq", ".name").CombinedOutput(); err == nil {
+		t.Errorf("--jq writing a string succeeded: %s", out)
+	}
+}
+
+// --- WHOLE-INPUT ANALYSIS TEST --- //
+func TestAnalyzeWholeInput(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 0; i < 25000; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d"}`, i, i%3))
+	}
+	lines = append(lines, `{"n": 25000, "kind": "k0", "late": "field"}`)
+	input := writeTempFile(t, "whole.json", strings.Join(lines, "\n")+"\n")
+	defer removeFiles(input)
+	out, err := exec.Command(bin, "analyze", "--input", input).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if strings.Contains(string(out), "late") {
+		t.Errorf("sampled analysis found the field of the last line:\n%s", out)
+	}
+	out, err = exec.Command(bin, "analyze", "--input", input, "--sample", "0").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	for _, want := range []string{"REFERENCES late_symbol(id)", "REFERENCES kind_symbol(id)", "n INTEGER"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("--sample 0 schema lacks %q:\n%s", want, out)
+		}
+	}
+
+	// A line longer than 64KiB neither ends the analysis nor is skipped,
+	// and a failing read is reported
+	long := fmt.Sprintf(`{"n": 1, "body": %q}`, strings.Repeat("x", 100000)) + "\n" + `{"n": 2, "after": "long"}` + "\n"
+	ddl, err := Analyze(strings.NewReader(long), AnalyzeOptions{})
+	if err != nil || !strings.Contains(ddl, "body TEXT") || !strings.Contains(ddl, "after") {
+		t.Errorf("analysis past a long line: %v\n%s", err, ddl)
+	}
+	readErr := errors.New("read failed")
+	if _, err := Analyze(io.MultiReader(strings.NewReader(`{"n": 1}`+"\n"), iotest.ErrReader(readErr)), AnalyzeOptions{}); !errors.Is(err, readErr) {
+		t.Errorf("analysis of a failing reader: %v", err)
+	}
+}
+
+// --- DUMP POST TEST --- //
+func TestDumpPost(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 5; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d}`, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	var mu sync.Mutex
+	var batches [][]map[string]interface{}
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("Content-Type = %q", r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		batches = append(batches, decodeAllLines(t, body))
+	}))
+	defer srv.Close()
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--post", srv.URL, "--batch", "2").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if len(out) != 0 {
+		t.Errorf("dump --post wrote %s", out)
+	}
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[2]) != 1 || batches[2][0]["n"] != 5.0 {
+		t.Errorf("batches = %v, want 2+2+1 documents after one retry", batches)
+	}
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+	if out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--post", rejecting.URL).CombinedOutput(); err == nil || !strings.Contains(string(out), "400") {
+		t.Errorf("dump --post to a rejecting endpoint: %v: %s", err, out)
+	}
+}
+
+// --- LIBRARY API TEST --- //
+func TestLibraryAPI(t *testing.T) {
+	input := `{"name": "ada", "tags": ["x"], "owner": {"team": "core"}}
+{"name": "bob", "tags": [], "owner": {"team": "core"}}
+`
+	ddl, err := Analyze(strings.NewReader(input), AnalyzeOptions{Sample: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Analyze(strings.NewReader("not json\n"), AnalyzeOptions{Sample: 20}); !errors.Is(err, ErrNoRows) {
+		t.Errorf("Analyze of no documents: %v, want ErrNoRows", err)
+	}
+	dbPath := filepath.Join(t.TempDir(), "lib.db")
+	if err := CreateDatabase(dbPath, ddl); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dbs := ParseDDL(ddl)
+	if err := Load(context.Background(), db, strings.NewReader(input), dbs); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := Dump(context.Background(), db, &out, dbs); err != nil {
+		t.Fatal(err)
+	}
+	got := normalizeJSON(decodeAllLines(t, out.Bytes()))
+	want := normalizeJSON(decodeAllLines(t, []byte(input)))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Dump = %v, want %v", got, want)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Dump(ctx, db, io.Discard, dbs); !errors.Is(err, context.Canceled) {
+		t.Errorf("Dump with a cancelled context: %v", err)
+	}
+}
+
+// --- SYNC TEST --- //
+func TestSync(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"k": "a", "v": 1}`, `{"k": "b", "v": 2}`})
+	tmp := t.TempDir()
+	source := filepath.Join(tmp, "source.ndjson")
+	sink := filepath.Join(tmp, "changes.ndjson")
+	config := filepath.Join(tmp, "sync.yaml")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf("source: %s\ndb: %s\nschema: %s\nkey: k\nsink: %s\ninterval: 5m\n", source, dbPath, ddlPath, sink)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	syncSource := func(lines ...string) string {
+		if err := os.WriteFile(source, []byte(strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(bin, "sync", "--config", config, "--once").CombinedOutput()
+		if err != nil {
+			t.Fatalf("sync: %v\n%s", err, out)
+		}
+		return string(out)
+	}
+	out := syncSource(`{"k": "a", "v": 1}`, `{"k": "b", "v": 20}`, `{"k": "c", "v": 3}`)
+	if !strings.Contains(out, "Synced 2 changes") {
+		t.Errorf("first sync: %s", out)
+	}
+	if out := syncSource(`{"k": "a", "v": 1}`, `{"k": "b", "v": 20}`, `{"k": "c", "v": 3}`); out != "" {
+		t.Errorf("sync of an unchanged source: %s", out)
+	}
+	syncSource(`{"k": "b", "v": 20}`, `{"k": "c", "v": 3}`)
+	dump, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := decodeAllLines(t, dump)
+	if len(docs) != 2 || docs[0]["k"] != "b" || docs[0]["v"] != 20.0 || docs[1]["k"] != "c" {
+		t.Errorf("synced documents = %v", docs)
+	}
+	pushed, err := os.ReadFile(sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, e := range decodeAllLines(t, pushed) {
+		ops = append(ops, fmt.Sprint(e["op"], " ", e["key"]))
+	}
+	if want := []string{"change b", "add c", "remove a"}; !reflect.DeepEqual(ops, want) {
+		t.Errorf("pushed changes = %v, want %v", ops, want)
+	}
+	var st map[string]interface{}
+	if data, err := os.ReadFile(dbPath + ".sync.json"); err != nil || json.Unmarshal(data, &st) != nil || st["pushed"] != 3.0 {
+		t.Errorf("sync state = %s (%v)", data, err)
+	}
+
+	// A source that stalls fails its cycle after fetch_timeout
+	stalled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"k": "a"}` + "\n"))
+		w.(http.Flusher).Flush()
+		<-stalled
+	}))
+	defer srv.Close()
+	defer close(stalled)
+	if err := os.WriteFile(config, []byte(fmt.Sprintf("source: %s/src.ndjson\ndb: %s\nschema: %s\nkey: k\nsink: %s\nfetch_timeout: 200ms\n", srv.URL, dbPath, ddlPath, sink)), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(bin, "sync", "--config", config, "--once").CombinedOutput(); err == nil || !strings.Contains(string(out), "Timeout") {
+		t.Errorf("sync of a stalled source: %v\n%s", err, out)
+	}
+}
+
+// --- QUERY TEST --- //
+func TestQuery(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 60; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "kind": "k%d", "meta": {"a": %d}, "tags": ["t%d"]}`, i, i%3, i%2, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil || !strings.Contains(string(ddl), "kind_symbol") {
+		t.Fatalf("kind is not symbolized:\n%s", ddl)
+	}
+	query := func(sql string) []map[string]interface{} {
+		out, err := exec.Command(bin, "query", "--db", dbPath, "--schema", ddlPath, sql).Output()
+		if err != nil {
+			t.Fatalf("query %q: %v", sql, err)
+		}
+		return decodeAllLines(t, out)
+	}
+	want := []map[string]interface{}{
+		{"id": 2.0, "n": 2.0, "kind": "k2", "meta": map[string]interface{}{"a": 0.0}, "tags": []interface{}{"t2"}},
+	}
+	if got := query("SELECT * FROM main WHERE n = 2"); !reflect.DeepEqual(got, want) {
+		t.Errorf("select * = %v, want %v", got, want)
+	}
+	got := query("SELECT kind_symbol, count(*) AS c FROM main GROUP BY 1 ORDER BY 2, 1 LIMIT 1")
+	if len(got) != 1 || got[0]["c"] != 20.0 || !strings.HasPrefix(fmt.Sprint(got[0]["kind"]), "k") {
+		t.Errorf("grouped by symbol = %v", got)
+	}
+	if out, err := exec.Command(bin, "query", "--db", dbPath, "--schema", ddlPath, "DELETE FROM main").CombinedOutput(); err == nil {
+		t.Errorf("query wrote to the database: %s", out)
+	}
+}
+
+// --- DATABASE LOCK TEST --- //
+func TestDatabaseLock(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"n": 1}`})
+	input := writeTempFile(t, "more_*.json", `{"n": 2}`+"\n")
+	defer removeFiles(input)
+	lock, err := LockDatabase(context.Background(), dbPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LockDatabase(context.Background(), dbPath, 0); !errors.Is(err, ErrLocked) {
+		t.Errorf("second lock: %v, want ErrLocked", err)
+	}
+	out, err := exec.Command(bin, "load", "--input", input, "--db", dbPath, "--schema", ddlPath).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), fmt.Sprintf("pid %d", os.Getpid())) || !strings.Contains(string(out), "--lock-wait") {
+		t.Errorf("load of a locked database: %v\n%s", err, out)
+	}
+
+	// A load told to wait queues behind the holder
+	time.AfterFunc(300*time.Millisecond, func() { lock.Unlock() })
+	if out, err := exec.Command(bin, "load", "--input", input, "--db", dbPath, "--schema", ddlPath, "--lock-wait", "10s").CombinedOutput(); err != nil {
+		t.Fatalf("load waiting for the lock: %v\n%s", err, out)
+	}
+	dump, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if docs := decodeAllLines(t, dump); len(docs) != 2 {
+		t.Errorf("documents after the queued load = %v", docs)
+	}
+}
+
+// --- STDIN INPUT TEST --- //
+func TestStdinInput(t *testing.T) {
+	bin := buildCLI(t)
+	tmp := t.TempDir()
+	dbPath := filepath.Join(tmp, "stdin.db")
+	var lines []string
+	for i := 1; i <= 30; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "name": "x%d"}`, i, i))
+	}
+	// import reads its input twice: the sampled lines must be loaded too
+	cmd := exec.Command(bin, "import", "--db", dbPath, "--sample", "5")
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil || !strings.Contains(string(out), "Imported stdin") {
+		t.Fatalf("import from stdin: %v\n%s", err, out)
+	}
+	cmd = exec.Command(bin, "load", "--db", dbPath, "--input", "-")
+	cmd.Stdin = strings.NewReader(`{"n": 31, "name": "x31"}` + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("load from stdin: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := decodeAllLines(t, out)
+	if len(docs) != 31 || docs[0]["name"] != "x1" || docs[30]["n"] != 31.0 {
+		t.Errorf("documents read from stdin = %d: %v", len(docs), docs)
+	}
+	cmd = exec.Command(bin, "analyze")
+	cmd.Stdin = strings.NewReader(lines[0] + "\n")
+	if ddl, err := cmd.Output(); err != nil || !strings.Contains(string(ddl), "name TEXT") {
+		t.Errorf("analyze of stdin: %v\n%s", err, ddl)
+	}
+}
+
+// --- AUDIT LOG TEST --- //
+func TestAuditLog(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"n": 1}`, `{"n": 2}`}, "--audit")
+	more := writeTempFile(t, "more_*.json", `{"n": 3}`+"\n")
+	defer removeFiles(more)
+	// A database with a log records writes made without --audit
+	if out, err := exec.Command(bin, "load", "--input", more, "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "audit", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("audit: %v\n%s", err, out)
+	}
+	entries := decodeAllLines(t, out)
+	if len(entries) != 2 || entries[0]["rows"] != 2.0 || entries[1]["rows"] != 1.0 || entries[1]["prev"] != entries[0]["hash"] ||
+		!strings.HasPrefix(fmt.Sprint(entries[1]["command"]), "jsql load --input") || entries[1]["input_sha256"] == nil {
+		t.Errorf("audit log = %s", out)
+	}
+	// Each batch commits with its own entry
+	two := writeTempFile(t, "two_*.json", `{"n": 4}`+"\n"+`{"n": 5}`+"\n")
+	defer removeFiles(two)
+	if out, err := exec.Command(bin, "load", "--input", two, "--db", dbPath, "--schema", ddlPath, "--batch-size", "1").CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(bin, "audit", "--db", dbPath, "--head", fmt.Sprint(entries[1]["hash"])).Output(); err != nil {
+		t.Errorf("audit --head: %v\n%s", err, out)
+	} else if batches := decodeAllLines(t, out); len(batches) != 4 || batches[2]["rows"] != 1.0 || batches[3]["rows"] != 1.0 {
+		t.Errorf("audit log of a batched load = %s", out)
+	}
+	if out, err := exec.Command(bin, "audit", "--db", dbPath, "--head", "0123").CombinedOutput(); err == nil || !strings.Contains(string(out), "truncated or rewritten") {
+		t.Errorf("audit --head of an unknown hash: %v\n%s", err, out)
+	}
+
+	// So do the other commands writing to it, and the batches of serve
+	for _, args := range [][]string{{"denormalize"}, {"repair"}, {"recompact-symbols"}} {
+		if out, err := exec.Command(bin, append(args, "--db", dbPath, "--schema", ddlPath)...).CombinedOutput(); err != nil {
+			t.Fatalf("%s: %v\n%s", args[0], err, out)
+		}
+	}
+	base := startServe(t, bin, "--db", dbPath, "--schema", ddlPath)
+	body := `{"n": 6}` + "\n" + `{"n": 7}` + "\n"
+	resp, err := http.Post(base+"/ingest", "application/x-ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	out, err = exec.Command(bin, "audit", "--db", dbPath).Output()
+	if err != nil {
+		t.Fatalf("audit: %v\n%s", err, out)
+	}
+	entries = decodeAllLines(t, out)
+	sum := sha256.Sum256([]byte(body))
+	if len(entries) != 8 || entries[4]["rows"] != 5.0 || !strings.HasPrefix(fmt.Sprint(entries[4]["command"]), "jsql denormalize") ||
+		!strings.HasPrefix(fmt.Sprint(entries[5]["command"]), "jsql repair") || !strings.HasPrefix(fmt.Sprint(entries[6]["command"]), "jsql recompact-symbols") ||
+		!strings.HasPrefix(fmt.Sprint(entries[7]["command"]), "jsql serve") || entries[7]["rows"] != 2.0 || entries[7]["input_sha256"] != hex.EncodeToString(sum[:]) {
+		t.Errorf("audit log after denormalize, repair, recompact-symbols and serve = %s", out)
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("DELETE FROM _jsql_audit WHERE id = 1"); err == nil {
+		t.Error("entry of the audit log deleted")
+	}
+	if _, err := db.Exec("DROP TRIGGER _jsql_audit_no_update; UPDATE _jsql_audit SET rows = 5 WHERE id = 1"); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command(bin, "audit", "--db", dbPath).CombinedOutput(); err == nil || !strings.Contains(string(out), "entry 1 does not match its hash") {
+		t.Errorf("audit of an altered log: %v\n%s", err, out)
+	}
+
+	// Databases without a log get none
+	plain, plainDDL := importLines(t, bin, []string{`{"n": 1}`})
+	if out, err := exec.Command(bin, "load", "--input", more, "--db", plain, "--schema", plainDDL).CombinedOutput(); err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(bin, "audit", "--db", plain).CombinedOutput(); err == nil || !strings.Contains(string(out), "no audit log") {
+		t.Errorf("audit of a database without a log: %v\n%s", err, out)
+	}
+}
+
+// --- SOFT DELETE TEST --- //
+func TestSoftDelete(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{
+		`{"k": "a", "o": {"x": 1}}`,
+		`{"k": "b", "o": {"x": 2}}`,
+		`{"k": "c"}`,
+	}, "--soft-delete")
+	patches := writeTempFile(t, "patches_*.json", `{"op": "remove", "key": "b"}`+"\n")
+	defer removeFiles(patches)
+	if out, err := exec.Command(bin, "patch", "--db", dbPath, "--schema", ddlPath, "--key", "k", "--input", patches).CombinedOutput(); err != nil {
+		t.Fatalf("patch: %v\n%s", err, out)
+	}
+	keys := func(out []byte) []string {
+		var ks []string
+		for _, doc := range decodeAllLines(t, out) {
+			ks = append(ks, fmt.Sprint(doc["k"]))
+		}
+		return ks
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(out); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("dump after a soft delete = %v", got)
+	}
+	all, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--include-deleted").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := decodeAllLines(t, all)
+	if len(docs) != 3 || docs[1]["_deleted_at"] == nil || docs[1]["o"] == nil || docs[0]["_deleted_at"] != nil {
+		t.Errorf("dump --include-deleted = %s", all)
+	}
+	// Removing it again fails: the document is gone, if recoverable
+	if out, _ := exec.Command(bin, "patch", "--db", dbPath, "--schema", ddlPath, "--key", "k", "--input", patches).CombinedOutput(); !strings.Contains(string(out), `"b" not found`) {
+		t.Errorf("second remove: %s", out)
+	}
+
+	// A dump with --include-deleted loads back with its deletions
+	copyPath, copyDDL := importLines(t, bin, strings.Split(strings.TrimSpace(string(all)), "\n"), "--soft-delete")
+	out, err = exec.Command(bin, "dump", "--db", copyPath, "--schema", copyDDL).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(out); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("dump of the reloaded copy = %v", got)
+	}
+}
+
+// --- DUMP WHERE TEST --- //
+func TestDumpWhere(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 20; i++ {
+		lines = append(lines, fmt.Sprintf(`{"age": %d, "name": "p%d"}`, i*5, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	dump := func(args ...string) ([]map[string]interface{}, error) {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath, "--schema", ddlPath}, args...)...).Output()
+		return decodeAllLines(t, out), err
+	}
+	docs, err := dump("--where", "age > ? AND name != ?", "--arg", "80", "--arg", "p18")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, d := range docs {
+		names = append(names, fmt.Sprint(d["name"]))
+	}
+	if want := []string{"p17", "p19", "p20"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("dump --where = %v, want %v", names, want)
+	}
+	if docs, err := dump("--where", "age <= 50", "--tail", "2"); err != nil || len(docs) != 2 || docs[1]["age"] != 50.0 {
+		t.Errorf("dump --where --tail = %v (%v)", docs, err)
+	}
+	if _, err := dump("--arg", "1"); err == nil {
+		t.Error("--arg without --where accepted")
+	}
+}
+
+// --- POSTGRES DIALECT TEST --- //
+
+// dollarSQLite speaks SQLite with PostgreSQL's $n placeholders, through the
+// connections of the postgres dialect, and loads documents in savepoints as
+// a postgres load does
+type dollarSQLite struct{ sqliteDialect }
+
+func (dollarSQLite) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (d dollarSQLite) Open(dsn string) (*sql.DB, error) {
+	c := hookConnector{dsn: dsn, drv: &sqlite3.SQLiteDriver{}}
+	return sql.OpenDB(rebindConnector{Connector: c, placeholder: d.Placeholder}), nil
+}
+
+func (dollarSQLite) AbortsOnError() bool { return true }
+
+func TestPostgresDialect(t *testing.T) {
+	if got, want := rebind(`SELECT '?', "a?" FROM t WHERE a = ? AND b IN (?, ?)`, Postgres.Placeholder), `SELECT '?', "a?" FROM t WHERE a = $1 AND b IN ($2, $3)`; got != want {
+		t.Errorf("rebind = %s, want %s", got, want)
+	}
+	if got, want := rebind("DELETE FROM t WHERE id = ?1 AND NOT EXISTS (SELECT 1 FROM u WHERE t_id = ?1)", Postgres.Placeholder), "DELETE FROM t WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM u WHERE t_id = $1)"; got != want {
+		t.Errorf("rebind = %s, want %s", got, want)
+	}
+	if got, want := Postgres.InsertIgnore("kind_symbol", []string{"value"}, 2), "INSERT INTO kind_symbol (value) VALUES (?), (?) ON CONFLICT DO NOTHING"; got != want {
+		t.Errorf("InsertIgnore = %s, want %s", got, want)
+	}
+	if got, want := Postgres.Upsert(metaTable, []string{"key", "value"}, "key"), `INSERT INTO _jsql_meta ("key", value) VALUES (?, ?) ON CONFLICT ("key") DO UPDATE SET value = EXCLUDED.value`; got != want {
+		t.Errorf("Upsert = %s, want %s", got, want)
+	}
+
+	ddl := `CREATE TABLE kind_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE addr (
+  city TEXT,
+  id INTEGER PRIMARY KEY
+);
+
+CREATE TABLE main (
+  addr_id INTEGER REFERENCES addr(id),
+  id INTEGER PRIMARY KEY,
+  kind_symbol INTEGER REFERENCES kind_symbol(id),
+  name VARCHAR(20) NOT NULL,
+  ok BOOLEAN,
+  score REAL,
+  tags JSON
+);
+
+CREATE INDEX main_score ON main (score);
+`
+	pg, err := Postgres.CreateDDL(ddl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"id BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY",
+		"kind_symbol BIGINT REFERENCES kind_symbol(id)",
+		"name VARCHAR(20) NOT NULL",
+		"score DOUBLE PRECISION",
+		"tags TEXT",
+		"CREATE INDEX main_score ON main (score);",
+	} {
+		if !strings.Contains(pg, want) {
+			t.Errorf("postgres DDL lacks %q:\n%s", want, pg)
+		}
+	}
+	if pg, err := Postgres.CreateDDL("CREATE TABLE t (\n  id INTEGER PRIMARY KEY,\n  n INTEGER\n) STRICT;\n"); err != nil || strings.Contains(pg, "STRICT") {
+		t.Errorf("STRICT table = %s (%v)", pg, err)
+	}
+	for _, bad := range []string{
+		"CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  userId TEXT\n);\n",
+		"CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  user TEXT\n);\n",
+		"CREATE TABLE main (\n  id INTEGER PRIMARY KEY\n);\n\nCREATE TRIGGER t AFTER INSERT ON main\nBEGIN\n  SELECT 1;\nEND;\n",
+	} {
+		if _, err := Postgres.CreateDDL(bad); err == nil {
+			t.Errorf("postgres DDL of %q succeeded", bad)
+		}
+	}
+
+	// Loading and dumping through a dialect's connections
+	d := dollarSQLite{}
+	dbPath := filepath.Join(t.TempDir(), "dollar.db")
+	if err := CreateTables(context.Background(), d, dbPath, ddl, false); err != nil {
+		t.Fatal(err)
+	}
+	stored, ok, err := StoredSchemaIn(d, dbPath)
+	if err != nil || !ok || !strings.Contains(stored, "kind_symbol") {
+		t.Fatalf("stored schema = %q, %v (%v)", stored, ok, err)
+	}
+	input := writeTempFile(t, "dialect_*.json", `{"name": "a", "kind": "x", "score": 1, "ok": true, "tags": ["t"], "addr": {"city": "P"}}
+{"kind": "y", "score": 2}
+{"name": "b", "kind": "x", "score": 3}
+{"name": "c", "kind": "y", "score": 4}
+`)
+	defer removeFiles(input)
+	dbs := ParseDDL(stored)
+	dbs.Dialect = d
+	if err := LoadData(context.Background(), input, dbPath, dbs); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := DumpRows(context.Background(), dbPath, dbs, DumpOptions{Output: &out}); err != nil {
+		t.Fatal(err)
+	}
+	docs := decodeAllLines(t, out.Bytes())
+	if len(docs) != 3 || docs[0]["kind"] != "x" || docs[0]["addr"] == nil || docs[0]["ok"] != true || !reflect.DeepEqual(docs[0]["tags"], []interface{}{"t"}) || docs[2]["name"] != "c" {
+		t.Errorf("dump through the dialect = %s", out.Bytes())
+	}
+	out.Reset()
+	if _, err := DumpRows(context.Background(), dbPath, dbs, DumpOptions{Output: &out, Where: "score > ?", Args: []any{1}, Tail: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if docs := decodeAllLines(t, out.Bytes()); len(docs) != 1 || docs[0]["name"] != "c" {
+		t.Errorf("dump --where --tail through the dialect = %s", out.Bytes())
+	}
+
+	// Commands refuse what they do not support with postgres before
+	// connecting
+	bin := buildCLI(t)
+	for _, c := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"load", "--driver", "postgres", "--dsn", "postgres://localhost/jsql", "--input", input, "--quarantine"}, "--quarantine: not supported with --driver postgres"},
+		{[]string{"dump", "--driver", "postgres", "--dsn", "postgres://localhost/jsql", "--sample", "0.5"}, "--sample: not supported with --driver postgres"},
+		{[]string{"create-db", "--driver", "postgres", "--schema", "x.sql"}, "--driver postgres needs --dsn"},
+		{[]string{"dump", "--db", dbPath, "--dsn", "postgres://localhost/jsql"}, "pass --driver postgres"},
+		{[]string{"load", "--driver", "mysql", "--dsn", "x"}, "unknown driver"},
+	} {
+		out, err := exec.Command(bin, c.args...).CombinedOutput()
+		if err == nil || !strings.Contains(string(out), c.want) {
+			t.Errorf("%v: %v\n%s", c.args, err, out)
+		}
+	}
+}
+
+// --- POSTGRES SERVER TEST --- //
+
+// TestPostgresServer creates, loads and dumps tables on the PostgreSQL
+// server JSQL_TEST_POSTGRES_DSN names, replacing the tables of its schema
+// there. It is skipped without one.
+func TestPostgresServer(t *testing.T) {
+	dsn := os.Getenv("JSQL_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("JSQL_TEST_POSTGRES_DSN is not set")
+	}
+	ddl := `CREATE TABLE kind_symbol (
+  id INTEGER PRIMARY KEY,
+  value TEXT UNIQUE
+);
+
+CREATE TABLE addr (
+  city TEXT,
+  id INTEGER PRIMARY KEY
+);
+
+CREATE TABLE main (
+  addr_id INTEGER REFERENCES addr(id),
+  geom WKB,
+  id INTEGER PRIMARY KEY,
+  kind_symbol INTEGER REFERENCES kind_symbol(id),
+  name TEXT,
+  ok BOOLEAN
+);
+`
+	if err := CreateTables(context.Background(), Postgres, dsn, ddl, true); err != nil {
+		t.Fatal(err)
+	}
+	stored, ok, err := StoredSchemaIn(Postgres, dsn)
+	if err != nil || !ok {
+		t.Fatalf("stored schema: %v %v", ok, err)
+	}
+	lines := []string{
+		`{"addr": {"city": "P"}, "geom": {"type": "Point", "coordinates": [1.5, 2]}, "kind": "x", "name": "a", "ok": true}`,
+		`{"kind": "y", "name": "b", "ok": false}`,
+	}
+	input := writeTempFile(t, "postgres_*.json", strings.Join(lines, "\n")+"\n")
+	defer removeFiles(input)
+	dbs := ParseDDL(stored)
+	dbs.Dialect = Postgres
+	// The second load finds its symbols there already
+	for i := 0; i < 2; i++ {
+		if err := LoadData(context.Background(), input, dsn, dbs); err != nil {
+			t.Fatalf("load %d: %v", i+1, err)
+		}
+	}
+
+	db, err := Postgres.Open(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Ids come from the identity columns, and those of nested rows back
+	// through RETURNING
+	var ids []int64
+	rows, err := db.Query("SELECT id FROM main ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if !reflect.DeepEqual(ids, []int64{1, 2, 3, 4}) {
+		t.Errorf("main ids = %v", ids)
+	}
+	var symbols int
+	if err := db.QueryRow("SELECT count(*) FROM kind_symbol").Scan(&symbols); err != nil || symbols != 2 {
+		t.Errorf("kind symbols = %d (%v)", symbols, err)
+	}
+	var geomType string
+	if err := db.QueryRow("SELECT data_type FROM information_schema.columns WHERE table_name = 'main' AND column_name = 'geom'").Scan(&geomType); err != nil || geomType != "bytea" {
+		t.Errorf("geom column type = %q (%v)", geomType, err)
+	}
+
+	var out bytes.Buffer
+	if _, err := DumpRows(context.Background(), dsn, dbs, DumpOptions{Output: &out}); err != nil {
+		t.Fatal(err)
+	}
+	want := decodeAllLines(t, []byte(strings.Join(append(lines, lines...), "\n")))
+	if got := decodeAllLines(t, out.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("dump from postgres:\n got %v\nwant %v", got, want)
+	}
+}
+
+// --- HISTORY TEST --- //
+func TestHistory(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{
+		`{"k": "a", "o": {"x": 1}}`,
+		`{"k": "b", "o": {"x": 2}}`,
+		`{"k": "c"}`,
+	}, "--history")
+	time.Sleep(20 * time.Millisecond)
+	before := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(20 * time.Millisecond)
+	patches := writeTempFile(t, "patches_*.json", `{"key": "a", "merge": {"o": {"x": 10}}}`+"\n"+`{"op": "remove", "key": "b"}`+"\n")
+	defer removeFiles(patches)
+	if out, err := exec.Command(bin, "patch", "--db", dbPath, "--schema", ddlPath, "--key", "k", "--input", patches).CombinedOutput(); err != nil {
+		t.Fatalf("patch: %v\n%s", err, out)
+	}
+	// The patch leaves one version of each document it changed, ended when
+	// it ran, and a keeps its row id
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := queryRows(db, "SELECT id, _valid_from < _valid_to AS ended FROM main_history ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rows) != "[map[ended:1 id:1] map[ended:1 id:2]]" {
+		t.Errorf("history of main after patching = %v", rows)
+	}
+	var id int64
+	if err := db.QueryRow("SELECT id FROM main WHERE k = 'a'").Scan(&id); err != nil || id != 1 {
+		t.Errorf("id of the patched document = %d, %v", id, err)
+	}
+	dump := func(args ...string) string {
+		out, err := exec.Command(bin, args...).Output()
+		if err != nil {
+			t.Fatalf("%s: %v", args[0], err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	if got, want := dump("dump", "--db", dbPath, "--schema", ddlPath), `{"k":"a","o":{"x":10}}`+"\n"+`{"k":"c"}`; got != want {
+		t.Errorf("dump after patching = %s", got)
+	}
+	if got, want := dump("asof", "--db", dbPath, "--schema", ddlPath, "--at", before), `{"k":"a","o":{"x":1}}`+"\n"+`{"k":"b","o":{"x":2}}`+"\n"+`{"k":"c"}`; got != want {
+		t.Errorf("asof before patching = %s, want %s", got, want)
+	}
+	if got := dump("asof", "--db", dbPath, "--schema", ddlPath, "--at", "2000-01-01"); got != "" {
+		t.Errorf("asof before loading = %s", got)
+	}
+	if out, err := exec.Command(bin, "asof", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err == nil || !strings.Contains(string(out), "--at is required") {
+		t.Errorf("asof without --at: %v %s", err, out)
+	}
+}
+
+// --- GET TEST --- //
+func TestGet(t *testing.T) {
+	bin := buildCLI(t)
+	var lines []string
+	for i := 1; i <= 30; i++ {
+		lines = append(lines, fmt.Sprintf(`{"name": "p%d", "age": %d, "role": "r%d", "addr": {"city": "c%d"}}`, i, 20+i%5, i%3, i))
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(ddl), "role_symbol") {
+		t.Fatalf("role is not symbolized:\n%s", ddl)
+	}
+	get := func(keys ...string) ([]string, error) {
+		args := []string{"get", "--db", dbPath, "--schema", ddlPath}
+		for _, k := range keys {
+			args = append(args, "--key", k)
+		}
+		out, err := exec.Command(bin, args...).Output()
+		var names []string
+		for _, doc := range decodeAllLines(t, out) {
+			names = append(names, fmt.Sprint(doc["name"]))
+		}
+		return names, err
+	}
+	for _, tc := range []struct {
+		keys []string
+		want []string
+	}{
+		{[]string{"name=p7"}, []string{"p7"}},
+		{[]string{"id=2"}, []string{"p2"}},
+		{[]string{"role=r1", "age=21"}, []string{"p1", "p16"}},
+	} {
+		if got, err := get(tc.keys...); err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("get %v = %v (%v), want %v", tc.keys, got, err, tc.want)
+		}
+	}
+	out, err := exec.Command(bin, "get", "--db", dbPath, "--schema", ddlPath, "--key", "name=p7").Output()
+	if err != nil || !strings.Contains(string(out), `"addr":{"city":"c7"}`) {
+		t.Errorf("get name=p7 = %s (%v)", out, err)
+	}
+	if _, err := get("name=nobody"); err == nil {
+		t.Error("get of a missing document succeeded")
+	}
+	if _, err := get("addr=c1"); err == nil {
+		t.Error("get by a nested object succeeded")
+	}
+}
+
+// --- LARGE INTEGER TEST --- //
+func TestLargeIntegers(t *testing.T) {
+	bin := buildCLI(t)
+	lines := []string{
+		`{"id64":1234567890123456789,"o":{"ns":-9223372036854775807},"seq":[9007199254740993,1],"x":1.5}`,
+		`{"id64":9007199254740993,"o":{"ns":5},"seq":[],"x":2}`,
+	}
+	dbPath, ddlPath := importLines(t, bin, lines)
+	ddl, err := os.ReadFile(ddlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"id64 INTEGER", "ns INTEGER", "x REAL"} {
+		if !strings.Contains(string(ddl), want) {
+			t.Errorf("DDL lacks %q:\n%s", want, ddl)
+		}
+	}
+	out, err := exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(out)), strings.Join(lines, "\n"); got != want {
+		t.Errorf("dump = %s, want %s", got, want)
+	}
+
+	// Patching a document keeps the integers of it and of the patch
+	patches := writeTempFile(t, "patches_*.json", `{"key": 9007199254740993, "merge": {"o": {"ns": 9007199254740995}}}`+"\n")
+	defer removeFiles(patches)
+	if out, err := exec.Command(bin, "patch", "--db", dbPath, "--schema", ddlPath, "--key", "id64", "--input", patches).CombinedOutput(); err != nil || !strings.Contains(string(out), "(0 failed)") {
+		t.Fatalf("patch: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath, "--tail", "1").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(out)), `{"id64":9007199254740993,"o":{"ns":9007199254740995},"seq":[],"x":2}`; got != want {
+		t.Errorf("dump after patching = %s, want %s", got, want)
+	}
+}
+
+// --- BATCH SIZE TEST --- //
+func TestBatchSize(t *testing.T) {
+	var lines []string
+	for i := 1; i <= 25; i++ {
+		lines = append(lines, fmt.Sprintf(`{"n": %d, "tag": "t%d"}`, i, i%3))
+	}
+	input := strings.Join(lines, "\n") + "\n"
+	ddl, err := Analyze(strings.NewReader(input), AnalyzeOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(t.TempDir(), "batch.db")
+	if err := CreateDatabase(dbPath, ddl); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	dbs := ParseDDL(ddl)
+	dbs.BatchSize = 10
+
+	// The input breaks off after line 25: the batches of lines 1-20 stay
+	r := io.MultiReader(strings.NewReader(input), iotest.ErrReader(errors.New("connection reset")))
+	err = Load(context.Background(), db, r, dbs)
+	if err == nil || !strings.Contains(err.Error(), "connection reset (2 batches, the last row at line 20)") {
+		t.Errorf("Load of a broken input: %v", err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM main").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Errorf("%d rows committed, want 20", n)
+	}
+
+	// Batches end at the end of a chunk with --strict
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	ddlPath, dataPath := filepath.Join(dir, "s.sql"), filepath.Join(dir, "data.json")
+	os.WriteFile(ddlPath, []byte(ddl), 0666)
+	os.WriteFile(dataPath, []byte(input), 0666)
+	dbPath = filepath.Join(dir, "s.db")
+	if out, err := exec.Command(bin, "create-db", "--db", dbPath, "--schema", ddlPath).CombinedOutput(); err != nil {
+		t.Fatalf("create-db: %v\n%s", err, out)
+	}
+	out, err := exec.Command(bin, "load", "--input", dataPath, "--db", dbPath, "--schema", ddlPath, "--strict", "--chunk-size", "4", "--batch-size", "10").CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "--batch-size must be a multiple of --chunk-size") {
+		t.Errorf("strict load with batches across chunks: %v\n%s", err, out)
+	}
+	out, err = exec.Command(bin, "load", "--input", dataPath, "--db", dbPath, "--schema", ddlPath, "--strict", "--chunk-size", "5", "--batch-size", "10").CombinedOutput()
+	if err != nil {
+		t.Fatalf("load: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Committed 3 batches, the last row at line 25") {
+		t.Errorf("load output lacks the batches committed:\n%s", out)
+	}
+	out, err = exec.Command(bin, "dump", "--db", dbPath, "--schema", ddlPath).Output()
+	if err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if got := len(decodeAllLines(t, out)); got != 25 {
+		t.Errorf("dumped %d documents, want 25", got)
+	}
+}
+
+// --- UNDERSCORE FIELDS TEST --- //
+func TestUnderscoreFieldsKept(t *testing.T) {
+	// Without the options adding jsql's own columns, fields of the same
+	// names are the documents' data
+	bin := buildCLI(t)
+	doc := `{"_deleted_at":"2020-01-01","_key_order":"k","_line":"x","_number_text":"t","_ord":3,"_source":"es-index","name":"a"}`
+	dbPath, ddlPath := importLines(t, bin, []string{doc})
+	for _, args := range [][]string{nil, {"--preserve-key-order", "--number-mode", "string"}} {
+		out, err := exec.Command(bin, append([]string{"dump", "--db", dbPath, "--schema", ddlPath}, args...)...).Output()
+		if err != nil {
+			t.Fatalf("dump %v: %v", args, err)
+		}
+		if got := strings.TrimSpace(string(out)); got != doc {
+			t.Errorf("dump %v = %s, want %s", args, got, doc)
+		}
+	}
+}
+
+// --- FLATTEN TEST --- //
+func TestFlattenRoundTrip(t *testing.T) {
+	docs := []string{
+		`{"a":{"b":1,"c":{"d.e":"x"}},"empty":{},"list":[1,{"k":2}]}`,
+		`{"0":"a","1":"b"}`,
+		`{"0":{"0":"a","1":"b"}}`,
+	}
+	for _, opts := range []FlattenOptions{{}, {IndexArrays: true}, {Sep: "/"}} {
+		for _, doc := range docs {
+			var obj map[string]interface{}
+			if err := json.Unmarshal([]byte(doc), &obj); err != nil {
+				t.Fatal(err)
+			}
+			got, err := UnflattenRecord(FlattenRecord(obj, opts), opts)
+			if err != nil {
+				t.Fatalf("UnflattenRecord %s %+v: %v", doc, opts, err)
+			}
+			js, _ := json.Marshal(got)
+			want := doc
+			if opts.IndexArrays && doc == `{"0":{"0":"a","1":"b"}}` {
+				// Nested objects keyed 0..n-1 read as arrays
+				want = `{"0":["a","b"]}`
+			}
+			if string(js) != want {
+				t.Errorf("round trip %+v = %s, want %s", opts, js, want)
+			}
+		}
+	}
+	flat := FlattenRecord(map[string]interface{}{"a": map[string]interface{}{"b": 1.0}, "l": []interface{}{"x"}}, FlattenOptions{IndexArrays: true})
+	if want := map[string]interface{}{"a.b": 1.0, "l.0": "x"}; !reflect.DeepEqual(flat, want) {
+		t.Errorf("FlattenRecord = %v, want %v", flat, want)
+	}
+}
+
+// --- INGEST BACKPRESSURE TEST --- //
+func TestIngestSlots(t *testing.T) {
+	// With one slot, a request whose body is still being read turns the
+	// next away before its body is read
+	s := NewIngestServer(nil, ParseDDL("CREATE TABLE main (\n  id INTEGER PRIMARY KEY,\n  n INTEGER\n);\n"), 1, 0)
+	pr, pw := io.Pipe()
+	first := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		s.handleIngest(rec, httptest.NewRequest(http.MethodPost, "/ingest", pr))
+		first <- rec.Code
+	}()
+	pw.Write([]byte(`{"n": 1}` + "\n"))
+	var read atomic.Bool
+	body := iotest.ErrReader(errors.New("unused"))
+	second := httptest.NewRecorder()
+	s.handleIngest(second, httptest.NewRequest(http.MethodPost, "/ingest", readerFunc(func(p []byte) (int, error) {
+		read.Store(true)
+		return body.Read(p)
+	})))
+	if second.Code != http.StatusTooManyRequests || read.Load() {
+		t.Errorf("second request: %d, body read %v", second.Code, read.Load())
+	}
+	pw.CloseWithError(errors.New("client gone"))
+	if code := <-first; code != http.StatusBadRequest {
+		t.Errorf("first request: %d", code)
+	}
+	// The slot is free again
+	if len(s.slots) != 0 {
+		t.Errorf("%d slots still taken", len(s.slots))
+	}
+}
+
+// readerFunc is an io.Reader calling a function
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// --- WRITERS LOCK TEST --- //
+func TestWritersTakeLock(t *testing.T) {
+	bin := buildCLI(t)
+	dbPath, ddlPath := importLines(t, bin, []string{`{"n": 1}`})
+	held, err := LockDatabase(context.Background(), dbPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Unlock()
+	for _, args := range [][]string{
+		{"create-db", "--force", "--db", dbPath, "--schema", ddlPath},
+		{"repair", "--db", dbPath},
+		{"recompact-symbols", "--db", dbPath},
+		{"optimize", "--db", dbPath},
+		{"denormalize", "--db", dbPath},
+		{"import", "--db", ":memory:", "--serialize", dbPath, "--input", writeTempFile(t, "in-*.json", `{"n": 2}`+"\n")},
+	} {
+		out, err := exec.Command(bin, args...).CombinedOutput()
+		if err == nil || !strings.Contains(string(out), "database is being written by another process") {
+			t.Errorf("%s with the lock held: %v\n%s", args[0], err, out)
+		}
+	}
+	if out, err := exec.Command(bin, "repair", "--dry-run", "--db", dbPath).CombinedOutput(); err != nil {
+		t.Errorf("repair --dry-run with the lock held: %v\n%s", err, out)
+	}
+}
+
+// --- SPLIT AND CAT TEST --- //
+func TestSplitCat(t *testing.T) {
+	bin := buildCLI(t)
+	dir := t.TempDir()
+	// Documents of 17, 27, ... 107 bytes with their newline
+	var input string
+	for i := 0; i < 10; i++ {
+		input += fmt.Sprintf(`{"i":%d,"pad":%q}`, i, strings.Repeat("x", i*10)) + "\n"
+	}
+	inPath := filepath.Join(dir, "in.ndjson")
+	if err := os.WriteFile(inPath, []byte(input), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// split returns the parts written, read back and decompressed
+	split := func(out string, args ...string) (parts []string, names []string) {
+		cmd := exec.Command(bin, append([]string{"split", "--input", inPath, "--out", filepath.Join(dir, out)}, args...)...)
+		msg, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("split %v: %v\n%s", args, err, msg)
+		}
+		var n int
+		if _, err := fmt.Sscanf(string(msg), "Wrote %d parts", &n); err != nil {
+			t.Fatalf("split %v: %s", args, msg)
+		}
+		for i := 0; i < n; i++ {
+			name := filepath.Join(dir, fmt.Sprintf(out, i))
+			f, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var r io.Reader = f
+			if strings.HasSuffix(name, ".gz") {
+				if r, err = gzip.NewReader(f); err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+			}
+			b, err := io.ReadAll(r)
+			f.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			parts, names = append(parts, string(b)), append(names, name)
+		}
+		return parts, names
+	}
+	count := func(parts []string) []int {
+		var n []int
+		for _, p := range parts {
+			n = append(n, strings.Count(p, "\n"))
+		}
+		return n
+	}
+
+	if parts, _ := split("lines-%d.ndjson", "--lines", "4"); !reflect.DeepEqual(count(parts), []int{4, 4, 2}) || strings.Join(parts, "") != input {
+		t.Errorf("split --lines 4: %d parts of %v lines", len(parts), count(parts))
+	}
+	// A part ends before the document that would take it over 100 bytes;
+	// the last document, larger on its own, gets a part of its own
+	parts, names := split("bytes-%d.ndjson", "--bytes", "100")
+	if !reflect.DeepEqual(count(parts), []int{3, 1, 1, 1, 1, 1, 1, 1}) || strings.Join(parts, "") != input {
+		t.Errorf("split --bytes 100: %d parts of %v lines", len(parts), count(parts))
+	}
+	gzParts, gzNames := split("gz-%d.ndjson.gz", "--lines", "5")
+	if !reflect.DeepEqual(count(gzParts), []int{5, 5}) || strings.Join(gzParts, "") != input {
+		t.Errorf("split to .gz parts: %d parts of %v lines", len(gzParts), count(gzParts))
+	}
+
+	// cat of the parts reproduces the input exactly, from plain or
+	// compressed parts, to standard output or a compressed file
+	for _, names := range [][]string{names, gzNames} {
+		out, err := exec.Command(bin, append([]string{"cat"}, names...)...).Output()
+		if err != nil || string(out) != input {
+			t.Errorf("cat %v: %v\n%s", names, err, out)
+		}
+	}
+	outPath := filepath.Join(dir, "all.ndjson.gz")
+	if msg, err := exec.Command(bin, append([]string{"cat", "--out", outPath}, gzNames...)...).CombinedOutput(); err != nil {
+		t.Fatalf("cat --out: %v\n%s", err, msg)
+	}
+	f, err := os.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(zr); err != nil || string(b) != input {
+		t.Errorf("cat --out all.ndjson.gz = %q, %v", b, err)
+	}
+
+	// Invalid lines are skipped and reported with their byte offset
+	bad := `{"i":0}` + "\n" + `{"i":1}` + "\n" + `{"i": ` + "\n" + `{"i":3}` + "\n"
+	if err := os.WriteFile(inPath, []byte(bad), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := exec.Command(bin, "split", "--input", inPath, "--out", filepath.Join(dir, "bad-%d.ndjson")).CombinedOutput()
+	if err != nil || !strings.Contains(string(msg), "line 3 (byte offset 16): invalid JSON, skipped") ||
+		!strings.Contains(string(msg), "Wrote 1 parts (1 invalid lines skipped)") {
+		t.Errorf("split of an invalid line: %v\n%s", err, msg)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dir, "bad-0.ndjson")); string(b) != `{"i":0}`+"\n"+`{"i":1}`+"\n"+`{"i":3}`+"\n" {
+		t.Errorf("part without the invalid line = %q", b)
+	}
+	msg, _ = exec.Command(bin, "cat", inPath).CombinedOutput()
+	if !strings.Contains(string(msg), inPath+": line 3 (byte offset 16): invalid JSON, skipped") {
+		t.Errorf("cat of an invalid line:\n%s", msg)
+	}
+}
+
+// --- LIBRARY LOG TEST --- //
+func TestLibraryLog(t *testing.T) {
+	ddl := `CREATE TABLE main (
+  id INTEGER PRIMARY KEY,
+  name TEXT,
+  n INTEGER NOT NULL
+);
+`
+	input := writeTempFile(t, "data_*.json", `{"name": "a", "n": 1}`+"\n"+`{"name": "b", "n": null}`+"\n"+`{"name":`+"\n")
+	patches := writeTempFile(t, "patches_*.json", `{"key": "a", "merge": {"n": null}}`+"\n")
+	defer removeFiles(input, patches)
+
+	// The package writes nothing to stderr, whatever its Log
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	var logged bytes.Buffer
+	for i, log := range []io.Writer{nil, &logged} {
+		dbPath := filepath.Join(t.TempDir(), "data.db")
+		if err := CreateDatabase(dbPath, ddl); err != nil {
+			t.Fatal(err)
+		}
+		dbs := ParseDDL(ddl)
+		dbs.Log = log
+		if err := LoadData(context.Background(), input, dbPath, dbs); err != nil {
+			t.Errorf("load %d: %v", i, err)
+		}
+		if _, failed, err := PatchDocuments(dbPath, dbs, "name", patches); err != nil || failed != 1 {
+			t.Errorf("patch %d: %d failed, %v", i, failed, err)
+		}
+	}
+	var split bytes.Buffer
+	if _, invalid, err := SplitFile(&split, input, filepath.Join(t.TempDir(), "part-%d.ndjson"), 10, 0); err != nil || invalid != 1 {
+		t.Errorf("split: %d invalid, %v", invalid, err)
+	}
+	w.Close()
+	os.Stderr = stderr
+	if out, _ := io.ReadAll(r); len(out) > 0 {
+		t.Errorf("written to stderr:\n%s", out)
+	}
+
+	got := logged.String()
+	for _, want := range []string{"skip JSON line 3", "Load row 2:", "patch line 1:"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("log lacks %q:\n%s", want, got)
+		}
+	}
+	if !strings.Contains(split.String(), "line 3 (byte offset 47): invalid JSON, skipped") {
+		t.Errorf("split log:\n%s", split.String())
+	}
+}
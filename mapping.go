@@ -0,0 +1,193 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Documents are loaded into a schema jsql did not generate, such as a
+// legacy database, by a YAML map of document paths to the columns storing
+// them:
+//
+//	id: orders.order_ref
+//	customer.name: orders.customer_name
+//	status:
+//	  column: orders.status_id
+//	  lookup: statuses.label
+//
+// Every column belongs to the one table the documents are loaded into.
+// Columns declaring a lookup hold the rowid of the row of another table
+// whose key column equals the value, inserted if there is none yet.
+
+// Mapping maps document paths to the columns of an existing table
+type Mapping struct {
+	Table   string
+	Columns map[string]string // column -> dotted document path
+	Lookups map[string]Lookup // column -> the table its values are looked up in
+}
+
+// Lookup finds the row of Table whose Key column holds a value
+type Lookup struct {
+	Table string
+	Key   string
+}
+
+// mappingTarget is the target of a path in a mapping file: table.column,
+// or the column with a lookup table.key
+type mappingTarget struct {
+	Column string `yaml:"column"`
+	Lookup string `yaml:"lookup"`
+}
+
+func (t *mappingTarget) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&t.Column)
+	}
+	type plain mappingTarget
+	return node.Decode((*plain)(t))
+}
+
+var reMappingRef = regexp.MustCompile(`^(\w+)\.(\w+)$`)
+
+// LoadMapping reads a mapping file
+func LoadMapping(path string) (*Mapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var targets map[string]mappingTarget
+	if err := yaml.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	m := &Mapping{Columns: map[string]string{}, Lookups: map[string]Lookup{}}
+	for _, field := range sortedKeys(targets) {
+		target := targets[field]
+		c := reMappingRef.FindStringSubmatch(target.Column)
+		switch {
+		case c == nil:
+			return nil, fmt.Errorf("%s: %s: %q must be table.column", path, field, target.Column)
+		case m.Table != "" && c[1] != m.Table:
+			return nil, fmt.Errorf("%s: %s: %s is not a column of %s, which the other fields are loaded into", path, field, target.Column, m.Table)
+		case c[2] == "id":
+			return nil, fmt.Errorf("%s: %s: row ids are assigned by SQLite", path, field)
+		case m.Columns[c[2]] != "":
+			return nil, fmt.Errorf("%s: %s and %s both map to %s", path, m.Columns[c[2]], field, target.Column)
+		}
+		m.Table = c[1]
+		m.Columns[c[2]] = field
+		if target.Lookup != "" {
+			l := reMappingRef.FindStringSubmatch(target.Lookup)
+			if l == nil {
+				return nil, fmt.Errorf("%s: %s: lookup %q must be table.column", path, field, target.Lookup)
+			}
+			m.Lookups[c[2]] = Lookup{Table: l[1], Key: l[2]}
+		}
+	}
+	if m.Table == "" {
+		return nil, fmt.Errorf("%s: maps no fields", path)
+	}
+	return m, nil
+}
+
+// MappingSchema returns the schema loading documents into the table of m,
+// with the types of the mapped columns read from the database
+func MappingSchema(dbPath string, m *Mapping) (*DatabaseSchema, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	types, err := columnTypes(db, m.Table)
+	if err != nil {
+		return nil, err
+	}
+	t := &TableSchema{Name: m.Table, Fields: map[string]FieldType{}, FKs: map[string]string{}, Lookups: m.Lookups}
+	for col := range m.Columns {
+		typ, ok := types[col]
+		if !ok {
+			return nil, fmt.Errorf("table %s has no column %s", m.Table, col)
+		}
+		t.Fields[col] = typ
+	}
+	for col, l := range m.Lookups {
+		keys, err := columnTypes(db, l.Table)
+		if err != nil {
+			return nil, fmt.Errorf("lookup of %s: %v", col, err)
+		}
+		if _, ok := keys[l.Key]; !ok {
+			return nil, fmt.Errorf("lookup of %s: table %s has no column %s", col, l.Table, l.Key)
+		}
+	}
+	return &DatabaseSchema{
+		Tables:     map[string]*TableSchema{m.Table: t},
+		Views:      map[string]*TableSchema{},
+		TableOrder: []string{m.Table},
+		Root:       m.Table,
+		Mapping:    m,
+	}, nil
+}
+
+// columnTypes returns the declared types of the columns of a table
+func columnTypes(db queryer, table string) (map[string]FieldType, error) {
+	rows, err := db.Query("SELECT name, type FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	types := map[string]FieldType{}
+	for rows.Next() {
+		var col, typ string
+		if err := rows.Scan(&col, &typ); err != nil {
+			return nil, err
+		}
+		types[col] = FieldType(strings.ToUpper(typ))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("database has no table %s", table)
+	}
+	return types, nil
+}
+
+// Apply returns the row of the mapped table holding the values of the
+// mapped fields of obj
+func (m *Mapping) Apply(obj map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return obj
+	}
+	row := make(map[string]interface{}, len(m.Columns))
+	for col, field := range m.Columns {
+		if v, ok := lookupPath(obj, field); ok {
+			row[col] = v
+		}
+	}
+	return row
+}
+
+// rowID returns the rowid of the row holding val in the key column,
+// inserting the row if there is none. A null value has no row.
+func (l Lookup) rowID(tx *sql.Tx, val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	var id int64
+	err := tx.QueryRow(fmt.Sprintf("SELECT rowid FROM %s WHERE %s = ?", quoteIdent(l.Table), quoteIdent(l.Key)), val).Scan(&id)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+	res, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (%s) VALUES (?)", quoteIdent(l.Table), quoteIdent(l.Key)), val)
+	if err != nil {
+		return nil, fmt.Errorf("%s.%s: %v", l.Table, l.Key, err)
+	}
+	return res.LastInsertId()
+}
@@ -0,0 +1,112 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// With --db :memory: a whole import runs in a database held in RAM, which
+// is written to the --serialize file in one go at the end: on network file
+// systems this is much faster than the many small writes of loading. The
+// database is a named SQLite memdb, which every connection opened on its
+// URI shares for as long as one of them stays open.
+
+// MemoryDBPath is the --db value selecting an in-memory database
+const MemoryDBPath = ":memory:"
+
+// memoryDBCount numbers the in-memory databases of the process
+var memoryDBCount atomic.Int64
+
+// MemoryDB is an in-memory database kept alive until it is closed
+type MemoryDB struct {
+	URI  string // opens the database from any connection
+	db   *sql.DB
+	conn *sql.Conn // held open so the database is not freed
+}
+
+// OpenMemoryDB creates an empty in-memory database
+func OpenMemoryDB() (*MemoryDB, error) {
+	uri := fmt.Sprintf("file:/jsql-%d-%d?vfs=memdb", os.Getpid(), memoryDBCount.Add(1))
+	db, err := sql.Open("sqlite3", uri)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &MemoryDB{URI: uri, db: db, conn: conn}, nil
+}
+
+// LoadFile replaces the in-memory database with a copy of the database at
+// path
+func (m *MemoryDB) LoadFile(path string) error {
+	src, err := sql.Open("sqlite3", sqliteURI(path, "mode=ro"))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	conn, err := src.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = copyDatabase(m.conn, conn)
+	return err
+}
+
+// Serialize writes the database to path. The image is written next to path
+// and renamed into place, so path is never left half-written.
+func (m *MemoryDB) Serialize(path string) error {
+	var image []byte
+	err := m.conn.Raw(func(dc any) error {
+		var err error
+		image, err = dc.(*sqlite3.SQLiteConn).Serialize("main")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(image); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := removeJournals(path); err != nil {
+		return err
+	}
+	return replaceFile(tmp.Name(), path)
+}
+
+// Close frees the database
+func (m *MemoryDB) Close() error {
+	m.conn.Close()
+	return m.db.Close()
+}
+
+// sqliteURI returns the URI opening the database at path with the query
+// parameters query, path being a file name or already a URI
+func sqliteURI(path, query string) string {
+	if strings.HasPrefix(path, "file:") {
+		if strings.Contains(path, "?") {
+			return path + "&" + query
+		}
+		return path + "?" + query
+	}
+	return "file:" + path + "?" + query
+}
@@ -0,0 +1,129 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The schema a database was created with is kept in it, as a JSON schema
+// model in the _jsql_meta table, so that a database file describes itself:
+// commands reading one prefer the stored schema to --schema, which may then
+// be left out. Columns added while loading are recorded in the same
+// transaction.
+const metaTable = "_jsql_meta"
+
+// execQueryer is satisfied by both *sql.DB and *sql.Tx
+type execQueryer interface {
+	queryer
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// storeSchema records ddl as the schema of the database
+func storeSchema(db execQueryer, ddl string) error {
+	return storeSchemaIn(SQLite, db, ddl)
+}
+
+// storeSchemaIn records ddl as the schema of a database of dialect d
+func storeSchemaIn(d Dialect, db execQueryer, ddl string) error {
+	model, err := MarshalSchemaModel(ddl)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + metaTable + " (key TEXT PRIMARY KEY, value TEXT)"); err != nil {
+		return err
+	}
+	_, err = db.Exec(d.Upsert(metaTable, []string{"key", "value"}, "key"), "schema", string(model))
+	return err
+}
+
+// loadStoredSchema returns the DDL of the schema stored in the database, if
+// it has one
+func loadStoredSchema(db queryer) (string, bool, error) {
+	var model string
+	err := db.QueryRow("SELECT value FROM " + metaTable + " WHERE key = 'schema'").Scan(&model)
+	// SQLite reports "no such table", PostgreSQL that the relation "does
+	// not exist"
+	if err == sql.ErrNoRows || err != nil && (strings.Contains(err.Error(), "no such table") || strings.Contains(err.Error(), "does not exist")) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	ddl, err := modelDDL([]byte(model))
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %v", metaTable, err)
+	}
+	return ddl, true, nil
+}
+
+// StoredSchema returns the DDL of the schema stored in the database at
+// dbPath, if it has one
+func StoredSchema(dbPath string) (string, bool, error) {
+	db, err := sql.Open("sqlite3", sqliteURI(dbPath, "mode=ro"))
+	if err != nil {
+		return "", false, err
+	}
+	defer db.Close()
+	return loadStoredSchema(db)
+}
+
+// StoredSchemaIn returns the DDL of the schema stored in the database of
+// dialect d that dsn names, if it has one
+func StoredSchemaIn(d Dialect, dsn string) (string, bool, error) {
+	if d == SQLite {
+		return StoredSchema(dsn)
+	}
+	db, err := d.Open(dsn)
+	if err != nil {
+		return "", false, err
+	}
+	defer db.Close()
+	return loadStoredSchema(db)
+}
+
+// appendStoredSchema adds a statement run while loading, such as an ALTER
+// TABLE, to the stored schema
+func appendStoredSchema(db execQueryer, stmt string) error {
+	ddl, ok, err := loadStoredSchema(db)
+	if err != nil || !ok {
+		return err
+	}
+	return storeSchema(db, ddl+"\n"+stmt+"\n")
+}
+
+// mergeStoredSchema stores the schema of a database whose tables of ddl were
+// just replaced: the stored tables and statements not involving them are
+// kept, and those of ddl added
+func mergeStoredSchema(db execQueryer, ddl string) error {
+	old, ok, err := loadStoredSchema(db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return storeSchema(db, ddl)
+	}
+	oldModel, newModel := NewSchemaModel(old), NewSchemaModel(ddl)
+	merged := &SchemaModel{}
+	replaced := map[string]bool{}
+	var names []string
+	for _, t := range newModel.Tables {
+		replaced[t.Name] = true
+		names = append(names, regexp.QuoteMeta(t.Name))
+	}
+	reReplaced := regexp.MustCompile(`\b(` + strings.Join(names, "|") + `)\b`)
+	for _, t := range oldModel.Tables {
+		if !replaced[t.Name] {
+			merged.Tables = append(merged.Tables, t)
+		}
+	}
+	for _, s := range oldModel.Statements {
+		if !reReplaced.MatchString(s) {
+			merged.Statements = append(merged.Statements, s)
+		}
+	}
+	merged.Tables = append(merged.Tables, newModel.Tables...)
+	merged.Statements = append(merged.Statements, newModel.Statements...)
+	return storeSchema(db, merged.DDL())
+}
@@ -0,0 +1,140 @@
+package jsql
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// batchBuckets are the upper bounds, in seconds, of the batch latency histogram
+var batchBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 60}
+
+// loadMetrics collects counters for the loader. They are exposed in the
+// Prometheus text format by the monitor listener (see --metrics-addr).
+type loadMetrics struct {
+	rowsIngested atomic.Int64
+	rowErrors    atomic.Int64
+	parseErrors  atomic.Int64
+	symbolHits   atomic.Int64
+	symbolMisses atomic.Int64
+	pendingRows  atomic.Int64 // rows written but not yet committed
+	lastCommit   atomic.Int64 // unix nanoseconds of the last successful commit
+
+	queuedBatches   atomic.Int64 // serve: batches waiting for or held by the writer
+	queueCapacity   atomic.Int64 // serve: --max-inflight
+	rejectedBatches atomic.Int64 // serve: requests answered with 429
+
+	mu           sync.Mutex
+	batchCounts  []int64 // one per bucket, plus +Inf
+	batchSum     float64
+	batchCount   int64
+	databasePath string
+}
+
+// metrics is the process-wide metrics registry
+var metrics = &loadMetrics{batchCounts: make([]int64, len(batchBuckets)+1)}
+
+// observeBatch records how long a batch (transaction) took to commit
+func (m *loadMetrics) observeBatch(d time.Duration) {
+	secs := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := 0
+	for i < len(batchBuckets) && secs > batchBuckets[i] {
+		i++
+	}
+	m.batchCounts[i]++
+	m.batchSum += secs
+	m.batchCount++
+}
+
+// setDatabase records which database file the size gauge reports on
+func (m *loadMetrics) setDatabase(path string) {
+	m.mu.Lock()
+	m.databasePath = path
+	m.mu.Unlock()
+}
+
+// databaseSize returns the size in bytes of the database and its WAL file
+func (m *loadMetrics) databaseSize() int64 {
+	m.mu.Lock()
+	path := m.databasePath
+	m.mu.Unlock()
+	if path == "" {
+		return 0
+	}
+	var size int64
+	for _, p := range []string{path, path + "-wal"} {
+		if st, err := os.Stat(p); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
+}
+
+// writeTo renders all metrics in the Prometheus text exposition format
+func (m *loadMetrics) writeTo(w io.Writer) {
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("jsql_rows_ingested_total", "Rows successfully inserted into the root table.", m.rowsIngested.Load())
+	counter("jsql_row_errors_total", "Rows that failed to insert.", m.rowErrors.Load())
+	counter("jsql_parse_errors_total", "Input lines that were not valid JSON objects.", m.parseErrors.Load())
+
+	hits, misses := m.symbolHits.Load(), m.symbolMisses.Load()
+	fmt.Fprintf(w, "# HELP jsql_symbol_lookups_total Symbol lookups by result (hit: existing value, miss: new value inserted).\n")
+	fmt.Fprintf(w, "# TYPE jsql_symbol_lookups_total counter\n")
+	fmt.Fprintf(w, "jsql_symbol_lookups_total{result=\"hit\"} %d\n", hits)
+	fmt.Fprintf(w, "jsql_symbol_lookups_total{result=\"miss\"} %d\n", misses)
+	ratio := 0.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	fmt.Fprintf(w, "# HELP jsql_symbol_hit_ratio Fraction of symbol lookups that found an existing value.\n")
+	fmt.Fprintf(w, "# TYPE jsql_symbol_hit_ratio gauge\njsql_symbol_hit_ratio %g\n", ratio)
+
+	m.mu.Lock()
+	fmt.Fprintf(w, "# HELP jsql_batch_duration_seconds Time taken to write and commit a batch.\n")
+	fmt.Fprintf(w, "# TYPE jsql_batch_duration_seconds histogram\n")
+	var cumulative int64
+	for i, le := range batchBuckets {
+		cumulative += m.batchCounts[i]
+		fmt.Fprintf(w, "jsql_batch_duration_seconds_bucket{le=\"%g\"} %d\n", le, cumulative)
+	}
+	cumulative += m.batchCounts[len(batchBuckets)]
+	fmt.Fprintf(w, "jsql_batch_duration_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+	fmt.Fprintf(w, "jsql_batch_duration_seconds_sum %g\n", m.batchSum)
+	fmt.Fprintf(w, "jsql_batch_duration_seconds_count %d\n", m.batchCount)
+	m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP jsql_pending_rows Rows written but not yet committed.\n")
+	fmt.Fprintf(w, "# TYPE jsql_pending_rows gauge\njsql_pending_rows %d\n", m.pendingRows.Load())
+	fmt.Fprintf(w, "# HELP jsql_queued_batches Batches queued for or being written by the serve writer.\n")
+	fmt.Fprintf(w, "# TYPE jsql_queued_batches gauge\njsql_queued_batches %d\n", m.queuedBatches.Load())
+	counter("jsql_rejected_batches_total", "Ingest requests rejected with 429 because the write queue was full.", m.rejectedBatches.Load())
+	fmt.Fprintf(w, "# HELP jsql_database_size_bytes Size of the database file including its WAL.\n")
+	fmt.Fprintf(w, "# TYPE jsql_database_size_bytes gauge\njsql_database_size_bytes %d\n", m.databaseSize())
+}
+
+// MonitorMux returns the /metrics, /healthz and /readyz handlers, whose
+// database size gauge reports on the database file at dbPath
+func MonitorMux(dbPath string) *http.ServeMux {
+	metrics.setDatabase(dbPath)
+	return monitorMux()
+}
+
+// monitorMux returns the metrics and health handlers served on the monitor address
+func monitorMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		metrics.writeTo(w)
+	})
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/readyz", handleReadyz)
+	return mux
+}
@@ -0,0 +1,40 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Readers that only query a database open it read-only and may have SQLite
+// memory-map it (PRAGMA mmap_size), reading pages straight from the page
+// cache instead of through a read syscall each. This pays off for large
+// databases on fast local disks; on network file systems it is unsafe.
+
+// OpenReadOnly opens the database at dbPath for reading, memory-mapping up to
+// mmapSize bytes of it (0: SQLite's default, no mapping)
+func OpenReadOnly(dbPath string, mmapSize int64) (*sql.DB, error) {
+	dsn := sqliteURI(dbPath, "mode=ro")
+	if mmapSize == 0 {
+		return sql.Open("sqlite3", dsn)
+	}
+	drv := &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		_, err := conn.Exec(fmt.Sprintf("PRAGMA mmap_size = %d", mmapSize), nil)
+		return err
+	}}
+	return sql.OpenDB(hookConnector{dsn: dsn, drv: drv}), nil
+}
+
+// hookConnector opens connections through a driver with a ConnectHook,
+// which every connection of the pool runs
+type hookConnector struct {
+	dsn string
+	drv *sqlite3.SQLiteDriver
+}
+
+func (c hookConnector) Connect(context.Context) (driver.Conn, error) { return c.drv.Open(c.dsn) }
+
+func (c hookConnector) Driver() driver.Driver { return c.drv }
@@ -0,0 +1,127 @@
+package jsql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The names of the columns referencing other tables follow a convention,
+// declared in the DDL as a comment directive
+//
+//	-- jsql:naming object=fk_* symbol=*_sym
+//
+// where * stands for the document field: fk_user holds the id of the user
+// object's row, and tag_sym the id of the symbolized tag value. Without the
+// directive the columns are user_id and tag_symbol.
+var reNamingDirective = regexp.MustCompile(`^--\s*jsql:naming((?:\s+\w+=\S+)+)\s*$`)
+
+var reNamingPattern = regexp.MustCompile(`^\w*\*\w*$`)
+
+// Naming is the convention for the names of columns referencing other
+// tables, as patterns in which * stands for the document field. Empty
+// patterns are jsql's own.
+type Naming struct {
+	Object string `json:"object,omitempty"` // column holding a nested object's row id
+	Symbol string `json:"symbol,omitempty"` // column holding a symbolized value's id
+}
+
+const (
+	defaultObjectPattern = "*_id"
+	defaultSymbolPattern = "*_symbol"
+)
+
+// ParseNaming parses a convention given as object=PATTERN and
+// symbol=PATTERN, separated by commas or spaces
+func ParseNaming(spec string) (Naming, error) {
+	var n Naming
+	for _, part := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		switch key, pattern, _ := strings.Cut(part, "="); key {
+		case "object":
+			n.Object = pattern
+		case "symbol":
+			n.Symbol = pattern
+		default:
+			return Naming{}, fmt.Errorf("%q must be object=PATTERN or symbol=PATTERN", part)
+		}
+	}
+	if err := n.check(); err != nil {
+		return Naming{}, err
+	}
+	return n, nil
+}
+
+// check returns an error if a pattern is not a name with one * or both
+// name columns alike
+func (n Naming) check() error {
+	for _, pattern := range []string{n.objectPattern(), n.symbolPattern()} {
+		if pattern == "*" || !reNamingPattern.MatchString(pattern) {
+			return fmt.Errorf("%q: the pattern must be a name with one * standing for the field", pattern)
+		}
+	}
+	if n.objectPattern() == n.symbolPattern() {
+		return fmt.Errorf("object and symbol columns must be named differently")
+	}
+	return nil
+}
+
+func (n Naming) objectPattern() string {
+	if n.Object == "" {
+		return defaultObjectPattern
+	}
+	return n.Object
+}
+
+func (n Naming) symbolPattern() string {
+	if n.Symbol == "" {
+		return defaultSymbolPattern
+	}
+	return n.Symbol
+}
+
+// ObjectColumn returns the column holding the row id of object field
+func (n Naming) ObjectColumn(field string) string {
+	return strings.Replace(n.objectPattern(), "*", field, 1)
+}
+
+// SymbolColumn returns the column holding the symbol id of field
+func (n Naming) SymbolColumn(field string) string {
+	return strings.Replace(n.symbolPattern(), "*", field, 1)
+}
+
+// objectField returns the field whose row id col holds, if it is named as
+// an object column
+func (n Naming) objectField(col string) (string, bool) {
+	return matchPattern(n.objectPattern(), col)
+}
+
+// symbolField returns the field whose symbol id col holds, if it is named
+// as a symbol column
+func (n Naming) symbolField(col string) (string, bool) {
+	return matchPattern(n.symbolPattern(), col)
+}
+
+// matchPattern returns what * stands for in name
+func matchPattern(pattern, name string) (string, bool) {
+	prefix, suffix, _ := strings.Cut(pattern, "*")
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+	return name[len(prefix) : len(name)-len(suffix)], true
+}
+
+// directive returns the jsql:naming directive declaring the convention, or
+// "" for jsql's own
+func (n Naming) directive() string {
+	var parts []string
+	if n.Object != "" && n.Object != defaultObjectPattern {
+		parts = append(parts, "object="+n.Object)
+	}
+	if n.Symbol != "" && n.Symbol != defaultSymbolPattern {
+		parts = append(parts, "symbol="+n.Symbol)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "-- jsql:naming " + strings.Join(parts, " ")
+}
@@ -0,0 +1,172 @@
+package jsql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// Numbers are stored as float64 or int64, and dumped in their shortest
+// form: 10.0 comes back as 10 and 1E-7 as 1e-7. Where the exact bytes
+// matter, analyze, import and dump --number-mode string keep the text of
+// such numbers in numberTextColumn, an optional root-table column holding
+// a JSON object of the original text of every number of the document that
+// would be written differently, by dotted path. The numeric columns are
+// untouched, so queries see the values as ever.
+const numberTextColumn = "_number_text"
+
+// reNumberTextDirective matches the directive marking the root table of a
+// schema analyzed with --number-mode string
+//
+//	-- jsql:number-text main
+var reNumberTextDirective = regexp.MustCompile(`^--\s*jsql:number-text\s+(\w+)\s*$`)
+
+const (
+	NumberModeFloat  = ""       // write numbers as their values format
+	NumberModeString = "string" // write numbers as the text they were loaded from
+)
+
+// numberTexts returns the JSON object of the numbers of a line that would
+// not be written back as they appear in it, or nil if there are none
+func numberTexts(line []byte) (interface{}, error) {
+	var texts map[string]string
+	err := walkTokens(line, nil, func(path string, tok json.Token) {
+		n, ok := tok.(json.Number)
+		if !ok {
+			return
+		}
+		if f, err := n.Float64(); err == nil && string(appendJSONFloat(nil, f)) == n.String() {
+			return
+		}
+		if texts == nil {
+			texts = map[string]string{}
+		}
+		texts[path] = n.String()
+	})
+	if err != nil || texts == nil {
+		return nil, err
+	}
+	js, err := json.Marshal(texts)
+	return string(js), err
+}
+
+// numberTextsOf returns the texts recorded in a _number_text value, or nil
+// if it holds none
+func numberTextsOf(v interface{}) map[string]string {
+	s, ok := v.(string)
+	if !ok {
+		return nil
+	}
+	var texts map[string]string
+	if err := json.Unmarshal([]byte(s), &texts); err != nil || len(texts) == 0 {
+		return nil
+	}
+	return texts
+}
+
+// numberTextHolds reports whether the recorded text of a number is still
+// that of v, which patch or an UPDATE may have changed since
+func numberTextHolds(text string, v interface{}) bool {
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return false
+	}
+	switch vv := v.(type) {
+	case float64:
+		return vv == f
+	case int64:
+		return float64(vv) == f
+	case int:
+		return float64(vv) == f
+	}
+	return false
+}
+
+// encoding/json decodes every number to a float64, which holds integers
+// exactly only up to 2^53: 64-bit ids and nanosecond timestamps lose their
+// last digits. Documents are decoded with decodeJSON instead, which keeps
+// such integers as int64, stored as such in INTEGER columns and written
+// back digit for digit. Other numbers stay float64, as everything else
+// expects. Integers beyond int64 are floats still.
+const maxExactInt = 1 << 53
+
+// decodeJSON decodes data, a single JSON value, into v as json.Unmarshal
+// does, keeping integers float64 cannot hold exactly as int64 in a
+// *map[string]interface{} or *interface{}. Other targets get json.Numbers
+// in their interface{} fields instead, for exactNumbers.
+func decodeJSON(data []byte, v any) error {
+	if !hasLongDigits(data) {
+		// Every number fits a float64
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return fmt.Errorf("invalid data after the JSON value")
+	}
+	var err error
+	switch p := v.(type) {
+	case *map[string]interface{}:
+		_, err = exactNumbers(*p)
+	case *interface{}:
+		*p, err = exactNumbers(*p)
+	}
+	return err
+}
+
+// exactNumbers replaces the json.Numbers of a value decoded with
+// UseNumber, in place within its objects and arrays, by their numberValue
+func exactNumbers(v interface{}) (interface{}, error) {
+	var err error
+	switch vv := v.(type) {
+	case json.Number:
+		return numberValue(vv)
+	case map[string]interface{}:
+		for k, e := range vv {
+			if vv[k], err = exactNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range vv {
+			if vv[i], err = exactNumbers(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+// hasLongDigits reports whether data has a run of as many digits as
+// maxExactInt has, without which the numbers of a document are exact as
+// float64s
+func hasLongDigits(data []byte) bool {
+	run := 0
+	for _, c := range data {
+		if c < '0' || c > '9' {
+			run = 0
+		} else if run++; run >= 16 {
+			return true
+		}
+	}
+	return false
+}
+
+// numberValue returns a number as an int64 if it is an integer float64
+// cannot hold exactly, else as a float64
+func numberValue(n json.Number) (interface{}, error) {
+	if i, err := strconv.ParseInt(n.String(), 10, 64); err == nil && (i > maxExactInt || i < -maxExactInt) {
+		return i, nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return nil, fmt.Errorf("number %s out of range", n)
+	}
+	return f, nil
+}
@@ -0,0 +1,27 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+)
+
+// ordColumn is the optional root-table column numbering the documents in
+// the order they were loaded, across loads: dump --order-by _ord writes
+// them in the order of their input files even where row ids do not, as
+// for documents replaced by patch. Like the provenance columns it is
+// filled by the loader, never from the input.
+const ordColumn = "_ord"
+
+// reOrdDirective matches the directive marking the root table of a schema
+// analyzed with --ord
+//
+//	-- jsql:ord main
+var reOrdDirective = regexp.MustCompile(`^--\s*jsql:ord\s+(\w+)\s*$`)
+
+// nextOrd returns the _ord of the next document loaded into table
+func nextOrd(tx *sql.Tx, table *TableSchema) (int64, error) {
+	var ord int64
+	err := tx.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) + 1 FROM %s", ordColumn, quoteIdent(table.Name))).Scan(&ord)
+	return ord, err
+}
@@ -0,0 +1,161 @@
+package jsql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Schemas for Go ORMs such as GORM follow conventions jsql's own do not:
+// snake_case columns, plural (or singular) table names and created_at and
+// updated_at columns kept by the database. analyze and import generate them
+// on request; the documents keep their fields through renames.
+
+// Tables with timestamps are declared in the DDL as comment directives
+//
+//	-- jsql:timestamps orders
+//
+// next to the orders table's created_at and updated_at columns, which their
+// DEFAULT and a trigger fill unless the documents have such fields. dump
+// leaves them out unless asked for provenance.
+var reTimestampsDirective = regexp.MustCompile(`^--\s*jsql:timestamps\s+(\w+)\s*$`)
+
+// timestampColumns are the columns of a table with timestamps
+var timestampColumns = map[string]bool{
+	"created_at": true,
+	"updated_at": true,
+}
+
+// snakeCase returns name in snake_case: userName and UserName become
+// user_name, HTTPStatus http_status
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var sb strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1])
+			if prevLower || nextLower {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+var reWord = regexp.MustCompile(`^\w+$`)
+
+// addSnakeRenames adds to renames the fields of docs, rows of table, and of
+// their nested objects whose names are not snake_case. Fields whose snake
+// name another field of the document already has keep their name.
+func addSnakeRenames(renames map[string]string, docs []map[string]interface{}, table string) {
+	for _, doc := range docs {
+		for k, v := range doc {
+			if sub, ok := v.(map[string]interface{}); ok {
+				addSnakeRenames(renames, []map[string]interface{}{sub}, k)
+			}
+			snake := snakeCase(k)
+			if _, taken := doc[snake]; snake == k || taken || !reWord.MatchString(k) {
+				continue
+			}
+			path := k
+			if table != "main" {
+				path = table + "." + k
+			}
+			if _, ok := renames[path]; !ok {
+				renames[path] = snake
+			}
+		}
+	}
+}
+
+// inflectTable returns the name of a table in the form asked for by
+// --table-names
+func inflectTable(name, form string) string {
+	switch form {
+	case "singular":
+		return singular(name)
+	case "plural":
+		return plural(name)
+	}
+	return name
+}
+
+// irregularPlurals are the English plurals no suffix rule makes
+var irregularPlurals = map[string]string{
+	"person": "people",
+	"child":  "children",
+	"man":    "men",
+	"woman":  "women",
+	"datum":  "data",
+	"status": "statuses",
+}
+
+// plural returns the plural of an English word, or of the last word of a
+// snake_case name, leaving plurals as they are
+func plural(word string) string {
+	head, last := splitLastWord(word)
+	if p, ok := irregularPlurals[last]; ok {
+		return head + p
+	}
+	if singular(last) != last {
+		return word
+	}
+	switch {
+	case strings.HasSuffix(last, "y") && len(last) > 1 && !strings.ContainsRune("aeiou", rune(last[len(last)-2])):
+		return head + last[:len(last)-1] + "ies"
+	case hasAnySuffix(last, "s", "x", "z", "ch", "sh"):
+		return head + last + "es"
+	}
+	return head + last + "s"
+}
+
+// singular returns the singular of an English word, or of the last word of
+// a snake_case name, leaving singulars as they are
+func singular(word string) string {
+	head, last := splitLastWord(word)
+	for s, p := range irregularPlurals {
+		if last == p {
+			return head + s
+		}
+	}
+	switch {
+	case strings.HasSuffix(last, "ies") && len(last) > 3:
+		return head + last[:len(last)-3] + "y"
+	case hasAnySuffix(last, "sses", "xes", "zes", "ches", "shes"):
+		return head + last[:len(last)-2]
+	case hasAnySuffix(last, "ss", "us", "is") || !strings.HasSuffix(last, "s") || len(last) < 3:
+		return word
+	}
+	return head + last[:len(last)-1]
+}
+
+// splitLastWord splits a snake_case name before its last word
+func splitLastWord(name string) (head, last string) {
+	i := strings.LastIndex(name, "_") + 1
+	return name[:i], name[i:]
+}
+
+func hasAnySuffix(s string, suffixes ...string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTimestamps writes the directive and trigger keeping the timestamps
+// of a table
+func writeTimestamps(sb *strings.Builder, table string) {
+	fmt.Fprintf(sb, "-- jsql:timestamps %s\n\n", table)
+	fmt.Fprintf(sb, `CREATE TRIGGER %[1]s_updated_at AFTER UPDATE ON %[1]s FOR EACH ROW WHEN NEW.updated_at IS OLD.updated_at
+BEGIN
+  UPDATE %[1]s SET updated_at = CURRENT_TIMESTAMP WHERE id = NEW.id;
+END;
+
+`, table)
+}
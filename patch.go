@@ -0,0 +1,533 @@
+package jsql
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped tokens
+func parsePointer(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q", path)
+	}
+	tokens := strings.Split(path[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token; "-" means one past the end
+func arrayIndex(token string, n int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && strings.HasPrefix(token, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > n || (!allowEnd && i == n) {
+		return 0, fmt.Errorf("array index %d out of range", i)
+	}
+	return i, nil
+}
+
+// pointerGet returns the value at tokens
+func pointerGet(doc interface{}, tokens []string) (interface{}, error) {
+	cur := doc
+	for _, t := range tokens {
+		switch c := cur.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("path member %q not found", t)
+			}
+			cur = v
+		case []interface{}:
+			i, err := arrayIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			cur = c[i]
+		default:
+			return nil, fmt.Errorf("cannot descend into %q", t)
+		}
+	}
+	return cur, nil
+}
+
+// pointerUpdate applies fn to the container holding the last token and
+// returns the (possibly reallocated) document
+func pointerUpdate(doc interface{}, tokens []string, fn func(parent interface{}, last string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+	switch c := doc.(type) {
+	case map[string]interface{}:
+		child, ok := c[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("path member %q not found", tokens[0])
+		}
+		updated, err := pointerUpdate(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[tokens[0]] = updated
+		return c, nil
+	case []interface{}:
+		i, err := arrayIndex(tokens[0], len(c), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := pointerUpdate(c[i], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = updated
+		return c, nil
+	}
+	return nil, fmt.Errorf("cannot descend into %q", tokens[0])
+}
+
+// pointerAdd inserts value at tokens (RFC 6902 "add")
+func pointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, last string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[last] = value
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("cannot add %q to a scalar", last)
+	})
+}
+
+// pointerRemove deletes the value at tokens (RFC 6902 "remove")
+func pointerRemove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("cannot remove the whole document")
+	}
+	return pointerUpdate(doc, tokens, func(parent interface{}, last string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[last]; !ok {
+				return nil, fmt.Errorf("path member %q not found", last)
+			}
+			delete(p, last)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(last, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("cannot remove %q from a scalar", last)
+	})
+}
+
+// deepCopy returns an independent copy of a decoded JSON value
+func deepCopy(v interface{}) interface{} {
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(vv))
+		for k, sub := range vv {
+			out[k] = deepCopy(sub)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(vv))
+		for i, sub := range vv {
+			out[i] = deepCopy(sub)
+		}
+		return out
+	}
+	return v
+}
+
+// ApplyJSONPatch applies an RFC 6902 patch to doc
+func ApplyJSONPatch(doc interface{}, patch []PatchOp) (interface{}, error) {
+	for n, op := range patch {
+		tokens, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			doc, err = pointerAdd(doc, tokens, deepCopy(op.Value))
+		case "remove":
+			doc, err = pointerRemove(doc, tokens)
+		case "replace":
+			if _, err = pointerGet(doc, tokens); err == nil {
+				if len(tokens) == 0 {
+					doc = deepCopy(op.Value)
+				} else {
+					doc, err = pointerRemove(doc, tokens)
+					if err == nil {
+						doc, err = pointerAdd(doc, tokens, deepCopy(op.Value))
+					}
+				}
+			}
+		case "move", "copy":
+			var from []string
+			var val interface{}
+			if from, err = parsePointer(op.From); err != nil {
+				break
+			}
+			if val, err = pointerGet(doc, from); err != nil {
+				break
+			}
+			val = deepCopy(val)
+			if op.Op == "move" {
+				if doc, err = pointerRemove(doc, from); err != nil {
+					break
+				}
+			}
+			doc, err = pointerAdd(doc, tokens, val)
+		case "test":
+			var val interface{}
+			if val, err = pointerGet(doc, tokens); err == nil && !jsonEqual(val, op.Value) {
+				err = fmt.Errorf("test failed at %q", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown op %q", op.Op)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("patch op %d (%s %s): %v", n, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// jsonEqual compares two values as JSON, so int64 and float64 agree
+func jsonEqual(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	var na, nb interface{}
+	decodeJSON(ja, &na)
+	decodeJSON(jb, &nb)
+	return reflect.DeepEqual(na, nb)
+}
+
+// ApplyMergePatch applies an RFC 7386 JSON Merge Patch to doc
+func ApplyMergePatch(doc interface{}, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return deepCopy(patch)
+	}
+	dm, ok := doc.(map[string]interface{})
+	if !ok {
+		dm = map[string]interface{}{}
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(dm, k)
+			continue
+		}
+		dm[k] = ApplyMergePatch(dm[k], v)
+	}
+	return dm
+}
+
+// PatchRecord is one line of a patch stream. The diff command's output is
+// accepted as is (op add/remove/change); otherwise a line gives either an
+// RFC 6902 "patch" or an RFC 7386 "merge" for the document with that key.
+type PatchRecord struct {
+	Op    string                 `json:"op"`
+	Key   interface{}            `json:"key"`
+	Value map[string]interface{} `json:"value"`
+	Patch []PatchOp              `json:"patch"`
+	Merge interface{}            `json:"merge"`
+}
+
+// decode decodes a line of a patch stream into rec, keeping the integers
+// of its values as decodeJSON does
+func (rec *PatchRecord) decode(line []byte) error {
+	if err := decodeJSON(line, rec); err != nil {
+		return err
+	}
+	var err error
+	if rec.Key, err = exactNumbers(rec.Key); err != nil {
+		return err
+	}
+	if _, err = exactNumbers(rec.Value); err != nil {
+		return err
+	}
+	if rec.Merge, err = exactNumbers(rec.Merge); err != nil {
+		return err
+	}
+	for i := range rec.Patch {
+		if rec.Patch[i].Value, err = exactNumbers(rec.Patch[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRowTree deletes a row together with the nested-object rows it
+// references. Symbol rows are shared and kept.
+func deleteRowTree(tx *sql.Tx, dbs *DatabaseSchema, table *TableSchema, id int64) error {
+	var children []string
+	for col, ref := range table.FKs {
+		if _, ok := table.Naming.objectField(col); ok && dbs.Tables[ref] != nil {
+			children = append(children, col)
+		}
+	}
+	if len(children) > 0 {
+		vals := make([]interface{}, len(children))
+		ptrs := make([]interface{}, len(children))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		q := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", strings.Join(children, ", "), table.Name)
+		if err := tx.QueryRow(q, id).Scan(ptrs...); err == sql.ErrNoRows {
+			return nil // already gone, e.g. a dangling reference
+		} else if err != nil {
+			return err
+		}
+		for i, col := range children {
+			if childID := toInt64(vals[i]); childID != 0 {
+				if err := deleteRowTree(tx, dbs, dbs.Tables[table.FKs[col]], childID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", table.Name), id)
+	return err
+}
+
+// patcher applies patch records to documents inside one transaction
+type patcher struct {
+	tx     *sql.Tx
+	d      *Dumper
+	key    string
+	ids    map[string]int64 // document key -> root row id, unless key is "id"
+	source string
+}
+
+// PatchDocuments applies a stream of patches to the documents of a database,
+// matching them by the key field ("id" matches the root row id). Each patched
+// document is re-read, patched and re-normalized under its original id.
+func PatchDocuments(dbPath string, dbs *DatabaseSchema, key string, input string) (applied int, failed int, err error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	p := &patcher{tx: tx, d: &Dumper{db: tx, dbs: dbs}, key: key, ids: map[string]int64{}, source: input}
+	if key != "id" {
+		err = p.d.eachRow(dbs.RootTable(), "", nil, func(id int64, obj map[string]interface{}) error {
+			if k, _, ok := keyOf(normalizeDocument(obj), key); ok {
+				p.ids[k] = id
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	in, err := openInput(input)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+	err = eachLine(in, func(line []byte, lineNum int, offset int64) error {
+		var rec PatchRecord
+		if err := rec.decode(line); err != nil {
+			logf(dbs.Log, "patch line %d: %v\n", lineNum, err)
+			failed++
+			return nil
+		}
+		if err := p.applyRecord(rec, lineNum); err != nil {
+			logf(dbs.Log, "patch line %d: %v\n", lineNum, err)
+			failed++
+			return nil
+		}
+		applied++
+		return nil
+	}, func(lineNum int, offset int64) {
+		logf(dbs.Log, "patch line %d (byte offset %d): invalid JSON\n", lineNum, offset)
+		failed++
+	})
+	if err != nil {
+		return applied, failed, err
+	}
+	if _, err := resolveLinks(tx, dbs); err != nil {
+		return applied, failed, err
+	}
+	if err := dbs.Audit.record(tx, int64(applied)); err != nil {
+		return applied, failed, fmt.Errorf("audit: %v", err)
+	}
+	return applied, failed, tx.Commit()
+}
+
+// lookup finds the root row id of the document with key value raw. Keyed
+// by "id", raw must be an integer.
+func (p *patcher) lookup(raw interface{}) (string, int64, bool, error) {
+	k, _, _ := keyOf(map[string]interface{}{"k": raw}, "k")
+	if p.key == "id" {
+		var id int64
+		switch v := raw.(type) {
+		case int64:
+			id = v
+		case float64:
+			if id = int64(v); float64(id) != v {
+				return k, 0, false, fmt.Errorf("key %s is not a row id", k)
+			}
+		default:
+			return k, 0, false, fmt.Errorf("key %s is not a row id", k)
+		}
+		q := fmt.Sprintf("SELECT 1 FROM %s WHERE id = ?", p.d.dbs.Root)
+		if p.d.dbs.RootTable().softDeletes() {
+			q += " AND " + deletedAtColumn + " IS NULL"
+		}
+		var exists int
+		if err := p.tx.QueryRow(q, id).Scan(&exists); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return k, 0, false, err
+		}
+		return k, id, exists == 1, nil
+	}
+	id, ok := p.ids[k]
+	return k, id, ok, nil
+}
+
+// apply applies one line of a patch stream
+// applyRecord applies one patch record in a savepoint of its own, so that
+// a record that fails halfway, such as a replacement violating NOT NULL
+// after the original rows were deleted, leaves its document unchanged
+func (p *patcher) applyRecord(rec PatchRecord, lineNum int) error {
+	if _, err := p.tx.Exec("SAVEPOINT patch"); err != nil {
+		return err
+	}
+	err := p.apply(rec, lineNum)
+	if err != nil {
+		if _, rerr := p.tx.Exec("ROLLBACK TO patch"); rerr != nil {
+			return rerr
+		}
+	}
+	if _, rerr := p.tx.Exec("RELEASE patch"); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (p *patcher) apply(rec PatchRecord, lineNum int) error {
+	dbs := p.d.dbs
+	root := dbs.RootTable()
+	if rec.Key == nil {
+		return fmt.Errorf("missing key")
+	}
+	k, id, exists, err := p.lookup(rec.Key)
+	if err != nil {
+		return err
+	}
+
+	if rec.Op == "add" {
+		if exists {
+			return fmt.Errorf("document %s already exists", k)
+		}
+		if rec.Value == nil {
+			return fmt.Errorf("add without value")
+		}
+		newID, err := insertRow(p.tx, root, rec.Value, dbs, provenance(p.source, lineNum))
+		if err != nil {
+			return err
+		}
+		p.ids[k] = newID
+		return nil
+	}
+	if !exists {
+		return fmt.Errorf("document %s not found", k)
+	}
+	if rec.Op == "remove" {
+		if root.softDeletes() {
+			err = softDeleteRow(p.tx, root, id)
+		} else {
+			err = deleteRowTree(p.tx, dbs, root, id)
+		}
+		if err == nil {
+			delete(p.ids, k)
+		}
+		return err
+	}
+
+	doc, err := p.d.dumpRowByID(root, id)
+	if err != nil {
+		return err
+	}
+	var patched interface{} = normalizeDocument(doc)
+	switch {
+	case rec.Patch != nil:
+		if patched, err = ApplyJSONPatch(patched, rec.Patch); err != nil {
+			return err
+		}
+	case rec.Merge != nil:
+		patched = ApplyMergePatch(patched, rec.Merge)
+	default:
+		return fmt.Errorf("line has neither patch nor merge")
+	}
+	obj, ok := patched.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("patched document is not an object")
+	}
+	// A patched document keeps its row id and its place in the input
+	// order. They are inserted with the new row rather than updated after,
+	// which history triggers would record as a version of their own.
+	prov := provenance(p.source, lineNum)
+	prov["id"] = id
+	if root.Ord {
+		var ord interface{}
+		if err := p.tx.QueryRow(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", ordColumn, quoteIdent(root.Name)), id).Scan(&ord); err != nil {
+			return err
+		}
+		prov[ordColumn] = ord
+	}
+	if err := deleteRowTree(p.tx, dbs, root, id); err != nil {
+		return err
+	}
+	if _, err := insertRow(p.tx, root, obj, dbs, prov); err != nil {
+		return err
+	}
+	if p.key != "id" {
+		if newK, _, ok := keyOf(obj, p.key); ok && newK != k {
+			delete(p.ids, k)
+			p.ids[newK] = id
+		}
+	}
+	return nil
+}
+
+// normalizeDocument round-trips a rehydrated document through JSON so that
+// its values have the types produced by decoding input (float64, ...)
+func normalizeDocument(obj map[string]interface{}) map[string]interface{} {
+	js, _ := json.Marshal(obj)
+	var norm map[string]interface{}
+	decodeJSON(js, &norm)
+	return norm
+}
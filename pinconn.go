@@ -0,0 +1,68 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+)
+
+// pinnedConn runs the queries of one Dumper operation on a single
+// connection, preparing each distinct query once. Reading a document runs
+// a lookup per nested row and symbol while the query of the documents is
+// still open: on the same connection these never wait for a second one
+// from a pool limited by --max-open-conns, and SQLite parses each lookup
+// once per operation rather than once per row.
+type pinnedConn struct {
+	ctx   context.Context
+	conn  *sql.Conn
+	stmts map[string]*sql.Stmt
+}
+
+// pinConn takes a connection from the pool of db until Close. Its queries
+// are interrupted once ctx is done.
+func pinConn(ctx context.Context, db *sql.DB) (*pinnedConn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pinnedConn{ctx: ctx, conn: conn, stmts: map[string]*sql.Stmt{}}, nil
+}
+
+// stmt returns the prepared statement of query
+func (p *pinnedConn) stmt(query string) (*sql.Stmt, error) {
+	if s, ok := p.stmts[query]; ok {
+		return s, nil
+	}
+	s, err := p.conn.PrepareContext(p.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	p.stmts[query] = s
+	return s, nil
+}
+
+func (p *pinnedConn) Query(query string, args ...any) (*sql.Rows, error) {
+	s, err := p.stmt(query)
+	if err != nil {
+		return nil, err
+	}
+	return s.QueryContext(p.ctx, args...)
+}
+
+func (p *pinnedConn) QueryRow(query string, args ...any) *sql.Row {
+	s, err := p.stmt(query)
+	if err != nil {
+		// A Row cannot be made to carry err; running the query unprepared
+		// reports it the usual way
+		return p.conn.QueryRowContext(p.ctx, query, args...)
+	}
+	return s.QueryRowContext(p.ctx, args...)
+}
+
+// Close closes the prepared statements and returns the connection to the
+// pool
+func (p *pinnedConn) Close() error {
+	for _, s := range p.stmts {
+		s.Close()
+	}
+	return p.conn.Close()
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package jsql
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// defaultEditor edits files when $EDITOR is not set
+const defaultEditor = "vi"
+
+// editorCommand runs editor, which may include arguments, on path
+func editorCommand(editor, path string) *exec.Cmd {
+	return exec.Command("sh", "-c", editor+` "$1"`, "sh", path)
+}
+
+// isLockedErr reports whether err is due to the file being open elsewhere,
+// which does not prevent removing or replacing it outside Windows
+func isLockedErr(err error) bool {
+	return false
+}
+
+// tryLockFile takes an exclusive flock of f, reporting false if another
+// process holds one
+func tryLockFile(f *os.File) (bool, error) {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,48 @@
+package jsql
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// defaultEditor edits files when $EDITOR is not set
+const defaultEditor = "notepad"
+
+// editorCommand runs editor, which may include arguments, on path
+func editorCommand(editor, path string) *exec.Cmd {
+	cmd := exec.Command("cmd")
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: `cmd /c ` + editor + ` "` + path + `"`}
+	return cmd
+}
+
+// Windows errors reported for files that another process holds open
+const (
+	errorAccessDenied     syscall.Errno = 5
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// isLockedErr reports whether err is due to the file being open elsewhere
+func isLockedErr(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == errorAccessDenied || errno == errorSharingViolation || errno == errorLockViolation
+}
+
+// tryLockFile takes an exclusive lock of f, reporting false if another
+// process holds one. The locked byte lies past any content, so that the
+// holder recorded in the file stays readable.
+func tryLockFile(f *os.File) (bool, error) {
+	ol := windows.Overlapped{OffsetHigh: 1}
+	err := windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &ol)
+	if errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,116 @@
+package jsql
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// PostSink ships dumped documents to an HTTP endpoint: it is written the
+// JSON lines of a dump and POSTs them as NDJSON bodies of Batch documents,
+// the last one possibly shorter once it is closed. A batch the endpoint
+// fails to take, with a network error, a 429 or a 5xx status, is sent
+// again up to Retries times, waiting twice as long before each attempt.
+type PostSink struct {
+	URL     string
+	Batch   int
+	Retries int
+
+	ctx    context.Context
+	client *http.Client
+	buf    bytes.Buffer
+	lines  int // documents in buf
+}
+
+// postBackoff is how long a failed batch waits before its first retry
+const postBackoff = 500 * time.Millisecond
+
+// maxPostBackoff bounds the wait between retries
+const maxPostBackoff = 30 * time.Second
+
+// NewPostSink returns a sink posting batches of documents to url until ctx
+// is done
+func NewPostSink(ctx context.Context, url string, batch, retries int) *PostSink {
+	return &PostSink{URL: url, Batch: batch, Retries: retries, ctx: ctx, client: &http.Client{Timeout: time.Minute}}
+}
+
+// Write buffers lines, posting every complete batch
+func (p *PostSink) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			p.buf.Write(b)
+			break
+		}
+		p.buf.Write(b[:i+1])
+		b = b[i+1:]
+		if p.lines++; p.lines == p.Batch {
+			if err := p.flush(); err != nil {
+				return n - len(b), err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close posts the documents of the last, partial batch
+func (p *PostSink) Close() error {
+	if p.buf.Len() == 0 {
+		return nil
+	}
+	return p.flush()
+}
+
+// flush posts the buffered documents
+func (p *PostSink) flush() error {
+	defer func() {
+		p.buf.Reset()
+		p.lines = 0
+	}()
+	wait := postBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.post(p.buf.Bytes())
+		if err == nil {
+			return nil
+		}
+		if _, retry := err.(retryablePostError); !retry || attempt == p.Retries {
+			return err
+		}
+		select {
+		case <-time.After(wait):
+		case <-p.ctx.Done():
+			return p.ctx.Err()
+		}
+		wait = min(2*wait, maxPostBackoff)
+	}
+}
+
+// retryablePostError is a failed POST worth sending again
+type retryablePostError struct{ error }
+
+// post sends one batch
+func (p *PostSink) post(body []byte) error {
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return retryablePostError{err}
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("POST %s: %s: %s", p.URL, resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return retryablePostError{err}
+	}
+	return err
+}
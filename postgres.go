@@ -0,0 +1,225 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Postgres is the dialect of PostgreSQL. Its connections take jsql's ?
+// placeholders, rewritten as $1, $2... on the way to the server. The
+// tables it creates hold the schema's types as their PostgreSQL
+// counterparts, with ids from an identity column; JSON columns are TEXT,
+// as they may hold plain strings.
+var Postgres Dialect = postgresDialect{}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string { return "postgres" }
+
+func (d postgresDialect) Open(dsn string) (*sql.DB, error) {
+	c, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(rebindConnector{Connector: c, placeholder: d.Placeholder}), nil
+}
+
+func (postgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (postgresDialect) Returning() bool { return true }
+
+// postgresTypes are the PostgreSQL types of the schema's own
+var postgresTypes = map[FieldType]string{
+	TypeInt:     "BIGINT",
+	TypeReal:    "DOUBLE PRECISION",
+	TypeText:    "TEXT",
+	TypeBool:    "BOOLEAN",
+	TypeJSON:    "TEXT",
+	"BLOB":      "BYTEA",
+	TypeUTCTime: "DOUBLE PRECISION",
+	TypeGeoJSON: "TEXT",
+	TypeWKB:     "BYTEA",
+}
+
+func (postgresDialect) ColumnType(t FieldType) string {
+	if typ, ok := postgresTypes[FieldType(strings.ToUpper(string(t)))]; ok {
+		return typ
+	}
+	return string(t)
+}
+
+// rePostgresStatement matches the statements of a schema, other than its
+// tables, that PostgreSQL takes as they are written
+var rePostgresStatement = regexp.MustCompile(`(?i)^CREATE\s+(UNIQUE\s+INDEX|INDEX|VIEW)\b`)
+
+// CreateDDL translates the tables of the schema column by column. Its
+// other statements must be indexes or views: triggers and virtual tables
+// are SQLite's own.
+func (d postgresDialect) CreateDDL(ddl string) (string, error) {
+	m := NewSchemaModel(ddl)
+	var sb strings.Builder
+	for _, t := range m.Tables {
+		if err := checkPostgresName(t.Name); err != nil {
+			return "", fmt.Errorf("table %v", err)
+		}
+		defs := make([]string, 0, len(t.Columns)+len(t.Constraints))
+		for _, c := range t.Columns {
+			if err := checkPostgresName(c.Name); err != nil {
+				return "", fmt.Errorf("column %s.%v", t.Name, err)
+			}
+			defs = append(defs, quoteIdent(c.Name)+" "+d.columnDefinition(c))
+		}
+		defs = append(defs, t.Constraints...)
+		for _, fk := range t.ForeignKeys {
+			defs = append(defs, fk.definition())
+		}
+		fmt.Fprintf(&sb, "CREATE TABLE %s (\n  %s\n);\n\n", quoteIdent(t.Name), strings.Join(defs, ",\n  "))
+	}
+	for _, s := range m.Statements {
+		if !rePostgresStatement.MatchString(s) {
+			first, _, _ := strings.Cut(s, "\n")
+			return "", fmt.Errorf("postgres has no equivalent of %s", first)
+		}
+		sb.WriteString(s + "\n\n")
+	}
+	return sb.String(), nil
+}
+
+// columnDefinition returns the definition of a column after its name, its
+// type translated
+func (d postgresDialect) columnDefinition(c ColumnModel) string {
+	if c.Name == "id" && c.PrimaryKey && c.Type == TypeInt {
+		return "BIGINT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY"
+	}
+	def := c.definition()
+	typ := reTypeName.FindString(def)
+	return d.ColumnType(FieldType(typ)) + def[len(typ):]
+}
+
+// reTypeName matches the type a column definition starts with
+var reTypeName = regexp.MustCompile(`^\w+`)
+
+// checkPostgresName reports a name the schema leaves unquoted that
+// PostgreSQL would read otherwise than SQLite: one it folds to lower case,
+// or one of its reserved words
+func checkPostgresName(name string) error {
+	if quoteIdent(name) != name {
+		return nil
+	}
+	if strings.ToLower(name) != name {
+		return fmt.Errorf("%s: postgres folds unquoted names to lower case; store the field under a lower-case column with analyze --rename", name)
+	}
+	if postgresKeywords[strings.ToUpper(name)] {
+		return fmt.Errorf("%s: a reserved word in postgres; store the field under another column with analyze --rename", name)
+	}
+	return nil
+}
+
+// postgresKeywords are the words PostgreSQL reserves that SQLite does not
+var postgresKeywords = map[string]bool{}
+
+func init() {
+	for _, kw := range strings.Fields(`ANALYSE ANY ARRAY ASYMMETRIC AUTHORIZATION BINARY BOTH
+		COLLATION CONCURRENTLY CURRENT_CATALOG CURRENT_ROLE CURRENT_SCHEMA
+		CURRENT_USER FALSE FETCH FREEZE GRANT ILIKE LATERAL LEADING LOCALTIME
+		LOCALTIMESTAMP ONLY OVERLAPS PLACING RETURNING SESSION_USER SIMILAR SOME
+		SYMMETRIC SYSTEM_USER TABLESAMPLE TRAILING TRUE USER VARIADIC VERBOSE`) {
+		postgresKeywords[kw] = true
+	}
+}
+
+func (postgresDialect) InsertIgnore(table string, cols []string, rows int) string {
+	return "INSERT INTO " + valuesClause(table, cols, rows) + " ON CONFLICT DO NOTHING"
+}
+
+func (postgresDialect) Upsert(table string, cols []string, key string) string {
+	var set []string
+	for _, col := range cols {
+		if col != key {
+			set = append(set, quoteIdent(col)+" = EXCLUDED."+quoteIdent(col))
+		}
+	}
+	return fmt.Sprintf("INSERT INTO %s ON CONFLICT (%s) DO UPDATE SET %s", valuesClause(table, cols, 1), quoteIdent(key), strings.Join(set, ", "))
+}
+
+func (postgresDialect) AbortsOnError() bool { return true }
+
+// rebindConnector opens connections rewriting the placeholders of every
+// statement
+type rebindConnector struct {
+	driver.Connector
+	placeholder func(int) string
+}
+
+func (c rebindConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rebindConn{Conn: conn, placeholder: c.placeholder}, nil
+}
+
+// rebindConn is a connection rewriting placeholders, passing everything
+// else on to the driver's
+type rebindConn struct {
+	driver.Conn
+	placeholder func(int) string
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.Conn.Prepare(rebind(query, c.placeholder))
+}
+
+func (c rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		return p.PrepareContext(ctx, rebind(query, c.placeholder))
+	}
+	return c.Prepare(query)
+}
+
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if e, ok := c.Conn.(driver.ExecerContext); ok {
+		return e.ExecContext(ctx, rebind(query, c.placeholder), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if q, ok := c.Conn.(driver.QueryerContext); ok {
+		return q.QueryContext(ctx, rebind(query, c.placeholder), args)
+	}
+	return nil, driver.ErrSkip
+}
+
+func (c rebindConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c rebindConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if v, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return v.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c rebindConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c rebindConn) IsValid() bool {
+	v, ok := c.Conn.(driver.Validator)
+	return !ok || v.IsValid()
+}
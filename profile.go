@@ -0,0 +1,153 @@
+package jsql
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed profiles/*.yaml
+var builtinProfiles embed.FS
+
+// Profile presets schema inference for a known dataset shape. Fields are
+// dotted document paths: "actor.login" is the login column of the actor
+// table, "type" a column of the root table.
+type Profile struct {
+	Description string               `yaml:"description"`
+	Types       map[string]FieldType `yaml:"types"`      // column types overriding inference; JSON keeps an object in one column
+	Symbols     []string             `yaml:"symbols"`    // always symbolized, wherever the field name occurs
+	NoSymbols   []string             `yaml:"no_symbols"` // never symbolized
+	Keys        []string             `yaml:"keys"`       // fields identifying a row: UNIQUE indexes
+	Indexes     []string             `yaml:"indexes"`    // fields to index
+}
+
+// LoadProfile reads a YAML profile file or, if name is not a file, the
+// built-in profile of that name
+func LoadProfile(name string) (*Profile, error) {
+	data, err := os.ReadFile(name)
+	if os.IsNotExist(err) && !strings.ContainsAny(name, `/\.`) {
+		data, err = builtinProfiles.ReadFile("profiles/" + name + ".yaml")
+		if err != nil {
+			return nil, fmt.Errorf("no profile file or built-in profile %q (built-in: %s)", name, strings.Join(BuiltinProfiles(), ", "))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Profile
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	for field, typ := range p.Types {
+		if p.Types[field], err = ParseFieldType(string(typ)); err != nil {
+			return nil, fmt.Errorf("%s: field %s: %v", name, field, err)
+		}
+	}
+	return &p, nil
+}
+
+// ParseFieldType parses a column type a profile may force, in any case
+func ParseFieldType(s string) (FieldType, error) {
+	switch typ := FieldType(strings.ToUpper(s)); typ {
+	case TypeInt, TypeReal, TypeText, TypeBool, TypeJSON, TypeGeoJSON, TypeWKB:
+		return typ, nil
+	}
+	return "", fmt.Errorf("unknown type %q", s)
+}
+
+// BuiltinProfiles returns the names of the embedded profiles
+func BuiltinProfiles() []string {
+	entries, _ := builtinProfiles.ReadDir("profiles")
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), path.Ext(e.Name())))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileColumn splits a dotted field path into the generated table and
+// column it ends up in
+func profileColumn(field string) (table, col string) {
+	parts := strings.Split(field, ".")
+	if len(parts) == 1 {
+		return "main", parts[0]
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
+
+// typeOverrides returns the profile's types keyed by "table.column"
+func (p *Profile) typeOverrides() map[string]FieldType {
+	if p == nil {
+		return nil
+	}
+	out := map[string]FieldType{}
+	for field, typ := range p.Types {
+		table, col := profileColumn(field)
+		out[table+"."+col] = typ
+	}
+	return out
+}
+
+// symbolChoices returns the field names the profile forces to be or not to
+// be symbolized. Keys and fields overridden to a non-text type are never
+// symbolized.
+func (p *Profile) symbolChoices() (force, never map[string]bool) {
+	force, never = map[string]bool{}, map[string]bool{}
+	if p == nil {
+		return
+	}
+	for _, f := range p.Symbols {
+		_, col := profileColumn(f)
+		force[col] = true
+	}
+	for _, f := range append(p.NoSymbols, p.Keys...) {
+		_, col := profileColumn(f)
+		never[col] = true
+	}
+	for f, typ := range p.Types {
+		if typ != TypeText && typ != TypeJSON {
+			_, col := profileColumn(f)
+			never[col] = true
+		}
+	}
+	for col := range never {
+		delete(force, col)
+	}
+	return
+}
+
+// writeIndexes emits the profile's key and index hints for the columns
+// present in schema, named after naming
+func (p *Profile) writeIndexes(sb *strings.Builder, schema map[string]*TableSchema, symbolic func(string) bool, tableName func(string) string, naming Naming) {
+	if p == nil {
+		return
+	}
+	write := func(fields []string, unique, suffix string) {
+		for _, f := range fields {
+			table, col := profileColumn(f)
+			ts := schema[table]
+			if ts == nil {
+				continue // not in the sample
+			}
+			column := col
+			switch {
+			case symbolic(col):
+				column = naming.SymbolColumn(col)
+			case ts.Fields[col] == "" && ts.Fields[col+"_id"] != "":
+				column = naming.ObjectColumn(col)
+			case ts.Fields[col] == "":
+				continue
+			}
+			name := tableName(table) + "_" + col + suffix
+			fmt.Fprintf(sb, "CREATE %sINDEX %s ON %s (%s);\n\n", unique, name, tableName(table), column)
+		}
+	}
+	write(p.Keys, "UNIQUE ", "_key")
+	write(p.Indexes, "", "_idx")
+}
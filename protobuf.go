@@ -0,0 +1,164 @@
+package jsql
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// ProtoSource reads a file of length-delimited protobuf messages, each
+// preceded by its size as a varint (writeDelimitedTo in Java, protodelim in
+// Go). Messages become documents with the fields' proto names as keys.
+type ProtoSource struct {
+	Path    string
+	Message protoreflect.MessageDescriptor
+}
+
+func (p *ProtoSource) String() string {
+	return p.Path
+}
+
+// LoadProtoMessage finds a message type in a descriptor set, as written by
+// protoc --include_imports --descriptor_set_out
+func LoadProtoMessage(path, name string) (protoreflect.MessageDescriptor, error) {
+	if name == "" {
+		return nil, fmt.Errorf("the message type (--message) is required")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s: message %s: %v", path, name, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s: %s is not a message type", path, name)
+	}
+	return md, nil
+}
+
+// Export writes each message as a JSON line
+func (p *ProtoSource) Export(w io.Writer, limit int) error {
+	f, err := openInputFile(p.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for n := 1; limit <= 0 || n <= limit; n++ {
+		msg := dynamicpb.NewMessage(p.Message)
+		err := protodelim.UnmarshalFrom(r, msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: message %d: %v", p.Path, n, err)
+		}
+		if err := enc.Encode(protoDocument(msg)); err != nil {
+			return fmt.Errorf("%s: message %d: %v", p.Path, n, err)
+		}
+	}
+	return bw.Flush()
+}
+
+// protoDocument converts a message to a document. Fields without presence
+// keep their zero values, as they are indistinguishable from being set;
+// unset optional, oneof, message and repeated fields are left out.
+func protoDocument(m protoreflect.Message) map[string]interface{} {
+	doc := map[string]interface{}{}
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !m.Has(fd) && (fd.HasPresence() || fd.IsList() || fd.IsMap()) {
+			continue
+		}
+		v := m.Get(fd)
+		switch {
+		case fd.IsList():
+			list := v.List()
+			vals := make([]interface{}, list.Len())
+			for j := range vals {
+				vals[j] = protoValue(fd, list.Get(j))
+			}
+			doc[string(fd.Name())] = vals
+		case fd.IsMap():
+			vals := map[string]interface{}{}
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				vals[k.String()] = protoValue(fd.MapValue(), v)
+				return true
+			})
+			doc[string(fd.Name())] = vals
+		default:
+			doc[string(fd.Name())] = protoValue(fd, v)
+		}
+	}
+	return doc
+}
+
+// protoValue converts a single value the way protojson does, except that
+// 64-bit integers stay numbers
+func protoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		// Well-known types (Timestamp, Duration, Struct, ...) have their
+		// own JSON forms
+		if strings.HasPrefix(string(fd.Message().FullName()), "google.protobuf.") {
+			js, err := protojson.Marshal(v.Message().Interface())
+			if err == nil {
+				return json.RawMessage(js)
+			}
+		}
+		return protoDocument(v.Message())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return int32(v.Enum())
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.StringKind:
+		return v.String()
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		f := v.Float()
+		switch {
+		case math.IsNaN(f):
+			return "NaN"
+		case math.IsInf(f, 1):
+			return "Infinity"
+		case math.IsInf(f, -1):
+			return "-Infinity"
+		}
+		return f
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return v.Uint()
+	default:
+		return v.Int()
+	}
+}
@@ -0,0 +1,175 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Rows that fail to load are kept, with --quarantine, in the _quarantine
+// table of the database itself, so failed data travels with the database.
+// retry-quarantine loads them again once the schema or the data is fixed.
+const quarantineTable = "_quarantine"
+
+const quarantineDDL = `CREATE TABLE IF NOT EXISTS _quarantine (
+  id INTEGER PRIMARY KEY,
+  root TEXT,
+  raw TEXT,
+  error TEXT,
+  source TEXT,
+  line INTEGER,
+  quarantined_at TEXT
+)`
+
+// quarantine records a row that failed to load into the root table, if
+// quarantining is enabled
+func (ds *DatabaseSchema) quarantine(tx *sql.Tx, raw []byte, loadErr error, source string, line int) error {
+	if !ds.Quarantine {
+		return nil
+	}
+	if _, err := tx.Exec(quarantineDDL); err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	_, err := tx.Exec("INSERT INTO "+quarantineTable+" (root, raw, error, source, line, quarantined_at) VALUES (?, ?, ?, ?, ?, ?)",
+		ds.Root, string(raw), loadErr.Error(), source, line, time.Now().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	return nil
+}
+
+// insertDocument enriches a top-level document and inserts it into the
+// root table. With quarantining enabled, or on an engine where a failed
+// statement aborts the transaction, a failing document leaves no partial
+// rows behind, in a savepoint of its own.
+func (ds *DatabaseSchema) insertDocument(tx *sql.Tx, obj map[string]interface{}, prov map[string]interface{}) error {
+	rows, err := ds.prepareRows(obj)
+	if err != nil {
+		return err
+	}
+	return ds.insertPrepared(tx, rows, prov)
+}
+
+// insertPrepared inserts the rows prepared from a top-level document like
+// insertDocument
+func (ds *DatabaseSchema) insertPrepared(tx *sql.Tx, rows []map[string]interface{}, prov map[string]interface{}) error {
+	if !ds.Quarantine && !ds.dialect().AbortsOnError() {
+		return ds.insertRootRows(tx, rows, prov)
+	}
+	if _, err := tx.Exec("SAVEPOINT document"); err != nil {
+		return err
+	}
+	err := ds.insertRootRows(tx, rows, prov)
+	if err != nil {
+		if _, rerr := tx.Exec("ROLLBACK TO document"); rerr != nil {
+			return rerr
+		}
+	}
+	if _, rerr := tx.Exec("RELEASE document"); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// prepareRows transforms, enriches, filters and maps a document, returning
+// the rows of the root table it is loaded as: one per element if the table
+// explodes an array of the document, none if a transform drops it
+func (ds *DatabaseSchema) prepareRows(obj map[string]interface{}) ([]map[string]interface{}, error) {
+	obj, keep, err := ds.Transform.Apply(obj)
+	if err != nil || !keep {
+		return nil, err
+	}
+	if err := enrichDocument(ds, obj); err != nil {
+		return nil, err
+	}
+	obj = ds.Mapping.Apply(ds.Filter.Apply(obj))
+	return ExplodeRecord(obj, ds.RootTable().Explode), nil
+}
+
+// insertRootRows inserts the rows prepared from a document into the root
+// table
+func (ds *DatabaseSchema) insertRootRows(tx *sql.Tx, rows []map[string]interface{}, prov map[string]interface{}) error {
+	root := ds.RootTable()
+	for _, doc := range rows {
+		if _, err := insertRow(tx, root, doc, ds, prov); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RetryQuarantine loads the quarantined rows of the root table again,
+// removing those that now load and updating the error of the others
+func RetryQuarantine(dbPath string, dbs *DatabaseSchema) (loaded, failed int, err error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(quarantineDDL); err != nil {
+		return 0, 0, err
+	}
+
+	type quarantined struct {
+		id     int64
+		raw    string
+		source string
+		line   int
+	}
+	rows, err := tx.Query("SELECT id, raw, source, line FROM "+quarantineTable+" WHERE root = ? ORDER BY id", dbs.Root)
+	if err != nil {
+		return 0, 0, err
+	}
+	var pending []quarantined
+	for rows.Next() {
+		var q quarantined
+		if err := rows.Scan(&q.id, &q.raw, &q.source, &q.line); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		pending = append(pending, q)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	// Rows failing again stay where they are, so no second quarantine
+	retry := *dbs
+	retry.Quarantine = true
+	for _, q := range pending {
+		var obj map[string]interface{}
+		loadErr := dbs.decodeDocument([]byte(q.raw), &obj)
+		if loadErr == nil {
+			loadErr = retry.insertDocument(tx, obj, provenance(q.source, q.line))
+		}
+		if loadErr != nil {
+			logf(dbs.Log, "%s line %d: %v\n", q.source, q.line, loadErr)
+			if _, err := tx.Exec("UPDATE "+quarantineTable+" SET error = ? WHERE id = ?", loadErr.Error(), q.id); err != nil {
+				return 0, 0, err
+			}
+			failed++
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM "+quarantineTable+" WHERE id = ?", q.id); err != nil {
+			return 0, 0, err
+		}
+		loaded++
+	}
+	pendingLinks, err := resolveLinks(tx, dbs)
+	if err != nil {
+		return 0, 0, err
+	}
+	for ref, n := range pendingLinks {
+		logf(dbs.Log, "%s: %d references without a match yet\n", ref, n)
+	}
+	if err := dbs.Audit.record(tx, int64(loaded)); err != nil {
+		return 0, 0, fmt.Errorf("audit: %v", err)
+	}
+	return loaded, failed, tx.Commit()
+}
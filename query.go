@@ -0,0 +1,100 @@
+package jsql
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Query runs an SQL query against the database and calls fn with each row
+// it returns as a document, its columns rehydrated the way dump does: a
+// symbol or object column of a table of the schema, found by its name,
+// gives the value or sub-document it references under the field it holds,
+// and JSON text is parsed. Other columns, such as expressions, are kept as
+// they are under their names. Where several tables have a column of the
+// name, the root table's, then the first in table order, decides.
+func (d *Dumper) Query(query string, args []any, fn func(map[string]interface{}) error) error {
+	if pool, ok := d.db.(*sql.DB); ok {
+		conn, err := pinConn(d.ctx, pool)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		pd := *d
+		pd.db = conn
+		return pd.Query(query, args, fn)
+	}
+	if d.cache == nil {
+		pd := *d
+		pd.cache = &dumpCache{symbols: map[string]map[int64]interface{}{}, refs: map[*TableSchema]tableRefs{}}
+		return pd.Query(query, args, fn)
+	}
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return err
+	}
+	table := d.queryTable(columns, types)
+	// Columns dump leaves out of documents are wanted when selected
+	d.opts.WithProvenance = true
+	vals := make([]interface{}, len(columns))
+	valPtrs := make([]interface{}, len(columns))
+	for i := range columns {
+		valPtrs[i] = &vals[i]
+	}
+	for rows.Next() {
+		clear(vals)
+		if err := rows.Scan(valPtrs...); err != nil {
+			return err
+		}
+		obj, err := d.dumpRowValueSet(table, columns, vals)
+		if err != nil {
+			return err
+		}
+		for i, col := range columns {
+			if col == "id" && vals[i] != nil {
+				obj[col] = vals[i]
+			}
+		}
+		if err := fn(obj); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// queryTable describes the result columns of a query as a table, taking
+// the type and reference of each from the schema's tables having a column
+// of its name, or else the type it is declared with
+func (d *Dumper) queryTable(columns []string, types []*sql.ColumnType) *TableSchema {
+	root := d.dbs.RootTable()
+	table := &TableSchema{Name: "query", Fields: map[string]FieldType{}, FKs: map[string]string{}, Naming: root.Naming}
+	tables := []*TableSchema{root}
+	for _, name := range d.dbs.TableOrder {
+		if t := d.dbs.Tables[name]; t != root {
+			tables = append(tables, t)
+		}
+	}
+	for i, col := range columns {
+		for _, t := range tables {
+			if typ, ok := t.Fields[col]; ok {
+				table.Fields[col] = typ
+				if ref := t.FKs[col]; ref != "" {
+					table.FKs[col] = ref
+				}
+				break
+			}
+		}
+		if _, ok := table.Fields[col]; !ok {
+			table.Fields[col] = FieldType(strings.ToUpper(types[i].DatabaseTypeName()))
+		}
+	}
+	return table
+}
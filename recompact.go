@@ -0,0 +1,122 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Recompaction reports the renumbering of one symbol table
+type Recompaction struct {
+	Table   string
+	Symbols int64 // values in the table
+	Moved   int64 // values whose id changed
+}
+
+// symbolReferences returns the "table.column" pairs referencing each symbol
+// table of dbs
+func symbolReferences(dbs *DatabaseSchema) map[string][]string {
+	refs := map[string][]string{}
+	for _, name := range dbs.TableOrder {
+		for col, sym := range dbs.Tables[name].FKs {
+			if _, ok := dbs.Tables[name].Naming.symbolField(col); ok && dbs.Tables[sym] != nil {
+				refs[sym] = append(refs[sym], name+"."+col)
+			}
+		}
+	}
+	for _, cols := range refs {
+		sort.Strings(cols)
+	}
+	return refs
+}
+
+// RecompactSymbols renumbers every symbol table by descending reference
+// count, so the most used values get the smallest ids: SQLite stores small
+// integers in fewer bytes, and hot values end up next to each other in the
+// table and its index. All referencing columns are updated in the same
+// transaction. Tables with hashed ids keep them.
+func RecompactSymbols(dbPath string, dbs *DatabaseSchema) ([]Recompaction, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	refs := symbolReferences(dbs)
+	syms := make([]string, 0, len(refs))
+	for sym := range refs {
+		syms = append(syms, sym)
+	}
+	sort.Strings(syms)
+	var done []Recompaction
+	for _, sym := range syms {
+		if dbs.Tables[sym].HashIDs {
+			continue
+		}
+		r, err := recompactSymbolTable(tx, sym, refs[sym])
+		if err != nil {
+			return nil, fmt.Errorf("recompact %s: %v", sym, err)
+		}
+		done = append(done, r)
+	}
+	var moved int64
+	for _, r := range done {
+		moved += r.Moved
+	}
+	if err := dbs.Audit.record(tx, moved); err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
+	}
+	return done, tx.Commit()
+}
+
+func recompactSymbolTable(tx *sql.Tx, sym string, cols []string) (Recompaction, error) {
+	r := Recompaction{Table: sym}
+	counts := make([]string, len(cols))
+	for i, tc := range cols {
+		table, col, _ := strings.Cut(tc, ".")
+		counts[i] = fmt.Sprintf("SELECT %s AS id FROM %s WHERE %s IS NOT NULL", col, table, col)
+	}
+	stmts := []string{
+		"DROP TABLE IF EXISTS temp._jsql_remap",
+		"CREATE TEMP TABLE _jsql_remap (old INTEGER PRIMARY KEY, new INTEGER NOT NULL)",
+		fmt.Sprintf(`INSERT INTO _jsql_remap (old, new)
+SELECT s.id, ROW_NUMBER() OVER (ORDER BY COUNT(r.id) DESC, s.id)
+FROM %s s LEFT JOIN (%s) r ON r.id = s.id
+GROUP BY s.id`, sym, strings.Join(counts, " UNION ALL ")),
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return r, err
+		}
+	}
+	if err := tx.QueryRow("SELECT COUNT(*), COUNT(*) FILTER (WHERE old != new) FROM _jsql_remap").Scan(&r.Symbols, &r.Moved); err != nil {
+		return r, err
+	}
+	if r.Moved > 0 {
+		for _, tc := range cols {
+			table, col, _ := strings.Cut(tc, ".")
+			_, err := tx.Exec(fmt.Sprintf(`UPDATE %[1]s SET %[2]s = (SELECT new FROM _jsql_remap WHERE old = %[1]s.%[2]s)
+WHERE %[2]s IN (SELECT old FROM _jsql_remap WHERE old != new)`, table, col))
+			if err != nil {
+				return r, err
+			}
+		}
+		// Through negative ids, so no two rows share an id midway
+		for _, stmt := range []string{
+			fmt.Sprintf("UPDATE %[1]s SET id = -(SELECT new FROM _jsql_remap WHERE old = %[1]s.id)", sym),
+			fmt.Sprintf("UPDATE %s SET id = -id", sym),
+		} {
+			if _, err := tx.Exec(stmt); err != nil {
+				return r, err
+			}
+		}
+	}
+	_, err := tx.Exec("DROP TABLE temp._jsql_remap")
+	return r, err
+}
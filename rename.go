@@ -0,0 +1,124 @@
+package jsql
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Renamed columns are declared in the DDL as comment directives
+//
+//	-- jsql:rename user.name -> username
+//
+// next to a column username (or username_symbol, username_id) of the user
+// table. The loader stores the documents' name field in it and dump turns
+// it back into name, so the JSON keys round-trip exactly.
+var reRenameDirective = regexp.MustCompile(`^--\s*jsql:rename\s+(\w+)\.(\w+)\s*->\s*(\w+)\s*$`)
+
+var reRename = regexp.MustCompile(`^(\w+(?:\.\w+)*)=(\w+)$`)
+
+// ParseRenames parses --rename field=column arguments. Fields are dotted
+// paths like profile fields: user.name is the name field of the user table,
+// a single segment a field of the root table.
+func ParseRenames(specs []string) (map[string]string, error) {
+	renames := map[string]string{}
+	for _, spec := range specs {
+		m := reRename.FindStringSubmatch(spec)
+		if m == nil {
+			return nil, fmt.Errorf("%q must be field=column", spec)
+		}
+		renames[m[1]] = m[2]
+	}
+	return renames, nil
+}
+
+// renamesByTable keys renames by the table the field belongs to, as named
+// before renaming, then by field
+func renamesByTable(renames map[string]string) map[string]map[string]string {
+	out := map[string]map[string]string{}
+	for path, col := range renames {
+		table, field := profileColumn(path)
+		if out[table] == nil {
+			out[table] = map[string]string{}
+		}
+		out[table][field] = col
+	}
+	return out
+}
+
+// renameKeys returns a copy of obj, a row of table, with the keys of it and
+// its nested objects renamed. Nested objects are rows of the table named by
+// their original key.
+func renameKeys(obj map[string]interface{}, table string, byTable map[string]map[string]string) map[string]interface{} {
+	out := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		if sub, ok := v.(map[string]interface{}); ok {
+			v = renameKeys(sub, k, byTable)
+		}
+		if col, ok := byTable[table][k]; ok {
+			k = col
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// renamedTable returns the name of a table once the fields holding its rows
+// are renamed
+func renamedTable(table string, byTable map[string]map[string]string) string {
+	for _, fields := range byTable {
+		if col, ok := fields[table]; ok {
+			return col
+		}
+	}
+	return table
+}
+
+// sortedRenames returns the "field -> column" renames of the analyzed table
+// tbl whose columns it has, ordered by column
+func sortedRenames(renames map[string]string, tbl string, ts *TableSchema) [][2]string {
+	byTable := renamesByTable(renames)
+	var out [][2]string
+	for table, fields := range byTable {
+		if renamedTable(table, byTable) != tbl {
+			continue
+		}
+		for field, col := range fields {
+			if ts.Fields[col] != "" || ts.Fields[col+"_id"] != "" {
+				out = append(out, [2]string{field, col})
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i][1] < out[j][1] })
+	return out
+}
+
+// columnKeys returns obj with the document fields the table renames keyed
+// by their columns
+func (t *TableSchema) columnKeys(obj map[string]interface{}) map[string]interface{} {
+	if len(t.Renames) == 0 {
+		return obj
+	}
+	out := make(map[string]interface{}, len(obj))
+	for k, v := range obj {
+		out[k] = v
+	}
+	for col, field := range t.Renames {
+		if v, ok := obj[field]; ok {
+			delete(out, field)
+			out[col] = v
+		}
+	}
+	return out
+}
+
+// documentKeys restores the original fields of a dumped row
+func (t *TableSchema) documentKeys(obj map[string]interface{}) map[string]interface{} {
+	for col, field := range t.Renames {
+		if v, ok := obj[col]; ok {
+			delete(obj, col)
+			obj[field] = v
+		}
+	}
+	return obj
+}
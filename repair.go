@@ -0,0 +1,157 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// RepairOptions controls how RepairDatabase fixes violations
+type RepairOptions struct {
+	Delete bool // delete offending rows (with their nested rows) instead of nulling the column
+	DryRun bool // report the repairs without keeping them
+}
+
+// Repair is one repair applied to the rows of a table
+type Repair struct {
+	Violation
+	Action string // merge, null or delete
+}
+
+// RepairDatabase fixes the violations reported by CheckDatabase in a single
+// transaction. Duplicate symbols are merged into the lowest id, with their
+// references remapped, before dangling references and invalid JSON values are
+// nulled or their rows deleted. Deleting a nested row leaves its parent
+// dangling, so with Delete the repair is repeated until whole documents are
+// gone. Invalid symbol values are reported by check but left alone.
+func RepairDatabase(dbPath string, dbs *DatabaseSchema, opts RepairOptions) ([]Repair, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var repairs []Repair
+	symbolTables := map[string]bool{}
+	for _, v := range invariantChecks(dbs) {
+		if v.Kind != DuplicateSymbol {
+			continue
+		}
+		symbolTables[v.Table] = true
+		if err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", v.Table, v.where)).Scan(&v.Count); err != nil {
+			return nil, err
+		}
+		if v.Count == 0 {
+			continue
+		}
+		if err := mergeSymbols(tx, dbs, v); err != nil {
+			return nil, fmt.Errorf("merge %s: %v", v.Table, err)
+		}
+		repairs = append(repairs, Repair{v, "merge"})
+	}
+
+	action := "null"
+	if opts.Delete {
+		action = "delete"
+	}
+	for {
+		found, err := checkInvariants(tx, dbs)
+		if err != nil {
+			return nil, err
+		}
+		fixed := 0
+		for _, v := range found {
+			if symbolTables[v.Table] {
+				continue
+			}
+			if err := repairRows(tx, dbs, v, opts.Delete); err != nil {
+				return nil, fmt.Errorf("repair %s.%s: %v", v.Table, v.Column, err)
+			}
+			repairs = addRepair(repairs, Repair{v, action})
+			fixed++
+		}
+		if fixed == 0 {
+			break
+		}
+	}
+	if opts.DryRun {
+		return repairs, nil
+	}
+	var rows int64
+	for _, r := range repairs {
+		rows += int64(r.Count)
+	}
+	if err := dbs.Audit.record(tx, rows); err != nil {
+		return nil, fmt.Errorf("audit: %v", err)
+	}
+	return repairs, tx.Commit()
+}
+
+// mergeSymbols points every reference to a duplicate symbol at the first
+// copy, deletes the duplicates and adds the missing UNIQUE index
+func mergeSymbols(tx *sql.Tx, dbs *DatabaseSchema, v Violation) error {
+	for _, name := range dbs.TableOrder {
+		for col, ref := range dbs.Tables[name].FKs {
+			if _, ok := dbs.Tables[name].Naming.symbolField(col); ref != v.Table || !ok {
+				continue
+			}
+			_, err := tx.Exec(fmt.Sprintf(`UPDATE %[1]s SET %[2]s = (
+  SELECT MIN(first.id) FROM %[3]s dup JOIN %[3]s first ON first.value = dup.value WHERE dup.id = %[1]s.%[2]s)
+WHERE %[2]s IN (SELECT id FROM %[3]s WHERE %[4]s)`, name, col, v.Table, v.where))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", v.Table, v.where)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %[1]s_value_unique ON %[1]s(value)", v.Table))
+	return err
+}
+
+// repairRows nulls the violating column, or deletes the violating rows
+func repairRows(tx *sql.Tx, dbs *DatabaseSchema, v Violation, del bool) error {
+	if !del {
+		_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s", v.Table, v.Column, v.where))
+		return err
+	}
+	rows, err := tx.Query(fmt.Sprintf("SELECT id FROM %s WHERE %s", v.Table, v.where))
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := deleteRowTree(tx, dbs, dbs.Tables[v.Table], id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addRepair adds r to repairs, summing counts of repeated passes
+func addRepair(repairs []Repair, r Repair) []Repair {
+	for i := range repairs {
+		if repairs[i].Table == r.Table && repairs[i].Column == r.Column && repairs[i].Kind == r.Kind {
+			repairs[i].Count += r.Count
+			return repairs
+		}
+	}
+	return append(repairs, r)
+}
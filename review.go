@@ -0,0 +1,132 @@
+package jsql
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// reviewPrefix marks the comment lines annotateDDL adds; they are removed
+// again once the schema is accepted
+const reviewPrefix = "-- review: "
+
+var reCreateTable = regexp.MustCompile(`(?i)^CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?` + qualifiedIdentPattern)
+
+// annotateDDL returns ddl with comments explaining each table and its
+// symbolized, nested and JSON columns, and how to change them
+func annotateDDL(ddl string) string {
+	ds := ParseDDL(ddl)
+	symbols := symbolReferences(ds)
+	notes := map[string][]string{}
+	for name, t := range ds.Tables {
+		switch {
+		case symbols[name] != nil:
+			notes[name] = append(notes[name], fmt.Sprintf("%s: symbol table of %s", name, strings.Join(symbols[name], ", ")))
+			continue
+		case name == ds.Root:
+			notes[name] = append(notes[name], fmt.Sprintf("%s: root table, one row per document", name))
+		default:
+			notes[name] = append(notes[name], fmt.Sprintf("%s: nested objects", name))
+		}
+		cols := make([]string, 0, len(t.Fields))
+		for col := range t.Fields {
+			cols = append(cols, col)
+		}
+		sort.Strings(cols)
+		for _, col := range cols {
+			ref := t.FKs[col]
+			symField, isSym := t.Naming.symbolField(col)
+			objField, isObj := t.Naming.objectField(col)
+			switch {
+			case ref != "" && isSym:
+				notes[name] = append(notes[name], fmt.Sprintf("  %s: symbolized, values stored once in %s", symField, ref))
+			case ref != "" && isObj:
+				notes[name] = append(notes[name], fmt.Sprintf("  %s: object, stored as a row of %s", objField, ref))
+			case t.Fields[col] == TypeJSON:
+				notes[name] = append(notes[name], fmt.Sprintf("  %s: kept as JSON", col))
+			}
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString(reviewPrefix + "change column types in place; to store a symbolized field as\n")
+	sb.WriteString(reviewPrefix + "plain text, replace \"f_symbol INTEGER REFERENCES f_symbol(id)\" with \"f TEXT\"\n")
+	for _, line := range strings.Split(ddl, "\n") {
+		if m := reCreateTable.FindStringSubmatch(line); m != nil {
+			for _, note := range notes[unquoteIdent(m[1])] {
+				sb.WriteString(reviewPrefix + note + "\n")
+			}
+		}
+		sb.WriteString(line + "\n")
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// stripAnnotations removes the comments added by annotateDDL
+func stripAnnotations(ddl string) string {
+	var sb strings.Builder
+	for _, line := range strings.Split(ddl, "\n") {
+		if !strings.HasPrefix(line, reviewPrefix) {
+			sb.WriteString(line + "\n")
+		}
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+// ReviewDDL shows the proposed schema with annotations on out and asks on
+// in whether to use it, open it in $EDITOR (vi if unset) first, or cancel.
+// It returns the accepted schema, or an error if the review was cancelled.
+func ReviewDDL(ddl string, in io.Reader, out io.Writer) (string, error) {
+	f, err := os.CreateTemp("", "jsql-review-*.sql")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(annotateDDL(ddl))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	r := bufio.NewReader(in)
+	for {
+		data, err := os.ReadFile(f.Name())
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(out, "%s\n\nCreate the database with this schema? [y]es, [e]dit, [n]o: ", strings.TrimRight(string(data), "\n"))
+		answer, err := r.ReadString('\n')
+		if err != nil && answer == "" {
+			return "", fmt.Errorf("review cancelled")
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return stripAnnotations(string(data)), nil
+		case "e", "edit":
+			if err := editFile(f.Name(), in, out); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("review cancelled")
+		}
+	}
+}
+
+// editFile opens path in the user's editor, attached to in and out, and
+// waits for it to exit
+func editFile(path string, in io.Reader, out io.Writer) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = defaultEditor
+	}
+	cmd := editorCommand(editor, path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %v", editor, err)
+	}
+	return nil
+}
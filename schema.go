@@ -1,6 +1,7 @@
-package main
+package jsql
 
 import (
+	"fmt"
 	"regexp"
 	"sort"
 	"strings"
@@ -9,47 +10,294 @@ import (
 // ParseDDL parses a DDL string and returns a DatabaseSchema
 func ParseDDL(ddl string) *DatabaseSchema {
 	lines := strings.Split(ddl, "\n")
-	ds := &DatabaseSchema{Tables: map[string]*TableSchema{}}
-	reCreate := regexp.MustCompile(`(?i)^CREATE TABLE (\w+)`)
-	reField := regexp.MustCompile(`^\s*(\w+)\s+(\w+)(.*)$`)
+	ds := &DatabaseSchema{Tables: map[string]*TableSchema{}, Views: map[string]*TableSchema{}, Root: "main"}
+	reField := regexp.MustCompile(`^\s*(` + identPattern + `)\s+(\w+)(.*)$`)
+	reFk := regexp.MustCompile(`(?i)\bREFERENCES\s+` + qualifiedIdentPattern)
 	var curr *TableSchema
+	var links, computed, explode, renames, timestamps, history, provenance, ord, keyOrder, numberText, softDelete, fallbacks [][]string
+	hashIDs := false
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
+		if reSymbolIDDirective.MatchString(line) {
+			hashIDs = true
+			continue
+		}
+		if m := reLinkDirective.FindStringSubmatch(line); m != nil {
+			links = append(links, m)
+			continue
+		}
+		if m := reComputedDirective.FindStringSubmatch(line); m != nil {
+			computed = append(computed, m)
+			continue
+		}
+		if m := reExplodeDirective.FindStringSubmatch(line); m != nil {
+			explode = append(explode, m)
+			continue
+		}
+		if m := reRenameDirective.FindStringSubmatch(line); m != nil {
+			renames = append(renames, m)
+			continue
+		}
+		if m := reTimestampsDirective.FindStringSubmatch(line); m != nil {
+			timestamps = append(timestamps, m)
+			continue
+		}
+		if m := reHistoryDirective.FindStringSubmatch(line); m != nil {
+			history = append(history, m)
+			continue
+		}
+		if m := reProvenanceDirective.FindStringSubmatch(line); m != nil {
+			provenance = append(provenance, m)
+			continue
+		}
+		if m := reOrdDirective.FindStringSubmatch(line); m != nil {
+			ord = append(ord, m)
+			continue
+		}
+		if m := reKeyOrderDirective.FindStringSubmatch(line); m != nil {
+			keyOrder = append(keyOrder, m)
+			continue
+		}
+		if m := reNumberTextDirective.FindStringSubmatch(line); m != nil {
+			numberText = append(numberText, m)
+			continue
+		}
+		if m := reSoftDeleteDirective.FindStringSubmatch(line); m != nil {
+			softDelete = append(softDelete, m)
+			continue
+		}
+		if m := reFallbackDirective.FindStringSubmatch(line); m != nil {
+			fallbacks = append(fallbacks, m)
+			continue
+		}
+		if m := reNamingDirective.FindStringSubmatch(line); m != nil {
+			// A malformed convention leaves jsql's own, as the patterns of
+			// --naming are checked before they are written
+			ds.Naming, _ = ParseNaming(m[1])
+			continue
+		}
 		if line == "" || strings.HasPrefix(line, "--") {
 			continue
 		}
-		if m := reCreate.FindStringSubmatch(line); m != nil {
+		if m := reAlterAdd.FindStringSubmatch(line); m != nil {
+			if t := ds.Tables[unquoteIdent(m[1])]; t != nil {
+				t.Fields[unquoteIdent(m[2])] = FieldType(strings.ToUpper(m[3]))
+			}
+			continue
+		}
+		if m := reCreateView.FindStringSubmatch(line); m != nil {
+			name := unquoteIdent(m[1])
+			ds.Views[name] = &TableSchema{Name: name, Fields: map[string]FieldType{}, FKs: map[string]string{}, View: true}
+			continue
+		}
+		if m := reCreateTable.FindStringSubmatch(line); m != nil {
+			name := unquoteIdent(m[1])
 			curr = &TableSchema{
-				Name:   m[1],
+				Name:   name,
 				Fields: map[string]FieldType{},
 				FKs:    map[string]string{},
 			}
-			ds.Tables[m[1]] = curr
+			ds.Tables[name] = curr
 			continue
 		}
 		if curr == nil {
 			continue
 		}
-		if strings.HasPrefix(line, ");") || line == ");" || line == ")" {
+		if strings.HasPrefix(line, ")") {
+			curr.Options = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, ")"), ";"))
 			curr = nil
 			continue
 		}
+		// Table constraints are kept as written. A FOREIGN KEY one to an
+		// id references a table like a column's REFERENCES clause; others
+		// are kept as ForeignKeys.
+		if m := reForeignKey.FindStringSubmatch(line); m != nil {
+			fk := ForeignKey{Field: unquoteIdent(m[1]), Columns: identList(m[2]), Table: unquoteIdent(m[3]), References: identList(m[4]), Clauses: m[5]}
+			if len(fk.References) == 0 && len(fk.Columns) > 1 {
+				fk.References = fk.Columns // the primary key, named alike
+			}
+			switch {
+			case len(fk.Columns) == 0 || len(fk.References) > 0 && len(fk.References) != len(fk.Columns):
+			case len(fk.Columns) > 1 || len(fk.References) > 0 && fk.References[0] != "id":
+				if fk.Field == "" {
+					fk.Field = fk.Table
+				}
+				curr.ForeignKeys = append(curr.ForeignKeys, fk)
+				continue
+			default:
+				curr.FKs[fk.Columns[0]] = fk.Table
+			}
+		}
+		if reTableConstraint.MatchString(line) {
+			curr.Constraints = append(curr.Constraints, strings.TrimSuffix(line, ","))
+			continue
+		}
 		if m := reField.FindStringSubmatch(line); m != nil {
-			col, typ, rest := m[1], strings.ToUpper(m[2]), m[3]
+			col, typ, rest := unquoteIdent(m[1]), strings.ToUpper(m[2]), m[3]
 			curr.Fields[col] = FieldType(typ)
-			if strings.Contains(rest, "REFERENCES") {
-				reFk := regexp.MustCompile(`REFERENCES\s+(\w+)`)
-				mt := reFk.FindStringSubmatch(rest)
-				if mt != nil {
-					curr.FKs[col] = mt[1]
+			if mt := reFk.FindStringSubmatch(rest); mt != nil {
+				curr.FKs[col] = unquoteIdent(mt[1])
+			}
+			if def, ok := parseDefault(rest); ok {
+				if curr.Defaults == nil {
+					curr.Defaults = map[string]interface{}{}
+				}
+				curr.Defaults[col] = def
+			} else if reAnyDefault.MatchString(rest) {
+				if curr.ExprDefaults == nil {
+					curr.ExprDefaults = map[string]bool{}
+				}
+				curr.ExprDefaults[col] = true
+			}
+		}
+	}
+	for _, t := range ds.Tables {
+		t.Naming = ds.Naming
+	}
+	for _, m := range links {
+		if t := ds.Tables[m[1]]; t != nil {
+			if t.Links == nil {
+				t.Links = map[string]Link{}
+			}
+			t.Links[linkColumn(m[2])] = Link{Field: m[2], Table: m[3], Key: m[4]}
+		}
+	}
+	for _, m := range computed {
+		if t := ds.Tables[m[1]]; t != nil {
+			if t.Computed == nil {
+				t.Computed = map[string]*Computed{}
+			}
+			t.Computed[m[2]] = compileComputed(m[3])
+		}
+	}
+	for _, m := range renames {
+		if t := ds.Tables[m[1]]; t != nil {
+			if t.Renames == nil {
+				t.Renames = map[string]string{}
+			}
+			t.Renames[m[3]] = m[2]
+		}
+	}
+	for _, m := range explode {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.Explode = m[2]
+		}
+	}
+	for _, m := range timestamps {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.Timestamps = true
+		}
+	}
+	for _, m := range history {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.History = true
+		}
+	}
+	for _, m := range provenance {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.Provenance = true
+		}
+	}
+	for _, m := range ord {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.Ord = true
+		}
+	}
+	for _, m := range keyOrder {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.KeyOrder = true
+		}
+	}
+	for _, m := range numberText {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.NumberText = true
+		}
+	}
+	for _, m := range softDelete {
+		if t := ds.Tables[m[1]]; t != nil {
+			t.SoftDelete = true
+		}
+	}
+	for _, m := range fallbacks {
+		if t := ds.Tables[m[1]]; t != nil {
+			if t.Fallbacks == nil {
+				t.Fallbacks = map[string]string{}
+			}
+			t.Fallbacks[fallbackColumn(m[2])] = m[2]
+		}
+	}
+	if hashIDs {
+		for _, t := range ds.Tables {
+			for col, sym := range t.FKs {
+				if _, ok := t.Naming.symbolField(col); ok && ds.Tables[sym] != nil {
+					ds.Tables[sym].HashIDs = true
 				}
 			}
 		}
 	}
 	ds.TableOrder = resolveTableOrder(ds.Tables)
+	// R*Tree tables named <table>_<column>_rtree index geometry columns
+	reRTree := regexp.MustCompile(`(?im)^CREATE VIRTUAL TABLE (?:IF NOT EXISTS )?` + qualifiedIdentPattern + ` USING rtree`)
+	for _, m := range reRTree.FindAllStringSubmatch(ddl, -1) {
+		rtree := unquoteIdent(m[1])
+		for _, t := range ds.Tables {
+			for col, typ := range t.Fields {
+				if (typ == TypeGeoJSON || typ == TypeWKB) && rtree == spatialIndexName(t.Name, col) {
+					if t.SpatialIndexes == nil {
+						t.SpatialIndexes = map[string]string{}
+					}
+					t.SpatialIndexes[col] = rtree
+				}
+			}
+		}
+	}
 	return ds
 }
 
+// reCreateView matches the start of a CREATE VIEW statement
+var reCreateView = regexp.MustCompile(`(?i)^CREATE\s+(?:TEMP\s+|TEMPORARY\s+)?VIEW\s+(?:IF\s+NOT\s+EXISTS\s+)?` + qualifiedIdentPattern)
+
+// spatialIndexName returns the name of the R*Tree table indexing a column
+func spatialIndexName(table, col string) string {
+	return table + "_" + col + "_rtree"
+}
+
+// tenantTable returns the name of a table as generated for tenant, which
+// prefixes every table so that several tenants can share one database
+func tenantTable(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "_" + name
+}
+
+// ValidTenant reports whether a tenant name can be used in table names
+func ValidTenant(tenant string) bool {
+	return tenant == "" || regexp.MustCompile(`^\w+$`).MatchString(tenant)
+}
+
+// SetTenant selects the root table of tenant, returning an error if the
+// schema does not contain it
+func (ds *DatabaseSchema) SetTenant(tenant string) error {
+	return ds.SetRoot(tenant, "main")
+}
+
+// SetRoot selects the root table named root of tenant, for schemas that hold
+// several datasets side by side
+func (ds *DatabaseSchema) SetRoot(tenant, root string) error {
+	table := tenantTable(tenant, root)
+	if _, ok := ds.Tables[table]; !ok {
+		return fmt.Errorf("schema has no table %s", table)
+	}
+	ds.Root = table
+	return nil
+}
+
+// RootTable returns the table holding the top-level records
+func (ds *DatabaseSchema) RootTable() *TableSchema {
+	return ds.Tables[ds.Root]
+}
+
 // resolveTableOrder determines the order in which tables should be created
 // based on their dependencies
 func resolveTableOrder(tables map[string]*TableSchema) []string {
@@ -57,13 +305,17 @@ func resolveTableOrder(tables map[string]*TableSchema) []string {
 	var order []string
 	var visit func(table string)
 	visit = func(tbl string) {
-		if visited[tbl] {
+		if visited[tbl] || tables[tbl] == nil {
 			return
 		}
+		// Marked before its references: links between datasets may form cycles
+		visited[tbl] = true
 		for _, fk := range tables[tbl].FKs {
 			visit(fk)
 		}
-		visited[tbl] = true
+		for _, fk := range tables[tbl].ForeignKeys {
+			visit(fk.Table)
+		}
 		order = append(order, tbl)
 	}
 	keys := make([]string, 0, len(tables))
@@ -0,0 +1,193 @@
+package jsql
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+// MergeSchemas combines schemas analyzed from different samples or
+// sources into one that loads the documents of all of them: the union of
+// their tables and columns, with the columns they type differently
+// widened. Where they disagree on a setting, such as the field an exploded
+// table takes its rows from, the first schema's is kept.
+func MergeSchemas(ddls ...string) (*SchemaModel, error) {
+	merged := &SchemaModel{}
+	for i, ddl := range ddls {
+		m := NewSchemaModel(ddl)
+		if i == 0 {
+			merged = m
+			continue
+		}
+		if err := merged.merge(m); err != nil {
+			return nil, err
+		}
+	}
+	merged.sortTables()
+	return merged, nil
+}
+
+// sortTables orders the tables so that those referenced by a table come
+// before it, in the order it references them, and the others stay in place
+func (m *SchemaModel) sortTables() {
+	byName := map[string]TableModel{}
+	for _, t := range m.Tables {
+		byName[t.Name] = t
+	}
+	visited := map[string]bool{}
+	sorted := make([]TableModel, 0, len(m.Tables))
+	var visit func(name string)
+	visit = func(name string) {
+		t, ok := byName[name]
+		if !ok || visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, c := range t.Columns {
+			visit(c.References)
+		}
+		for _, fk := range t.ForeignKeys {
+			visit(fk.Table)
+		}
+		sorted = append(sorted, t)
+	}
+	for _, t := range m.Tables {
+		visit(t.Name)
+	}
+	m.Tables = sorted
+}
+
+// merge adds the tables, columns and statements of o to m
+func (m *SchemaModel) merge(o *SchemaModel) error {
+	if !reflect.DeepEqual(m.Naming, o.Naming) {
+		return fmt.Errorf("schemas name the columns referencing other tables differently")
+	}
+	for _, ot := range o.Tables {
+		i := slices.IndexFunc(m.Tables, func(t TableModel) bool { return t.Name == ot.Name })
+		if i < 0 {
+			m.Tables = append(m.Tables, ot)
+			continue
+		}
+		m.Tables[i].merge(ot, m.Naming)
+	}
+	for _, s := range o.Statements {
+		if !slices.Contains(m.Statements, s) {
+			m.Statements = append(m.Statements, s)
+		}
+	}
+	return nil
+}
+
+// merge adds the columns and settings of o to t. Constraints only one of
+// them has are dropped, as they might reject the other's documents.
+func (t *TableModel) merge(o TableModel, naming *Naming) {
+	var n Naming
+	if naming != nil {
+		n = *naming
+	}
+	for _, oc := range o.Columns {
+		i := slices.IndexFunc(t.Columns, func(c ColumnModel) bool { return c.Name == oc.Name })
+		if i < 0 {
+			oc.NotNull = false
+			t.Columns = append(t.Columns, oc)
+			continue
+		}
+		t.Columns[i] = mergeColumns(t.Columns[i], oc)
+	}
+	for i := range t.Columns {
+		if !slices.ContainsFunc(o.Columns, func(c ColumnModel) bool { return c.Name == t.Columns[i].Name }) {
+			t.Columns[i].NotNull = false
+		}
+	}
+	// A field symbolized in one schema and not the other stays symbolized
+	t.Columns = slices.DeleteFunc(t.Columns, func(c ColumnModel) bool {
+		return c.References == "" && slices.ContainsFunc(t.Columns, func(s ColumnModel) bool {
+			field, ok := n.symbolField(s.Name)
+			return s.Symbol && ok && field == c.Name
+		})
+	})
+	t.SymbolTable = t.SymbolTable || o.SymbolTable
+	t.HashIDs = t.HashIDs || o.HashIDs
+	t.Timestamps = t.Timestamps || o.Timestamps
+	t.History = t.History || o.History
+	t.Provenance = t.Provenance || o.Provenance
+	t.Ord = t.Ord || o.Ord
+	t.KeyOrder = t.KeyOrder || o.KeyOrder
+	t.NumberText = t.NumberText || o.NumberText
+	t.SoftDelete = t.SoftDelete || o.SoftDelete
+	if t.Explode == "" {
+		t.Explode = o.Explode
+	}
+	t.Renames = mergeMaps(t.Renames, o.Renames)
+	for _, field := range o.Fallbacks {
+		if !slices.Contains(t.Fallbacks, field) {
+			t.Fallbacks = append(t.Fallbacks, field)
+		}
+	}
+	slices.Sort(t.Fallbacks)
+	t.Computed = mergeMaps(t.Computed, o.Computed)
+	for _, l := range o.Links {
+		if !slices.ContainsFunc(t.Links, func(have Link) bool { return have.Field == l.Field }) {
+			t.Links = append(t.Links, l)
+		}
+	}
+	for _, fk := range o.ForeignKeys {
+		if !slices.ContainsFunc(t.ForeignKeys, func(have ForeignKey) bool { return have.Field == fk.Field }) {
+			t.ForeignKeys = append(t.ForeignKeys, fk)
+		}
+	}
+	t.Constraints = slices.DeleteFunc(t.Constraints, func(c string) bool { return !slices.Contains(o.Constraints, c) })
+	if t.Options != o.Options {
+		t.Options = ""
+	}
+}
+
+// mergeColumns returns a column holding the values of both: their type
+// widened, and what the definitions do not agree on dropped
+func mergeColumns(a, b ColumnModel) ColumnModel {
+	if a.SQL != b.SQL {
+		a.SQL = ""
+	}
+	a.Type = widenColumnType(a.Type, b.Type)
+	a.Unique = a.Unique && b.Unique
+	a.NotNull = a.NotNull && b.NotNull
+	if !reflect.DeepEqual(a.Default, b.Default) {
+		a.Default = nil
+	}
+	if a.References == "" {
+		a.References, a.Symbol = b.References, b.Symbol
+	}
+	return a
+}
+
+// widenColumnType returns the type of a column holding the values of
+// columns of both types: booleans widen to integers, integers to reals,
+// and any other mix to text, which holds every value
+func widenColumnType(a, b FieldType) FieldType {
+	if a == b {
+		return a
+	}
+	rank := map[FieldType]int{TypeBool: 1, TypeInt: 2, TypeReal: 3}
+	if rank[a] > 0 && rank[b] > 0 {
+		if rank[a] > rank[b] {
+			return a
+		}
+		return b
+	}
+	return TypeText
+}
+
+// mergeMaps returns the entries of both maps, those of a where both have a
+// key
+func mergeMaps(a, b map[string]string) map[string]string {
+	for k, v := range b {
+		if _, ok := a[k]; ok {
+			continue
+		}
+		if a == nil {
+			a = map[string]string{}
+		}
+		a[k] = v
+	}
+	return a
+}
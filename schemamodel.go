@@ -0,0 +1,395 @@
+package jsql
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SchemaModel is a schema as JSON: the tables with their columns and the
+// settings the loader reads from jsql directives, for tools that should not
+// parse SQL. analyze --output json writes it, and every --schema flag
+// accepts it in place of a DDL file.
+type SchemaModel struct {
+	Tables     []TableModel `json:"tables"`               // in creation order
+	Statements []string     `json:"statements,omitempty"` // other SQL: indexes, triggers, R*Tree tables
+	Naming     *Naming      `json:"naming,omitempty"`     // how columns referencing other tables are named, if not *_id and *_symbol
+}
+
+// TableModel is one table of a SchemaModel
+type TableModel struct {
+	Name        string            `json:"name"`
+	Columns     []ColumnModel     `json:"columns"`
+	SymbolTable bool              `json:"symbol_table,omitempty"` // holds the values of symbolized columns
+	HashIDs     bool              `json:"hash_ids,omitempty"`     // symbol ids are hashes of the values
+	Explode     string            `json:"explode,omitempty"`      // array field whose elements are the rows
+	Timestamps  bool              `json:"timestamps,omitempty"`   // created_at and updated_at are kept by the database
+	History     bool              `json:"history,omitempty"`      // former versions of rows are kept in <name>_history
+	Provenance  bool              `json:"provenance,omitempty"`   // _line, _source and _ingested_at are filled by the loader
+	Ord         bool              `json:"ord,omitempty"`          // _ord numbers the documents, filled by the loader
+	KeyOrder    bool              `json:"key_order,omitempty"`    // _key_order records the order of the keys, filled by the loader
+	NumberText  bool              `json:"number_text,omitempty"`  // _number_text keeps the text of numbers, filled by the loader
+	SoftDelete  bool              `json:"soft_delete,omitempty"`  // removing a document sets _deleted_at instead
+	Renames     map[string]string `json:"renames,omitempty"`      // column -> document field it holds
+	Fallbacks   []string          `json:"fallbacks,omitempty"`    // fields whose values that do not fit are stored in <field>_fallback
+	Links       []Link            `json:"links,omitempty"`
+	Computed    map[string]string `json:"computed,omitempty"`    // column -> expression
+	Constraints []string          `json:"constraints,omitempty"` // table constraints, as written
+	ForeignKeys []ForeignKey      `json:"foreign_keys,omitempty"`
+	Options     string            `json:"options,omitempty"` // after the column list, e.g. STRICT
+}
+
+// ColumnModel is one column of a TableModel
+type ColumnModel struct {
+	Name       string      `json:"name"`
+	Type       FieldType   `json:"type"`
+	PrimaryKey bool        `json:"primary_key,omitempty"`
+	Unique     bool        `json:"unique,omitempty"`
+	NotNull    bool        `json:"not_null,omitempty"`
+	Default    interface{} `json:"default,omitempty"`
+	References string      `json:"references,omitempty"` // table whose id the column holds
+	Symbol     bool        `json:"symbol,omitempty"`     // the field is symbolized into References
+	// SQL is the definition after the column name as written, when it says
+	// more than the fields above: a sized or multi-word type, CHECK, COLLATE,
+	// a DEFAULT expression. It takes their place in the DDL.
+	SQL string `json:"sql,omitempty"`
+}
+
+var (
+	reColumnDef    = regexp.MustCompile(`^(` + identPattern + `)\s+(\w+)(.*?),?$`)
+	reTriggerStart = regexp.MustCompile(`(?i)^CREATE\s+(?:TEMP\s+|TEMPORARY\s+)?TRIGGER\b`)
+	// table constraints, which are kept as written
+	reTableConstraint = regexp.MustCompile(`(?i)^(PRIMARY\s+KEY|FOREIGN\s+KEY|UNIQUE\s*\(|CHECK\s*\(|CONSTRAINT\s+` + identPattern + `)`)
+	// a FOREIGN KEY table constraint: its name, columns, referenced table
+	// and columns, and the clauses after them
+	reForeignKey = regexp.MustCompile(`(?i)^(?:CONSTRAINT\s+(` + identPattern + `)\s+)?FOREIGN\s+KEY\s*\(([^)]*)\)\s*REFERENCES\s+` + qualifiedIdentPattern + `\s*(?:\(([^)]*)\))?\s*(.*?),?$`)
+)
+
+// NewSchemaModel builds the model of a DDL schema. Comments other than jsql
+// directives are not kept.
+func NewSchemaModel(ddl string) *SchemaModel {
+	ds := ParseDDL(ddl)
+	symbols := symbolReferences(ds)
+	m := &SchemaModel{}
+	if ds.Naming.directive() != "" {
+		m.Naming = &ds.Naming
+	}
+	tables := map[string]*TableModel{}
+	var curr *TableModel
+	var stmt []string
+	for _, line := range strings.Split(ddl, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case stmt != nil:
+			stmt = append(stmt, line)
+			if strings.HasSuffix(line, ";") && (!reTriggerStart.MatchString(stmt[0]) || strings.HasSuffix(strings.ToUpper(line), "END;")) {
+				m.Statements = append(m.Statements, strings.Join(stmt, "\n"))
+				stmt = nil
+			}
+		case curr != nil:
+			if strings.HasPrefix(line, ")") {
+				curr = nil
+			} else if c := reColumnDef.FindStringSubmatch(line); c != nil && !reTableConstraint.MatchString(line) {
+				curr.Columns = append(curr.Columns, columnModel(ds.Tables[curr.Name], unquoteIdent(c[1]), c[2]+c[3]))
+			}
+		case line == "" || strings.HasPrefix(line, "--"):
+		case reCreateTable.MatchString(line):
+			name := unquoteIdent(reCreateTable.FindStringSubmatch(line)[1])
+			curr = &TableModel{Name: name}
+			tables[name] = curr
+		case reAlterAdd.MatchString(line):
+			a := reAlterAdd.FindStringSubmatch(line)
+			if t := tables[unquoteIdent(a[1])]; t != nil {
+				def := strings.TrimSuffix(line[len(a[0])-len(a[3]):], ";")
+				t.Columns = append(t.Columns, columnModel(ds.Tables[t.Name], unquoteIdent(a[2]), strings.TrimSpace(def)))
+			}
+		default:
+			stmt = []string{line}
+			if strings.HasSuffix(line, ";") && !reTriggerStart.MatchString(line) {
+				m.Statements = append(m.Statements, line)
+				stmt = nil
+			}
+		}
+	}
+	for _, name := range ds.TableOrder {
+		tm, ts := tables[name], ds.Tables[name]
+		if tm == nil {
+			continue
+		}
+		tm.SymbolTable = symbols[name] != nil
+		tm.HashIDs = ts.HashIDs
+		tm.Explode = ts.Explode
+		tm.Timestamps = ts.Timestamps
+		tm.History = ts.History
+		tm.Provenance = ts.Provenance
+		tm.Ord = ts.Ord
+		tm.KeyOrder = ts.KeyOrder
+		tm.NumberText = ts.NumberText
+		tm.SoftDelete = ts.SoftDelete
+		tm.Renames = ts.Renames
+		for _, field := range ts.Fallbacks {
+			tm.Fallbacks = append(tm.Fallbacks, field)
+		}
+		sort.Strings(tm.Fallbacks)
+		tm.Constraints = ts.Constraints
+		tm.ForeignKeys = ts.ForeignKeys
+		tm.Options = ts.Options
+		for _, l := range ts.Links {
+			tm.Links = append(tm.Links, l)
+		}
+		sort.Slice(tm.Links, func(i, j int) bool { return tm.Links[i].Field < tm.Links[j].Field })
+		for col, c := range ts.Computed {
+			if tm.Computed == nil {
+				tm.Computed = map[string]string{}
+			}
+			tm.Computed[col] = c.Expr
+		}
+		m.Tables = append(m.Tables, *tm)
+	}
+	return m
+}
+
+// columnModel describes column col of t, whose definition after the name
+// is def
+func columnModel(t *TableSchema, col, def string) ColumnModel {
+	upper := strings.ToUpper(def)
+	c := ColumnModel{
+		Name:       col,
+		Type:       t.Fields[col],
+		PrimaryKey: strings.Contains(upper, "PRIMARY KEY"),
+		Unique:     strings.Contains(upper, "UNIQUE"),
+		NotNull:    strings.Contains(upper, "NOT NULL"),
+		Default:    t.Defaults[col],
+		References: t.FKs[col],
+	}
+	_, isSym := t.Naming.symbolField(col)
+	c.Symbol = c.References != "" && isSym
+	if !strings.EqualFold(strings.Join(strings.Fields(c.definition()), " "), strings.Join(strings.Fields(def), " ")) {
+		c.SQL = def
+	}
+	return c
+}
+
+// definition returns the SQL defining the column after its name
+func (c ColumnModel) definition() string {
+	if c.SQL != "" {
+		return c.SQL
+	}
+	def := string(c.Type)
+	if c.PrimaryKey {
+		def += " PRIMARY KEY"
+	}
+	if c.Unique {
+		def += " UNIQUE"
+	}
+	if c.NotNull {
+		def += " NOT NULL"
+	}
+	if c.Default != nil {
+		def += " DEFAULT " + sqlLiteral(c.Default)
+	}
+	if c.References != "" {
+		def += " REFERENCES " + quoteIdent(c.References) + "(id)"
+	}
+	return def
+}
+
+// DDL returns the SQL of the schema, with its settings as jsql directives
+func (m *SchemaModel) DDL() string {
+	var sb strings.Builder
+	for _, t := range m.Tables {
+		if t.HashIDs {
+			sb.WriteString("-- jsql:symbol-id hash\n\n")
+			break
+		}
+	}
+	if m.Naming != nil && m.Naming.directive() != "" {
+		sb.WriteString(m.Naming.directive() + "\n\n")
+	}
+	for _, t := range m.Tables {
+		sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n", quoteIdent(t.Name)))
+		defs := make([]string, 0, len(t.Columns)+len(t.Constraints))
+		for _, c := range t.Columns {
+			defs = append(defs, quoteIdent(c.Name)+" "+c.definition())
+		}
+		defs = append(defs, t.Constraints...)
+		for _, fk := range t.ForeignKeys {
+			defs = append(defs, fk.definition())
+		}
+		sb.WriteString("  " + strings.Join(defs, ",\n  ") + "\n)")
+		if t.Options != "" {
+			sb.WriteString(" " + t.Options)
+		}
+		sb.WriteString(";\n\n")
+		if t.Explode != "" {
+			sb.WriteString(fmt.Sprintf("-- jsql:explode %s.%s\n\n", t.Name, t.Explode))
+		}
+		if t.Timestamps {
+			sb.WriteString(fmt.Sprintf("-- jsql:timestamps %s\n\n", t.Name))
+		}
+		if t.History {
+			sb.WriteString(fmt.Sprintf("-- jsql:history %s\n\n", t.Name))
+		}
+		if t.Provenance {
+			sb.WriteString(fmt.Sprintf("-- jsql:provenance %s\n\n", t.Name))
+		}
+		if t.Ord {
+			sb.WriteString(fmt.Sprintf("-- jsql:ord %s\n\n", t.Name))
+		}
+		if t.KeyOrder {
+			sb.WriteString(fmt.Sprintf("-- jsql:key-order %s\n\n", t.Name))
+		}
+		if t.NumberText {
+			sb.WriteString(fmt.Sprintf("-- jsql:number-text %s\n\n", t.Name))
+		}
+		if t.SoftDelete {
+			sb.WriteString(fmt.Sprintf("-- jsql:soft-delete %s\n\n", t.Name))
+		}
+		for _, col := range sortedKeys(t.Renames) {
+			sb.WriteString(fmt.Sprintf("-- jsql:rename %s.%s -> %s\n\n", t.Name, t.Renames[col], col))
+		}
+		for _, field := range t.Fallbacks {
+			sb.WriteString(fmt.Sprintf("-- jsql:fallback %s.%s\n\n", t.Name, field))
+		}
+		for _, l := range t.Links {
+			sb.WriteString(fmt.Sprintf("-- jsql:link %s.%s -> %s.%s\n\n", t.Name, l.Field, l.Table, l.Key))
+		}
+		for _, col := range sortedKeys(t.Computed) {
+			sb.WriteString(fmt.Sprintf("-- jsql:computed %s.%s = %s\n\n", t.Name, col, t.Computed[col]))
+		}
+	}
+	for _, s := range m.Statements {
+		sb.WriteString(s + "\n\n")
+	}
+	return sb.String()
+}
+
+// definition returns the SQL of the constraint
+func (fk ForeignKey) definition() string {
+	def := fmt.Sprintf("FOREIGN KEY (%s) REFERENCES %s(%s)", strings.Join(quoteIdents(fk.Columns), ", "), quoteIdent(fk.Table), strings.Join(quoteIdents(fk.References), ", "))
+	if fk.Field != fk.Table {
+		def = "CONSTRAINT " + quoteIdent(fk.Field) + " " + def
+	}
+	if fk.Clauses != "" {
+		def += " " + fk.Clauses
+	}
+	return def
+}
+
+// sortedKeys returns the keys of a string map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// isSchemaModel reports whether the contents of a schema file are a JSON
+// model rather than DDL
+func isSchemaModel(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+//go:embed schemas
+var embeddedSchemas embed.FS
+
+// embedPrefix names a schema of EmbeddedSchemas rather than a file
+const embedPrefix = "embed:"
+
+// EmbeddedSchemas holds the schemas compiled into the binary, which --schema
+// embed:NAME reads. jsql embeds its schemas directory; programs shipping a
+// fixed schema may set their own go:embed file system.
+var EmbeddedSchemas, _ = fs.Sub(embeddedSchemas, "schemas")
+
+// ReadDDL reads a schema file, or an embedded schema named embed:NAME,
+// returning its DDL. A JSON schema model is converted to DDL.
+func ReadDDL(path string) (string, error) {
+	if name, ok := strings.CutPrefix(path, embedPrefix); ok {
+		return readEmbeddedDDL(name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fileDDL(data, path)
+}
+
+// ReadDDLFS reads a schema file from fsys, returning its DDL
+func ReadDDLFS(fsys fs.FS, name string) (string, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	return fileDDL(data, name)
+}
+
+// readEmbeddedDDL reads the embedded schema name, which may leave out its
+// .sql or .json extension
+func readEmbeddedDDL(name string) (string, error) {
+	for _, n := range []string{name, name + ".sql", name + ".json"} {
+		if ddl, err := ReadDDLFS(EmbeddedSchemas, n); !errors.Is(err, fs.ErrNotExist) {
+			return ddl, err
+		}
+	}
+	var names []string
+	fs.WalkDir(EmbeddedSchemas, ".", func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && (path.Ext(p) == ".sql" || path.Ext(p) == ".json") {
+			names = append(names, p)
+		}
+		return nil
+	})
+	if len(names) == 0 {
+		return "", fmt.Errorf("no embedded schema %q: none are compiled in", name)
+	}
+	return "", fmt.Errorf("no embedded schema %q (embedded: %s)", name, strings.Join(names, ", "))
+}
+
+// isEmbedded reports whether a --schema value names an embedded schema
+func isEmbedded(path string) bool {
+	return strings.HasPrefix(path, embedPrefix)
+}
+
+// fileDDL returns the DDL of the contents of a schema file
+func fileDDL(data []byte, name string) (string, error) {
+	if !isSchemaModel(data) {
+		return string(data), nil
+	}
+	ddl, err := modelDDL(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return ddl, nil
+}
+
+// modelDDL converts a JSON schema model to DDL
+func modelDDL(data []byte) (string, error) {
+	var m SchemaModel
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", err
+	}
+	if m.Naming != nil {
+		if err := m.Naming.check(); err != nil {
+			return "", fmt.Errorf("naming: %v", err)
+		}
+	}
+	return m.DDL(), nil
+}
+
+// MarshalSchemaModel returns the JSON model of a DDL schema
+func MarshalSchemaModel(ddl string) ([]byte, error) {
+	data, err := json.MarshalIndent(NewSchemaModel(ddl), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
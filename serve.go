@@ -0,0 +1,251 @@
+package jsql
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ingestBatch is one POST body waiting for the writer
+type ingestBatch struct {
+	records []map[string]interface{}
+	lines   []int  // input line number of each record
+	source  string // recorded in the _source provenance column
+	sha256  string // of the request body, for the audit log
+	done    chan ingestResult
+}
+
+// ingestResult is reported back to the client once its batch is committed
+type ingestResult struct {
+	Rows   int      `json:"rows"`
+	Errors []string `json:"errors,omitempty"`
+	err    error
+}
+
+// IngestServer accepts NDJSON over HTTP and funnels it through a single
+// SQLite writer. A request takes one of a bounded number of slots before
+// its body is read, so that a burst of producers gets 429 responses
+// instead of exhausting memory with parsed bodies or starving the writer.
+type IngestServer struct {
+	db            *sql.DB
+	dbs           *DatabaseSchema
+	slots         chan struct{} // one per batch being read, queued or written
+	queue         chan *ingestBatch
+	maxBatchBytes int64
+}
+
+// NewIngestServer creates a server allowing maxInflight batches to be read,
+// queued or in progress at once
+func NewIngestServer(db *sql.DB, dbs *DatabaseSchema, maxInflight int, maxBatchBytes int64) *IngestServer {
+	metrics.queueCapacity.Store(int64(maxInflight))
+	return &IngestServer{
+		db:            db,
+		dbs:           dbs,
+		slots:         make(chan struct{}, maxInflight),
+		queue:         make(chan *ingestBatch, maxInflight),
+		maxBatchBytes: maxBatchBytes,
+	}
+}
+
+// Run writes queued batches, one transaction per batch, until the queue is closed
+func (s *IngestServer) Run() {
+	for b := range s.queue {
+		res := s.write(b)
+		metrics.queuedBatches.Add(-1)
+		b.done <- res
+	}
+}
+
+// write inserts a batch in a single transaction
+func (s *IngestServer) write(b *ingestBatch) ingestResult {
+	start := time.Now()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ingestResult{err: err}
+	}
+	mainTable := s.dbs.RootTable()
+	var res ingestResult
+	for i, obj := range b.records {
+		err := enrichDocument(s.dbs, obj)
+		if err == nil {
+			_, err = insertRow(tx, mainTable, obj, s.dbs, provenance(b.source, b.lines[i]))
+		}
+		if err != nil {
+			res.Errors = append(res.Errors, fmt.Sprintf("line %d: %v", b.lines[i], err))
+			metrics.rowErrors.Add(1)
+			continue
+		}
+		res.Rows++
+		metrics.pendingRows.Add(1)
+	}
+	if _, err := resolveLinks(tx, s.dbs); err != nil {
+		tx.Rollback()
+		metrics.pendingRows.Store(0)
+		return ingestResult{err: err}
+	}
+	if s.dbs.Audit != nil {
+		audit := *s.dbs.Audit
+		audit.Input, audit.InputSHA256 = b.source, b.sha256
+		if err := audit.record(tx, int64(res.Rows)); err != nil {
+			tx.Rollback()
+			metrics.pendingRows.Store(0)
+			return ingestResult{err: fmt.Errorf("audit: %v", err)}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		metrics.pendingRows.Store(0)
+		return ingestResult{err: err}
+	}
+	metrics.rowsIngested.Add(int64(res.Rows))
+	metrics.pendingRows.Store(0)
+	metrics.lastCommit.Store(time.Now().UnixNano())
+	metrics.observeBatch(time.Since(start))
+	return res
+}
+
+// handleIngest parses an NDJSON body and queues it for the writer
+func (s *IngestServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "POST line-delimited JSON", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case s.slots <- struct{}{}:
+		defer func() { <-s.slots }()
+	default:
+		metrics.rejectedBatches.Add(1)
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "write queue full", http.StatusTooManyRequests)
+		return
+	}
+	body := r.Body
+	if s.maxBatchBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, s.maxBatchBytes)
+	}
+	b := &ingestBatch{source: r.RemoteAddr, done: make(chan ingestResult, 1)}
+	var parseErrors []string
+	digest := sha256.New()
+	sc := bufio.NewScanner(io.TeeReader(body, digest))
+	sc.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := sc.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var obj map[string]interface{}
+		if err := s.dbs.decodeDocument(line, &obj); err != nil {
+			parseErrors = append(parseErrors, fmt.Sprintf("line %d: %v", lineNum, err))
+			metrics.parseErrors.Add(1)
+			continue
+		}
+		b.records = append(b.records, obj)
+		b.lines = append(b.lines, lineNum)
+	}
+	if err := sc.Err(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body exceeds %d bytes", s.maxBatchBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.sha256 = hex.EncodeToString(digest.Sum(nil))
+
+	// The slot taken leaves room in the queue
+	s.queue <- b
+	metrics.queuedBatches.Add(1)
+
+	res := <-b.done
+	if res.err != nil {
+		http.Error(w, res.err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Errors = append(parseErrors, res.Errors...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// maxPageRows caps the limit parameter of GET /rows
+const maxPageRows = 1000
+
+// RowsHandler serves GET /rows?cursor=...&limit=N, a page of documents and
+// the cursor of the next one
+func RowsHandler(d *Dumper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "GET /rows?cursor=...&limit=N", http.StatusMethodNotAllowed)
+			return
+		}
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 || n > maxPageRows {
+				http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxPageRows), http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		docs, next, err := d.Page(r.URL.Query().Get("cursor"), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if docs == nil {
+			docs = []map[string]interface{}{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		enc.Encode(struct {
+			Rows       []map[string]interface{} `json:"rows"`
+			NextCursor string                   `json:"next_cursor,omitempty"`
+		}{docs, next})
+	}
+}
+
+// Mux returns the ingest endpoint alongside the metrics and health handlers
+func (s *IngestServer) Mux() *http.ServeMux {
+	mux := monitorMux()
+	mux.HandleFunc("/ingest", s.handleIngest)
+	return mux
+}
+
+// ParseByteSize parses sizes such as 1048576, 512KiB, 16MiB, 1GB
+func ParseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	}
+	mult := int64(1)
+	for _, u := range units {
+		if len(s) > len(u.suffix) && s[len(s)-len(u.suffix):] == u.suffix {
+			s, mult = s[:len(s)-len(u.suffix)], u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
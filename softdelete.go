@@ -0,0 +1,34 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+)
+
+// deletedAtColumn is the optional root-table column of soft deletes: with
+// it, removing a document, as patch and sync do, sets it to the time
+// instead of deleting the document's rows, so the document can be
+// recovered. Dumps and diffs leave out soft-deleted documents unless
+// --include-deleted shows them, with the field. Loading a document that
+// has the field keeps it, so a dump with --include-deleted loads back as
+// it was.
+const deletedAtColumn = "_deleted_at"
+
+// reSoftDeleteDirective matches the directive marking the root table of a
+// schema analyzed with --soft-delete
+//
+//	-- jsql:soft-delete main
+var reSoftDeleteDirective = regexp.MustCompile(`^--\s*jsql:soft-delete\s+(\w+)\s*$`)
+
+// softDeletes reports whether removing a document of table only marks it
+// deleted
+func (t *TableSchema) softDeletes() bool {
+	return t.SoftDelete
+}
+
+// softDeleteRow marks the row of a document deleted
+func softDeleteRow(tx *sql.Tx, table *TableSchema, id int64) error {
+	_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s = strftime('%%Y-%%m-%%dT%%H:%%M:%%fZ', 'now') WHERE id = ?", quoteIdent(table.Name), deletedAtColumn), id)
+	return err
+}
@@ -0,0 +1,158 @@
+package jsql
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+// RecordSource produces input documents from something other than a
+// line-delimited JSON file
+type RecordSource interface {
+	// Export writes the documents to w as JSON lines, stopping after limit
+	// documents if limit is positive
+	Export(w io.Writer, limit int) error
+	String() string // the source as named in messages and provenance
+}
+
+// QuerySource reads input documents from the result rows of a query on
+// another database instead of a line-delimited JSON file
+type QuerySource struct {
+	DB         string // SQLite database file, or a postgres:// URL
+	SQL        string // query whose rows are the documents
+	JSONColumn string // column holding each row's document as JSON; empty for a document of all columns
+}
+
+func (q *QuerySource) String() string {
+	return q.DB
+}
+
+// open opens the source database read-only where the driver allows it
+func (q *QuerySource) open() (*sql.DB, error) {
+	if strings.HasPrefix(q.DB, "postgres://") || strings.HasPrefix(q.DB, "postgresql://") {
+		return sql.Open("postgres", q.DB)
+	}
+	if _, err := os.Stat(q.DB); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", "file:"+q.DB+"?mode=ro")
+}
+
+// Export runs the query and writes one JSON line per result row to w,
+// stopping after limit rows if limit is positive
+func (q *QuerySource) Export(w io.Writer, limit int) error {
+	db, err := q.open()
+	if err != nil {
+		return fmt.Errorf("source %s: %v", q.DB, err)
+	}
+	defer db.Close()
+	rows, err := db.Query(q.SQL)
+	if err != nil {
+		return fmt.Errorf("source %s: %v", q.DB, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	jsonAt := -1
+	for i, col := range cols {
+		if col == q.JSONColumn {
+			jsonAt = i
+		}
+	}
+	if q.JSONColumn != "" && jsonAt < 0 {
+		return fmt.Errorf("source %s: query has no column %s", q.DB, q.JSONColumn)
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(vals))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	for n := 0; (limit <= 0 || n < limit) && rows.Next(); n++ {
+		if err := rows.Scan(ptrs...); err != nil {
+			return fmt.Errorf("source %s: row %d: %v", q.DB, n+1, err)
+		}
+		if jsonAt >= 0 {
+			writeJSONLine(bw, vals[jsonAt])
+			continue
+		}
+		doc := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			if b, ok := vals[i].([]byte); ok {
+				doc[col] = string(b)
+			} else {
+				doc[col] = vals[i]
+			}
+		}
+		if err := enc.Encode(doc); err != nil {
+			return fmt.Errorf("source %s: row %d: %v", q.DB, n+1, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("source %s: %v", q.DB, err)
+	}
+	return bw.Flush()
+}
+
+// writeJSONLine writes a JSON column value as one line. Values that are not
+// valid JSON are written with their newlines replaced, so the loader
+// reports (or quarantines) them under their row number.
+func writeJSONLine(w *bufio.Writer, v interface{}) {
+	var text []byte
+	switch vv := v.(type) {
+	case []byte:
+		text = vv
+	case string:
+		text = []byte(vv)
+	case nil:
+		text = []byte("null")
+	default:
+		text = []byte(fmt.Sprint(vv))
+	}
+	var buf bytes.Buffer
+	if json.Compact(&buf, text) == nil {
+		text = buf.Bytes()
+	} else {
+		text = bytes.ReplaceAll(text, []byte("\n"), []byte(" "))
+	}
+	w.Write(text)
+	w.WriteByte('\n')
+}
+
+// LoadSource loads the documents of a source into the database. They are
+// numbered like the lines of a file, with the source as their provenance.
+// Cancelling ctx interrupts the load as for LoadData.
+func LoadSource(ctx context.Context, src RecordSource, dbPath string, dbs *DatabaseSchema) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.Export(pw, 0))
+	}()
+	defer pr.Close()
+	return loadReader(ctx, pr, src.String(), dbPath, dbs)
+}
+
+// SampleFile writes the first n documents of a source to a temporary file
+// for analysis, returning its path
+func SampleFile(src RecordSource, n int) (string, error) {
+	f, err := os.CreateTemp("", "jsql-source-*.jsonl")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := src.Export(f, n); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
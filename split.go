@@ -0,0 +1,171 @@
+package jsql
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// openInput opens a line-delimited JSON file, decompressing *.gz transparently
+func openInput(path string) (io.ReadCloser, error) {
+	f, err := openInputFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// CreateOutput creates a file, compressing it with gzip when named *.gz
+func CreateOutput(path string) (io.WriteCloser, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	return &gzipFile{Writer: gzip.NewWriter(f), f: f}, nil
+}
+
+// gzipFile closes both the gzip stream and the underlying file
+type gzipFile struct {
+	*gzip.Writer
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	if err := g.Writer.Close(); err != nil {
+		g.f.Close()
+		return err
+	}
+	return g.f.Close()
+}
+
+// eachLine calls fn with every non-blank line of r, its 1-based line number
+// and its byte offset. Lines that are not valid JSON are passed to bad
+// instead. Unlike bufio.Scanner there is no limit on line length.
+func eachLine(r io.Reader, fn func(line []byte, lineNum int, offset int64) error, bad func(lineNum int, offset int64)) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	var offset int64
+	lineNum := 0
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			lineNum++
+			start := offset
+			offset += int64(len(line))
+			trimmed := bytes.TrimSpace(line)
+			if len(trimmed) > 0 {
+				if !json.Valid(trimmed) {
+					bad(lineNum, start)
+				} else if err := fn(trimmed, lineNum, start); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SplitFile writes the documents of input into parts of at most linesPer
+// documents and, if bytesPer is not 0, at most bytesPer bytes each before
+// compression, named by formatting outPattern with the part number. A
+// document longer than bytesPer gets a part of its own. Invalid lines are
+// skipped and reported on log, which may be nil. It returns the number of
+// parts written and of invalid lines skipped.
+func SplitFile(log io.Writer, input, outPattern string, linesPer int, bytesPer int64) (parts int, invalid int, err error) {
+	in, err := openInput(input)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer in.Close()
+
+	var out io.WriteCloser
+	var w *bufio.Writer
+	inPart, partBytes := 0, int64(0)
+	closePart := func() error {
+		if out == nil {
+			return nil
+		}
+		if err := w.Flush(); err != nil {
+			out.Close()
+			return err
+		}
+		err := out.Close()
+		out = nil
+		return err
+	}
+	err = eachLine(in, func(line []byte, lineNum int, offset int64) error {
+		size := int64(len(line)) + 1
+		if out == nil || inPart >= linesPer || bytesPer > 0 && inPart > 0 && partBytes+size > bytesPer {
+			if err := closePart(); err != nil {
+				return err
+			}
+			name := fmt.Sprintf(outPattern, parts)
+			var err error
+			if out, err = CreateOutput(name); err != nil {
+				return err
+			}
+			w = bufio.NewWriter(out)
+			parts++
+			inPart, partBytes = 0, 0
+		}
+		inPart++
+		partBytes += size
+		w.Write(line)
+		return w.WriteByte('\n')
+	}, func(lineNum int, offset int64) {
+		invalid++
+		logf(log, "%s: line %d (byte offset %d): invalid JSON, skipped\n", input, lineNum, offset)
+	})
+	if cerr := closePart(); err == nil {
+		err = cerr
+	}
+	return parts, invalid, err
+}
+
+// CatFiles concatenates the documents of inputs onto w, one per line,
+// reporting invalid lines on log as SplitFile does
+func CatFiles(w, log io.Writer, inputs []string) (invalid int, err error) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	for _, input := range inputs {
+		in, err := openInput(input)
+		if err != nil {
+			return invalid, err
+		}
+		err = eachLine(in, func(line []byte, lineNum int, offset int64) error {
+			bw.Write(line)
+			return bw.WriteByte('\n')
+		}, func(lineNum int, offset int64) {
+			invalid++
+			logf(log, "%s: line %d (byte offset %d): invalid JSON, skipped\n", input, lineNum, offset)
+		})
+		in.Close()
+		if err != nil {
+			return invalid, err
+		}
+	}
+	return invalid, bw.Flush()
+}
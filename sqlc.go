@@ -0,0 +1,142 @@
+package jsql
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// reCreateIndex matches an index statement up to its leading column
+var reCreateIndex = regexp.MustCompile(`(?i)^CREATE\s+(UNIQUE\s+)?INDEX\s+(?:IF\s+NOT\s+EXISTS\s+)?` + qualifiedIdentPattern + `\s+ON\s+` + qualifiedIdentPattern + `\s*\(\s*(` + identPattern + `)`)
+
+// SqlcQueries returns the queries.sql of a schema in sqlc's annotated
+// format, from which sqlc generates typed Go accessors. Every table but the
+// symbol tables gets CRUD queries, and a lookup by each column an index leads
+// with. Symbolized fields are passed as values: the queries look their ids
+// up in a CTE, after an upsert query has inserted new ones.
+func SqlcQueries(ddl string) string {
+	ds := ParseDDL(ddl)
+	m := NewSchemaModel(ddl)
+	indexed := map[string]map[string]bool{} // table -> leading column -> unique
+	for _, s := range m.Statements {
+		if ix := reCreateIndex.FindStringSubmatch(s); ix != nil {
+			table := unquoteIdent(ix[3])
+			if indexed[table] == nil {
+				indexed[table] = map[string]bool{}
+			}
+			indexed[table][unquoteIdent(ix[4])] = ix[1] != ""
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("-- Queries for sqlc, generated by jsql analyze --sqlc\n")
+	for _, t := range m.Tables {
+		ts := ds.Tables[t.Name]
+		table := quoteIdent(t.Name)
+		if t.SymbolTable {
+			// Hashed ids are computed by jsql, so only it inserts such symbols
+			if !t.HashIDs {
+				fmt.Fprintf(&sb, "\n-- name: Upsert%s :exec\nINSERT OR IGNORE INTO %s (value) VALUES (json_quote(sqlc.arg(value)));\n", goName(t.Name), table)
+			}
+			continue
+		}
+		one, many := goName(singular(t.Name)), goName(plural(t.Name))
+		q := sqlcTable{ts: ts}
+		for _, c := range t.Columns {
+			if c.Name == "id" || t.Timestamps && timestampColumns[c.Name] || t.History && c.Name == validFromColumn {
+				continue
+			}
+			q.add(c)
+			if unique, ok := indexed[t.Name][c.Name]; ok || c.Unique {
+				q.lookups = append(q.lookups, sqlcLookup{c, unique || c.Unique})
+			}
+		}
+
+		fmt.Fprintf(&sb, "\n-- name: Get%s :one\nSELECT * FROM %s\nWHERE id = sqlc.arg(id) LIMIT 1;\n", one, table)
+		fmt.Fprintf(&sb, "\n-- name: List%s :many\nSELECT * FROM %s\nORDER BY id;\n", many, table)
+		for _, l := range q.lookups {
+			field, cond := q.param(l.col)
+			if l.unique {
+				fmt.Fprintf(&sb, "\n-- name: Get%sBy%s :one\nSELECT * FROM %s\nWHERE %s = %s LIMIT 1;\n", one, goName(field), table, quoteIdent(l.col.Name), cond)
+			} else {
+				fmt.Fprintf(&sb, "\n-- name: List%sBy%s :many\nSELECT * FROM %s\nWHERE %s = %s\nORDER BY id;\n", many, goName(field), table, quoteIdent(l.col.Name), cond)
+			}
+		}
+		if len(q.cols) == 0 {
+			fmt.Fprintf(&sb, "\n-- name: Insert%s :one\nINSERT INTO %s DEFAULT VALUES\nRETURNING id;\n", one, table)
+		} else {
+			fmt.Fprintf(&sb, "\n-- name: Insert%s :one\n%sINSERT INTO %s (%s)\nVALUES (%s)\nRETURNING id;\n", one, q.with(), table, strings.Join(quoteIdents(q.cols), ", "), strings.Join(q.values, ", "))
+			sets := make([]string, len(q.cols))
+			for i, col := range q.cols {
+				sets[i] = quoteIdent(col) + " = " + q.values[i]
+			}
+			fmt.Fprintf(&sb, "\n-- name: Update%s :exec\n%sUPDATE %s\nSET %s\nWHERE id = sqlc.arg(id);\n", one, q.with(), table, strings.Join(sets, ", "))
+		}
+		fmt.Fprintf(&sb, "\n-- name: Delete%s :exec\nDELETE FROM %s\nWHERE id = sqlc.arg(id);\n", one, table)
+	}
+	return sb.String()
+}
+
+// sqlcTable collects the columns of a table the queries write
+type sqlcTable struct {
+	ts      *TableSchema
+	cols    []string
+	values  []string // SQL of the value of each column
+	ctes    []string // of the symbol ids
+	lookups []sqlcLookup
+}
+
+// sqlcLookup is a column queries select rows by
+type sqlcLookup struct {
+	col    ColumnModel
+	unique bool
+}
+
+// param returns the name of the parameter holding the value of a column,
+// and the SQL of the value stored: a symbol's id is looked up by its value
+func (q *sqlcTable) param(c ColumnModel) (string, string) {
+	if field, ok := q.ts.Naming.symbolField(c.Name); ok && c.Symbol {
+		return field, fmt.Sprintf("(SELECT id FROM %s WHERE value = json_quote(sqlc.arg(%s)))", quoteIdent(c.References), field)
+	}
+	return c.Name, "sqlc.arg(" + c.Name + ")"
+}
+
+// add adds a column the queries write
+func (q *sqlcTable) add(c ColumnModel) {
+	q.cols = append(q.cols, c.Name)
+	field, value := q.param(c)
+	if field == c.Name {
+		q.values = append(q.values, value)
+		return
+	}
+	cte := "sym_" + field
+	q.ctes = append(q.ctes, cte+" AS "+value)
+	q.values = append(q.values, "(SELECT id FROM "+cte+")")
+}
+
+// with returns the WITH clause of the symbol ids, if there are any
+func (q *sqlcTable) with() string {
+	if len(q.ctes) == 0 {
+		return ""
+	}
+	return "WITH " + strings.Join(q.ctes, ",\n  ") + "\n"
+}
+
+// goName returns a table or column name as an exported Go identifier:
+// order_items becomes OrderItems
+func goName(name string) string {
+	var sb strings.Builder
+	upper := true
+	for _, r := range name {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			upper = true
+		case upper:
+			sb.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
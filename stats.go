@@ -0,0 +1,229 @@
+package jsql
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"strings"
+	"text/tabwriter"
+)
+
+// TableStats is the data-quality overview of a table written by profile
+type TableStats struct {
+	Table   string        `json:"table"`
+	Rows    int64         `json:"rows"`
+	Columns []ColumnStats `json:"columns"`
+}
+
+// ColumnStats describes the values of one column. The values of symbol
+// columns are those of their symbols rather than the ids.
+type ColumnStats struct {
+	Column   string       `json:"column"`
+	Type     string       `json:"type,omitempty"`
+	Symbols  string       `json:"symbols,omitempty"` // symbol table the values are resolved from
+	Nulls    int64        `json:"nulls"`
+	Distinct int64        `json:"distinct"`
+	Min      interface{}  `json:"min"`
+	Max      interface{}  `json:"max"`
+	Top      []ValueCount `json:"top,omitempty"`
+	Lengths  *LengthStats `json:"lengths,omitempty"` // of text and blob values
+}
+
+// ValueCount is a value and the number of rows holding it
+type ValueCount struct {
+	Value interface{} `json:"value"`
+	Rows  int64       `json:"rows"`
+}
+
+// LengthStats is the distribution of the lengths of a column's values, in
+// characters for text and bytes for blobs
+type LengthStats struct {
+	Min       int64          `json:"min"`
+	Max       int64          `json:"max"`
+	Avg       float64        `json:"avg"`
+	Histogram []LengthBucket `json:"histogram"`
+}
+
+// LengthBucket counts the values longer than half UpTo and at most UpTo
+// long; the first bucket holds the empty values
+type LengthBucket struct {
+	UpTo int64 `json:"up_to"`
+	Rows int64 `json:"rows"`
+}
+
+// ProfileTable computes the statistics of every column of a table of the
+// database, with the top values most rows hold. The table need not be one
+// of the schema's; dbs, which may be nil, tells which columns are symbols.
+func ProfileTable(dbPath string, dbs *DatabaseSchema, table string, top int) (*TableStats, error) {
+	db, err := OpenReadOnly(dbPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT name, type FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return nil, err
+	}
+	var cols []ColumnStats
+	for rows.Next() {
+		var c ColumnStats
+		if err := rows.Scan(&c.Column, &c.Type); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		cols = append(cols, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(cols) == 0 {
+		return nil, fmt.Errorf("database has no table %s", table)
+	}
+	stats := &TableStats{Table: table, Columns: cols}
+	if err := db.QueryRow("SELECT count(*) FROM " + quoteIdent(table)).Scan(&stats.Rows); err != nil {
+		return nil, err
+	}
+	var ts *TableSchema
+	if dbs != nil {
+		ts = dbs.Tables[table]
+	}
+	for i := range stats.Columns {
+		c := &stats.Columns[i]
+		// The values of symbol columns are selected through a join
+		from, expr := quoteIdent(table), quoteIdent(c.Column)
+		if ts != nil {
+			if _, ok := ts.Naming.symbolField(c.Column); ok && ts.FKs[c.Column] != "" {
+				c.Symbols = ts.FKs[c.Column]
+				from += fmt.Sprintf(" LEFT JOIN %s AS sym ON sym.id = %s.%s", quoteIdent(c.Symbols), quoteIdent(table), quoteIdent(c.Column))
+				expr = "json_extract(sym.value, '$')"
+			}
+		}
+		if err := statColumn(db, c, from, expr, stats.Rows, top); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", table, c.Column, err)
+		}
+	}
+	return stats, nil
+}
+
+// statColumn fills in the statistics of the values expr selects from
+func statColumn(db queryer, c *ColumnStats, from, expr string, total int64, top int) error {
+	var values int64
+	err := db.QueryRow(fmt.Sprintf("SELECT count(%[1]s), count(DISTINCT %[1]s), min(%[1]s), max(%[1]s) FROM %[2]s", expr, from)).Scan(&values, &c.Distinct, &c.Min, &c.Max)
+	if err != nil {
+		return err
+	}
+	c.Nulls = total - values
+	c.Min, c.Max = statValue(c.Min), statValue(c.Max)
+	if top > 0 && values > 0 {
+		rows, err := db.Query(fmt.Sprintf("SELECT %[1]s AS v, count(*) AS n FROM %[2]s WHERE %[1]s IS NOT NULL GROUP BY v ORDER BY n DESC, v LIMIT ?", expr, from), top)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var vc ValueCount
+			if err := rows.Scan(&vc.Value, &vc.Rows); err != nil {
+				return err
+			}
+			vc.Value = statValue(vc.Value)
+			c.Top = append(c.Top, vc)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	rows, err := db.Query(fmt.Sprintf("SELECT length(%[1]s) AS len, count(*) FROM %[2]s WHERE typeof(%[1]s) IN ('text', 'blob') GROUP BY len ORDER BY len", expr, from))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var l LengthStats
+	var n, sum int64
+	for rows.Next() {
+		var length, count int64
+		if err := rows.Scan(&length, &count); err != nil {
+			return err
+		}
+		if n == 0 {
+			l.Min = length
+		}
+		l.Max = length
+		n += count
+		sum += length * count
+		upTo := lengthBucket(length)
+		if k := len(l.Histogram); k > 0 && l.Histogram[k-1].UpTo == upTo {
+			l.Histogram[k-1].Rows += count
+		} else {
+			l.Histogram = append(l.Histogram, LengthBucket{UpTo: upTo, Rows: count})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if n > 0 {
+		l.Avg = float64(sum) / float64(n)
+		c.Lengths = &l
+	}
+	return nil
+}
+
+// lengthBucket returns the power of two a length is rounded up to
+func lengthBucket(length int64) int64 {
+	if length <= 1 {
+		return length
+	}
+	return 1 << bits.Len64(uint64(length-1))
+}
+
+// statValue returns a value scanned from SQLite as it is written out
+func statValue(v interface{}) interface{} {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return v
+}
+
+// WriteJSON writes the statistics as an indented JSON object
+func (s *TableStats) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// WriteTable writes the statistics as a table, a column per line
+func (s *TableStats) WriteTable(w io.Writer) error {
+	fmt.Fprintf(w, "%s: %d rows\n", s.Table, s.Rows)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLUMN\tTYPE\tNULLS\tDISTINCT\tMIN\tMAX\tLENGTH\tTOP")
+	for _, c := range s.Columns {
+		typ := c.Type
+		if c.Symbols != "" {
+			typ = "symbol " + c.Symbols
+		}
+		length := "-"
+		if l := c.Lengths; l != nil {
+			length = fmt.Sprintf("%d-%d avg %.1f", l.Min, l.Max, l.Avg)
+		}
+		top := make([]string, len(c.Top))
+		for i, vc := range c.Top {
+			top[i] = fmt.Sprintf("%s (%d)", statText(vc.Value), vc.Rows)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", c.Column, typ, c.Nulls, c.Distinct, statText(c.Min), statText(c.Max), length, strings.Join(top, ", "))
+	}
+	return tw.Flush()
+}
+
+// statText returns a value for the table, shortened to a readable width
+func statText(v interface{}) string {
+	if v == nil {
+		return "-"
+	}
+	s := []rune(strings.Join(strings.Fields(fmt.Sprint(v)), " "))
+	if len(s) > 24 {
+		return string(s[:23]) + "…"
+	}
+	return string(s)
+}
@@ -0,0 +1,66 @@
+package jsql
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// StdinInput is the input path naming standard input, so that jsql reads
+// the output of a pipeline: curl ... | jq -c ... | jsql import --db my.db
+const StdinInput = "-"
+
+// stdinDigest hashes what has been read of standard input, for the audit
+// log
+var stdinDigest = sha256.New()
+
+// stdin is standard input, read through stdinDigest
+var stdin io.Reader = io.TeeReader(os.Stdin, stdinDigest)
+
+// stdinSpool, once SpoolStdin has set it, keeps what has been read of
+// standard input. import reads its input twice, to analyze and then to
+// load it: every read of standard input replays the spool before reading
+// on, so that the second read sees what the first took.
+var stdinSpool *os.File
+
+// SpoolStdin starts keeping what is read of standard input, returning the
+// function removing the spool
+func SpoolStdin() (func(), error) {
+	f, err := os.CreateTemp("", "jsql-stdin-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	stdinSpool = f
+	return func() {
+		stdinSpool = nil
+		f.Close()
+		os.Remove(f.Name())
+	}, nil
+}
+
+// openInputFile opens an input file, or standard input for "-"
+func openInputFile(path string) (io.ReadCloser, error) {
+	if path != StdinInput {
+		return os.Open(path)
+	}
+	if stdinSpool == nil {
+		return io.NopCloser(stdin), nil
+	}
+	spooled, err := os.Open(stdinSpool.Name())
+	if err != nil {
+		return nil, err
+	}
+	// The spool is only appended to once its reader is at its end
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(spooled, io.TeeReader(stdin, stdinSpool)), spooled}, nil
+}
+
+// InputName names an input path in messages and provenance
+func InputName(path string) string {
+	if path == StdinInput {
+		return "stdin"
+	}
+	return path
+}
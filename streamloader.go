@@ -0,0 +1,239 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Loader streams documents into a database for programs producing them
+// directly rather than from files. Add may be called from any number of
+// goroutines: documents are queued and written BatchSize at a time, each
+// batch in one transaction, with the ids of symbols kept in memory between
+// batches. A document that fails to load is rolled back alone (and
+// quarantined if the schema says so) and reported by the Add or Flush that
+// wrote it.
+type Loader struct {
+	BatchSize int    // documents per transaction
+	Source    string // recorded in the _source provenance column
+
+	db      *sql.DB
+	dbs     *DatabaseSchema
+	mu      sync.Mutex
+	pending []map[string]interface{}
+	added   int // documents added so far, numbering them like input lines
+}
+
+// NewLoader opens the database at dbPath for loading documents into the
+// root table of dbs. The Loader keeps its cache of symbol ids on a copy of
+// dbs, so that dbs may be shared with other Loaders and loads.
+func NewLoader(dbPath string, dbs *DatabaseSchema) (*Loader, error) {
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return nil, err
+	}
+	own := *dbs
+	own.symbols = &symbolCache{ids: map[string]int64{}}
+	return &Loader{BatchSize: 1000, Source: "loader", db: db, dbs: &own}, nil
+}
+
+// Add queues a document, writing the queued documents once there are
+// BatchSize of them. The Loader keeps the map, which the caller must not
+// change afterwards.
+func (l *Loader) Add(ctx context.Context, doc map[string]any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = append(l.pending, doc)
+	if len(l.pending) < l.BatchSize {
+		return nil
+	}
+	return l.flush(ctx)
+}
+
+// Flush writes the queued documents
+func (l *Loader) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.flush(context.Background())
+}
+
+// Close flushes the queued documents and closes the database
+func (l *Loader) Close() error {
+	err := l.Flush()
+	if cerr := l.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flush writes the queued documents in one transaction. l.mu is held.
+func (l *Loader) flush(ctx context.Context) error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	docs := l.pending
+	l.pending = nil
+	first := l.added + 1
+	l.added += len(docs)
+	start := time.Now()
+	tx, err := l.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Documents are prepared first so their symbols are resolved together
+	rows := make([][]map[string]interface{}, len(docs))
+	prepErrs := make([]error, len(docs))
+	var batch []map[string]interface{}
+	for i, doc := range docs {
+		if rows[i], prepErrs[i] = l.dbs.prepareRows(doc); prepErrs[i] == nil {
+			batch = append(batch, rows[i]...)
+		}
+	}
+	inserted, err := l.dbs.resolveSymbols(tx, batch)
+	if err != nil {
+		return l.rollback(tx, err)
+	}
+	var errs []error
+	var failed []map[string]interface{}
+	for i, doc := range docs {
+		n := first + i
+		err := prepErrs[i]
+		if err == nil {
+			err = l.insert(tx, rows[i], n)
+		}
+		if err != nil {
+			failed = append(failed, rows[i]...)
+			errs = append(errs, fmt.Errorf("document %d: %v", n, err))
+			metrics.rowErrors.Add(1)
+			raw, _ := json.Marshal(doc)
+			if err := l.dbs.quarantine(tx, raw, err, l.Source, n); err != nil {
+				return l.rollback(tx, err)
+			}
+			continue
+		}
+		metrics.rowsIngested.Add(1)
+		metrics.pendingRows.Add(1)
+	}
+	if err := l.dbs.dropUnusedSymbols(tx, inserted, failed); err != nil {
+		return l.rollback(tx, err)
+	}
+	if _, err := resolveLinks(tx, l.dbs); err != nil {
+		return l.rollback(tx, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return l.rollback(tx, err)
+	}
+	l.dbs.symbols.commit()
+	metrics.pendingRows.Store(0)
+	metrics.lastCommit.Store(time.Now().UnixNano())
+	metrics.observeBatch(time.Since(start))
+	return errors.Join(errs...)
+}
+
+// insert inserts the rows of one document, rolling back what it wrote if
+// it fails
+func (l *Loader) insert(tx *sql.Tx, rows []map[string]interface{}, n int) error {
+	if _, err := tx.Exec("SAVEPOINT document"); err != nil {
+		return err
+	}
+	err := l.dbs.insertRootRows(tx, rows, provenance(l.Source, n))
+	if err != nil {
+		l.dbs.symbols.rollbackDocument()
+		if _, rerr := tx.Exec("ROLLBACK TO document"); rerr != nil {
+			return rerr
+		}
+	} else {
+		l.dbs.symbols.releaseDocument()
+	}
+	if _, rerr := tx.Exec("RELEASE document"); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// rollback abandons a batch after err
+func (l *Loader) rollback(tx *sql.Tx, err error) error {
+	tx.Rollback()
+	l.dbs.symbols.rollback()
+	metrics.pendingRows.Store(0)
+	return err
+}
+
+// symbolCache remembers the ids of symbols between the transactions of a
+// Loader. Ids seen in the current document and transaction are staged
+// apart, as a rollback may remove their rows again.
+type symbolCache struct {
+	ids    map[string]int64 // "table\x00stored value" -> id, committed
+	staged map[string]int64 // of documents written in this transaction
+	doc    map[string]int64 // of the document being written
+}
+
+// symbolID returns the id of a symbol, from the cache if there is one
+func (ds *DatabaseSchema) symbolID(tx *sql.Tx, symTable *TableSchema, val interface{}) (int64, error) {
+	c := ds.symbols
+	if c == nil || val == nil {
+		return getOrInsertSymbol(tx, ds.dialect(), symTable, val)
+	}
+	js, _ := json.Marshal(val)
+	key := symTable.Name + "\x00" + string(js)
+	for _, m := range []map[string]int64{c.ids, c.staged, c.doc} {
+		if id, ok := m[key]; ok {
+			metrics.symbolHits.Add(1)
+			return id, nil
+		}
+	}
+	id, err := getOrInsertSymbol(tx, ds.dialect(), symTable, val)
+	if err == nil {
+		if c.doc == nil {
+			c.doc = map[string]int64{}
+		}
+		c.doc[key] = id
+	}
+	return id, err
+}
+
+// cached reports whether the id of a symbol is known
+func (c *symbolCache) cached(key string) bool {
+	for _, m := range []map[string]int64{c.ids, c.staged, c.doc} {
+		if _, ok := m[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseDocument stages the ids of a document written successfully
+func (c *symbolCache) releaseDocument() {
+	if c.staged == nil {
+		c.staged = map[string]int64{}
+	}
+	for k, id := range c.doc {
+		c.staged[k] = id
+	}
+	c.doc = nil
+}
+
+// rollbackDocument forgets the ids of a document rolled back
+func (c *symbolCache) rollbackDocument() {
+	c.doc = nil
+}
+
+// commit keeps the ids of a committed transaction
+func (c *symbolCache) commit() {
+	for k, id := range c.staged {
+		c.ids[k] = id
+	}
+	c.staged = nil
+}
+
+// rollback forgets the ids of a transaction rolled back
+func (c *symbolCache) rollback() {
+	c.staged, c.doc = nil, nil
+}
@@ -1,14 +1,25 @@
-package main
+package jsql
 
 import (
+	"bufio"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // getOrInsertSymbol retrieves or creates a symbol table entry
 // Always marshals to JSON for consistency regardless of type
-func getOrInsertSymbol(tx *sql.Tx, symTable *TableSchema, val interface{}) (int64, error) {
+func getOrInsertSymbol(tx *sql.Tx, d Dialect, symTable *TableSchema, val interface{}) (int64, error) {
+	defer tableQueries.observe(symTable.Name, time.Now())
 	if val == nil {
 		return 0, nil
 	}
@@ -17,32 +28,466 @@ func getOrInsertSymbol(tx *sql.Tx, symTable *TableSchema, val interface{}) (int6
 
 	var id int64
 	err := tx.QueryRow(
-		fmt.Sprintf("SELECT id FROM %s WHERE value = ?", symTable.Name),
+		fmt.Sprintf("SELECT id FROM %s WHERE value = ?", quoteIdent(symTable.Name)),
 		stored,
 	).Scan(&id)
 	if err == sql.ErrNoRows {
-		_, err := tx.Exec(fmt.Sprintf("INSERT OR IGNORE INTO %s (value) VALUES (?)", symTable.Name), stored)
-		if err != nil {
+		metrics.symbolMisses.Add(1)
+		if symTable.HashIDs {
+			id = symbolHash(stored)
+			if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (id, value) VALUES (?, ?)", quoteIdent(symTable.Name)), id, stored); err != nil {
+				// Another value hashing to the same id is already there
+				return 0, fmt.Errorf("%s: id %d of %s: %v", symTable.Name, id, stored, err)
+			}
+			return id, nil
+		}
+		q := d.InsertIgnore(symTable.Name, []string{"value"}, 1)
+		if d.Returning() {
+			// No row comes back if the value was ignored after all
+			if err := tx.QueryRow(q+" RETURNING id", stored).Scan(&id); err != sql.ErrNoRows {
+				return id, err
+			}
+		} else if _, err := tx.Exec(q, stored); err != nil {
 			return 0, err
 		}
-		err = tx.QueryRow(fmt.Sprintf("SELECT id FROM %s WHERE value = ?", symTable.Name), stored).Scan(&id)
+		err = tx.QueryRow(fmt.Sprintf("SELECT id FROM %s WHERE value = ?", quoteIdent(symTable.Name)), stored).Scan(&id)
 		return id, err
 	}
+	if err == nil {
+		metrics.symbolHits.Add(1)
+	}
 	return id, err
 }
 
+// Symbol tables declared with
+//
+//	-- jsql:symbol-id hash
+//
+// in the DDL take ids from a hash of the value instead of the next free
+// rowid, so databases built from overlapping data agree on them.
+var reSymbolIDDirective = regexp.MustCompile(`^--\s*jsql:symbol-id\s+hash\s*$`)
+
+// symbolHash returns the id of a stored symbol value: the 64-bit FNV-1a
+// hash, with the sign bit cleared and 0 (no symbol) avoided
+func symbolHash(stored string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(stored))
+	if id := int64(h.Sum64() &^ (1 << 63)); id != 0 {
+		return id
+	}
+	return 1
+}
+
 // getSymbolValue retrieves a symbol value by ID
-func getSymbolValue(db *sql.DB, symTable string, id int64) (interface{}, error) {
+func getSymbolValue(db queryer, symTable string, id int64) (interface{}, error) {
+	defer tableQueries.observe(symTable, time.Now())
 	var val string
 	err := db.QueryRow(
-		fmt.Sprintf("SELECT value FROM %s WHERE id = ?", symTable), id,
+		fmt.Sprintf("SELECT value FROM %s WHERE id = ?", quoteIdent(symTable)), id,
 	).Scan(&val)
 	if err != nil {
 		return nil, err
 	}
+	return decodeSymbolValue(val), nil
+}
+
+// decodeSymbolValue returns the value of a stored symbol
+func decodeSymbolValue(stored string) interface{} {
 	var v interface{}
-	if err := json.Unmarshal([]byte(val), &v); err == nil {
-		return v, nil
+	if err := decodeJSON([]byte(stored), &v); err == nil {
+		return v
+	}
+	return stored
+}
+
+// maxCachedSymbols bounds the values a dump caches per symbol table, so
+// that huge symbol tables cost lookups rather than memory
+const maxCachedSymbols = 1 << 16
+
+// symbolValue returns the value of a symbol, from the values the dump has
+// already read where it can: a symbol's id never changes, and most
+// documents repeat a few symbols. Symbol tables of at most
+// DumpOptions.PreloadSymbols rows are read whole on first use. Dumpers
+// without a cache, outside eachRow, look every symbol up.
+func (d *Dumper) symbolValue(symTable string, id int64) (interface{}, error) {
+	if d.cache == nil {
+		return getSymbolValue(d.db, symTable, id)
+	}
+	cache, ok := d.cache.symbols[symTable]
+	if !ok {
+		cache = map[int64]interface{}{}
+		d.cache.symbols[symTable] = cache
+		if d.opts.PreloadSymbols > 0 {
+			if err := preloadSymbols(d.db, symTable, d.opts.PreloadSymbols, cache); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if v, ok := cache[id]; ok {
+		// Documents must not share the objects and arrays they hold
+		return deepCopy(v), nil
+	}
+	v, err := getSymbolValue(d.db, symTable, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(cache) < maxCachedSymbols {
+		cache[id] = deepCopy(v)
+	}
+	return v, nil
+}
+
+// preloadSymbols reads all values of a symbol table into cache if it has
+// at most limit rows
+func preloadSymbols(db queryer, symTable string, limit int, cache map[int64]interface{}) error {
+	defer tableQueries.observe(symTable, time.Now())
+	var n int
+	err := db.QueryRow(fmt.Sprintf("SELECT count(*) FROM (SELECT 1 FROM %s LIMIT ?) AS head", quoteIdent(symTable)), limit+1).Scan(&n)
+	if err != nil || n > limit {
+		return err
+	}
+	rows, err := db.Query(fmt.Sprintf("SELECT id, value FROM %s", quoteIdent(symTable)))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var val string
+		if err := rows.Scan(&id, &val); err != nil {
+			return err
+		}
+		cache[id] = decodeSymbolValue(val)
+	}
+	return rows.Err()
+}
+
+// symbolTableOf returns the symbol table the field is symbolized into
+func (ds *DatabaseSchema) symbolTableOf(field string) *TableSchema {
+	for _, name := range ds.TableOrder {
+		if sym := ds.Tables[name].FKs[ds.Tables[name].Naming.SymbolColumn(field)]; sym != "" {
+			return ds.Tables[sym]
+		}
+	}
+	return nil
+}
+
+// PrepopulateSymbols inserts the values of a dictionary file into the
+// symbol tables, so frequent values get small ids and databases built with
+// the same file agree on them. Each line is "field<TAB>value", optionally
+// followed by "<TAB>count"; values are taken in descending count order, or
+// in file order without counts. A value that is a JSON string, array or
+// object is stored as that JSON, anything else as a string. It returns how
+// many new symbols were inserted.
+func PrepopulateSymbols(dbPath string, dbs *DatabaseSchema, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	type entry struct {
+		field string
+		value interface{}
+		count int64
+	}
+	var entries []entry
+	sc := bufio.NewScanner(f)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, "\t")
+		if len(parts) < 2 || len(parts) > 3 {
+			return 0, fmt.Errorf("%s:%d: want field<TAB>value[<TAB>count]", path, lineNum)
+		}
+		e := entry{field: parts[0], value: parts[1]}
+		if len(parts) == 3 {
+			if e.count, err = strconv.ParseInt(parts[2], 10, 64); err != nil {
+				return 0, fmt.Errorf("%s:%d: count: %v", path, lineNum, err)
+			}
+		}
+		if s := parts[1]; s != "" && strings.ContainsRune(`"[{`, rune(s[0])) {
+			var v interface{}
+			if json.Unmarshal([]byte(s), &v) == nil {
+				e.value = v
+			}
+		}
+		entries = append(entries, e)
+	}
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].count > entries[j].count })
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	inserted := 0
+	unknown := map[string]bool{}
+	for _, e := range entries {
+		symTab := dbs.symbolTableOf(e.field)
+		if symTab == nil {
+			if !unknown[e.field] {
+				logf(dbs.Log, "%s: field %s is not symbolized, skipping its values\n", path, e.field)
+				unknown[e.field] = true
+			}
+			continue
+		}
+		js, _ := json.Marshal(e.value)
+		q, args := fmt.Sprintf("INSERT OR IGNORE INTO %s (value) VALUES (?)", quoteIdent(symTab.Name)), []any{string(js)}
+		if symTab.HashIDs {
+			q, args = fmt.Sprintf("INSERT OR IGNORE INTO %s (id, value) VALUES (?, ?)", quoteIdent(symTab.Name)), []any{symbolHash(string(js)), string(js)}
+		}
+		res, err := tx.Exec(q, args...)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", symTab.Name, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			inserted++
+		}
+	}
+	return inserted, tx.Commit()
+}
+
+// symbolBatch is how many documents the loader reads ahead to resolve the
+// symbols of all of them at once
+const symbolBatch = 1000
+
+// symbolsPerQuery bounds the values of one IN list or multi-row INSERT,
+// well below SQLite's limit on bound parameters
+const symbolsPerQuery = 500
+
+// symbolKeys returns the cache keys ("table\x00stored value") of the
+// symbols of root table rows, in order of appearance. Symbol tables with
+// hashed ids are left out: they are resolved row by row, which reports
+// hash collisions per row.
+func (ds *DatabaseSchema) symbolKeys(rows []map[string]interface{}) []string {
+	var keys []string
+	seen := map[string]bool{}
+	var collect func(t *TableSchema, obj map[string]interface{})
+	collect = func(t *TableSchema, obj map[string]interface{}) {
+		obj = t.columnKeys(obj)
+		for _, field := range sortedKeys(t.FKs) {
+			fk := t.FKs[field]
+			base, isSymbol := t.Naming.symbolField(field)
+			if !isSymbol {
+				objField, isObj := t.Naming.objectField(field)
+				sub, ok := obj[objField].(map[string]interface{})
+				if ok && isObj && ds.Tables[fk] != nil {
+					collect(ds.Tables[fk], sub)
+				}
+				continue
+			}
+			symTab := ds.Tables[fk]
+			val := obj[base]
+			if symTab == nil || symTab.HashIDs || val == nil {
+				continue
+			}
+			js, _ := json.Marshal(val)
+			key := fk + "\x00" + string(js)
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	root := ds.RootTable()
+	for _, row := range rows {
+		collect(root, row)
+	}
+	return keys
+}
+
+// resolveSymbols looks up the symbols of the root table rows of a batch of
+// documents with one query per symbol table, inserts the missing ones with
+// one multi-row INSERT, and stages all their ids in ds.symbols, where
+// inserting the rows then finds them. It returns the ids of the symbols it
+// inserted, by cache key.
+func (ds *DatabaseSchema) resolveSymbols(tx *sql.Tx, rows []map[string]interface{}) (map[string]int64, error) {
+	c := ds.symbols
+	if c == nil {
+		return nil, nil
+	}
+	values := map[string][]string{} // symbol table -> stored values
+	for _, key := range ds.symbolKeys(rows) {
+		if !c.cached(key) {
+			table, stored, _ := strings.Cut(key, "\x00")
+			values[table] = append(values[table], stored)
+		}
+	}
+	if c.staged == nil {
+		c.staged = map[string]int64{}
+	}
+	inserted := map[string]int64{}
+	for _, table := range sortedKeys(values) {
+		for stored := range slices.Chunk(values[table], symbolsPerQuery) {
+			ids, err := lookupSymbols(tx, table, stored)
+			if err != nil {
+				return nil, err
+			}
+			var missing []string
+			for _, s := range stored {
+				if _, ok := ids[s]; !ok {
+					missing = append(missing, s)
+				}
+			}
+			if len(missing) > 0 {
+				metrics.symbolMisses.Add(int64(len(missing)))
+				newIDs, err := insertSymbols(tx, ds.dialect(), table, missing)
+				if err != nil {
+					return nil, err
+				}
+				for s, id := range newIDs {
+					ids[s] = id
+					inserted[table+"\x00"+s] = id
+				}
+			}
+			for s, id := range ids {
+				c.staged[table+"\x00"+s] = id
+			}
+		}
+	}
+	return inserted, nil
+}
+
+// dropUnusedSymbols deletes those of the symbols resolveSymbols inserted
+// for the rows of failed documents that no row refers to, as a document
+// rolled back row by row leaves no new symbols behind either
+func (ds *DatabaseSchema) dropUnusedSymbols(tx *sql.Tx, inserted map[string]int64, failed []map[string]interface{}) error {
+	if len(inserted) == 0 || len(failed) == 0 {
+		return nil
+	}
+	for _, key := range ds.symbolKeys(failed) {
+		id, ok := inserted[key]
+		if !ok {
+			continue
+		}
+		table, _, _ := strings.Cut(key, "\x00")
+		var refs []string
+		for _, name := range ds.TableOrder {
+			for _, col := range sortedKeys(ds.Tables[name].FKs) {
+				if ds.Tables[name].FKs[col] == table {
+					refs = append(refs, fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s WHERE %s = ?1)", quoteIdent(name), quoteIdent(col)))
+				}
+			}
+		}
+		q := fmt.Sprintf("DELETE FROM %s WHERE id = ?1", quoteIdent(table))
+		if len(refs) > 0 {
+			q += " AND " + strings.Join(refs, " AND ")
+		}
+		res, err := tx.Exec(q, id)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			delete(ds.symbols.staged, key)
+			delete(inserted, key)
+		}
 	}
-	return val, nil
-}
\ No newline at end of file
+	return nil
+}
+
+// insertSymbols inserts stored values into a symbol table with one
+// multi-row INSERT, returning the ids of those it holds afterwards
+func insertSymbols(tx *sql.Tx, d Dialect, table string, stored []string) (map[string]int64, error) {
+	defer tableQueries.observe(table, time.Now())
+	q := d.InsertIgnore(table, []string{"value"}, len(stored))
+	if !d.Returning() {
+		if _, err := tx.Exec(q, stringArgs(stored)...); err != nil {
+			return nil, fmt.Errorf("%s: %v", table, err)
+		}
+		return lookupSymbols(tx, table, stored)
+	}
+	ids, err := scanSymbolIDs(tx.Query(q+" RETURNING value, id", stringArgs(stored)...))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", table, err)
+	}
+	// Values ignored as already present return no row
+	var ignored []string
+	for _, s := range stored {
+		if _, ok := ids[s]; !ok {
+			ignored = append(ignored, s)
+		}
+	}
+	if len(ignored) > 0 {
+		found, err := lookupSymbols(tx, table, ignored)
+		if err != nil {
+			return nil, err
+		}
+		for s, id := range found {
+			ids[s] = id
+		}
+	}
+	return ids, nil
+}
+
+// lookupSymbols returns the ids of those stored values that table holds
+func lookupSymbols(tx *sql.Tx, table string, stored []string) (map[string]int64, error) {
+	defer tableQueries.observe(table, time.Now())
+	q := fmt.Sprintf("SELECT value, id FROM %s WHERE value IN (%s) ORDER BY id", quoteIdent(table), strings.TrimSuffix(strings.Repeat("?,", len(stored)), ","))
+	ids, err := scanSymbolIDs(tx.Query(q, stringArgs(stored)...))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", table, err)
+	}
+	return ids, nil
+}
+
+// scanSymbolIDs reads value, id rows into a map, keeping the first id of a
+// value
+func scanSymbolIDs(rows *sql.Rows, err error) (map[string]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := map[string]int64{}
+	for rows.Next() {
+		var value interface{}
+		var id int64
+		if err := rows.Scan(&value, &id); err != nil {
+			return nil, err
+		}
+		key := storedSymbol(value)
+		if _, ok := ids[key]; !ok {
+			ids[key] = id
+		}
+	}
+	return ids, rows.Err()
+}
+
+// storedSymbol returns a value read from a symbol table as the JSON it was
+// stored as: numeric symbol tables hold numbers, which SQLite converted
+// from their JSON text on insert
+func storedSymbol(value interface{}) string {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			return string(appendJSONFloat(nil, v))
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// stringArgs converts strings to query arguments
+func stringArgs(ss []string) []any {
+	args := make([]any, len(ss))
+	for i, s := range ss {
+		args[i] = s
+	}
+	return args
+}
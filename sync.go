@@ -0,0 +1,318 @@
+package jsql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sync keeps a database in step with a source it pulls again and again: a
+// standing ETL loop built from diff, patch and dump --post. Every cycle
+// fetches the source, diffs its documents against the database's by a key
+// field, applies the diff so that the database holds exactly the source's
+// documents (new ones added, changed ones patched, missing ones removed),
+// and pushes the diff to a sink as the cycle's incremental dump. The state
+// file records what the last cycle fetched, so an unchanged source is
+// neither diffed nor pushed again.
+
+// SyncConfig is the YAML configuration of the sync command
+type SyncConfig struct {
+	Source   string        `yaml:"source"`    // file, http(s):// URL or s3://bucket/key of line-delimited JSON
+	DB       string        `yaml:"db"`        // database kept in step, which must exist
+	Schema   string        `yaml:"schema"`    // DDL file, if the database has no stored schema
+	Key      string        `yaml:"key"`       // field identifying a document
+	Sink     string        `yaml:"sink"`      // http(s):// URL the diff is posted to, or file it is appended to
+	Batch    int           `yaml:"batch"`     // documents per sink request
+	State    string        `yaml:"state"`     // state file, <db>.sync.json by default
+	Interval time.Duration `yaml:"interval"`  // between cycles; 0 runs one
+	LockWait time.Duration `yaml:"lock_wait"` // for another process writing the database; a cycle still locked out fails
+
+	FetchTimeout time.Duration `yaml:"fetch_timeout"` // for the download of a URL source, 5m by default
+}
+
+// syncState is what the last cycle of a sync fetched and did
+type syncState struct {
+	ETag     string `json:"etag,omitempty"` // of the source, if it is a URL
+	SHA256   string `json:"sha256"`         // of the source's content
+	Checked  string `json:"checked"`        // when the source was last fetched
+	Synced   string `json:"synced"`         // when the database last took a change of the source
+	Changes  int    `json:"changes"`        // documents that change added, changed or removed
+	Pushed   int    `json:"pushed"`         // diff lines posted or appended to the sink, in all
+	Unpushed int    `json:"unpushed"`       // diff lines waiting in the pending file for the sink
+	Failures int    `json:"failures"`       // cycles in a row that failed
+}
+
+// LoadSyncConfig reads and validates a YAML sync configuration
+func LoadSyncConfig(file string) (*SyncConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := SyncConfig{Batch: 100, FetchTimeout: 5 * time.Minute}
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	switch {
+	case c.Source == "" || c.DB == "" || c.Key == "":
+		return nil, fmt.Errorf("%s: source, db and key are required", file)
+	case c.Batch < 1:
+		return nil, fmt.Errorf("%s: batch must be at least 1", file)
+	case c.Interval < 0 || c.LockWait < 0:
+		return nil, fmt.Errorf("%s: interval and lock_wait must not be negative", file)
+	case c.FetchTimeout <= 0:
+		return nil, fmt.Errorf("%s: fetch_timeout must be positive", file)
+	}
+	if c.State == "" {
+		c.State = c.DB + ".sync.json"
+	}
+	return &c, nil
+}
+
+// sourceURL returns the URL a source is fetched from, or "" for a file.
+// s3://bucket/key names an object of a public bucket, or of one
+// AWS_ENDPOINT_URL serves.
+func sourceURL(source string) string {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return source
+	}
+	if rest, ok := strings.CutPrefix(source, "s3://"); ok {
+		bucket, key, _ := strings.Cut(rest, "/")
+		if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+			return strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/" + key
+		}
+		return "https://" + bucket + ".s3.amazonaws.com/" + key
+	}
+	return ""
+}
+
+// fetch copies the source into a temporary file, named with the source's
+// extension so that a .gz source is read decompressed. It returns "" if a
+// URL reports that the source has not changed since etag. A URL that does
+// not answer in full within c.FetchTimeout fails the cycle.
+func (c *SyncConfig) fetch(ctx context.Context, etag string) (file, newETag string, err error) {
+	var body io.ReadCloser
+	if url := sourceURL(c.Source); url != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return "", "", err
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		client := &http.Client{Timeout: c.FetchTimeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", "", err
+		}
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return "", etag, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", "", fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+		body, newETag = resp.Body, resp.Header.Get("ETag")
+	} else if body, err = os.Open(c.Source); err != nil {
+		return "", "", err
+	}
+	defer body.Close()
+	ext := path.Ext(c.Source)
+	if ext == ".gz" {
+		ext = path.Ext(strings.TrimSuffix(c.Source, ext)) + ext
+	}
+	f, err := os.CreateTemp("", "jsql-sync-*"+ext)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, body); err != nil {
+		os.Remove(f.Name())
+		return "", "", err
+	}
+	return f.Name(), newETag, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's content
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readSyncState reads the state file, which need not exist yet
+func (c *SyncConfig) readSyncState() (syncState, error) {
+	var st syncState
+	data, err := os.ReadFile(c.State)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("%s: %v", c.State, err)
+	}
+	return st, nil
+}
+
+// writeSyncState replaces the state file
+func (c *SyncConfig) writeSyncState(st syncState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := c.State + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	return replaceFile(tmp, c.State)
+}
+
+// pendingFile keeps the diffs the sink failed to take, to push them first
+// next cycle
+func (c *SyncConfig) pendingFile() string {
+	return c.State + ".pending.ndjson"
+}
+
+// SyncOnce runs one cycle of the sync, returning the number of documents
+// it added, changed or removed. A source unchanged since the last cycle is
+// left alone. A diff the sink fails to take is kept and pushed again first
+// by the next cycle. The audit log records the command of dbs.Audit, if
+// set, for the changes. Cancelling ctx stops the cycle.
+func (c *SyncConfig) SyncOnce(ctx context.Context, dbs *DatabaseSchema) (changes int, err error) {
+	lock, err := LockDatabase(ctx, c.DB, c.LockWait)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Unlock()
+	st, err := c.readSyncState()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			st.Failures++
+		} else {
+			st.Failures = 0
+		}
+		if werr := c.writeSyncState(st); err == nil {
+			err = werr
+		}
+	}()
+	if st.Unpushed > 0 {
+		if err := c.push(ctx, c.pendingFile()); err != nil {
+			return 0, fmt.Errorf("push %d pending changes to %s: %v", st.Unpushed, c.Sink, err)
+		}
+		st.Pushed += st.Unpushed
+		st.Unpushed = 0
+		if err := removeFile(c.pendingFile()); err != nil {
+			return 0, err
+		}
+	}
+
+	st.Checked = time.Now().UTC().Format(time.RFC3339)
+	file, etag, err := c.fetch(ctx, st.ETag)
+	if err != nil || file == "" {
+		return 0, err
+	}
+	defer os.Remove(file)
+	sum, err := fileSHA256(file)
+	if err != nil || sum == st.SHA256 {
+		st.ETag = etag
+		return 0, err
+	}
+	diff, err := os.CreateTemp("", "jsql-sync-*.ndjson")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(diff.Name())
+	changes, err = DiffSources(diff, dbs.Log, c.DB, dbs, file, nil, c.Key)
+	if cerr := diff.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || changes == 0 {
+		st.ETag, st.SHA256 = etag, sum
+		return 0, err
+	}
+	command := "jsql sync"
+	if dbs.Audit != nil {
+		command = dbs.Audit.Command
+	}
+	dbs.Audit = &AuditWrite{Command: command, Input: c.Source, InputSHA256: sum}
+	if _, failed, err := PatchDocuments(c.DB, dbs, c.Key, diff.Name()); err != nil {
+		return 0, err
+	} else if failed > 0 {
+		return 0, fmt.Errorf("%d of %d changes failed to apply; the source is synced again next cycle", failed, changes)
+	}
+	st.ETag, st.SHA256, st.Changes = etag, sum, changes
+	st.Synced = time.Now().UTC().Format(time.RFC3339)
+	if err := c.push(ctx, diff.Name()); err != nil {
+		if perr := appendFile(c.pendingFile(), diff.Name()); perr != nil {
+			return changes, fmt.Errorf("push %d changes to %s: %v; keep them: %v", changes, c.Sink, err, perr)
+		}
+		st.Unpushed = changes
+		return changes, fmt.Errorf("push %d changes to %s: %v", changes, c.Sink, err)
+	}
+	if c.Sink != "" {
+		st.Pushed += changes
+	}
+	return changes, nil
+}
+
+// appendFile appends the content of src to dst
+func appendFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// push sends the diff of a cycle to the sink: posted in batches to a URL,
+// or appended to a file
+func (c *SyncConfig) push(ctx context.Context, diff string) error {
+	if c.Sink == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.Sink, "http://") && !strings.HasPrefix(c.Sink, "https://") {
+		return appendFile(c.Sink, diff)
+	}
+	in, err := os.Open(diff)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	sink := NewPostSink(ctx, c.Sink, c.Batch, 5)
+	if _, err := io.Copy(sink, in); err != nil {
+		return err
+	}
+	return sink.Close()
+}
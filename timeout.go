@@ -0,0 +1,16 @@
+package jsql
+
+import (
+	"context"
+	"fmt"
+)
+
+// timedOut returns the error of ctx in place of err once ctx is done: the
+// error the interrupted work reports, such as a transaction already rolled
+// back, is only its consequence.
+func timedOut(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("timed out: %w", ctx.Err())
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package jsql
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// Logs gathered from machines in several time zones carry timestamps that
+// sort and compare wrongly as text. With --normalize-time utc, analyze
+// gives the string fields holding an RFC 3339 time with a zone in every
+// sampled document a UTCTIME column, which the loader fills with the UTC
+// Unix epoch in seconds, fractional below a second, and a companion
+// <column>_offset INTEGER column with the original offset in seconds east
+// of UTC. Values that are not such times are stored as the text they are.
+// dump writes the times back with their original offsets, or in UTC with
+// dump --normalize-time utc.
+
+// TypeUTCTime columns hold times as UTC epoch seconds
+const TypeUTCTime FieldType = "UTCTIME"
+
+// timeOffsetSuffix names the column keeping the offset of a UTCTIME column
+const timeOffsetSuffix = "_offset"
+
+// NormalizeTimeUTC is the only --normalize-time mode
+const NormalizeTimeUTC = "utc"
+
+// parseZonedTime parses an RFC 3339 time, with a T or a space between the
+// date and the time, which must have a zone
+func parseZonedTime(v interface{}) (time.Time, bool) {
+	s, ok := v.(string)
+	if !ok || len(s) < len("2006-01-02T15:04:05Z") {
+		return time.Time{}, false
+	}
+	if s[10] == ' ' {
+		s = s[:10] + "T" + s[11:]
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
+
+// timeOffsetColumn returns the column keeping the offset of col, if col is
+// a UTCTIME column that has one
+func timeOffsetColumn(table *TableSchema, col string) (string, bool) {
+	if table.Fields[col] != TypeUTCTime || table.Fields[col+timeOffsetSuffix] == "" {
+		return "", false
+	}
+	return col + timeOffsetSuffix, true
+}
+
+// timeColumnOf returns the UTCTIME column whose offset col keeps
+func timeColumnOf(table *TableSchema, col string) (string, bool) {
+	base, ok := strings.CutSuffix(col, timeOffsetSuffix)
+	if !ok || table.Fields[base] != TypeUTCTime {
+		return "", false
+	}
+	return base, true
+}
+
+// utcTimeValues returns what the loader stores for val in a UTCTIME column
+// and its offset column
+func utcTimeValues(val interface{}) (epoch, offset interface{}) {
+	t, ok := parseZonedTime(val)
+	if !ok {
+		return val, nil
+	}
+	_, off := t.Zone()
+	if t.Nanosecond() == 0 {
+		return t.Unix(), off
+	}
+	return float64(t.Unix()) + float64(t.Nanosecond())/1e9, off
+}
+
+// decodeUTCTime turns a stored UTCTIME value back into a time string, with
+// its offset unless utc is set. Fractions of a second are kept to the
+// microsecond, the precision of the stored epoch.
+func decodeUTCTime(val, offset interface{}, utc bool) interface{} {
+	var t time.Time
+	switch v := val.(type) {
+	case int64:
+		t = time.Unix(v, 0)
+	case float64:
+		sec := math.Floor(v)
+		t = time.Unix(int64(sec), int64(math.Round((v-sec)*1e6))*1e3)
+	case []byte:
+		return string(v)
+	default:
+		return val
+	}
+	if off, ok := offset.(int64); ok && !utc {
+		return t.In(time.FixedZone("", int(off))).Format(time.RFC3339Nano)
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
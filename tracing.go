@@ -0,0 +1,134 @@
+package jsql
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer records the phases of a command. It does nothing until --trace
+// installs a tracer provider.
+var tracer = otel.Tracer("github.com/tomberek/jsql")
+
+// traceRoot is the context of the span covering the whole command, the
+// parent of the spans of its phases
+var traceRoot = context.Background()
+
+// tableQueries counts the queries run against each table while tracing;
+// nil otherwise
+var tableQueries *queryStats
+
+// queryStats counts queries and the time they took, per table
+type queryStats struct {
+	mu     sync.Mutex
+	tables map[string]tableStat
+}
+
+type tableStat struct {
+	queries int64
+	elapsed time.Duration
+}
+
+// observe records a query against table that started at start
+func (s *queryStats) observe(table string, start time.Time) {
+	if s == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	s.mu.Lock()
+	st := s.tables[table]
+	st.queries++
+	st.elapsed += elapsed
+	s.tables[table] = st
+	s.mu.Unlock()
+}
+
+// snapshot returns a copy of the counts so far
+func (s *queryStats) snapshot() map[string]tableStat {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]tableStat, len(s.tables))
+	for table, st := range s.tables {
+		out[table] = st
+	}
+	return out
+}
+
+// phase is a traced stage of a command, such as analyzing the sample or
+// loading an input
+type phase struct {
+	span   trace.Span
+	before map[string]tableStat
+}
+
+// startPhase starts the span of a phase of the command
+func startPhase(name string, attrs ...attribute.KeyValue) *phase {
+	_, span := tracer.Start(traceRoot, name, trace.WithAttributes(attrs...))
+	return &phase{span: span, before: tableQueries.snapshot()}
+}
+
+// set adds attributes to the span of the phase
+func (p *phase) set(attrs ...attribute.KeyValue) {
+	p.span.SetAttributes(attrs...)
+}
+
+// end ends the span of the phase, with an event per table queried during
+// it giving the number of queries and the time they took
+func (p *phase) end() {
+	if p.span.IsRecording() {
+		after := tableQueries.snapshot()
+		for _, table := range sortedKeys(after) {
+			st, prev := after[table], p.before[table]
+			if st.queries == prev.queries {
+				continue
+			}
+			p.span.AddEvent("table", trace.WithAttributes(
+				attribute.String("jsql.table", table),
+				attribute.Int64("jsql.queries", st.queries-prev.queries),
+				attribute.Float64("jsql.seconds", (st.elapsed-prev.elapsed).Seconds()),
+			))
+		}
+	}
+	p.span.End()
+}
+
+// StartTracing writes the spans of command to path, starting the span of
+// the whole command, and returns the function ending it and writing out the
+// spans. An empty path leaves tracing off.
+func StartTracing(command, path string) (func() error, error) {
+	if path == "" {
+		return func() error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	tableQueries = &queryStats{tables: map[string]tableStat{}}
+	root := startPhase("jsql " + command)
+	traceRoot = trace.ContextWithSpan(context.Background(), root.span)
+	return func() error {
+		root.end()
+		err := provider.Shutdown(context.Background())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,107 @@
+package jsql
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// reInsertTrigger splits an INSERT trigger into its table and the part from
+// FOR EACH ROW / WHEN / BEGIN on
+var reInsertTrigger = regexp.MustCompile(`(?is)^CREATE\s+TRIGGER\s+(?:IF\s+NOT\s+EXISTS\s+)?\S+\s+(?:BEFORE\s+|AFTER\s+)?INSERT\s+ON\s+(\S+)\s+(?:FOR\s+EACH\s+ROW\s+)?(.*)$`)
+
+// deferredTrigger is a trigger dropped for the duration of a load
+type deferredTrigger struct {
+	name, table, sql string
+}
+
+// deferredTriggers holds the triggers dropped by deferTriggers and the last
+// row id of each table before the load
+type deferredTriggers struct {
+	triggers []deferredTrigger
+	lastID   map[string]int64
+}
+
+// deferTriggers drops the triggers of the schema's tables inside tx, so rows
+// are inserted without firing them one by one
+func deferTriggers(tx *sql.Tx, dbs *DatabaseSchema) (*deferredTriggers, error) {
+	rows, err := tx.Query("SELECT name, tbl_name, sql FROM sqlite_master WHERE type = 'trigger' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	d := &deferredTriggers{lastID: map[string]int64{}}
+	for rows.Next() {
+		var t deferredTrigger
+		if err := rows.Scan(&t.name, &t.table, &t.sql); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if dbs.Tables[t.table] != nil {
+			d.triggers = append(d.triggers, t)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, t := range d.triggers {
+		if _, ok := d.lastID[t.table]; !ok {
+			var last int64
+			if err := tx.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(id), 0) FROM %s", t.table)).Scan(&last); err != nil {
+				return nil, err
+			}
+			d.lastID[t.table] = last
+		}
+		if _, err := tx.Exec(fmt.Sprintf("DROP TRIGGER %q", t.name)); err != nil {
+			return nil, fmt.Errorf("drop trigger %s: %v", t.name, err)
+		}
+	}
+	return d, nil
+}
+
+// restore recreates the dropped triggers and replays the INSERT triggers
+// for the rows added since deferTriggers, a statement per trigger: the
+// trigger body runs as an INSTEAD OF trigger of a temporary view, into
+// which the new rows are selected, so NEW and WHEN work as they did.
+// UPDATE and DELETE triggers are only recreated, as loading inserts rows.
+func (d *deferredTriggers) restore(tx *sql.Tx) error {
+	tables := map[string]bool{}
+	for _, t := range d.triggers {
+		m := reInsertTrigger.FindStringSubmatch(t.sql)
+		if m == nil {
+			continue
+		}
+		view := "_jsql_replay_" + t.table
+		if !tables[t.table] {
+			if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP VIEW %s AS SELECT * FROM main.%s", view, t.table)); err != nil {
+				return fmt.Errorf("replay %s: %v", t.name, err)
+			}
+			tables[t.table] = true
+		}
+		if _, err := tx.Exec(fmt.Sprintf("CREATE TEMP TRIGGER _jsql_replay_%s INSTEAD OF INSERT ON %s %s", t.name, view, m[2])); err != nil {
+			return fmt.Errorf("replay %s: %v", t.name, err)
+		}
+	}
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+	for _, table := range names {
+		q := fmt.Sprintf("INSERT INTO _jsql_replay_%[1]s SELECT * FROM main.%[1]s WHERE id > ? ORDER BY id", table)
+		if _, err := tx.Exec(q, d.lastID[table]); err != nil {
+			return fmt.Errorf("replay triggers of %s: %v", table, err)
+		}
+		// Dropping the view drops its temporary triggers
+		if _, err := tx.Exec(fmt.Sprintf("DROP VIEW _jsql_replay_%s", table)); err != nil {
+			return err
+		}
+	}
+	for _, t := range d.triggers {
+		if _, err := tx.Exec(t.sql); err != nil {
+			return fmt.Errorf("recreate trigger %s: %v", t.name, err)
+		}
+	}
+	return nil
+}
@@ -1,4 +1,11 @@
-package main
+package jsql
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tomberek/jsql/internal/pathspec"
+)
 
 // FieldType represents a SQL field type
 type FieldType string
@@ -9,6 +16,10 @@ const (
 	TypeText FieldType = "TEXT"
 	TypeBool FieldType = "BOOLEAN"
 	TypeJSON FieldType = "JSON"
+
+	// GeoJSON geometries, as canonical JSON text or as WKB
+	TypeGeoJSON FieldType = "GEOJSON"
+	TypeWKB     FieldType = "WKB"
 )
 
 // TableSchema represents the schema of a table
@@ -16,13 +27,79 @@ type TableSchema struct {
 	Name   string
 	Fields map[string]FieldType
 	FKs    map[string]string // column -> referenced table
+
+	SpatialIndexes map[string]string      // geometry column -> R*Tree table
+	Links          map[string]Link        // link column -> natural key reference it resolves
+	Computed       map[string]*Computed   // column -> expression filling it
+	Defaults       map[string]interface{} // column -> value stored when the field is absent
+	ExprDefaults   map[string]bool        // columns whose DEFAULT is an SQL expression, which fills them when the field is absent
+	HashIDs        bool                   // symbol table whose ids are hashes of the values
+	Explode        string                 // array field whose elements are the rows of this root table
+	Renames        map[string]string      // column -> document field it holds
+	Fallbacks      map[string]string      // fallback column added by --fallback-json -> document field
+	Constraints    []string               // table constraints (UNIQUE, CHECK, FOREIGN KEY...), as written
+	Options        string                 // table options after the column list, e.g. STRICT
+	View           bool                   // a view: read-only, its rows dumped as they are
+	ForeignKeys    []ForeignKey           // references by keys other than a single id column
+	Naming         Naming                 // how its object and symbol columns are named, as for the whole schema
+	Lookups        map[string]Lookup      // mapped column -> table its values are looked up in, storing the row's rowid
+	Timestamps     bool                   // has created_at and updated_at columns kept by the database
+	History        bool                   // keeps the former versions of its rows in <name>_history
+	Provenance     bool                   // has _line, _source and _ingested_at columns filled by the loader
+	Ord            bool                   // has an _ord column numbering its documents, filled by the loader
+	KeyOrder       bool                   // has a _key_order column recording the order of the keys, filled by the loader
+	NumberText     bool                   // has a _number_text column keeping the text of numbers, filled by the loader
+	SoftDelete     bool                   // removing a document sets its _deleted_at column instead
+}
+
+// ForeignKey is a table-level FOREIGN KEY whose referenced columns are not
+// just id, such as a composite natural key. Documents hold the referenced
+// row as an object under Field.
+type ForeignKey struct {
+	Field      string   `json:"field"` // the constraint's name, or else the referenced table
+	Columns    []string `json:"columns"`
+	Table      string   `json:"table"`
+	References []string `json:"references"`        // columns of Table, in the order of Columns
+	Clauses    string   `json:"clauses,omitempty"` // ON DELETE, DEFERRABLE... as written
 }
 
 // DatabaseSchema represents the schema of the entire database
 type DatabaseSchema struct {
 	Tables     map[string]*TableSchema
+	Views      map[string]*TableSchema // by name, with the columns known once dumped
 	TableOrder []string
+	Root       string  // table holding the top-level records
+	Naming     Naming  // how columns referencing other tables are named
+	Dialect    Dialect // of the database loaded or dumped; nil for SQLite
+
+	Blobs     *BlobStorage     // optional store for large TEXT and JSON values
+	Transform *WasmTransform   // module rewriting every loaded document first
+	Enrich    []*Enrichment    // lookups adding fields to every loaded document
+	Filter    *pathspec.Filter // fields kept and dropped from every loaded document
+	Mapping   *Mapping         // fields stored in the columns of an existing table
+	Audit     *AuditWrite      // recorded in the audit log by every transaction of a write
+	Log       io.Writer        // receives the rows skipped or failing and other notes of a write; nil discards them
+
+	Quarantine    bool // keep rows failing to load in the _quarantine table
+	FallbackJSON  bool // store values that do not fit their column as JSON in a fallback column
+	DeferTriggers bool // drop triggers while loading, replaying INSERT triggers at the end
+	Strict        bool // a failing row rolls back its chunk of ChunkSize input lines
+	ChunkSize     int
+	BatchSize     int    // input lines per transaction; 0 loads in one transaction
+	DuplicateKeys string // how keys an object has twice are decoded: DuplicateKeysLast, Error or Array
+
+	Altered    []string         // ALTER TABLE statements run while loading
+	Downgrades map[string]int64 // "table.field" -> values stored in its fallback column
+
+	symbols *symbolCache // symbol ids kept between the transactions of a Loader
+}
+
+// logf writes a note to w, the Log of a schema or source, unless it is nil
+func logf(w io.Writer, format string, args ...interface{}) {
+	if w != nil {
+		fmt.Fprintf(w, format, args...)
+	}
 }
 
 // stringSet is a utility type for tracking unique values
-type stringSet map[string]struct{}
\ No newline at end of file
+type stringSet map[string]struct{}
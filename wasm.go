@@ -0,0 +1,116 @@
+package jsql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WasmTransform rewrites every document with a WebAssembly module, so
+// transforms can be written in any language that compiles to it and run
+// sandboxed: the module sees no files, environment or network, and can
+// only write to stderr. A module exports
+//
+//	memory
+//	alloc(size i32) i32            // a buffer of size bytes for the input
+//	transform(ptr i32, len i32) i64 // the output, as ptr<<32 | len
+//
+// transform is given the JSON of a document in a buffer from alloc and
+// returns where in memory the JSON of the transformed document is; a
+// result of 0 drops the document. A trap fails the document. WASI reactor
+// modules are initialized with their _initialize export first.
+type WasmTransform struct {
+	Path string
+
+	ctx       context.Context // interrupts the module's calls once done
+	runtime   wazero.Runtime
+	module    api.Module
+	alloc     api.Function
+	transform api.Function
+}
+
+// wasmMemoryLimit bounds the memory of a transform, in 64KiB pages
+const wasmMemoryLimit = 4096
+
+// OpenWasmTransform compiles and instantiates the module at path, whose
+// standard error goes to stderr unless it is nil. Once ctx is done, a call
+// of the module in progress is stopped and fails.
+func OpenWasmTransform(ctx context.Context, path string, stderr io.Writer) (*WasmTransform, error) {
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := wazero.NewRuntimeConfig().WithMemoryLimitPages(wasmMemoryLimit).WithCloseOnContextDone(true)
+	r := wazero.NewRuntimeWithConfig(ctx, cfg)
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, r); err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+	modCfg := wazero.NewModuleConfig().WithName("transform").WithStartFunctions("_initialize")
+	if stderr != nil {
+		modCfg = modCfg.WithStderr(stderr)
+	}
+	mod, err := r.InstantiateWithConfig(ctx, code, modCfg)
+	if err != nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	w := &WasmTransform{Path: path, ctx: ctx, runtime: r, module: mod, alloc: mod.ExportedFunction("alloc"), transform: mod.ExportedFunction("transform")}
+	if w.alloc == nil || w.transform == nil || mod.Memory() == nil {
+		r.Close(ctx)
+		return nil, fmt.Errorf("%s: a transform module exports memory, alloc and transform", path)
+	}
+	return w, nil
+}
+
+// Apply returns the transformed document, or false if the module dropped it
+func (w *WasmTransform) Apply(doc map[string]interface{}) (map[string]interface{}, bool, error) {
+	if w == nil {
+		return doc, true, nil
+	}
+	in, err := json.Marshal(doc)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx := w.ctx
+	res, err := w.alloc.Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, false, fmt.Errorf("wasm alloc: %v", err)
+	}
+	ptr := uint32(res[0])
+	mem := w.module.Memory()
+	if !mem.Write(ptr, in) {
+		return nil, false, fmt.Errorf("wasm alloc: buffer at %d of %d bytes is out of memory", ptr, len(in))
+	}
+	res, err = w.transform.Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, false, fmt.Errorf("wasm transform: %v", err)
+	}
+	if res[0] == 0 {
+		return nil, false, nil
+	}
+	outPtr, outLen := uint32(res[0]>>32), uint32(res[0])
+	out, ok := mem.Read(outPtr, outLen)
+	if !ok {
+		return nil, false, fmt.Errorf("wasm transform: result at %d of %d bytes is out of memory", outPtr, outLen)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(out, &obj); err != nil || obj == nil {
+		return nil, false, fmt.Errorf("wasm transform: result is not a JSON object: %.80q", out)
+	}
+	return obj, true, nil
+}
+
+// Close releases the module
+func (w *WasmTransform) Close() error {
+	if w == nil {
+		return nil
+	}
+	return w.runtime.Close(context.Background())
+}
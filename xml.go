@@ -0,0 +1,102 @@
+package jsql
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// xmlTextKey holds the text of elements that also have attributes or
+// children
+const xmlTextKey = "text"
+
+// XMLSource streams the records of an XML file: every Element, wherever it
+// occurs, is one document. Attributes become fields named AttrPrefix+name,
+// child elements fields of their own, repeated ones arrays. Elements
+// holding only text become strings; all values stay strings.
+type XMLSource struct {
+	Path       string
+	Element    string
+	AttrPrefix string
+}
+
+func (x *XMLSource) String() string {
+	return x.Path
+}
+
+// xmlNode is any element with its attributes, children and text
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []xmlNode  `xml:",any"`
+	Text    string     `xml:",chardata"`
+}
+
+// Export writes each record element as a JSON line
+func (x *XMLSource) Export(w io.Writer, limit int) error {
+	f, err := openInputFile(x.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	d := xml.NewDecoder(bufio.NewReader(f))
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for n := 1; limit <= 0 || n <= limit; {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", x.Path, err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != x.Element {
+			continue
+		}
+		var node xmlNode
+		if err := d.DecodeElement(&node, &start); err != nil {
+			return fmt.Errorf("%s: record %d: %v", x.Path, n, err)
+		}
+		doc, ok := x.value(node).(map[string]interface{})
+		if !ok {
+			doc = map[string]interface{}{xmlTextKey: x.value(node)}
+		}
+		if err := enc.Encode(doc); err != nil {
+			return fmt.Errorf("%s: record %d: %v", x.Path, n, err)
+		}
+		n++
+	}
+	return bw.Flush()
+}
+
+// value converts an element to a string, or to a map if it has attributes
+// or children
+func (x *XMLSource) value(node xmlNode) interface{} {
+	text := strings.TrimSpace(node.Text)
+	if len(node.Attrs) == 0 && len(node.Nodes) == 0 {
+		return text
+	}
+	obj := map[string]interface{}{}
+	for _, a := range node.Attrs {
+		obj[x.AttrPrefix+a.Name.Local] = a.Value
+	}
+	for _, child := range node.Nodes {
+		name, v := child.XMLName.Local, x.value(child)
+		switch prev := obj[name].(type) {
+		case nil:
+			obj[name] = v
+		case []interface{}:
+			obj[name] = append(prev, v)
+		default:
+			obj[name] = []interface{}{prev, v}
+		}
+	}
+	if text != "" {
+		obj[xmlTextKey] = text
+	}
+	return obj
+}